@@ -8,18 +8,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash"
-	"io"
-	"net/http"
+	"math/rand"
 	"os"
 	"path"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/shlex"
-	"github.com/hashicorp/go-multierror"
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/thought-machine/please/src/core"
@@ -32,9 +29,24 @@ var log = logging.MustGetLogger("build")
 // Type that indicates that we're stopping the build of a target in a nonfatal way.
 var errStop = fmt.Errorf("stopping build")
 
-// httpClient is the shared http client that we use for fetching remote files.
-var httpClient http.Client
-var httpClientOnce sync.Once
+// Type that indicates that a target has been put back to wait for some newly added dependencies.
+var errRequeued = fmt.Errorf("waiting for new dependencies")
+
+// requeuedTargets records remotely built targets whose post-build functions have added new
+// dependencies, so we had to wait for those before building them again.
+var requeuedTargets sync.Map
+
+// wasRequeued returns true if the given target was requeued to wait for new dependencies.
+// It's forgotten again afterwards, so any later rebuild (e.g. via plz watch) starts from scratch.
+func wasRequeued(label core.BuildLabel) bool {
+	_, requeued := requeuedTargets.Load(label)
+	requeuedTargets.Delete(label)
+	return requeued
+}
+
+// downloader is the shared downloadManager that we use for fetching remote files.
+var downloader *downloadManager
+var downloaderOnce sync.Once
 
 var magicSourcesWorkerKey = "WORKER"
 
@@ -48,6 +60,9 @@ func Build(tid int, state *core.BuildState, label core.BuildLabel, remote bool)
 			target.SetState(core.Stopped)
 			state.LogBuildResult(tid, target.Label, core.TargetBuildStopped, "Build stopped")
 			return
+		} else if err == errRequeued {
+			state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Waiting for new dependencies")
+			return
 		}
 		state.LogBuildError(tid, label, core.TargetBuildFailed, err, "Build failed: %s", err)
 		if err := RemoveOutputs(target); err != nil {
@@ -92,8 +107,10 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 	if err := target.CheckDuplicateOutputs(); err != nil {
 		return err
 	}
+	// If the target's been requeued then both its pre- and post-build functions have already run.
+	requeued := wasRequeued(target.Label)
 	// This must run before we can leave this function successfully by any path.
-	if target.PreBuildFunction != nil {
+	if target.PreBuildFunction != nil && !requeued {
 		log.Debug("Running pre-build function for %s", target.Label)
 		if err := state.Parser.RunPreBuildFunction(tid, state, target); err != nil {
 			return err
@@ -113,7 +130,7 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 		if err := prepareDirectories(target); err != nil {
 			return err
 		}
-		if err := prepareSources(state.Graph, target); err != nil {
+		if err := prepareSources(state, target); err != nil {
 			return err
 		}
 		// This is important to catch errors here where we will recover the panic, rather
@@ -122,12 +139,19 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 		return errStop
 	}
 	var cacheKey, out []byte
+	var duration time.Duration
 	if runRemotely {
 		m, err := state.RemoteClient.Build(tid, target)
 		if err != nil {
 			return err
 		}
 		out = m.Stdout
+		if !m.StartTime.IsZero() && !m.EndTime.IsZero() {
+			duration = m.EndTime.Sub(m.StartTime)
+		}
+		if err := state.CheckBudget(target, false, m.OutputSize, duration); err != nil {
+			return err
+		}
 	} else {
 		if target.IsHashFilegroup {
 			updateHashFilegroupPaths(state, target)
@@ -244,19 +268,22 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 			return err
 		}
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Preparing...")
-		if err := prepareSources(state.Graph, target); err != nil {
+		if err := prepareSources(state, target); err != nil {
 			return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
 		}
 
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, target.BuildingDescription)
+		start := time.Now()
 		out, err = buildMaybeRemotely(state, target, cacheKey)
 		if err != nil {
 			return err
 		}
+		duration = time.Since(start)
 	}
-	if target.PostBuildFunction != nil {
+	if target.PostBuildFunction != nil && !requeued {
 		out = bytes.TrimSpace(out)
 		outs := target.Outputs()
+		deps := len(target.DeclaredDependencies())
 		if err := runPostBuildFunction(tid, state, target, string(out), postBuildOutput); err != nil {
 			return err
 		}
@@ -264,8 +291,20 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 		if !runRemotely {
 			storePostBuildOutput(target, out)
 		}
-		if runRemotely && len(outs) != len(target.Outputs()) {
+		if runRemotely && (len(outs) != len(target.Outputs()) || deps != len(target.DeclaredDependencies())) {
 			// postBuildFunction has changed the target - must rebuild it
+			if !state.Graph.AllDepsBuilt(target) {
+				// It's added dependencies that aren't built yet. They've already been queued, so
+				// put this one back to be picked up again once they're done.
+				log.Info("Waiting for new dependencies of %s before rebuilding it", target)
+				requeuedTargets.Store(target.Label, struct{}{})
+				target.SetState(core.Active)
+				// They might have finished before we got here, in which case we must queue it ourselves.
+				if state.Graph.AllDepsBuilt(target) && target.SyncUpdateState(core.Active, core.Pending) {
+					state.AddPendingBuild(target.Label, false)
+				}
+				return errRequeued
+			}
 			log.Info("Rebuilding %s after post-build function", target)
 			m, err := state.RemoteClient.Build(tid, target)
 			if err != nil {
@@ -289,6 +328,9 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 	if err != nil {
 		return fmt.Errorf("error moving outputs for target %s: %s", target.Label, err)
 	}
+	if err := state.CheckBudget(target, false, outputSize(state, target), duration); err != nil {
+		return err
+	}
 	if _, err = calculateAndCheckRuleHash(state, target); err != nil {
 		return err
 	}
@@ -330,8 +372,19 @@ func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command s
 	if target.IsRemoteFile {
 		return nil, fetchRemoteFile(state, target)
 	}
-	env := core.StampedBuildEnvironment(state, target, inputHash, path.Join(core.RepoRoot, target.TmpDir()))
+	env, err := core.StampedBuildEnvironment(state, target, inputHash, path.Join(core.RepoRoot, target.TmpDir()))
+	if err != nil {
+		return nil, err
+	}
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, env, command)
+	secrets, err := core.InjectedSecretEnv(state.Config, target)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, secrets...)
+	if state.ShuffleInputs {
+		rand.Shuffle(len(env), func(i, j int) { env[i], env[j] = env[j], env[i] })
+	}
 	out, combined, err := state.ProcessExecutor.ExecWithTimeoutShell(target, target.TmpDir(), env, target.BuildTimeout, state.ShowAllOutput, command, target.Sandbox)
 	if err != nil {
 		return nil, fmt.Errorf("Error building target %s: %s\n%s", target.Label, err, combined)
@@ -376,8 +429,16 @@ func prepareDirectory(directory string, remove bool) error {
 }
 
 // Symlinks the source files of this rule into its temp directory.
-func prepareSources(graph *core.BuildGraph, target *core.BuildTarget) error {
-	for source := range core.IterSources(graph, target, false) {
+func prepareSources(state *core.BuildState, target *core.BuildTarget) error {
+	sources := []core.SourcePair{}
+	for source := range core.IterSources(state.Graph, target, false) {
+		sources = append(sources, source)
+	}
+	if state.ShuffleInputs {
+		// The order they're created in can affect e.g. the order that directories are listed in.
+		rand.Shuffle(len(sources), func(i, j int) { sources[i], sources[j] = sources[j], sources[i] })
+	}
+	for _, source := range sources {
 		if err := core.PrepareSourcePair(source); err != nil {
 			return err
 		}
@@ -468,6 +529,28 @@ func moveOutput(state *core.BuildState, target *core.BuildTarget, tmpOutput, rea
 	return true, nil
 }
 
+// outputSize returns the total size of all the outputs of a target, or zero if it doesn't have
+// an output size budget (since there's no point walking them all in that case).
+func outputSize(state *core.BuildState, target *core.BuildTarget) uint64 {
+	if budget, _, _ := state.Config.Budgets(target); budget == 0 {
+		return 0
+	}
+	var size uint64
+	for _, out := range target.FullOutputs() {
+		if err := fs.Walk(out, func(name string, isDir bool) error {
+			if !isDir {
+				if info, err := os.Lstat(name); err == nil {
+					size += uint64(info.Size())
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Warning("Failed to calculate size of %s: %s", out, err)
+		}
+	}
+	return size
+}
+
 // RemoveOutputs removes all generated outputs for a rule.
 func RemoveOutputs(target *core.BuildTarget) error {
 	for _, output := range target.Outputs() {
@@ -763,74 +846,28 @@ func linkIfNotExists(src, dest string, f linkFunc) {
 // fetchRemoteFile fetches a remote file from a URL.
 // This is a builtin for better efficiency and more control over the whole process.
 func fetchRemoteFile(state *core.BuildState, target *core.BuildTarget) error {
-	httpClientOnce.Do(func() {
-		if state.Config.Build.HTTPProxy != "" {
-			httpClient.Transport = &http.Transport{
-				Proxy: http.ProxyURL(state.Config.Build.HTTPProxy.AsURL()),
-			}
-		}
+	downloaderOnce.Do(func() {
+		downloader = newDownloadManager(state.Config) // Can't do this at init time because config isn't loaded then.
 	})
 	if err := prepareDirectory(target.OutDir(), false); err != nil {
 		return err
 	} else if err := prepareDirectory(target.TmpDir(), false); err != nil {
 		return err
 	}
-	httpClient.Timeout = time.Duration(state.Config.Build.Timeout) // Can't set this when we init the client because config isn't loaded then.
-	var err error
-	for _, src := range target.Sources {
-		if e := fetchOneRemoteFile(state, target, src.String()); e != nil {
-			err = multierror.Append(err, e)
-		} else {
-			return nil
-		}
-	}
-	return err
-}
-
-func fetchOneRemoteFile(state *core.BuildState, target *core.BuildTarget, url string) error {
 	env := core.BuildEnvironment(state, target, path.Join(core.RepoRoot, target.TmpDir()))
-	url = os.Expand(url, env.ReplaceEnvironment)
-	tmpPath := path.Join(target.TmpDir(), target.Outputs()[0])
-	f, err := os.Create(tmpPath)
-	if err != nil {
-		return err
+	urls := make([]string, len(target.Sources))
+	for i, src := range target.Sources {
+		urls[i] = os.Expand(src.String(), env.ReplaceEnvironment)
 	}
-	resp, err := httpClient.Get(url)
+	tmpPath := path.Join(target.TmpDir(), target.Outputs()[0])
+	// If we only want the hashes, or aren't verifying them, there's no point rejecting any mirrors over them.
+	verify := state.VerifyHashes && !state.NeedHashesOnly
+	h, err := downloader.Download(target, urls, tmpPath, state.PathHasher.NewHash, verify)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("Error retrieving %s: %s", url, resp.Status)
-	}
-	var r io.Reader = resp.Body
-	if length := resp.Header.Get("Content-Length"); length != "" {
-		if i, err := strconv.Atoi(length); err == nil {
-			r = &progressReader{Reader: resp.Body, Target: target, Total: float32(i)}
-		}
-	}
-	target.ShowProgress = true // Required for it to actually display
-	h := sha1.New()
-	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
-		return err
-	}
-	state.PathHasher.SetHash(tmpPath, h.Sum(nil))
-	return f.Close()
-}
-
-// A progressReader tracks progress from a HTTP response and marks it on the given target.
-type progressReader struct {
-	Reader      io.Reader
-	Target      *core.BuildTarget
-	Done, Total float32
-}
-
-// Read implements the io.Reader interface
-func (r *progressReader) Read(b []byte) (int, error) {
-	n, err := r.Reader.Read(b)
-	r.Done += float32(n)
-	r.Target.Progress = 100.0 * r.Done / r.Total
-	return n, err
+	state.PathHasher.SetHash(tmpPath, h)
+	return nil
 }
 
 // buildMaybeRemotely builds a target, either sending it to a remote worker if needed,
@@ -354,6 +354,15 @@ func (f postBuildFunction) Call(target *core.BuildTarget, output string) error {
 }
 func (f postBuildFunction) String() string { return "" }
 
+func TestWasRequeued(t *testing.T) {
+	label := core.ParseBuildLabel("//package1:requeued", "")
+	assert.False(t, wasRequeued(label))
+	requeuedTargets.Store(label, struct{}{})
+	assert.True(t, wasRequeued(label))
+	// It should only apply to the one build after being requeued.
+	assert.False(t, wasRequeued(label))
+}
+
 func TestMain(m *testing.M) {
 	cache = &mockCache{}
 	backend := logging.NewLogBackend(os.Stderr, "", 0)
@@ -0,0 +1,212 @@
+// Support for plz debug determinism, which builds targets several times and compares the outputs
+// of each run to find rules that don't build deterministically.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// hexdumpWidth is the number of bytes shown on each line of a hexdump.
+const hexdumpWidth = 16
+
+// A DeterminismChecker records the outputs of targets over several builds and compares them.
+type DeterminismChecker struct {
+	dir  string
+	runs []map[core.BuildLabel]map[string][]byte
+}
+
+// NewDeterminismChecker returns a new DeterminismChecker that keeps copies of outputs in the given directory.
+func NewDeterminismChecker(dir string) (*DeterminismChecker, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return &DeterminismChecker{dir: dir}, os.MkdirAll(dir, core.DirPermissions)
+}
+
+// Record records the outputs of the given targets after a build.
+func (dc *DeterminismChecker) Record(state *core.BuildState, labels []core.BuildLabel) error {
+	run := map[core.BuildLabel]map[string][]byte{}
+	runDir := dc.runDir(len(dc.runs))
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		hashes := map[string][]byte{}
+		outDir := target.OutDir()
+		for _, out := range target.Outputs() {
+			if err := fs.Walk(path.Join(outDir, out), func(name string, isDir bool) error {
+				if isDir {
+					return nil
+				}
+				rel := strings.TrimPrefix(name, outDir+"/")
+				dest := path.Join(runDir, label.PackageName, label.Name, rel)
+				if err := fs.CopyFile(name, dest, 0644); err != nil {
+					return err
+				}
+				h, err := hashFile(dest)
+				hashes[rel] = h
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+		run[label] = hashes
+	}
+	dc.runs = append(dc.runs, run)
+	return nil
+}
+
+// Report writes a report of any differences between the recorded runs to w.
+// It returns true if all the outputs were the same each time.
+func (dc *DeterminismChecker) Report(w io.Writer) (bool, error) {
+	if len(dc.runs) < 2 {
+		return false, fmt.Errorf("need at least two runs to compare, got %d", len(dc.runs))
+	}
+	labels := make(core.BuildLabels, 0, len(dc.runs[0]))
+	for label := range dc.runs[0] {
+		labels = append(labels, label)
+	}
+	sort.Sort(labels)
+	same := true
+	for _, label := range labels {
+		s, err := dc.reportTarget(w, label)
+		if err != nil {
+			return false, err
+		}
+		same = same && s
+	}
+	return same, nil
+}
+
+// reportTarget writes a report on a single target. It returns true if it was deterministic.
+func (dc *DeterminismChecker) reportTarget(w io.Writer, label core.BuildLabel) (bool, error) {
+	fmt.Fprintf(w, "%s:\n", label)
+	first := dc.runs[0][label]
+	same := true
+	for i, run := range dc.runs[1:] {
+		for _, name := range unionKeys(first, run[label]) {
+			h1, present1 := first[name]
+			h2, present2 := run[label][name]
+			if present1 && present2 && bytes.Equal(h1, h2) {
+				continue
+			} else if !same {
+				// Only show the first divergence in detail; later ones are usually consequences of it.
+				fmt.Fprintf(w, "  %s differs between runs 1 and %d\n", name, i+2)
+				continue
+			}
+			same = false
+			if !present1 || !present2 {
+				fmt.Fprintf(w, "  %s was only created in one of runs 1 and %d\n", name, i+2)
+				continue
+			}
+			fmt.Fprintf(w, "  %s differs between runs 1 and %d\n", name, i+2)
+			if err := dc.hexdumpDiff(w, label, name, 0, i+1); err != nil {
+				return false, err
+			}
+		}
+	}
+	if same {
+		fmt.Fprintf(w, "  All %d runs produced identical outputs\n", len(dc.runs))
+	}
+	return same, nil
+}
+
+// hexdumpDiff writes a hexdump of the first place that an output differs between two runs.
+func (dc *DeterminismChecker) hexdumpDiff(w io.Writer, label core.BuildLabel, name string, run1, run2 int) error {
+	b1, err := ioutil.ReadFile(path.Join(dc.runDir(run1), label.PackageName, label.Name, name))
+	if err != nil {
+		return err
+	}
+	b2, err := ioutil.ReadFile(path.Join(dc.runDir(run2), label.PackageName, label.Name, name))
+	if err != nil {
+		return err
+	}
+	offset := firstDifference(b1, b2)
+	fmt.Fprintf(w, "    First difference at byte %d (sizes %d and %d):\n", offset, len(b1), len(b2))
+	start := offset - offset%hexdumpWidth
+	fmt.Fprintf(w, "    run %d: %s\n", run1+1, hexdumpLine(b1, start))
+	fmt.Fprintf(w, "    run %d: %s\n", run2+1, hexdumpLine(b2, start))
+	return nil
+}
+
+// runDir returns the directory that outputs of the given run are copied into.
+func (dc *DeterminismChecker) runDir(run int) string {
+	return path.Join(dc.dir, fmt.Sprintf("run%d", run+1))
+}
+
+// hashFile returns the SHA1 hash of a file's contents.
+func hashFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	return h.Sum(nil), err
+}
+
+// unionKeys returns the sorted union of the keys of two maps.
+func unionKeys(m1, m2 map[string][]byte) []string {
+	keys := make([]string, 0, len(m1))
+	for k := range m1 {
+		keys = append(keys, k)
+	}
+	for k := range m2 {
+		if _, present := m1[k]; !present {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// firstDifference returns the offset of the first byte that differs between two slices.
+func firstDifference(b1, b2 []byte) int {
+	for i := 0; i < len(b1) && i < len(b2); i++ {
+		if b1[i] != b2[i] {
+			return i
+		}
+	}
+	if len(b1) < len(b2) {
+		return len(b1)
+	}
+	return len(b2)
+}
+
+// hexdumpLine formats a single line of a hexdump of b starting at the given offset,
+// in the style of hexdump -C.
+func hexdumpLine(b []byte, offset int) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%08x ", offset)
+	for i := offset; i < offset+hexdumpWidth; i++ {
+		if i%8 == 0 {
+			buf.WriteByte(' ')
+		}
+		if i < len(b) {
+			fmt.Fprintf(&buf, "%02x ", b[i])
+		} else {
+			buf.WriteString("   ")
+		}
+	}
+	buf.WriteString(" |")
+	for i := offset; i < offset+hexdumpWidth && i < len(b); i++ {
+		if c := b[i]; c >= 32 && c < 127 {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteByte('.')
+		}
+	}
+	buf.WriteByte('|')
+	return buf.String()
+}
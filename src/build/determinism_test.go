@@ -0,0 +1,55 @@
+package build
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestDeterminismChecker(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	stable := core.NewBuildTarget(core.ParseBuildLabel("//src/build/determinism:stable", ""))
+	stable.AddOutput("stable.txt")
+	state.Graph.AddTarget(stable)
+	unstable := core.NewBuildTarget(core.ParseBuildLabel("//src/build/determinism:unstable", ""))
+	unstable.AddOutput("unstable.txt")
+	state.Graph.AddTarget(unstable)
+	labels := []core.BuildLabel{stable.Label, unstable.Label}
+
+	dir, err := ioutil.TempDir("", "determinism")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dc, err := NewDeterminismChecker(dir)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(stable.OutDir(), core.DirPermissions))
+	for _, contents := range []string{"built at 12:00:00", "built at 12:00:07"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(stable.OutDir(), "stable.txt"), []byte("hello"), 0644))
+		require.NoError(t, ioutil.WriteFile(path.Join(unstable.OutDir(), "unstable.txt"), []byte(contents), 0644))
+		require.NoError(t, dc.Record(state, labels))
+	}
+
+	var buf bytes.Buffer
+	same, err := dc.Report(&buf)
+	require.NoError(t, err)
+	assert.False(t, same)
+	assert.Equal(t, `//src/build/determinism:stable:
+  All 2 runs produced identical outputs
+//src/build/determinism:unstable:
+  unstable.txt differs between runs 1 and 2
+    First difference at byte 16 (sizes 17 and 17):
+    run 1: 00000010  30                                                |0|
+    run 2: 00000010  37                                                |7|
+`, buf.String())
+}
+
+func TestHexdumpLine(t *testing.T) {
+	b := []byte("PK\x03\x04 some zip file contents")
+	assert.Equal(t, "00000000  50 4b 03 04 20 73 6f 6d  65 20 7a 69 70 20 66 69  |PK.. some zip fi|", hexdumpLine(b, 0))
+}
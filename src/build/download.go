@@ -0,0 +1,191 @@
+// Code for downloading remote files locally.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// maxDownloadResumes is the number of times we'll try to resume an interrupted download from
+// any one URL before giving up on it and moving onto the next.
+const maxDownloadResumes = 3
+
+// A downloadManager fetches remote files for remote_file rules.
+// It limits the number of concurrent downloads from each host, rotates through the mirrors
+// for a file when one fails, resumes interrupted downloads where the server supports it, and
+// verifies the results against the target's hashes as they arrive.
+type downloadManager struct {
+	client  http.Client
+	perHost int
+	mutex   sync.Mutex
+	hosts   map[string]chan struct{}
+}
+
+// newDownloadManager creates a new downloadManager from the given config.
+func newDownloadManager(config *core.Configuration) *downloadManager {
+	d := &downloadManager{
+		perHost: config.Build.DownloadsPerHost,
+		hosts:   map[string]chan struct{}{},
+	}
+	if config.Build.HTTPProxy != "" {
+		d.client.Transport = &http.Transport{
+			Proxy: http.ProxyURL(config.Build.HTTPProxy.AsURL()),
+		}
+	}
+	d.client.Timeout = time.Duration(config.Build.Timeout)
+	return d
+}
+
+// A statusError is returned for a HTTP response with a non-2xx status.
+// These aren't worth retrying against the same URL.
+type statusError struct {
+	URL    string
+	Status string
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("Error retrieving %s: %s", err.URL, err.Status)
+}
+
+// Download fetches the given target's output from the first of the given URLs that succeeds, writing it to
+// the given file. It returns the hash of the file as calculated by the given function.
+// If verify is true the file must also match one of the target's hashes; if it doesn't, the next URL is tried.
+func (d *downloadManager) Download(target *core.BuildTarget, urls []string, filename string, newHash func() hash.Hash, verify bool) ([]byte, error) {
+	var merr error
+	for _, u := range urls {
+		h, err := d.downloadURL(target, u, filename, newHash, verify)
+		if err == nil {
+			return h, nil
+		}
+		log.Debug("Failed to download %s for %s: %s", u, target, err)
+		merr = multierror.Append(merr, err)
+	}
+	return nil, merr
+}
+
+// downloadURL downloads a single URL, resuming it if it gets interrupted.
+func (d *downloadManager) downloadURL(target *core.BuildTarget, u string, filename string, newHash func() hash.Hash, verify bool) ([]byte, error) {
+	release := d.acquire(u)
+	defer release()
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := newHash()
+	verifier := core.NewHashVerifier(nil)
+	if verify {
+		verifier = core.NewHashVerifier(target.ExpectedHashes())
+	}
+	// restart discards anything we've downloaded so far.
+	restart := func() error {
+		h.Reset()
+		verifier.Reset()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return f.Truncate(0)
+	}
+	w := io.MultiWriter(f, h, verifier)
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		n, err := d.fetch(target, u, w, offset, restart)
+		if err == nil {
+			break
+		}
+		var serr *statusError
+		if errors.As(err, &serr) || attempt >= maxDownloadResumes {
+			return nil, err
+		}
+		offset = n
+		log.Warning("Download of %s interrupted after %d bytes, resuming: %s", u, offset, err)
+	}
+	if err := verifier.Verify(); err != nil {
+		return nil, fmt.Errorf("Bad hash for %s from %s: %s", target.Label, u, err)
+	}
+	return h.Sum(nil), f.Close()
+}
+
+// fetch makes a single request for the given URL, starting from the given offset.
+// It returns the total number of bytes downloaded so far, including anything before the offset.
+// If the server doesn't honour the requested range, restart is called before writing anything.
+func (d *downloadManager) fetch(target *core.BuildTarget, u string, w io.Writer, offset int64, restart func() error) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return offset, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return offset, &statusError{URL: u, Status: resp.Status}
+	} else if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// The server doesn't support ranges so we are getting the whole thing again.
+		log.Debug("Server for %s doesn't support range requests, restarting download", u)
+		if err := restart(); err != nil {
+			return 0, err
+		}
+		offset = 0
+	}
+	var r io.Reader = resp.Body
+	if resp.ContentLength > 0 {
+		r = &progressReader{Reader: resp.Body, Target: target, Done: float32(offset), Total: float32(offset + resp.ContentLength)}
+		target.ShowProgress = true // Required for it to actually display
+	}
+	n, err := io.Copy(w, r)
+	return offset + n, err
+}
+
+// acquire waits until we are allowed to start a download of the given URL.
+// It returns a function that must be called when the download is finished.
+func (d *downloadManager) acquire(u string) func() {
+	if d.perHost <= 0 {
+		return func() {}
+	}
+	host := u
+	if parsed, err := url.Parse(u); err == nil {
+		host = parsed.Host
+	}
+	d.mutex.Lock()
+	ch, present := d.hosts[host]
+	if !present {
+		ch = make(chan struct{}, d.perHost)
+		d.hosts[host] = ch
+	}
+	d.mutex.Unlock()
+	ch <- struct{}{}
+	return func() { <-ch }
+}
+
+// A progressReader tracks progress from a HTTP response and marks it on the given target.
+type progressReader struct {
+	Reader      io.Reader
+	Target      *core.BuildTarget
+	Done, Total float32
+}
+
+// Read implements the io.Reader interface
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.Done += float32(n)
+	r.Target.Progress = 100.0 * r.Done / r.Total
+	return n, err
+}
@@ -0,0 +1,165 @@
+package build
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const downloadContents = "wibble wibble wibble"
+
+func TestDownloadFallsBackToMirror(t *testing.T) {
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(downloadContents))
+	}))
+	defer good.Close()
+
+	target := newDownloadTarget("mirror")
+	filename := downloadFile(t)
+	h, err := newTestDownloadManager().Download(target, []string{bad.URL, good.URL}, filename, sha1.New, true)
+	require.NoError(t, err)
+	assertDownloaded(t, filename)
+	assert.Equal(t, sha1Hex(downloadContents), hex.EncodeToString(h))
+}
+
+func TestDownloadAllMirrorsFail(t *testing.T) {
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	_, err := newTestDownloadManager().Download(newDownloadTarget("fail"), []string{bad.URL, bad.URL}, downloadFile(t), sha1.New, true)
+	assert.Error(t, err)
+}
+
+func TestDownloadRejectsBadHash(t *testing.T) {
+	wrong := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("wobble wobble wobble"))
+	}))
+	defer wrong.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(downloadContents))
+	}))
+	defer good.Close()
+
+	target := newDownloadTarget("hash")
+	target.Hashes = []string{sha256Hex(downloadContents)}
+	filename := downloadFile(t)
+	_, err := newTestDownloadManager().Download(target, []string{wrong.URL}, filename, sha1.New, true)
+	assert.Error(t, err)
+	_, err = newTestDownloadManager().Download(target, []string{wrong.URL, good.URL}, filename, sha1.New, true)
+	require.NoError(t, err)
+	assertDownloaded(t, filename)
+	// Shouldn't fail if we're not verifying.
+	_, err = newTestDownloadManager().Download(target, []string{wrong.URL}, filename, sha1.New, false)
+	assert.NoError(t, err)
+}
+
+func TestDownloadResumes(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			// Claim to send the whole thing, but stop halfway through.
+			w.Header().Set("Content-Length", strconv.Itoa(len(downloadContents)))
+			w.Write([]byte(downloadContents[:10]))
+			return
+		}
+		assert.Equal(t, "bytes=10-", r.Header.Get("Range"))
+		w.Header().Set("Content-Range", "bytes 10-"+strconv.Itoa(len(downloadContents)-1)+"/"+strconv.Itoa(len(downloadContents)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(downloadContents[10:]))
+	}))
+	defer srv.Close()
+
+	target := newDownloadTarget("resume")
+	target.Hashes = []string{sha1Hex(downloadContents)}
+	filename := downloadFile(t)
+	h, err := newTestDownloadManager().Download(target, []string{srv.URL}, filename, sha1.New, true)
+	require.NoError(t, err)
+	assertDownloaded(t, filename)
+	assert.Equal(t, sha1Hex(downloadContents), hex.EncodeToString(h))
+	assert.EqualValues(t, 2, requests)
+}
+
+func TestDownloadRestartsWithoutRangeSupport(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(downloadContents)))
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Write([]byte(downloadContents[:10]))
+			return
+		}
+		w.Write([]byte(downloadContents)) // Ignores the Range header
+	}))
+	defer srv.Close()
+
+	target := newDownloadTarget("restart")
+	target.Hashes = []string{sha1Hex(downloadContents)}
+	filename := downloadFile(t)
+	_, err := newTestDownloadManager().Download(target, []string{srv.URL}, filename, sha1.New, true)
+	require.NoError(t, err)
+	assertDownloaded(t, filename)
+}
+
+func TestDownloadPerHostLimit(t *testing.T) {
+	d := newTestDownloadManager()
+	d.perHost = 1
+	release := d.acquire("https://example.com/file1")
+	acquired := make(chan struct{})
+	go func() {
+		defer d.acquire("https://example.com/file2")()
+		close(acquired)
+	}()
+	// A different host isn't affected.
+	d.acquire("https://example.org/file1")()
+	select {
+	case <-acquired:
+		t.Fatal("Should not have been able to acquire a second download from the same host")
+	default:
+	}
+	release()
+	<-acquired
+}
+
+func newTestDownloadManager() *downloadManager {
+	return newDownloadManager(core.DefaultConfiguration())
+}
+
+func newDownloadTarget(name string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: name})
+	target.IsRemoteFile = true
+	return target
+}
+
+func downloadFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "download_test")
+	require.NoError(t, err)
+	return path.Join(dir, "out")
+}
+
+func assertDownloaded(t *testing.T, filename string) {
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, downloadContents, string(b))
+}
+
+func sha1Hex(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -6,7 +6,7 @@
 // be sure to build each output file only once.
 // Currently this is implemented by a single thread that builds them all; there
 // are other schemes we could have but this is simple enough (and since we link
-// them rather than copying there should not be a lot of I/O wait).
+// or reflink them rather than copying there should not be a lot of I/O wait).
 
 package build
 
@@ -64,7 +64,7 @@ func (builder *filegroupBuilder) Build(state *core.BuildState, target *core.Buil
 		return true, err
 	} else if err := fs.EnsureDir(to); err != nil {
 		return true, err
-	} else if err := fs.RecursiveLink(from, to, target.OutMode()); err != nil {
+	} else if err := state.Linker.Link(from, to, target.OutMode()); err != nil {
 		return true, err
 	}
 	builder.built[to] = true
@@ -18,6 +18,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -218,6 +219,16 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 	for _, secret := range target.Secrets {
 		h.Write([]byte(secret))
 	}
+	propNames := make([]string, 0, len(target.ExecProperties))
+	for name := range target.ExecProperties {
+		propNames = append(propNames, name)
+	}
+	sort.Strings(propNames)
+	for _, name := range propNames {
+		h.Write([]byte(name))
+		h.Write([]byte{'='})
+		h.Write([]byte(target.ExecProperties[name]))
+	}
 	hashBool(h, target.IsBinary)
 	hashBool(h, target.IsTest)
 	hashOptionalBool(h, target.Sandbox)
@@ -233,6 +244,19 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 			h.Write([]byte(datum.String()))
 		}
 		hashOptionalBool(h, target.TestSandbox)
+		envNames := make([]string, 0, len(target.TestEnv))
+		for name := range target.TestEnv {
+			envNames = append(envNames, name)
+		}
+		sort.Strings(envNames)
+		for _, name := range envNames {
+			h.Write([]byte(name))
+			h.Write([]byte{'='})
+			h.Write([]byte(target.TestEnv[name]))
+		}
+		for _, fixture := range target.Fixtures {
+			h.Write([]byte(fixture.String()))
+		}
 	}
 
 	hashBool(h, target.NeedsTransitiveDependencies)
@@ -266,6 +290,9 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 	hashBool(h, target.PostBuildFunction != nil)
 	if target.PassEnv != nil {
 		for _, env := range *target.PassEnv {
+			if state.Config.OverridesEnv(env) {
+				continue // The value from the config is already hashed.
+			}
 			h.Write([]byte(env))
 			h.Write([]byte{'='})
 			h.Write([]byte(os.Getenv(env)))
@@ -453,6 +480,21 @@ func PrintHashes(state *core.BuildState, target *core.BuildTarget) {
 	}
 }
 
+// RemoteDiff compares a target that has been built locally with how it would be built remotely,
+// writing a report of any differences to w. It's used by plz debug remote-diff.
+// It returns true if there weren't any.
+func RemoteDiff(state *core.BuildState, target *core.BuildTarget, w io.Writer) (bool, error) {
+	if state.RemoteClient == nil {
+		return false, fmt.Errorf("remote execution is not configured")
+	}
+	_, _, cmd, err := core.WorkerCommandAndArgs(state, target)
+	if err != nil {
+		return false, err
+	}
+	env := core.BuildEnvironment(state, target, path.Join(core.RepoRoot, target.TmpDir()))
+	return state.RemoteClient.Diff(target, env, cmd, w)
+}
+
 // secretHash calculates a hash for any secrets of a target.
 func secretHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	if len(target.Secrets) == 0 {
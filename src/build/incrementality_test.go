@@ -50,12 +50,15 @@ var KnownFields = map[string]bool{
 	"NamedSecrets":                true,
 	"TestOutputs":                 true,
 	"Stamp":                       true,
+	"ExecProperties":              true,
 
 	// These only contribute to the runtime hash, not at build time.
 	"Data":              true,
 	"namedData":         true,
 	"TestSandbox":       true,
 	"ContainerSettings": true,
+	"TestEnv":           true,
+	"Fixtures":          true,
 
 	// These would ideally not contribute to the hash, but we need that at present
 	// because we don't have a good way to force a recheck of its reverse dependencies.
@@ -77,6 +80,13 @@ var KnownFields = map[string]bool{
 	"ShowProgress":        true,
 	"Progress":            true,
 	"NeededForSubinclude": true,
+	"Retention":           true,
+	"CPULimit":            true,
+	"MemoryLimit":         true,
+	"OutputSizeBudget":    true,
+	"BuildDurationBudget": true,
+	"TestDurationBudget":  true,
+	"Kind":                true,
 
 	// Used to save the rule hash rather than actually being hashed itself.
 	"RuleHash": true,
@@ -7,6 +7,8 @@ import (
 	"bufio"
 	"compress/gzip"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/djherbis/atime"
@@ -26,6 +29,16 @@ import (
 
 const remoteActionFilename = ".plz_remote_action"
 
+// cleanLockFilename is the name of the lock file within the cache directory that's held while cleaning it.
+// This prevents several plz processes sharing a cache from all trying to clean it at once.
+const cleanLockFilename = ".plz_clean.lock"
+
+// errCleanLocked is returned when another process already holds the lock for cleaning the cache.
+var errCleanLocked = errors.New("dir cache is already being cleaned by another process")
+
+// retentionSuffix is the suffix of the file we write alongside each cache entry to record its retention class.
+const retentionSuffix = ".retention"
+
 type dirCache struct {
 	Dir      string
 	Compress bool
@@ -33,6 +46,10 @@ type dirCache struct {
 	mtime    time.Time
 	added    map[string]uint64
 	mutex    sync.Mutex
+	// Maximum age of ephemeral artifacts before they are cleaned.
+	ephemeralMaxAge time.Duration
+	// Maximum age of any other artifacts before they are cleaned.
+	maxAge time.Duration
 }
 
 func (cache *dirCache) Store(target *core.BuildTarget, key []byte, metadata *core.BuildMetadata, files []string) {
@@ -58,6 +75,28 @@ func (cache *dirCache) Store(target *core.BuildTarget, key []byte, metadata *cor
 	if err := os.Rename(tmpDir, cacheDir); err != nil && !os.IsNotExist(err) {
 		log.Warning("Failed to create cache directory %s: %s", cacheDir, err)
 	}
+	cache.storeRetention(target, cacheDir)
+}
+
+// storeRetention records the retention class of a target alongside its cache entry.
+func (cache *dirCache) storeRetention(target *core.BuildTarget, cacheDir string) {
+	filename := cacheDir + retentionSuffix
+	if target.Retention == "" {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Warning("Failed to remove retention file %s: %s", filename, err)
+		}
+	} else if err := ioutil.WriteFile(filename, []byte(target.Retention), 0644); err != nil {
+		log.Warning("Failed to store retention class for %s in dir cache: %s", target.Label, err)
+	}
+}
+
+// loadRetention loads the retention class for a cache entry.
+func (cache *dirCache) loadRetention(cacheDir string) string {
+	data, err := ioutil.ReadFile(cacheDir + retentionSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
 
 // storeFiles stores the given files in the cache, either compressed or not.
@@ -373,10 +412,12 @@ func (cache *dirCache) isMarked(path string) (uint64, bool) {
 
 func newDirCache(config *core.Configuration) *dirCache {
 	cache := &dirCache{
-		Compress: config.Cache.DirCompress,
-		Dir:      config.Cache.Dir,
-		added:    map[string]uint64{},
-		mtime:    time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Compress:        config.Cache.DirCompress,
+		Dir:             config.Cache.Dir,
+		added:           map[string]uint64{},
+		mtime:           time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		ephemeralMaxAge: time.Duration(config.Cache.DirCacheEphemeralMaxAge),
+		maxAge:          time.Duration(config.Cache.DirCacheMaxAge),
 	}
 	if cache.Compress {
 		cache.Suffix = ".tar.gz"
@@ -396,14 +437,24 @@ func newDirCache(config *core.Configuration) *dirCache {
 	return cache
 }
 
+// Lengths of the names of cache entries, which are 20-byte sha1 or 32-byte sha256 hashes encoded to base64.
+// Temporary entries that are still being written to have an extra = appended.
+const (
+	sha1EntryLength       = 28
+	sha1TempEntryLength   = sha1EntryLength + 1
+	sha256EntryLength     = 44
+	sha256TempEntryLength = sha256EntryLength + 1
+)
+
 // Period of time in seconds between which two artifacts are considered to have the same atime.
 const accessTimeGracePeriod = 600 // Ten minutes
 
 // A cacheEntry represents a single file entry in the cache.
 type cacheEntry struct {
-	Path  string
-	Size  uint64
-	Atime int64
+	Path      string
+	Size      uint64
+	Atime     int64
+	Retention string
 }
 
 func findSize(path string) (uint64, error) {
@@ -420,9 +471,40 @@ func findSize(path string) (uint64, error) {
 	return totalSize, nil
 }
 
+// CleanDirCache runs a single pass of cleaning over the directory cache, reducing it to within
+// the configured size & age limits. It returns the size of the cache afterwards and the number of
+// bytes that were reclaimed, or an error if it couldn't be cleaned (including if another process
+// is already cleaning it).
+func CleanDirCache(config *core.Configuration) (uint64, uint64, error) {
+	cache := newDirCache(config)
+	return cache.cleanOnce(uint64(config.Cache.DirCacheHighWaterMark), uint64(config.Cache.DirCacheLowWaterMark))
+}
+
 // clean runs background cleaning of this cache until the process exits.
 // Returns the total size of the cache after it's finished.
 func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
+	totalSize, reclaimed, err := cache.cleanOnce(highWaterMark, lowWaterMark)
+	if err == errCleanLocked {
+		log.Debug("%s", err)
+	} else if err != nil {
+		log.Error("Failed to clean dir cache: %s", err)
+	} else if reclaimed > 0 {
+		log.Notice("Cleaned %s from dir cache, it's now %s", humanize.Bytes(reclaimed), humanize.Bytes(totalSize))
+	}
+	return totalSize
+}
+
+// cleanOnce implements clean, returning the total size of the cache afterwards and the number
+// of bytes that were removed from it.
+// If another process is already cleaning the cache it does nothing and returns errCleanLocked.
+func (cache *dirCache) cleanOnce(highWaterMark, lowWaterMark uint64) (uint64, uint64, error) {
+	lock, err := cache.lockForCleaning()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to acquire dir cache lock: %s", err)
+	} else if lock == nil {
+		return 0, 0, errCleanLocked
+	}
+	defer lock.Close()
 	entries := []cacheEntry{}
 	var totalSize uint64
 	if err := fs.Walk(cache.Dir, func(path string, isDir bool) error {
@@ -432,33 +514,54 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 				totalSize += size
 				return filepath.SkipDir // Already handled
 			}
-			size, err := findSize(path)
+			// Stat this before walking it, since that updates its atime.
+			info, err := os.Stat(path)
 			if err != nil {
 				return err
 			}
-			info, err := os.Stat(path)
+			size, err := findSize(path)
 			if err != nil {
 				return err
+			} else if cache.isInProgress(name, info) {
+				totalSize += size
+				return filepath.SkipDir // Another process is still writing this, leave it alone.
 			}
 			entries = append(entries, cacheEntry{
-				Path:  path,
-				Size:  size,
-				Atime: atime.Get(info).Unix(),
+				Path:      path,
+				Size:      size,
+				Atime:     atime.Get(info).Unix(),
+				Retention: cache.loadRetention(path),
 			})
 			totalSize += size
 			return filepath.SkipDir
 		}
 		return nil // nothing particularly to do for other entries
 	}); err != nil {
-		log.Error("error walking cache directory: %s\n", err)
-		return totalSize
+		return totalSize, 0, fmt.Errorf("error walking cache directory: %s", err)
 	}
 	log.Info("Total cache size: %s", humanize.Bytes(uint64(totalSize)))
+	initialSize := totalSize
+	// Artifacts are expired once they get old enough, regardless of how big the cache is.
+	if cache.ephemeralMaxAge > 0 || cache.maxAge > 0 {
+		remaining := entries[:0]
+		for _, entry := range entries {
+			if cache.isExpired(entry) && cache.removeEntry(entry) {
+				totalSize -= entry.Size
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+		entries = remaining
+	}
 	if totalSize < highWaterMark {
-		return totalSize // Nothing to do, cache is small enough.
+		return totalSize, initialSize - totalSize, nil // Nothing more to do, cache is small enough.
 	}
-	// OK, we need to slim it down a bit. We implement a simple LRU algorithm.
+	// OK, we need to slim it down a bit. We implement a simple LRU algorithm, although
+	// ephemeral artifacts always go first.
 	sort.Slice(entries, func(i, j int) bool {
+		if ei, ej := entries[i].Retention == core.RetentionEphemeral, entries[j].Retention == core.RetentionEphemeral; ei != ej {
+			return ei
+		}
 		diff := entries[i].Atime - entries[j].Atime
 		if diff > -accessTimeGracePeriod && diff < accessTimeGracePeriod {
 			return entries[i].Size > entries[j].Size
@@ -466,19 +569,9 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 		return entries[i].Atime < entries[j].Atime
 	})
 	for _, entry := range entries {
-		if _, marked := cache.isMarked(entry.Path); marked {
-			continue
-		}
-
-		log.Debug("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)), humanize.Bytes(uint64(entry.Size)))
-		// Try to rename the directory first so we don't delete bits while someone might access them.
-		newPath := entry.Path + "="
-		if err := os.Rename(entry.Path, newPath); err != nil {
-			log.Errorf("Couldn't rename %s: %s", entry.Path, err)
-			continue
-		}
-		if err := os.RemoveAll(newPath); err != nil {
-			log.Errorf("Couldn't remove %s: %s", newPath, err)
+		if entry.Retention == core.RetentionRelease {
+			continue // These are never cleaned.
+		} else if !cache.removeEntry(entry) {
 			continue
 		}
 		totalSize -= entry.Size
@@ -486,7 +579,63 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 			break
 		}
 	}
-	return totalSize
+	return totalSize, initialSize - totalSize, nil
+}
+
+// lockForCleaning acquires the lock file for cleaning the cache.
+// It returns nil if another process already holds it; the caller should close the file to release it.
+func (cache *dirCache) lockForCleaning() (*os.File, error) {
+	f, err := os.OpenFile(path.Join(cache.Dir, cleanLockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	} else if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// isExpired returns true if the given entry hasn't been accessed for longer than its maximum age.
+func (cache *dirCache) isExpired(entry cacheEntry) bool {
+	maxAge := cache.maxAge
+	if entry.Retention == core.RetentionRelease {
+		return false
+	} else if entry.Retention == core.RetentionEphemeral && cache.ephemeralMaxAge > 0 {
+		maxAge = cache.ephemeralMaxAge
+	}
+	return maxAge > 0 && entry.Atime < time.Now().Add(-maxAge).Unix()
+}
+
+// isInProgress returns true if the given entry is a temporary one that was recently modified,
+// in which case it's likely that another process is still writing it.
+func (cache *dirCache) isInProgress(name string, info os.FileInfo) bool {
+	name = strings.TrimSuffix(name, cache.Suffix)
+	return (len(name) == sha1TempEntryLength || len(name) == sha256TempEntryLength) && time.Since(info.ModTime()) < accessTimeGracePeriod*time.Second
+}
+
+// removeEntry removes a single entry from the cache. It returns true if it was removed.
+func (cache *dirCache) removeEntry(entry cacheEntry) bool {
+	if _, marked := cache.isMarked(entry.Path); marked {
+		return false
+	}
+	log.Debug("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)), humanize.Bytes(uint64(entry.Size)))
+	// Try to rename the directory first so we don't delete bits while someone might access them.
+	newPath := entry.Path + "="
+	if err := os.Rename(entry.Path, newPath); err != nil {
+		log.Errorf("Couldn't rename %s: %s", entry.Path, err)
+		return false
+	}
+	if err := os.RemoveAll(newPath); err != nil {
+		log.Errorf("Couldn't remove %s: %s", newPath, err)
+		return false
+	}
+	if err := os.Remove(entry.Path + retentionSuffix); err != nil && !os.IsNotExist(err) {
+		log.Warning("Couldn't remove %s: %s", entry.Path+retentionSuffix, err)
+	}
+	return true
 }
 
 // shouldClean returns true if we should clean this file.
@@ -498,9 +647,9 @@ func (cache *dirCache) shouldClean(name string, isDir bool) bool {
 		return false // Suffix must match.
 	}
 	name = strings.TrimSuffix(name, cache.Suffix)
-	// 28 == length of 20-byte sha1 hash, encoded to base64, which always gets a trailing =
-	// as padding so we can check that to be "sure".
-	// Also 29 in case we appended an extra = (which we do for temporary files that are still being written to)
-	// Similarly for sha256 which is length 44.
-	return ((len(name) == 28 || len(name) == 29) && name[27] == '=') || ((len(name) == 44 || len(name) == 45) && name[43] == '=')
+	// The hash always gets a trailing = as padding when encoded to base64, so we can check that to be "sure".
+	// The name may also be one longer in case we appended an extra = (which we do for temporary files that
+	// are still being written to).
+	return ((len(name) == sha1EntryLength || len(name) == sha1TempEntryLength) && name[sha1EntryLength-1] == '=') ||
+		((len(name) == sha256EntryLength || len(name) == sha256TempEntryLength) && name[sha256EntryLength-1] == '=')
 }
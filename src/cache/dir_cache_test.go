@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -148,6 +149,101 @@ func TestCleanCompressed(t *testing.T) {
 	assert.True(t, inCompressedCache(target2))
 }
 
+func TestCleanRelease(t *testing.T) {
+	cache := makeCache(".plz-cache-test8", false)
+	target1 := makeTarget("//test8:target1", 2000)
+	target1.Retention = core.RetentionRelease
+	cache.Store(target1, hash, &core.BuildMetadata{}, target1.Outputs())
+	writeFile(cachePath(target1, false), 2000)
+	cache.added = map[string]uint64{} // Forget that we stored it
+	target2 := makeTarget("//test8:target2", 2000)
+	writeFile(cachePath(target2, false), 2000)
+	// Should clean target2 but never target1, even though the cache stays over the low water mark.
+	cache.clean(1000, 500)
+	assert.True(t, inCache(target1))
+	assert.False(t, inCache(target2))
+}
+
+func TestCleanEphemeralFirst(t *testing.T) {
+	cache := makeCache(".plz-cache-test9", false)
+	target1 := makeTarget("//test9:target1", 2000)
+	writeFile(cachePath(target1, false), 2000)
+	target2 := makeTarget("//test9:target2", 2000)
+	target2.Retention = core.RetentionEphemeral
+	cache.Store(target2, hash, &core.BuildMetadata{}, target2.Outputs())
+	cache.added = map[string]uint64{}
+	// target2 is more recent but ephemeral so should be cleaned first.
+	cache.clean(10000, 15000)
+	assert.True(t, inCache(target1))
+	assert.False(t, inCache(target2))
+}
+
+func TestCleanEphemeralExpiry(t *testing.T) {
+	cache := makeCache(".plz-cache-test10", false)
+	cache.ephemeralMaxAge = time.Nanosecond
+	target1 := makeTarget("//test10:target1", 2000)
+	writeFile(cachePath(target1, false), 2000)
+	target2 := makeTarget("//test10:target2", 2000)
+	target2.Retention = core.RetentionEphemeral
+	cache.Store(target2, hash, &core.BuildMetadata{}, target2.Outputs())
+	cache.added = map[string]uint64{}
+	time.Sleep(time.Second) // atimes are only accurate to the second
+	// Cache is well under its high water mark but target2 should be cleaned since it's expired.
+	cache.clean(50000, 40000)
+	assert.True(t, inCache(target1))
+	assert.False(t, inCache(target2))
+}
+
+func TestCleanMaxAge(t *testing.T) {
+	cache := makeCache(".plz-cache-test11", false)
+	cache.maxAge = time.Nanosecond
+	target1 := makeTarget("//test11:target1", 2000)
+	target1.Retention = core.RetentionRelease
+	cache.Store(target1, hash, &core.BuildMetadata{}, target1.Outputs())
+	target2 := makeTarget("//test11:target2", 2000)
+	cache.Store(target2, hash, &core.BuildMetadata{}, target2.Outputs())
+	cache.added = map[string]uint64{}
+	time.Sleep(time.Second) // atimes are only accurate to the second
+	// Cache is well under its high water mark but target2 has expired; target1 is never cleaned.
+	_, reclaimed, err := cache.cleanOnce(50000, 40000)
+	assert.NoError(t, err)
+	assert.NotZero(t, reclaimed)
+	assert.True(t, inCache(target1))
+	assert.False(t, inCache(target2))
+}
+
+func TestCleanSkipsInProgress(t *testing.T) {
+	cache := makeCache(".plz-cache-test12", false)
+	target := makeTarget("//test12:target1", 2000)
+	// Simulates another process that's halfway through writing this entry.
+	tmpFile := path.Join(".plz-cache-test12", "test12", "target1", b64Hash+"=", "test.go")
+	writeFile(tmpFile, 2000)
+	_, reclaimed, err := cache.cleanOnce(1000, 500)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, reclaimed)
+	assert.True(t, core.PathExists(tmpFile))
+	assert.False(t, inCache(target))
+}
+
+func TestCleanLocked(t *testing.T) {
+	cache := makeCache(".plz-cache-test13", false)
+	target := makeTarget("//test13:target1", 2000)
+	writeFile(cachePath(target, false), 2000)
+	lock, err := cache.lockForCleaning()
+	assert.NoError(t, err)
+	assert.NotNil(t, lock)
+	// Nothing should happen while another cleaner holds the lock.
+	_, reclaimed, err := cache.cleanOnce(1000, 500)
+	assert.Equal(t, errCleanLocked, err)
+	assert.EqualValues(t, 0, reclaimed)
+	assert.True(t, inCache(target))
+	lock.Close()
+	_, reclaimed, err = cache.cleanOnce(1000, 500)
+	assert.NoError(t, err)
+	assert.NotZero(t, reclaimed)
+	assert.False(t, inCache(target))
+}
+
 func makeCache(dir string, compress bool) *dirCache {
 	config := core.DefaultConfiguration()
 	config.Cache.Dir = dir
@@ -4,7 +4,9 @@ package cache
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -14,6 +16,9 @@ import (
 	"path"
 	"time"
 
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
@@ -21,40 +26,113 @@ import (
 type httpCache struct {
 	url      string
 	writable bool
+	bazel    bool
 	client   *http.Client
 }
 
+// HTTPProtocolBazel is the name of the HTTP cache protocol compatible with bazel-remote
+// (and other servers that implement Bazel's HTTP caching protocol).
+const HTTPProtocolBazel = "bazel"
+
+// bazelArtifactName is the name we give the tarball in the ActionResults we store in Bazel-compatible caches.
+const bazelArtifactName = "plz-artifacts.tar.gz"
+
 // mtime is the time we attach for the modification time of all files.
 var mtime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 
+// retentionHeader is the header we use to indicate the retention class of an artifact to the server.
+const retentionHeader = "X-Please-Retention"
+
 // nobody is the usual uid / gid of the 'nobody' user.
 const nobody = 65534
 
 func (cache *httpCache) Store(target *core.BuildTarget, key []byte, metadata *core.BuildMetadata, files []string) {
 	if cache.writable {
-		r, w := io.Pipe()
-		go cache.write(w, target, key, metadata, files)
-		req, err := http.NewRequest(http.MethodPut, cache.makeURL(key), r)
-		if err != nil {
-			log.Warning("Invalid cache URL: %s", err)
+		if cache.bazel {
+			if err := cache.storeBazel(target, key, files); err != nil {
+				log.Warning("Failed to store files in HTTP cache: %s", err)
+			}
 			return
 		}
-		if resp, err := cache.client.Do(req); err != nil {
+		r, w := io.Pipe()
+		go func() {
+			cache.write(w, target, files)
+			w.Close()
+		}()
+		if err := cache.put(target, cache.makeURL(key), r, -1); err != nil {
 			log.Warning("Failed to store files in HTTP cache: %s", err)
-		} else {
-			resp.Body.Close()
 		}
 	}
 }
 
+// storeBazel stores artifacts in a Bazel-compatible cache.
+// The artifacts are stored as a single tarball in the CAS, along with an ActionResult in
+// the action cache that refers to it (servers typically validate that's what they get).
+// The tarball is written to a temporary file since we need its hash before we can upload it,
+// and it may well be too big to hold in memory.
+func (cache *httpCache) storeBazel(target *core.BuildTarget, key []byte, files []string) error {
+	f, err := ioutil.TempFile("", "plz-http-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	cache.write(io.MultiWriter(f, h), target, files)
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	digest := &pb.Digest{Hash: hex.EncodeToString(h.Sum(nil)), SizeBytes: size}
+	if err := cache.put(target, cache.url+"/cas/"+digest.Hash, f, size); err != nil {
+		return err
+	}
+	b, err := proto.Marshal(&pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: bazelArtifactName, Digest: digest}},
+	})
+	if err != nil {
+		return err
+	}
+	return cache.put(target, cache.makeURL(key), bytes.NewReader(b), int64(len(b)))
+}
+
+// put makes a single PUT request to the server. size is the length of the body, or -1 if it's not known in advance.
+func (cache *httpCache) put(target *core.BuildTarget, url string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return fmt.Errorf("Invalid cache URL: %s", err)
+	}
+	req.ContentLength = size
+	if target.Retention != "" {
+		req.Header.Set(retentionHeader, target.Retention)
+	}
+	resp, err := cache.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, string(b))
+	}
+	return nil
+}
+
 // makeURL returns the remote URL for a key.
+// Bazel-compatible servers require keys to be SHA-256 hashes, so we hash ours again for them
+// (it might be a SHA-1 hash depending on config).
 func (cache *httpCache) makeURL(key []byte) string {
+	if cache.bazel {
+		sum := sha256.Sum256(key)
+		return cache.url + "/ac/" + hex.EncodeToString(sum[:])
+	}
 	return cache.url + "/" + hex.EncodeToString(key)
 }
 
 // write writes a series of files into the given Writer.
-func (cache *httpCache) write(w io.WriteCloser, target *core.BuildTarget, key []byte, metadata *core.BuildMetadata, files []string) {
-	defer w.Close()
+func (cache *httpCache) write(w io.Writer, target *core.BuildTarget, files []string) {
 	gzw := gzip.NewWriter(w)
 	defer gzw.Close()
 	tw := tar.NewWriter(gzw)
@@ -119,7 +197,35 @@ func (cache *httpCache) Retrieve(target *core.BuildTarget, key []byte, files []s
 }
 
 func (cache *httpCache) retrieve(target *core.BuildTarget, key []byte) (*core.BuildMetadata, error) {
-	req, err := http.NewRequest(http.MethodGet, cache.makeURL(key), nil)
+	body, err := cache.get(cache.makeURL(key))
+	if err != nil || body == nil {
+		return nil, err
+	}
+	defer body.Close()
+	if cache.bazel {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		ar := &pb.ActionResult{}
+		if err := proto.Unmarshal(b, ar); err != nil {
+			return nil, err
+		} else if len(ar.OutputFiles) != 1 || ar.OutputFiles[0].Path != bazelArtifactName || ar.OutputFiles[0].Digest == nil {
+			return nil, fmt.Errorf("Unexpected action result in cache, was it not stored by plz?")
+		}
+		artifacts, err := cache.get(cache.url + "/cas/" + ar.OutputFiles[0].Digest.Hash)
+		if err != nil || artifacts == nil {
+			return nil, err
+		}
+		defer artifacts.Close()
+		return cache.extract(target, artifacts)
+	}
+	return cache.extract(target, body)
+}
+
+// get makes a single GET request to the server. It returns nil if the item doesn't exist.
+func (cache *httpCache) get(url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -127,13 +233,19 @@ func (cache *httpCache) retrieve(target *core.BuildTarget, key []byte) (*core.Bu
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
 		return nil, nil // doesn't exist - not an error
 	} else if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		b, _ := ioutil.ReadAll(resp.Body)
 		return nil, fmt.Errorf("%s", string(b))
 	}
-	defer resp.Body.Close()
-	gzr, err := gzip.NewReader(resp.Body)
+	return resp.Body, nil
+}
+
+// extract extracts a tarball of artifacts from the given reader.
+func (cache *httpCache) extract(target *core.BuildTarget, r io.Reader) (*core.BuildMetadata, error) {
+	gzr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
@@ -189,6 +301,7 @@ func newHTTPCache(config *core.Configuration) *httpCache {
 	return &httpCache{
 		url:      config.Cache.HTTPURL.String(),
 		writable: config.Cache.HTTPWriteable,
+		bazel:    config.Cache.HTTPProtocol == HTTPProtocolBazel,
 		client: &http.Client{
 			Timeout: time.Duration(config.Cache.HTTPTimeout),
 		},
@@ -1,14 +1,21 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 )
 
@@ -49,6 +56,33 @@ func TestStoreAndRetrieve(t *testing.T) {
 	assert.Equal(t, b, b2)
 }
 
+func TestStoreAndRetrieveBazel(t *testing.T) {
+	s := &bazelTestServer{t: t, data: map[string][]byte{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+	target.AddOutput("testfile2")
+	config := core.DefaultConfiguration()
+	config.Cache.HTTPURL = cli.URL(server.URL)
+	config.Cache.HTTPWriteable = true
+	config.Cache.HTTPProtocol = HTTPProtocolBazel
+	cache := newHTTPCache(config)
+
+	key := []byte("test_key")
+	cache.Store(target, key, &core.BuildMetadata{}, target.Outputs())
+	assert.Equal(t, 2, len(s.data))
+
+	b, err := ioutil.ReadFile("plz-out/gen/pkg/name/testfile2")
+	assert.NoError(t, err)
+	metadata := cache.Retrieve(target, key, nil)
+	assert.NotNil(t, metadata)
+	b2, err := ioutil.ReadFile("plz-out/gen/pkg/name/testfile2")
+	assert.NoError(t, err)
+	assert.Equal(t, b, b2)
+
+	assert.Nil(t, cache.Retrieve(target, []byte("missing_key"), nil))
+}
+
 type testServer struct {
 	data map[string][]byte
 }
@@ -67,3 +101,37 @@ func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(data)
 }
+
+// bazelTestServer implements a minimal version of bazel-remote's HTTP protocol, including its
+// validation of keys and contents.
+type bazelTestServer struct {
+	t    *testing.T
+	data map[string][]byte
+}
+
+func (s *bazelTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || (parts[0] != "ac" && parts[0] != "cas") || len(parts[1]) != 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPut {
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(s.t, int64(len(b)), r.ContentLength)
+		if parts[0] == "cas" {
+			sum := sha256.Sum256(b)
+			assert.Equal(s.t, parts[1], hex.EncodeToString(sum[:]))
+		} else {
+			assert.NoError(s.t, proto.Unmarshal(b, &pb.ActionResult{}))
+		}
+		s.data[r.URL.Path] = b
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	data, present := s.data[r.URL.Path]
+	if !present {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
@@ -30,6 +30,7 @@ import (
 	pb "github.com/thought-machine/please/src/cache/proto/rpc_cache"
 	"github.com/thought-machine/please/src/cache/tools"
 	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/grpcutil"
 )
 
 func init() {
@@ -133,6 +134,7 @@ func (cache *rpcCache) sendArtifacts(target *core.BuildTarget, key []byte, artif
 		Os:        runtime.GOOS,
 		Arch:      runtime.GOARCH,
 		Hostname:  cache.hostname,
+		Retention: target.Retention,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
@@ -270,10 +272,11 @@ func (cache *rpcCache) Shutdown() {}
 
 func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode bool) {
 	log.Info("Connecting to RPC cache at %s", url)
-	opts := []grpc.DialOption{
+	opts := append(grpcutil.DialOptions(config),
 		grpc.WithTimeout(cache.timeout),
+		// This takes priority over the general limit since it has to agree with the server's.
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cache.maxMsgSize), grpc.MaxCallSendMsgSize(cache.maxMsgSize)),
-	}
+	)
 	if config.Cache.RPCPublicKey != "" || config.Cache.RPCCACert != "" || config.Cache.RPCSecure {
 		auth, err := loadAuth(config.Cache.RPCCACert, config.Cache.RPCPublicKey, config.Cache.RPCPrivateKey)
 		if err != nil {
@@ -284,7 +287,7 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
-	connection, err := grpc.Dial(url, opts...)
+	connection, err := grpcutil.DefaultPool.Dial(url, opts...)
 	if err != nil {
 		cache.Connecting = false
 		log.Warning("Failed to connect to RPC cache: %s", err)
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Budgets returns the output size, build duration and test duration budgets for a target.
+// Any set on the target itself take priority; otherwise the smallest of those configured for
+// any of its labels applies. Zero means there isn't a budget.
+func (config *Configuration) Budgets(target *BuildTarget) (outputSize uint64, buildDuration, testDuration time.Duration) {
+	outputSize = target.OutputSizeBudget
+	buildDuration = target.BuildDurationBudget
+	testDuration = target.TestDurationBudget
+	for _, label := range target.Labels {
+		if budget, present := config.Budget[label]; present {
+			if target.OutputSizeBudget == 0 {
+				outputSize = smallestBudget(outputSize, uint64(budget.OutputSize))
+			}
+			if target.BuildDurationBudget == 0 {
+				buildDuration = time.Duration(smallestBudget(uint64(buildDuration), uint64(budget.BuildDuration)))
+			}
+			if target.TestDurationBudget == 0 {
+				testDuration = time.Duration(smallestBudget(uint64(testDuration), uint64(budget.TestDuration)))
+			}
+		}
+	}
+	return outputSize, buildDuration, testDuration
+}
+
+// smallestBudget returns the smaller of two budgets, where zero means there isn't one.
+func smallestBudget(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// CheckBudget checks the size of a target's outputs and how long it took to build or test
+// against its budgets. If it's exceeded any of them it logs a warning, or returns an error if
+// budgets are being enforced.
+// Either outputSize or duration can be zero if they aren't known.
+func (state *BuildState) CheckBudget(target *BuildTarget, test bool, outputSize uint64, duration time.Duration) error {
+	sizeBudget, buildBudget, testBudget := state.Config.Budgets(target)
+	durationBudget := buildBudget
+	action := "build"
+	if test {
+		durationBudget = testBudget
+		action = "test"
+	}
+	var problems []string
+	if sizeBudget > 0 && outputSize > sizeBudget {
+		problems = append(problems, fmt.Sprintf("its outputs are %s, but its budget is %s", humanize.Bytes(outputSize), humanize.Bytes(sizeBudget)))
+	}
+	if durationBudget > 0 && duration > durationBudget {
+		problems = append(problems, fmt.Sprintf("it took %s to %s, but its budget is %s", duration.Round(time.Millisecond), action, durationBudget))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s exceeded its budget: %s", target.Label, strings.Join(problems, " and "))
+	if !state.Config.Build.EnforceBudgets {
+		log.Warning("%s", msg)
+		return nil
+	}
+	err := NewBuildError(ErrorBudgetExceeded, fmt.Errorf("%s", msg))
+	err.Package = target.Label.PackageName
+	err.Target = target.Label.String()
+	return err
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
+)
+
+func TestBudgetsFromLabels(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Budget = map[string]*Budget{
+		"go":    {OutputSize: 1000, BuildDuration: cli.Duration(time.Minute)},
+		"small": {OutputSize: 100, TestDuration: cli.Duration(time.Second)},
+	}
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddLabel("go")
+	target.AddLabel("small")
+	size, build, test := config.Budgets(target)
+	assert.EqualValues(t, 100, size)
+	assert.Equal(t, time.Minute, build)
+	assert.Equal(t, time.Second, test)
+}
+
+func TestBudgetsTargetTakesPriority(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Budget = map[string]*Budget{
+		"go": {OutputSize: 1000, BuildDuration: cli.Duration(time.Minute)},
+	}
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddLabel("go")
+	target.OutputSizeBudget = 5000
+	size, build, _ := config.Budgets(target)
+	assert.EqualValues(t, 5000, size)
+	assert.Equal(t, time.Minute, build)
+}
+
+func TestCheckBudget(t *testing.T) {
+	state := NewDefaultBuildState()
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.OutputSizeBudget = 1000
+	target.BuildDurationBudget = time.Minute
+	assert.NoError(t, state.CheckBudget(target, false, 500, time.Second))
+	// Exceeding it only warns by default.
+	assert.NoError(t, state.CheckBudget(target, false, 5000, time.Second))
+	state.Config.Build.EnforceBudgets = true
+	assert.NoError(t, state.CheckBudget(target, false, 500, time.Second))
+	// Test durations aren't checked against the build budget.
+	assert.NoError(t, state.CheckBudget(target, true, 0, time.Hour))
+	err := state.CheckBudget(target, false, 5000, time.Hour)
+	assert.Error(t, err)
+	be, ok := err.(*BuildError)
+	assert.True(t, ok)
+	assert.Equal(t, ErrorBudgetExceeded, be.Code)
+	assert.Equal(t, "//src/core:core", be.Target)
+}
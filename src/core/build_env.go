@@ -2,9 +2,11 @@ package core
 
 import (
 	"encoding/base64"
+	"fmt"
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -49,7 +51,9 @@ func buildEnvironment(state *BuildState, target *BuildTarget) BuildEnv {
 	)
 	if target.PassEnv != nil {
 		for _, e := range *target.PassEnv {
-			env = append(env, e+"="+os.Getenv(e))
+			if !state.Config.OverridesEnv(e) {
+				env = append(env, e+"="+os.Getenv(e))
+			}
 		}
 	}
 	return env
@@ -169,28 +173,42 @@ func TestEnvironment(state *BuildState, target *BuildTarget, testDir string) Bui
 	if state.DebugTests {
 		env = append(env, "DEBUG=true")
 	}
+	// Variables the test declared itself go last, and take priority over anything above.
+	names := make([]string, 0, len(target.TestEnv))
+	for name := range target.TestEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = env.Set(name, target.TestEnv[name])
+	}
 	return env
 }
 
 // StampedBuildEnvironment returns the shell env vars to be passed into exec.Command.
-// Optionally includes a stamp if the target is marked as such.
-func StampedBuildEnvironment(state *BuildState, target *BuildTarget, stamp []byte, tmpDir string) BuildEnv {
+// Optionally includes a stamp if the target is marked as such; it returns an error if the
+// stamp variables can't be generated (e.g. because the configured stamp command fails).
+func StampedBuildEnvironment(state *BuildState, target *BuildTarget, stamp []byte, tmpDir string) (BuildEnv, error) {
 	env := BuildEnvironment(state, target, tmpDir)
 	if target.Stamp {
-		stampEnvOnce.Do(initStampEnv)
+		stampEnvOnce.Do(func() { stampEnvErr = initStampEnv(state.Config) })
+		if stampEnvErr != nil {
+			return nil, stampEnvErr
+		}
 		env = append(env, stampEnv...)
 		env = append(env, "STAMP_FILE="+target.StampFileName())
-		return append(env, "STAMP="+base64.RawURLEncoding.EncodeToString(stamp))
+		return append(env, "STAMP="+base64.RawURLEncoding.EncodeToString(stamp)), nil
 	}
-	return env
+	return env, nil
 }
 
 // stampEnv is the generic (i.e. non-target-specific) environment variables we pass to a
 // build rule marked with stamp=True.
 var stampEnv BuildEnv
+var stampEnvErr error
 var stampEnvOnce sync.Once
 
-func initStampEnv() {
+func initStampEnv(config *Configuration) error {
 	repoScm := scm.NewFallback(RepoRoot)
 	revision := repoScm.CurrentRevIdentifier()
 	stampEnv = BuildEnv{
@@ -198,6 +216,14 @@ func initStampEnv() {
 		"SCM_REVISION=" + revision,
 		"SCM_DESCRIBE=" + repoScm.DescribeIdentifier(revision),
 	}
+	if config.Build.StampCommand != "" {
+		env, err := stampCommandEnv(config.Build.StampCommand)
+		if err != nil {
+			return fmt.Errorf("Failed to run stamp command: %s", err)
+		}
+		stampEnv = append(stampEnv, env...)
+	}
+	return nil
 }
 
 func toolPath(state *BuildState, tool BuildInput, abs bool) string {
@@ -242,6 +268,17 @@ func (env BuildEnv) Replace(key, value string) {
 	}
 }
 
+// Set sets the value of the given variable in this BuildEnv, adding it if it isn't already present.
+func (env BuildEnv) Set(key, value string) BuildEnv {
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
 // Redacted implements the interface for our logging implementation.
 func (env BuildEnv) Redacted() interface{} {
 	r := make(BuildEnv, len(env))
@@ -2,6 +2,7 @@ package core
 
 import (
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,6 +34,34 @@ func TestReplace(t *testing.T) {
 	}, env)
 }
 
+func TestSet(t *testing.T) {
+	env := BuildEnv{
+		"TMP_DIR=/home/user/please/src/core",
+		"PKG=src/core",
+	}
+	env = env.Set("PKG", "src/test")
+	env = env.Set("NAME", "test")
+	assert.EqualValues(t, BuildEnv{
+		"TMP_DIR=/home/user/please/src/core",
+		"PKG=src/test",
+		"NAME=test",
+	}, env)
+}
+
+func TestTestEnvironmentTestEnv(t *testing.T) {
+	state := NewDefaultBuildState()
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core_test", ""))
+	target.IsTest = true
+	target.TestEnv = map[string]string{
+		"DATABASE_URL": "postgres://localhost",
+		"PKG":          "overridden",
+	}
+	env := TestEnvironment(state, target, "plz-out/tmp/src/core")
+	assert.Equal(t, "postgres://localhost", env.ReplaceEnvironment("DATABASE_URL"))
+	assert.Equal(t, "overridden", env.ReplaceEnvironment("PKG"))
+	assert.Equal(t, "plz-out/tmp/src/core", env.ReplaceEnvironment("TEST_DIR"))
+}
+
 func TestRedact(t *testing.T) {
 	env := BuildEnv{
 		"WHATEVER=12345",
@@ -54,3 +83,19 @@ func TestString(t *testing.T) {
 	}
 	assert.EqualValues(t, "A=B\nC=D", env.String())
 }
+
+func TestStampedBuildEnvironmentStampCommandFails(t *testing.T) {
+	stampEnvOnce = sync.Once{}
+	defer func() { stampEnvOnce = sync.Once{} }()
+	state := NewDefaultBuildState()
+	state.Config.Build.StampCommand = "echo broken >&2; exit 1"
+	target := NewBuildTarget(ParseBuildLabel("//src/core:stamped", ""))
+	target.Stamp = true
+	_, err := StampedBuildEnvironment(state, target, nil, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "broken")
+	// Targets that don't need the stamp are unaffected.
+	target.Stamp = false
+	_, err = StampedBuildEnvironment(state, target, nil, "")
+	assert.NoError(t, err)
+}
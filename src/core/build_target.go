@@ -45,6 +45,25 @@ const CoverageFile = "test.coverage"
 // execution API requires that we specify which is which.
 const TestResultsDirLabel = "test_results_dir"
 
+// TestPortLabel is a known label that indicates that the test needs a free port allocated to it.
+// It is passed to the test in the TEST_PORT environment variable.
+const TestPortLabel = "test_port"
+
+// SandboxNetworkOnlyEnv is added to the environment of tests that should be run in their own
+// network namespace but not otherwise sandboxed. It's interpreted by please_sandbox.
+const SandboxNetworkOnlyEnv = "SANDBOX_NETWORK_ONLY=true"
+
+// RemoteToolchainLabel is a known label prefix that indicates that the outputs of a target are
+// preinstalled on remote workers at the given path (e.g. remote_toolchain:/usr/local/go), so they
+// don't need to be uploaded as inputs to remote actions that use it.
+const RemoteToolchainLabel = "remote_toolchain:"
+
+// RetentionRelease is the retention class for artifacts that caches should never clean.
+const RetentionRelease = "release"
+
+// RetentionEphemeral is the retention class for artifacts that caches should expire aggressively.
+const RetentionEphemeral = "ephemeral"
+
 // tempOutputSuffix is the suffix we attach to temporary outputs to avoid name clashes.
 const tempOutputSuffix = ".out"
 
@@ -120,6 +139,19 @@ type BuildTarget struct {
 	Stamp bool
 	// If true, the target must be run locally (i.e. is not compatible with remote execution).
 	Local bool
+	// Maximum number of CPUs that the target's build or test action may use. Zero means unlimited.
+	CPULimit int `name:"cpu_limit"`
+	// Maximum amount of memory (in bytes) that the target's build or test action may use. Zero means unlimited.
+	MemoryLimit uint64 `name:"memory_limit"`
+	// Extra platform properties to request for the target's actions when building remotely.
+	// These are merged with (and override) the ones in the remote config.
+	ExecProperties map[string]string `name:"exec_properties"`
+	// Maximum total size (in bytes) of the target's outputs. Zero means no budget.
+	OutputSizeBudget uint64 `name:"output_size_budget"`
+	// Maximum time the target should take to build. Zero means no budget.
+	BuildDurationBudget time.Duration `name:"build_duration_budget"`
+	// Maximum time the target should take to test. Zero means no budget.
+	TestDurationBudget time.Duration `name:"test_duration_budget"`
 	// If true, the target is needed for a subinclude and therefore we will have to make sure its
 	// outputs are available locally when built.
 	NeededForSubinclude bool
@@ -131,6 +163,9 @@ type BuildTarget struct {
 	IsRemoteFile bool `print:"false"`
 	// Marks that the target was added in a post-build function.
 	AddedPostBuild bool `print:"false"`
+	// The kind of rule that created this target, i.e. the function that was called in the
+	// BUILD file (e.g. go_library), or build_rule if it was called directly.
+	Kind string `print:"false"`
 	// If true, the interactive progress display will try to infer the target's progress
 	// via some heuristics on its output.
 	ShowProgress bool `name:"progress"`
@@ -181,6 +216,14 @@ type BuildTarget struct {
 	// Extra output files from the test.
 	// These are in addition to the usual test.results output file.
 	TestOutputs []string `name:"test_outputs"`
+	// Extra environment variables to set when running this target as a test.
+	TestEnv map[string]string `name:"test_env"`
+	// Binaries that are run before this test to set up anything it needs, and after it to tear
+	// that down again. They're also data of the test.
+	Fixtures []BuildLabel `name:"fixtures"`
+	// Retention class of this target's outputs once they're in the cache.
+	// This doesn't affect how the target is built, only how long caches keep it around for.
+	Retention string
 }
 
 // BuildMetadata is temporary metadata that's stored around a build target - we don't
@@ -200,6 +243,9 @@ type BuildMetadata struct {
 	RemoteAction []byte
 	// True if this represents a test run.
 	Test bool
+	// Total size of the outputs, where known (currently only for remote builds of targets with a
+	// budget for it, since otherwise we don't need to download their trees).
+	OutputSize uint64 `print:"false"`
 }
 
 // A PreBuildFunction is a type that allows hooking a pre-build callback.
@@ -755,6 +801,15 @@ func (target *BuildTarget) HasLabel(label string) bool {
 	return label == "test" && target.IsTest
 }
 
+// RemoteToolchainPath returns the path that this target's outputs are preinstalled at on remote
+// workers, or the empty string if it isn't a remote toolchain.
+func (target *BuildTarget) RemoteToolchainPath() string {
+	if paths := target.PrefixedLabels(RemoteToolchainLabel); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
 // PrefixedLabels returns all labels of this target with the given prefix.
 func (target *BuildTarget) PrefixedLabels(prefix string) []string {
 	ret := []string{}
@@ -916,6 +971,13 @@ func (target *BuildTarget) AddDatum(datum BuildInput) {
 	}
 }
 
+// AddFixture adds a fixture to the target. Fixtures are also added as data, since they need to
+// be available at runtime.
+func (target *BuildTarget) AddFixture(fixture BuildLabel) {
+	target.Fixtures = append(target.Fixtures, fixture)
+	target.AddDatum(fixture)
+}
+
 // AddNamedDatum adds a data file to the target which is tagged with a particular name.
 func (target *BuildTarget) AddNamedDatum(name string, datum BuildInput) {
 	if target.namedData == nil {
@@ -1280,6 +1342,12 @@ func (target *BuildTarget) ProgressDescription() string {
 	return target.BuildingDescription
 }
 
+// ResourceLimits returns the maximum number of CPUs and amount of memory the target may use.
+// This is provided as a function to satisfy the process package.
+func (target *BuildTarget) ResourceLimits() (int, uint64) {
+	return target.CPULimit, target.MemoryLimit
+}
+
 // SetProgress sets the current progress of this target.
 func (target *BuildTarget) SetProgress(progress float32) {
 	target.Progress = progress
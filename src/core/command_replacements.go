@@ -80,6 +80,35 @@ func ReplaceTestSequences(state *BuildState, target *BuildTarget, command string
 	return replaceSequencesInternal(state, target, command, true)
 }
 
+// WrapTestFixtures wraps a test command to run the target's fixtures around it. Each is run with
+// an argument of "setup" before the test, and "teardown" afterwards in reverse order, whether or
+// not the test passed. The exit code is that of the test, or the first fixture that failed to
+// set up (in which case the test isn't run).
+func WrapTestFixtures(state *BuildState, target *BuildTarget, command string) (string, error) {
+	if len(target.Fixtures) == 0 {
+		return command, nil
+	}
+	fixtures := make([]string, len(target.Fixtures))
+	for i, fixture := range target.Fixtures {
+		cmd, err := replaceSequencesInternal(state, target, "$(exe "+fixture.String()+")", true)
+		if err != nil {
+			return "", err
+		}
+		fixtures[i] = cmd
+	}
+	var b strings.Builder
+	for _, fixture := range fixtures {
+		b.WriteString(fixture + " setup && ")
+	}
+	// The test runs in a subshell so it can't exit before the fixtures are torn down.
+	b.WriteString("(" + command + "\n); _TEST_EXIT_CODE=$?")
+	for i := len(fixtures) - 1; i >= 0; i-- {
+		b.WriteString("; " + fixtures[i] + " teardown")
+	}
+	b.WriteString("; exit $_TEST_EXIT_CODE")
+	return b.String(), nil
+}
+
 // TestWorkerCommand returns the worker & its arguments (if any) for a test, and the command to run for the test itself.
 func TestWorkerCommand(state *BuildState, target *BuildTarget) (string, string, string, error) {
 	return workerAndArgs(state, target, target.GetTestCommand(state))
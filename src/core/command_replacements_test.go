@@ -98,6 +98,26 @@ func TestDataReplacementForTest(t *testing.T) {
 	assert.Equal(t, expected, cmd)
 }
 
+func TestWrapTestFixtures(t *testing.T) {
+	target2 := makeTarget("//path/to:target2", "", nil)
+	target2.IsBinary = true
+	target1 := makeTarget("//path/to:target1", "", target2)
+	target1.IsTest = true
+	target1.AddFixture(target2.Label)
+
+	expected := "path/to/target2.py setup && ($TEST\n); _TEST_EXIT_CODE=$?; path/to/target2.py teardown; exit $_TEST_EXIT_CODE"
+	cmd, err := WrapTestFixtures(state, target1, "$TEST")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cmd)
+}
+
+func TestWrapTestFixturesNone(t *testing.T) {
+	target := makeTarget("//path/to:target1", "", nil)
+	cmd, err := WrapTestFixtures(state, target, "$TEST")
+	assert.NoError(t, err)
+	assert.Equal(t, "$TEST", cmd)
+}
+
 func TestAmpersandReplacement(t *testing.T) {
 	target := makeTarget("//path/to:target1", "cat $(location b&b.txt)", nil)
 	expected := "cat \"path/to/b&b.txt\""
@@ -233,6 +233,30 @@ func TestPassEnv(t *testing.T) {
 	assert.Equal(t, expected, config.GetBuildEnv())
 }
 
+func TestEnvAllowlist(t *testing.T) {
+	assert.NoError(t, os.Setenv("FOO", "first"))
+	assert.NoError(t, os.Setenv("BAR", "second"))
+	assert.NoError(t, os.Setenv("BAZ", "third"))
+	config, err := ReadConfigFiles([]string{"src/core/test_data/envallowlist.plzconfig"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, config.AllowsEnv("FOO"))
+	assert.False(t, config.AllowsEnv("BAR"))
+	assert.True(t, config.OverridesEnv("BAZ"))
+	assert.False(t, config.OverridesEnv("FOO"))
+	expected := []string{
+		"ARCH=" + runtime.GOARCH,
+		"BAZ=overridden",
+		"FOO=first",
+		"GOARCH=" + runtime.GOARCH,
+		"GOOS=" + runtime.GOOS,
+		"OS=" + runtime.GOOS,
+		"PATH=" + os.Getenv("TMP_DIR") + ":/usr/local/bin:/usr/bin:/bin",
+		"XARCH=x86_64",
+		"XOS=" + xos(),
+	}
+	assert.Equal(t, expected, config.GetBuildEnv())
+}
+
 func TestBuildPathWithPathEnv(t *testing.T) {
 	config, err := ReadConfigFiles([]string{"src/core/test_data/passenv.plzconfig"}, nil)
 	assert.NoError(t, err)
@@ -340,3 +364,37 @@ func TestGetTags(t *testing.T) {
 	assert.Equal(t, "Version", tags["PLZ_VERSION"].Name)
 	assert.True(t, tags["PLZ_VERSION"].Type == reflect.TypeOf(cli.Version{}))
 }
+
+func TestGetValue(t *testing.T) {
+	config := DefaultConfiguration()
+	config.BuildConfig = map[string]string{"android-tools-version": "23.0.2"}
+	config.Parse.BuildFileName = []string{"BUILD", "BUILD.plz"}
+	v, err := config.GetValue("build.timeout")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10m0s"}, v)
+	v, err = config.GetValue("Build.Arch")
+	assert.NoError(t, err)
+	arch := cli.HostArch()
+	assert.Equal(t, []string{arch.String()}, v)
+	v, err = config.GetValue("build.xattrs")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"true"}, v)
+	v, err = config.GetValue("parse.buildfilename")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BUILD", "BUILD.plz"}, v)
+	v, err = config.GetValue("buildconfig.android-tools-version")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"23.0.2"}, v)
+	_, err = config.GetValue("build.wibble")
+	assert.Error(t, err)
+	_, err = config.GetValue("build")
+	assert.Error(t, err)
+}
+
+func TestNumParseThreads(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Please.NumThreads = 12
+	assert.Equal(t, 12, config.NumParseThreads())
+	config.Parse.NumThreads = 4
+	assert.Equal(t, 4, config.NumParseThreads())
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// UpdateConfigFile sets a single config setting in the given file, creating it if needed.
+// The key is in the same dot notation as ApplyOverrides; any existing values for it in the
+// file are replaced, and everything else in the file (including comments) is left alone.
+func UpdateConfigFile(filename, key string, values []string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	contents, err := updateConfig(string(b), key, values)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(filename), DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(contents), 0644)
+}
+
+// updateConfig implements UpdateConfigFile on the contents of a file.
+func updateConfig(contents, key string, values []string) (string, error) {
+	split := strings.Split(key, ".")
+	if len(split) != 2 {
+		return "", fmt.Errorf("Bad option format: %s", key)
+	}
+	section, name := split[0], split[1]
+	newLines := make([]string, len(values))
+	for i, v := range values {
+		newLines[i] = name + " = " + quoteConfigValue(v)
+	}
+	var lines []string
+	if contents != "" {
+		lines = strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+	}
+	ret := make([]string, 0, len(lines)+len(newLines)+2)
+	inSection := false
+	sectionFound := false
+	written := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inSection = configNamesEqual(strings.Trim(trimmed, "[] \t"), section)
+			if inSection && !sectionFound {
+				sectionFound = true
+				ret = append(ret, line)
+				// Any existing values will be replaced below; if there aren't any, the new ones go here.
+				if !configSectionHasKey(lines, line, name) {
+					ret = append(ret, newLines...)
+					written = true
+				}
+				continue
+			}
+		} else if inSection && configLineHasKey(trimmed, name) {
+			if !written {
+				ret = append(ret, newLines...)
+				written = true
+			}
+			continue
+		}
+		ret = append(ret, line)
+	}
+	if !sectionFound {
+		if len(ret) > 0 && ret[len(ret)-1] != "" {
+			ret = append(ret, "")
+		}
+		ret = append(ret, "["+section+"]")
+		ret = append(ret, newLines...)
+	}
+	return strings.Join(ret, "\n") + "\n", nil
+}
+
+// configSectionHasKey returns true if the section starting at the given header line has any values for the given key.
+func configSectionHasKey(lines []string, header, name string) bool {
+	inSection := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if inSection {
+				return false
+			}
+			inSection = line == header
+		} else if inSection && configLineHasKey(trimmed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// configLineHasKey returns true if the given (trimmed) line sets the given key.
+func configLineHasKey(line, name string) bool {
+	if line == "" || line[0] == ';' || line[0] == '#' {
+		return false
+	}
+	if idx := strings.IndexByte(line, '='); idx != -1 {
+		line = line[:idx]
+	}
+	return configNamesEqual(strings.TrimSpace(line), name)
+}
+
+// configNamesEqual returns true if the two section or variable names are equivalent.
+// Like gcfg, names are case-insensitive and dashes are ignored.
+func configNamesEqual(a, b string) bool {
+	return strings.EqualFold(strings.Replace(a, "-", "", -1), strings.Replace(b, "-", "", -1))
+}
+
+// quoteConfigValue quotes a value for writing to a config file, if it needs it.
+func quoteConfigValue(v string) string {
+	if strings.ContainsAny(v, ";#\"\\") || strings.TrimSpace(v) != v {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+	return v
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateConfigNewSection(t *testing.T) {
+	s, err := updateConfig("[please]\nversion = 15.5.0\n", "build.timeout", []string{"20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[please]\nversion = 15.5.0\n\n[build]\ntimeout = 20m\n", s)
+}
+
+func TestUpdateConfigEmpty(t *testing.T) {
+	s, err := updateConfig("", "build.timeout", []string{"20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[build]\ntimeout = 20m\n", s)
+}
+
+func TestUpdateConfigExistingSection(t *testing.T) {
+	s, err := updateConfig("[Build]\n; The default timeout\nlang = en_GB\n\n[please]\nversion = 15.5.0\n", "build.timeout", []string{"20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[Build]\ntimeout = 20m\n; The default timeout\nlang = en_GB\n\n[please]\nversion = 15.5.0\n", s)
+}
+
+func TestUpdateConfigReplacesValue(t *testing.T) {
+	s, err := updateConfig("[build]\nTimeout = 10m ; ten minutes\nlang = en_GB\n", "build.timeout", []string{"20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[build]\ntimeout = 20m\nlang = en_GB\n", s)
+}
+
+func TestUpdateConfigReplacesMultipleValues(t *testing.T) {
+	s, err := updateConfig("[build]\npath = /bin\nlang = en_GB\npath = /usr/bin\n", "build.path", []string{"/usr/local/bin", "/usr/bin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[build]\npath = /usr/local/bin\npath = /usr/bin\nlang = en_GB\n", s)
+}
+
+func TestUpdateConfigIgnoresOtherSections(t *testing.T) {
+	s, err := updateConfig("[cache]\ntimeout = 5s\n[build]\nlang = en_GB\n", "build.timeout", []string{"20m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[cache]\ntimeout = 5s\n[build]\ntimeout = 20m\nlang = en_GB\n", s)
+}
+
+func TestUpdateConfigQuotesValues(t *testing.T) {
+	s, err := updateConfig("", "build.nonce", []string{"a;b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[build]\nnonce = \"a;b\"\n", s)
+}
+
+func TestUpdateConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_update_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "please", "plzconfig.ci")
+	require.NoError(t, UpdateConfigFile(filename, "build.timeout", []string{"20m"}))
+	require.NoError(t, UpdateConfigFile(filename, "build.timeout", []string{"30m"}))
+	config, err := ReadConfigFiles([]string{path.Join(dir, "please", "plzconfig")}, []string{"ci"})
+	require.NoError(t, err)
+	v, err := config.GetValue("build.timeout")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"30m0s"}, v)
+}
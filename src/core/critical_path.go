@@ -0,0 +1,84 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// CriticalPathFile is the file that the critical path of the last build is recorded in.
+const CriticalPathFile = "plz-out/log/critical_path.json"
+
+// A CriticalPathEntry is a single target on the critical path of a build.
+type CriticalPathEntry struct {
+	Label    BuildLabel    `json:"label"`
+	Duration time.Duration `json:"duration"`
+}
+
+// CriticalPath returns the critical path through the graph, i.e. the chain of dependent targets
+// whose durations sum to the longest total. The given durations are the time each target took;
+// anything not in there is assumed to have taken no time (e.g. because it was already built).
+// The returned path is ordered from the first target to be built to the last.
+func CriticalPath(graph *BuildGraph, durations map[BuildLabel]time.Duration) []CriticalPathEntry {
+	totals := map[*BuildTarget]time.Duration{}
+	next := map[*BuildTarget]*BuildTarget{}
+	var longest func(target *BuildTarget) time.Duration
+	longest = func(target *BuildTarget) time.Duration {
+		if total, present := totals[target]; present {
+			return total
+		}
+		totals[target] = 0 // Guards against cycles, although there shouldn't be any by now.
+		var max time.Duration
+		for _, dep := range target.Dependencies() {
+			if total := longest(dep); total > max || next[target] == nil {
+				max = total
+				next[target] = dep
+			}
+		}
+		total := max + durations[target.Label]
+		totals[target] = total
+		return total
+	}
+	var end *BuildTarget
+	var max time.Duration
+	for label := range durations {
+		if target := graph.Target(label); target != nil {
+			if total := longest(target); total > max || (total == max && end != nil && label.Less(end.Label)) {
+				max = total
+				end = target
+			}
+		}
+	}
+	ret := []CriticalPathEntry{}
+	for target := end; target != nil; target = next[target] {
+		ret = append([]CriticalPathEntry{{Label: target.Label, Duration: durations[target.Label]}}, ret...)
+	}
+	// Trim anything at the start that took no time; it's not interesting to report it.
+	for len(ret) > 0 && ret[0].Duration == 0 {
+		ret = ret[1:]
+	}
+	return ret
+}
+
+// WriteCriticalPath writes the given critical path to CriticalPathFile.
+func WriteCriticalPath(entries []CriticalPathEntry) error {
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(CriticalPathFile), DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(CriticalPathFile, b, 0644)
+}
+
+// ReadCriticalPath reads the critical path of the last build from CriticalPathFile.
+func ReadCriticalPath() ([]CriticalPathEntry, error) {
+	b, err := ioutil.ReadFile(CriticalPathFile)
+	if err != nil {
+		return nil, err
+	}
+	entries := []CriticalPathEntry{}
+	return entries, json.Unmarshal(b, &entries)
+}
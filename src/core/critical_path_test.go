@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCriticalPath(t *testing.T) {
+	graph := NewGraph()
+	label := func(name string) BuildLabel { return ParseBuildLabel("//src/core:"+name, "") }
+	for _, name := range []string{"lib1", "lib2", "lib3", "bin"} {
+		graph.AddTarget(NewBuildTarget(label(name)))
+	}
+	graph.AddDependency(label("lib2"), label("lib1"))
+	graph.AddDependency(label("bin"), label("lib2"))
+	graph.AddDependency(label("bin"), label("lib3"))
+
+	path := CriticalPath(graph, map[BuildLabel]time.Duration{
+		label("lib1"): 3 * time.Second,
+		label("lib2"): 2 * time.Second,
+		label("lib3"): 4 * time.Second,
+		label("bin"):  time.Second,
+	})
+	assert.Equal(t, []CriticalPathEntry{
+		{Label: label("lib1"), Duration: 3 * time.Second},
+		{Label: label("lib2"), Duration: 2 * time.Second},
+		{Label: label("bin"), Duration: time.Second},
+	}, path)
+}
+
+func TestCriticalPathSkipsUnbuiltTargets(t *testing.T) {
+	graph := NewGraph()
+	label := func(name string) BuildLabel { return ParseBuildLabel("//src/core:"+name, "") }
+	graph.AddTarget(NewBuildTarget(label("lib")))
+	graph.AddTarget(NewBuildTarget(label("bin")))
+	graph.AddDependency(label("bin"), label("lib"))
+
+	path := CriticalPath(graph, map[BuildLabel]time.Duration{label("bin"): time.Second})
+	assert.Equal(t, []CriticalPathEntry{{Label: label("bin"), Duration: time.Second}}, path)
+}
@@ -0,0 +1,114 @@
+package core
+
+import "errors"
+
+// An ErrorCode classifies a build failure. The values are stable so tooling (e.g. CI systems)
+// can make decisions based on them without having to parse error messages.
+type ErrorCode string
+
+// The set of known error codes.
+const (
+	// ErrorUnknown is used for failures we can't classify any further.
+	ErrorUnknown ErrorCode = "unknown"
+	// ErrorSyntax indicates that a BUILD file (or something it includes) couldn't be lexed or parsed.
+	ErrorSyntax ErrorCode = "syntax"
+	// ErrorEvaluation indicates that a BUILD file parsed correctly but failed while being interpreted.
+	ErrorEvaluation ErrorCode = "evaluation"
+	// ErrorMissingTarget indicates that a package was parsed but did not contain the requested target.
+	ErrorMissingTarget ErrorCode = "missing_target"
+	// ErrorMissingPackage indicates that there was no BUILD file for a requested package.
+	ErrorMissingPackage ErrorCode = "missing_package"
+	// ErrorUnknownSubrepo indicates that a label referred to a subrepo that isn't defined.
+	ErrorUnknownSubrepo ErrorCode = "unknown_subrepo"
+	// ErrorParseFailed is used for any other failure while parsing a package.
+	ErrorParseFailed ErrorCode = "parse_failed"
+	// ErrorBuildFailed indicates that a target failed to build.
+	ErrorBuildFailed ErrorCode = "build_failed"
+	// ErrorTestFailed indicates that a test failed to run or did not pass.
+	ErrorTestFailed ErrorCode = "test_failed"
+	// ErrorBudgetExceeded indicates that a target exceeded its output size or duration budget.
+	ErrorBudgetExceeded ErrorCode = "budget_exceeded"
+)
+
+// An ErrorPosition describes a location in a source file that an error relates to.
+type ErrorPosition struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+}
+
+// A BuildError is a structured description of a build failure.
+// It's intended for consumption by tooling; its Error() method returns the same thing that the
+// underlying error would so it doesn't change how errors are presented to the user.
+type BuildError struct {
+	Code       ErrorCode      `json:"code"`
+	Package    string         `json:"package,omitempty"`
+	Target     string         `json:"target,omitempty"`
+	Position   *ErrorPosition `json:"position,omitempty"`
+	Message    string         `json:"message"`
+	Suggestion string         `json:"suggestion,omitempty"`
+	err        error
+}
+
+// NewBuildError returns a new BuildError with the given code wrapping the given error.
+// The message is taken from the error.
+func NewBuildError(code ErrorCode, err error) *BuildError {
+	return &BuildError{Code: code, Message: err.Error(), err: err}
+}
+
+// Error implements the builtin error interface.
+func (err *BuildError) Error() string {
+	if err.err == nil {
+		return err.Message
+	}
+	return err.err.Error()
+}
+
+// Unwrap returns the error that this one wraps.
+func (err *BuildError) Unwrap() error {
+	return err.err
+}
+
+// A StructuredError is an error that can describe itself as a BuildError.
+type StructuredError interface {
+	error
+	BuildError() *BuildError
+}
+
+// AsBuildError returns a structured description of the given error, which is a failure of the
+// given target with the given status. Errors that don't carry any more specific information
+// are classified according to the status.
+// It returns nil if the error is nil.
+func AsBuildError(err error, label BuildLabel, status BuildResultStatus) *BuildError {
+	if err == nil {
+		return nil
+	}
+	var ret *BuildError
+	var structured StructuredError
+	if errors.As(err, &structured) {
+		ret = structured.BuildError()
+	} else if errors.As(err, &ret) {
+		cp := *ret
+		ret = &cp
+	} else {
+		ret = &BuildError{Code: errorCodeForStatus(status), Message: err.Error(), err: err}
+	}
+	if ret.Package == "" && ret.Target == "" {
+		ret.Package = label.PackageName
+		ret.Target = label.String()
+	}
+	return ret
+}
+
+// errorCodeForStatus returns the most appropriate error code for a failure with the given status.
+func errorCodeForStatus(status BuildResultStatus) ErrorCode {
+	switch status {
+	case ParseFailed:
+		return ErrorParseFailed
+	case TargetBuildFailed:
+		return ErrorBuildFailed
+	case TargetTestFailed:
+		return ErrorTestFailed
+	}
+	return ErrorUnknown
+}
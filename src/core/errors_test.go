@@ -0,0 +1,34 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsBuildErrorNil(t *testing.T) {
+	assert.Nil(t, AsBuildError(nil, BuildLabel{}, TargetBuildFailed))
+}
+
+func TestAsBuildErrorFromStatus(t *testing.T) {
+	label := ParseBuildLabel("//src/core:core", "")
+	err := AsBuildError(fmt.Errorf("it broke"), label, TargetBuildFailed)
+	assert.Equal(t, ErrorBuildFailed, err.Code)
+	assert.Equal(t, "src/core", err.Package)
+	assert.Equal(t, "//src/core:core", err.Target)
+	assert.Equal(t, "it broke", err.Message)
+	assert.Equal(t, "it broke", err.Error())
+}
+
+func TestAsBuildErrorPreservesCode(t *testing.T) {
+	be := NewBuildError(ErrorMissingTarget, fmt.Errorf("no such target\nMaybe you meant :core ?"))
+	be.Message = "no such target"
+	be.Suggestion = "Maybe you meant :core ?"
+	err := AsBuildError(be, ParseBuildLabel("//src/core:all", ""), ParseFailed)
+	assert.Equal(t, ErrorMissingTarget, err.Code)
+	assert.Equal(t, "no such target", err.Message)
+	assert.Equal(t, "Maybe you meant :core ?", err.Suggestion)
+	assert.Equal(t, "no such target\nMaybe you meant :core ?", err.Error())
+	assert.Equal(t, "", be.Package, "original error should not be modified")
+}
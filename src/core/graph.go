@@ -25,6 +25,8 @@ type BuildGraph struct {
 	revDeps map[BuildLabel][]*BuildTarget
 	// Registered subrepos, as a map of their name to their root.
 	subrepos map[string]*Subrepo
+	// Map of source file paths to the targets that have them as sources.
+	sourceOwners map[string][]*BuildTarget
 	// Used to arbitrate access to the graph. We parallelise most build operations
 	// and Go maps aren't natively threadsafe so this is needed.
 	mutex sync.RWMutex
@@ -38,6 +40,12 @@ func (graph *BuildGraph) AddTarget(target *BuildTarget) *BuildTarget {
 		panic("Attempted to re-add existing target to build graph: " + target.Label.String())
 	}
 	graph.targets[target.Label] = target
+	for _, src := range target.AllSources() {
+		if file, ok := src.(FileLabel); ok {
+			p := file.Paths(nil)[0]
+			graph.sourceOwners[p] = append(graph.sourceOwners[p], target)
+		}
+	}
 	// Register any of its dependencies now
 	for _, dep := range target.DeclaredDependencies() {
 		graph.addDependencyForTarget(target, dep)
@@ -147,6 +155,18 @@ func (graph *BuildGraph) SubrepoOrDie(name string) *Subrepo {
 	return subrepo
 }
 
+// Subrepos returns all the currently registered subrepos, sorted by name.
+func (graph *BuildGraph) Subrepos() []*Subrepo {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	subrepos := make([]*Subrepo, 0, len(graph.subrepos))
+	for _, subrepo := range graph.subrepos {
+		subrepos = append(subrepos, subrepo)
+	}
+	sort.Slice(subrepos, func(i, j int) bool { return subrepos[i].Name < subrepos[j].Name })
+	return subrepos
+}
+
 // Len returns the number of targets currently in the graph.
 func (graph *BuildGraph) Len() int {
 	graph.mutex.RLock()
@@ -212,6 +232,7 @@ func NewGraph() *BuildGraph {
 		pendingRevDeps: map[BuildLabel]map[BuildLabel]*BuildTarget{},
 		revDeps:        map[BuildLabel][]*BuildTarget{},
 		subrepos:       map[string]*Subrepo{},
+		sourceOwners:   map[string][]*BuildTarget{},
 	}
 }
 
@@ -225,6 +246,14 @@ func (graph *BuildGraph) ReverseDependencies(target *BuildTarget) []*BuildTarget
 	return []*BuildTarget{}
 }
 
+// SourceOwners returns the set of targets that have the given file as one of their sources.
+// The file is given relative to the repo root (i.e. as it would be in a target's srcs, with its package).
+func (graph *BuildGraph) SourceOwners(file string) []*BuildTarget {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	return append([]*BuildTarget(nil), graph.sourceOwners[file]...)
+}
+
 // AllDepsBuilt returns true if all the dependencies of a target are built.
 func (graph *BuildGraph) AllDepsBuilt(target *BuildTarget) bool {
 	graph.mutex.RLock()
@@ -0,0 +1,210 @@
+// Persistence of the build graph between invocations, which lets later ones skip parsing
+// packages whose BUILD files (and everything else that went into them) haven't changed.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+)
+
+// GraphCacheFile is the file that the build graph is persisted into between invocations.
+const GraphCacheFile = "plz-out/log/graph.gob"
+
+func init() {
+	// gob needs to know about all the implementations of BuildInput.
+	gob.Register(BuildLabel{})
+	gob.Register(FileLabel{})
+	gob.Register(SubrepoFileLabel{})
+	gob.Register(SystemFileLabel{})
+	gob.Register(SystemPathLabel{})
+	gob.Register(NamedOutputLabel{})
+	gob.Register(URLLabel(""))
+}
+
+// A GraphCache is the persisted form of a build graph.
+type GraphCache struct {
+	// Key identifies everything that affects every package (e.g. the config and the version of
+	// Please). If it differs the whole cache is invalid.
+	Key []byte
+	// The packages in the cache, keyed by name.
+	Packages map[string]*CachedPackage
+}
+
+// A CachedPackage is the persisted form of a single package.
+type CachedPackage struct {
+	Name     string
+	Filename string
+	// The files that were read to create the package (i.e. its BUILD file and anything it subincluded).
+	Files []string
+	// Key identifies the state of those files and of the package's directory when it was cached.
+	// It's up to the parser to calculate it; it's opaque to us.
+	Key         []byte
+	Subincludes []BuildLabel
+	Targets     []*cachedTarget
+	// Maps registered output files to the name of the target that outputs them.
+	Outputs map[string]string
+}
+
+// A cachedTarget is the persisted form of a build target.
+// The target itself only persists its exported fields, so we need to handle the others separately.
+type cachedTarget struct {
+	Target       *BuildTarget
+	Dependencies []cachedDependency
+	NamedData    map[string][]BuildInput
+	Outputs      []string
+	NamedOutputs map[string][]string
+	NamedTools   map[string][]BuildInput
+}
+
+// A cachedDependency is the persisted form of a declared dependency of a target.
+// Resolved dependencies aren't persisted; they get resolved again once the target is restored.
+type cachedDependency struct {
+	Declared                         BuildLabel
+	Exported, Internal, Source, Data bool
+}
+
+// NewGraphCache returns a new, empty, graph cache.
+func NewGraphCache(key []byte) *GraphCache {
+	return &GraphCache{Key: key, Packages: map[string]*CachedPackage{}}
+}
+
+// ReadGraphCache reads a graph cache from the given file.
+// If it doesn't exist or its key doesn't match the given one, an empty cache is returned.
+func ReadGraphCache(filename string, key []byte) *GraphCache {
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read graph cache: %s", err)
+		}
+		return NewGraphCache(key)
+	}
+	defer f.Close()
+	cache := &GraphCache{}
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(cache); err != nil {
+		log.Warning("Failed to decode graph cache: %s", err)
+		return NewGraphCache(key)
+	} else if !bytes.Equal(cache.Key, key) {
+		log.Debug("Graph cache is out of date, discarding")
+		return NewGraphCache(key)
+	}
+	return cache
+}
+
+// Write writes this graph cache to the given file.
+func (cache *GraphCache) Write(filename string) error {
+	if err := os.MkdirAll(path.Dir(filename), DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(cache); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// NewCachedPackage creates the persisted form of a package.
+// The caller is responsible for setting its files & key.
+func NewCachedPackage(pkg *Package) *CachedPackage {
+	pkg.mutex.RLock()
+	defer pkg.mutex.RUnlock()
+	cp := &CachedPackage{
+		Name:        pkg.Name,
+		Filename:    pkg.Filename,
+		Subincludes: pkg.Subincludes,
+		Targets:     make([]*cachedTarget, 0, len(pkg.targets)),
+		Outputs:     make(map[string]string, len(pkg.Outputs)),
+	}
+	for _, target := range pkg.targets {
+		cp.Targets = append(cp.Targets, newCachedTarget(target))
+	}
+	for out, target := range pkg.Outputs {
+		cp.Outputs[out] = target.Label.Name
+	}
+	return cp
+}
+
+// newCachedTarget creates the persisted form of a build target.
+func newCachedTarget(target *BuildTarget) *cachedTarget {
+	t := &BuildTarget{}
+	*t = *target
+	// These are all things that happen after parsing, so we don't want to keep them.
+	t.state = 0
+	t.Progress = 0
+	t.Results = TestSuite{}
+	t.Subrepo = nil
+	t.dependencies = nil
+	ct := &cachedTarget{
+		Target:       t,
+		Dependencies: make([]cachedDependency, len(target.dependencies)),
+		NamedData:    target.namedData,
+		Outputs:      target.outputs,
+		NamedOutputs: target.namedOutputs,
+		NamedTools:   target.namedTools,
+	}
+	for i, dep := range target.dependencies {
+		ct.Dependencies[i] = cachedDependency{
+			Declared: dep.declared,
+			Exported: dep.exported,
+			Internal: dep.internal,
+			Source:   dep.source,
+			Data:     dep.data,
+		}
+	}
+	return ct
+}
+
+// GobEncode implements gob.GobEncoder. Subrepos are never persisted as part of a target (they're
+// reattached when it's restored); this exists to stop gob trying to encode the entire build state.
+func (s *Subrepo) GobEncode() ([]byte, error) {
+	return nil, fmt.Errorf("Cannot persist subrepo %s", s.Name)
+}
+
+// GobDecode implements gob.GobDecoder.
+func (s *Subrepo) GobDecode([]byte) error {
+	return fmt.Errorf("Cannot restore a persisted subrepo")
+}
+
+// Restore adds the targets of this persisted package to the given one, which must be empty.
+// It doesn't add the package itself to the graph.
+func (cp *CachedPackage) Restore(state *BuildState, pkg *Package) {
+	pkg.Subincludes = cp.Subincludes
+	for _, ct := range cp.Targets {
+		target := ct.restore()
+		target.Subrepo = pkg.Subrepo
+		pkg.AddTarget(target)
+		state.Graph.AddTarget(target)
+	}
+	for out, name := range cp.Outputs {
+		pkg.Outputs[out] = pkg.TargetOrDie(name)
+	}
+}
+
+// restore recreates a build target from its persisted form.
+func (ct *cachedTarget) restore() *BuildTarget {
+	target := ct.Target
+	target.dependencies = make([]depInfo, len(ct.Dependencies))
+	for i, dep := range ct.Dependencies {
+		target.dependencies[i] = depInfo{
+			declared: dep.Declared,
+			exported: dep.Exported,
+			internal: dep.Internal,
+			source:   dep.Source,
+			data:     dep.Data,
+		}
+	}
+	target.namedData = ct.NamedData
+	target.outputs = ct.Outputs
+	target.namedOutputs = ct.NamedOutputs
+	target.namedTools = ct.NamedTools
+	return target
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graph_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "graph.gob")
+
+	state := NewDefaultBuildState()
+	pkg := NewPackage("src/core")
+	pkg.Filename = "src/core/BUILD"
+	pkg.RegisterSubinclude(ParseBuildLabel("//build_defs:go", ""))
+	lib := NewBuildTarget(ParseBuildLabel("//src/core:lib", ""))
+	lib.AddSource(FileLabel{File: "core.go", Package: "src/core"})
+	lib.AddNamedOutput("srcs", "core.a")
+	lib.AddMaybeExportedDependency(ParseBuildLabel("//src/fs:fs", ""), true, false, false)
+	lib.AddTool(SystemPathLabel{Name: "go", Path: []string{"/usr/bin"}})
+	lib.Labels = []string{"go"}
+	test := NewBuildTarget(ParseBuildLabel("//src/core:test", ""))
+	test.IsTest = true
+	test.AddDependency(lib.Label)
+	test.AddOutput("test")
+	test.AddDatum(FileLabel{File: "test_data", Package: "src/core"})
+	test.TestEnv = map[string]string{"A": "B"}
+	test.Results.Name = "test"
+	state.AddTarget(pkg, lib)
+	state.AddTarget(pkg, test)
+
+	cp := NewCachedPackage(pkg)
+	cp.Key = []byte{4, 5, 6}
+	cache := NewGraphCache([]byte{1, 2, 3})
+	cache.Packages[pkg.Name] = cp
+	require.NoError(t, cache.Write(filename))
+
+	// A different key invalidates the whole thing.
+	assert.Equal(t, 0, len(ReadGraphCache(filename, []byte{1, 2}).Packages))
+	cache = ReadGraphCache(filename, []byte{1, 2, 3})
+	require.Equal(t, 1, len(cache.Packages))
+	cp = cache.Packages["src/core"]
+	assert.Equal(t, []byte{4, 5, 6}, cp.Key)
+
+	state2 := NewDefaultBuildState()
+	pkg2 := NewPackage("src/core")
+	cp.Restore(state2, pkg2)
+	assert.Equal(t, pkg.Subincludes, pkg2.Subincludes)
+	lib2 := state2.Graph.TargetOrDie(lib.Label)
+	assert.Equal(t, lib.AllSources(), lib2.AllSources())
+	assert.Equal(t, lib.NamedOutputs("srcs"), lib2.NamedOutputs("srcs"))
+	assert.Equal(t, lib.DeclaredDependencies(), lib2.DeclaredDependencies())
+	assert.Equal(t, lib.ExportedDependencies(), lib2.ExportedDependencies())
+	assert.Equal(t, lib.AllTools(), lib2.AllTools())
+	assert.Equal(t, lib.Labels, lib2.Labels)
+	test2 := pkg2.Target("test")
+	require.NotNil(t, test2)
+	assert.True(t, test2.IsTest)
+	assert.Equal(t, test.Outputs(), test2.Outputs())
+	assert.Equal(t, test.Data, test2.Data)
+	assert.Equal(t, test.TestEnv, test2.TestEnv)
+	assert.Equal(t, "", test2.Results.Name)
+	assert.Equal(t, Inactive, test2.State())
+	assert.Equal(t, test2, pkg2.Outputs["test"])
+	// The original target should be untouched.
+	assert.Equal(t, "test", test.Results.Name)
+}
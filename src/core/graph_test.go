@@ -90,6 +90,34 @@ func TestSubrepo(t *testing.T) {
 	assert.Equal(t, "plz-out/gen/test", subrepo.Root)
 }
 
+func TestSubrepos(t *testing.T) {
+	graph := NewGraph()
+	graph.AddSubrepo(&Subrepo{Name: "test2"})
+	graph.AddSubrepo(&Subrepo{Name: "test1"})
+	subrepos := graph.Subrepos()
+	assert.Equal(t, 2, len(subrepos))
+	assert.Equal(t, "test1", subrepos[0].Name)
+	assert.Equal(t, "test2", subrepos[1].Name)
+}
+
+func TestSourceOwners(t *testing.T) {
+	graph := NewGraph()
+	target1 := makeTarget("//src/core:target1")
+	target1.AddSource(FileLabel{File: "graph.go", Package: "src/core"})
+	target2 := makeTarget("//src/core:target2")
+	target2.AddSource(FileLabel{File: "graph.go", Package: "src/core"})
+	target2.AddSource(FileLabel{File: "graph_test.go", Package: "src/core"})
+	graph.AddTarget(target1)
+	graph.AddTarget(target2)
+	assert.Equal(t, []*BuildTarget{target1, target2}, graph.SourceOwners("src/core/graph.go"))
+	assert.Equal(t, []*BuildTarget{target2}, graph.SourceOwners("src/core/graph_test.go"))
+	assert.Equal(t, 0, len(graph.SourceOwners("src/core/build_target.go")))
+	// Modifying the result shouldn't affect the graph.
+	owners := graph.SourceOwners("src/core/graph.go")
+	owners[0] = target2
+	assert.Equal(t, []*BuildTarget{target1, target2}, graph.SourceOwners("src/core/graph.go"))
+}
+
 // makeTarget creates a new build target for us.
 func makeTarget(label string, deps ...*BuildTarget) *BuildTarget {
 	target := NewBuildTarget(ParseBuildLabel(label, ""))
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// An ExpectedHash is one of the hashes declared on a target that its outputs are expected to match.
+type ExpectedHash struct {
+	// The hash algorithm; either "sha1" or "sha256", or empty if we don't recognise it.
+	Algorithm string
+	// The raw (i.e. not hex-encoded) digest.
+	Digest []byte
+}
+
+// ExpectedHashes returns the hashes declared on this target, decoded from the hex form they're written in.
+// Any label prefixes on them (e.g. "linux_amd64: 1234abcd...") are stripped.
+func (target *BuildTarget) ExpectedHashes() []ExpectedHash {
+	ret := make([]ExpectedHash, len(target.Hashes))
+	for i, h := range target.Hashes {
+		ret[i] = ParseExpectedHash(h)
+	}
+	return ret
+}
+
+// ParseExpectedHash parses a single hash string in the form used for a target's hashes.
+func ParseExpectedHash(h string) ExpectedHash {
+	if idx := strings.LastIndexByte(h, ':'); idx != -1 {
+		h = h[idx+1:]
+	}
+	// TODO(peterebden): we should validate at parse time that these are sensible.
+	b, _ := hex.DecodeString(strings.TrimSpace(h))
+	switch len(b) {
+	case sha1.Size:
+		return ExpectedHash{Algorithm: "sha1", Digest: b}
+	case sha256.Size:
+		return ExpectedHash{Algorithm: "sha256", Digest: b}
+	}
+	return ExpectedHash{Digest: b}
+}
+
+// New returns a new hash.Hash for this hash's algorithm, or nil if we don't recognise it.
+func (h ExpectedHash) New() hash.Hash {
+	switch h.Algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// SRI returns this hash in the Subresource Integrity format (e.g. "sha256-<base64 digest>").
+func (h ExpectedHash) SRI() string {
+	if h.Algorithm == "" {
+		return base64.StdEncoding.EncodeToString(h.Digest)
+	}
+	return h.Algorithm + "-" + base64.StdEncoding.EncodeToString(h.Digest)
+}
+
+// String implements the fmt.Stringer interface.
+func (h ExpectedHash) String() string {
+	return hex.EncodeToString(h.Digest)
+}
+
+// A HashVerifier calculates hashes of everything written to it and checks them against a set of expected hashes.
+// It only calculates hashes of the types needed (so may not calculate any at all if the set is empty).
+type HashVerifier struct {
+	expected []ExpectedHash
+	hashes   map[string]hash.Hash
+}
+
+// NewHashVerifier returns a new HashVerifier checking against the given hashes.
+func NewHashVerifier(expected []ExpectedHash) *HashVerifier {
+	v := &HashVerifier{expected: expected, hashes: map[string]hash.Hash{}}
+	for _, h := range expected {
+		if _, present := v.hashes[h.Algorithm]; !present {
+			if hasher := h.New(); hasher != nil {
+				v.hashes[h.Algorithm] = hasher
+			}
+		}
+	}
+	return v
+}
+
+// Write implements the io.Writer interface.
+func (v *HashVerifier) Write(b []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(b)
+	}
+	return len(b), nil
+}
+
+// Reset discards everything written so far.
+func (v *HashVerifier) Reset() {
+	for _, h := range v.hashes {
+		h.Reset()
+	}
+}
+
+// Verify checks the data written so far against the expected hashes.
+// It succeeds if there are no expected hashes, or if any one of them matches.
+func (v *HashVerifier) Verify() error {
+	if len(v.hashes) == 0 {
+		return nil
+	}
+	sums := make(map[string][]byte, len(v.hashes))
+	for alg, h := range v.hashes {
+		sums[alg] = h.Sum(nil)
+	}
+	for _, h := range v.expected {
+		if sum, present := sums[h.Algorithm]; present && bytes.Equal(sum, h.Digest) {
+			return nil
+		}
+	}
+	actual := make([]string, 0, len(sums))
+	for _, h := range v.expected {
+		if sum, present := sums[h.Algorithm]; present {
+			actual = append(actual, h.Algorithm+":"+hex.EncodeToString(sum))
+			delete(sums, h.Algorithm)
+		}
+	}
+	if len(v.expected) == 1 {
+		return fmt.Errorf("was %s but expected %s", strings.Join(actual, ", "), v.expected[0])
+	}
+	expected := make([]string, len(v.expected))
+	for i, h := range v.expected {
+		expected[i] = h.String()
+	}
+	return fmt.Errorf("was %s but expected one of [%s]", strings.Join(actual, ", "), strings.Join(expected, ", "))
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// These are the hashes of "wibble".
+const (
+	wibbleSHA1   = "02e0182ae38f90d11be647e337665e67f9243817"
+	wibbleSHA256 = "3b3b53c2a6bdd088d8b0fa6b73274972db439f6ae25393f680a77d6112cded94"
+)
+
+func TestParseExpectedHash(t *testing.T) {
+	h := ParseExpectedHash("linux_amd64: " + wibbleSHA1)
+	assert.Equal(t, "sha1", h.Algorithm)
+	assert.Equal(t, wibbleSHA1, h.String())
+	h = ParseExpectedHash(wibbleSHA256)
+	assert.Equal(t, "sha256", h.Algorithm)
+	h = ParseExpectedHash("1234")
+	assert.Equal(t, "", h.Algorithm)
+	assert.Nil(t, h.New())
+}
+
+func TestSRI(t *testing.T) {
+	h := ParseExpectedHash("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	assert.Equal(t, "sha256-ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=", h.SRI())
+}
+
+func TestHashVerifier(t *testing.T) {
+	sha1 := ParseExpectedHash(wibbleSHA1)
+	v := NewHashVerifier([]ExpectedHash{sha1})
+	v.Write([]byte("wibble"))
+	assert.NoError(t, v.Verify())
+
+	v = NewHashVerifier([]ExpectedHash{sha1})
+	v.Write([]byte("wobble"))
+	assert.Error(t, v.Verify())
+	v.Reset()
+	v.Write([]byte("wibble"))
+	assert.NoError(t, v.Verify())
+
+	// Any one of them matching is sufficient.
+	other, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000000")
+	v = NewHashVerifier([]ExpectedHash{{Algorithm: "sha256", Digest: other}, sha1})
+	v.Write([]byte("wibble"))
+	assert.NoError(t, v.Verify())
+
+	// Nothing to check against always passes.
+	v = NewHashVerifier(nil)
+	v.Write([]byte("wibble"))
+	assert.NoError(t, v.Verify())
+}
@@ -30,6 +30,9 @@ type Package struct {
 	Outputs map[string]*BuildTarget
 	// Protects access to above
 	mutex sync.RWMutex
+	// True if the package can't be restored from the graph cache, for example because parsing it
+	// ran a command or defined a subrepo, neither of which would happen again if it were.
+	NoWarmStart bool
 	// Targets whose dependencies got modified during a pre or post-build function.
 	modifiedTargets map[*BuildTarget]struct{}
 	// Used to arbitrate a single post-build function running at a time.
@@ -117,9 +120,13 @@ func (pkg *Package) HasSubinclude(label BuildLabel) bool {
 }
 
 // SubrepoArchName returns a subrepo name, modified for the architecture of this package if it's not the host.
+// Names that already refer to a particular architecture are returned unchanged.
 func (pkg *Package) SubrepoArchName(subrepo string) string {
 	if subrepo != "" && pkg.Subrepo != nil && pkg.Subrepo.IsCrossCompile && pkg.SubrepoName != subrepo {
-		return subrepo + "_" + pkg.SubrepoName
+		if _, _, ok := SplitArchSubrepoName(subrepo); ok {
+			return subrepo
+		}
+		return ArchSubrepoName(subrepo, pkg.Subrepo.Arch)
 	}
 	return subrepo
 }
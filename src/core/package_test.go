@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
 )
 
 func TestRegisterSubinclude(t *testing.T) {
@@ -73,3 +75,13 @@ func TestVerifyOutputs(t *testing.T) {
 	target1.AddDependency(target2.Label)
 	assert.Equal(t, 0, len(pkg.verifyOutputs()))
 }
+
+func TestSubrepoArchName(t *testing.T) {
+	pkg := NewPackage("third_party/cc")
+	assert.Equal(t, "gtest", pkg.SubrepoArchName("gtest"))
+	pkg.SubrepoName = "linux_arm64"
+	pkg.Subrepo = &Subrepo{Name: "linux_arm64", Arch: cli.NewArch("linux", "arm64"), IsCrossCompile: true}
+	assert.Equal(t, "gtest@linux_arm64", pkg.SubrepoArchName("gtest"))
+	assert.Equal(t, "gtest@darwin_amd64", pkg.SubrepoArchName("gtest@darwin_amd64"))
+	assert.Equal(t, "linux_arm64", pkg.SubrepoArchName("linux_arm64"))
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// InjectedSecretLabel is the prefix of labels that request a secret from the [secret] config
+// section to be injected into a target's actions.
+const InjectedSecretLabel = "secret:"
+
+// secretFetchTimeout is how long we wait to fetch a secret from a URL.
+const secretFetchTimeout = 10 * time.Second
+
+// InjectedSecrets returns the names of the secrets that should be injected into this target's actions.
+func (target *BuildTarget) InjectedSecrets() []string {
+	return target.PrefixedLabels(InjectedSecretLabel)
+}
+
+// InjectedSecretVar returns the name of the environment variable that a secret is injected as.
+func InjectedSecretVar(name string) string {
+	return "SECRET_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// InjectedSecretEnv fetches the secrets for a target and returns them as environment variables.
+// This is done immediately before running an action (rather than when calculating its environment)
+// so they never contribute to its hash and we always get the current value.
+func InjectedSecretEnv(config *Configuration, target *BuildTarget) (BuildEnv, error) {
+	names := target.InjectedSecrets()
+	if len(names) == 0 {
+		return nil, nil
+	}
+	env := make(BuildEnv, 0, len(names))
+	for _, name := range names {
+		secret, present := config.Secret[name]
+		if !present {
+			return nil, fmt.Errorf("%s requires secret %s, but there's no [secret \"%s\"] section in the config", target.Label, name, name)
+		}
+		value, err := secret.Fetch()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch secret %s for %s: %s", name, target.Label, err)
+		}
+		env = append(env, InjectedSecretVar(name)+"="+value)
+	}
+	return env, nil
+}
+
+// Fetch returns the current value of this secret.
+func (secret *InjectedSecret) Fetch() (string, error) {
+	if secret.FromEnv != "" {
+		value, present := os.LookupEnv(secret.FromEnv)
+		if !present {
+			return "", fmt.Errorf("environment variable %s isn't set", secret.FromEnv)
+		}
+		return value, nil
+	} else if secret.FromFile != "" {
+		b, err := ioutil.ReadFile(ExpandHomePath(secret.FromFile))
+		return strings.TrimRight(string(b), "\n"), err
+	} else if secret.FromURL != "" {
+		return secret.fetchURL()
+	}
+	return "", fmt.Errorf("none of FromEnv, FromFile or FromURL are set")
+}
+
+// fetchURL fetches this secret from its URL.
+func (secret *InjectedSecret) fetchURL() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, secret.FromURL, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, header := range secret.Header {
+		idx := strings.IndexByte(header, ':')
+		if idx == -1 {
+			return "", fmt.Errorf("invalid header %s, should be in the form Name: Value", header)
+		}
+		req.Header.Set(strings.TrimSpace(header[:idx]), strings.TrimSpace(header[idx+1:]))
+	}
+	client := &http.Client{Timeout: secretFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", secret.FromURL, resp.Status)
+	}
+	return strings.TrimRight(string(b), "\n"), nil
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectedSecretVar(t *testing.T) {
+	assert.Equal(t, "SECRET_SIGNING_KEY", InjectedSecretVar("signing-key"))
+}
+
+func TestInjectedSecretEnvNoSecrets(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	env, err := InjectedSecretEnv(DefaultConfiguration(), target)
+	assert.NoError(t, err)
+	assert.Empty(t, env)
+}
+
+func TestInjectedSecretEnv(t *testing.T) {
+	os.Setenv("PLZ_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("PLZ_TEST_SECRET")
+	f, err := ioutil.TempFile("", "secret")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("correct horse battery staple\n")
+	f.Close()
+
+	config := DefaultConfiguration()
+	config.Secret = map[string]*InjectedSecret{
+		"env":  {FromEnv: "PLZ_TEST_SECRET"},
+		"file": {FromFile: f.Name()},
+	}
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddLabel("secret:env")
+	target.AddLabel("secret:file")
+	env, err := InjectedSecretEnv(config, target)
+	assert.NoError(t, err)
+	assert.Equal(t, BuildEnv{
+		"SECRET_ENV=hunter2",
+		"SECRET_FILE=correct horse battery staple",
+	}, env)
+}
+
+func TestInjectedSecretFromURL(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("token\n"))
+	}))
+	defer s.Close()
+	secret := &InjectedSecret{FromURL: s.URL, Header: []string{"Metadata-Flavor: Google"}}
+	value, err := secret.Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", value)
+	secret.Header = nil
+	_, err = secret.Fetch()
+	assert.Error(t, err)
+}
+
+func TestInjectedSecretMissing(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddLabel("secret:nope")
+	_, err := InjectedSecretEnv(DefaultConfiguration(), target)
+	assert.Error(t, err)
+	config := DefaultConfiguration()
+	config.Secret = map[string]*InjectedSecret{"nope": {FromEnv: "PLZ_TEST_SECRET_THAT_ISNT_SET"}}
+	_, err = InjectedSecretEnv(config, target)
+	assert.Error(t, err)
+}
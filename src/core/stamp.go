@@ -1,7 +1,13 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
 )
 
 // StampFile returns the contents of a stamp file, that is the data that would be written for
@@ -40,3 +46,31 @@ type targetInfo struct {
 	Labels   []string `json:"labels,omitempty"`
 	Licences []string `json:"licences,omitempty"`
 }
+
+// stampVarName matches the names of variables that can be defined by the stamp command.
+var stampVarName = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// stampCommandEnv runs the given command and returns the variables it defines.
+// Its output should be lines of KEY=VALUE; blank lines are ignored.
+func stampCommandEnv(command string) (BuildEnv, error) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = RepoRoot
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, stderr.String())
+	}
+	env := BuildEnv{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		} else if idx := strings.IndexByte(line, '='); idx == -1 || !stampVarName.MatchString(line[:idx]) {
+			return nil, fmt.Errorf("invalid output line from stamp command, should be KEY=VALUE: %s", line)
+		}
+		env = append(env, line)
+	}
+	return env, scanner.Err()
+}
@@ -39,3 +39,19 @@ func TestStampFile(t *testing.T) {
 }`)
 	assert.Equal(t, expected, StampFile(t1))
 }
+
+func TestStampCommandEnv(t *testing.T) {
+	env, err := stampCommandEnv("echo BUILD_USER=pleasebot; echo; echo 'RELEASE_NAME=v1=beta'")
+	assert.NoError(t, err)
+	assert.EqualValues(t, BuildEnv{"BUILD_USER=pleasebot", "RELEASE_NAME=v1=beta"}, env)
+}
+
+func TestStampCommandEnvInvalidOutput(t *testing.T) {
+	_, err := stampCommandEnv("echo 'not a variable'")
+	assert.Error(t, err)
+}
+
+func TestStampCommandEnvFails(t *testing.T) {
+	_, err := stampCommandEnv("echo WIBBLE=wobble; exit 1")
+	assert.Error(t, err)
+}
@@ -77,8 +77,13 @@ type RemoteClient interface {
 	Download(target *BuildTarget) error
 	// PrintHashes shows the hashes of a target.
 	PrintHashes(target *BuildTarget, isTest bool)
+	// Diff compares a locally built target with how it would be built remotely, writing any differences to w.
+	// It returns true if there weren't any.
+	Diff(target *BuildTarget, env BuildEnv, command string, w io.Writer) (bool, error)
 	// DataRate returns an estimate of the current in/out RPC data rates and totals so far in bytes per second.
 	DataRate() (int, int, int, int)
+	// Shutdown is called once the build has finished, to flush anything that's still outstanding.
+	Shutdown()
 }
 
 // A TargetHasher is a thing that knows how to create hashes for targets.
@@ -125,6 +130,8 @@ type BuildState struct {
 	PathHasher *fs.PathHasher
 	// Hashers of all supported functions
 	hashers map[string]*fs.PathHasher
+	// Links or copies files to their outputs for filegroups.
+	Linker *fs.Linker
 	// Cache to store / retrieve old build results.
 	Cache Cache
 	// Client to remote execution service, if configured.
@@ -179,12 +186,23 @@ type BuildState struct {
 	CleanWorkdirs bool
 	// True if we're forcing a rebuild of the original targets.
 	ForceRebuild bool
+	// True to randomise the order that sources are prepared in and environment variables are
+	// passed to build actions. Used to check that targets build deterministically.
+	ShuffleInputs bool
 	// True to always show test output, even on success.
 	ShowTestOutput bool
 	// True to print all output of all tasks to stderr.
 	ShowAllOutput bool
 	// True to attach a debugger on test failure.
 	DebugTests bool
+	// True to print the critical path through the build once it's finished.
+	PrintCriticalPath bool
+	// The number of packages that took longest to parse to print once the build is finished.
+	PrintSlowestPackages int
+	// True to print the cache hit rates for each kind of rule once the build is finished.
+	PrintCacheStats bool
+	// File to write the cache hit rates for each kind of rule into, in the Prometheus text format.
+	CacheStatsFile string
 	// True if we think the underlying filesystem supports xattrs (which affects how we write some metadata).
 	XattrsSupported bool
 	// Experimental directories
@@ -433,7 +451,9 @@ func (state *BuildState) LogBuildResult(tid int, label BuildLabel, status BuildR
 			close(ch) // This signals to anyone waiting that it's done.
 		}
 		state.progress.pendingPackageMutex.Unlock()
-		return // We don't notify anything else on these.
+		// We don't notify remote clients on these, but local consumers use them to time parsing.
+		state.logResult(&BuildResult{ThreadID: tid, Time: time.Now(), Label: label, Status: status, Description: description}, false)
+		return
 	}
 	state.LogResult(&BuildResult{
 		ThreadID:    tid,
@@ -483,6 +503,11 @@ func (state *BuildState) LogBuildError(tid int, label BuildLabel, status BuildRe
 
 // LogResult logs a build result directly to the state's queue.
 func (state *BuildState) LogResult(result *BuildResult) {
+	state.logResult(result, true)
+}
+
+// logResult implements LogResult. If remote is false the result is not sent to remote clients.
+func (state *BuildState) logResult(result *BuildResult, remote bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			// This is basically always "send on closed channel" which can happen because this
@@ -494,7 +519,7 @@ func (state *BuildState) LogResult(result *BuildResult) {
 	if state.results != nil {
 		state.results <- result
 	}
-	if state.remoteResults != nil {
+	if remote && state.remoteResults != nil {
 		state.remoteResults <- result
 		state.lastResults[result.ThreadID] = result
 	}
@@ -837,10 +862,11 @@ func NewBuildState(config *Configuration) *BuildState {
 			"sha1":   fs.NewPathHasher(RepoRoot, config.Build.Xattrs, sha1.New, ""),
 			"sha256": fs.NewPathHasher(RepoRoot, config.Build.Xattrs, sha256.New, "_sha256"),
 		},
-		ProcessExecutor: process.New(sandboxTool),
+		Linker:          fs.NewLinker(config.Build.FilegroupLinkMode),
+		ProcessExecutor: process.New(sandboxTool, config.Build.Cgroup),
 		StartTime:       startTime,
 		Config:          config,
-		ParsePool:       NewPool(config.Please.NumThreads),
+		ParsePool:       NewPool(config.NumParseThreads()),
 		VerifyHashes:    true,
 		NeedBuild:       true,
 		Success:         true,
@@ -857,6 +883,11 @@ func NewBuildState(config *Configuration) *BuildState {
 		},
 	}
 	state.PathHasher = state.Hasher(config.Build.HashFunction)
+	if !config.Build.HashCache {
+		for _, hasher := range state.hashers {
+			hasher.DisableCache()
+		}
+	}
 	state.progress.allStates = []*BuildState{state}
 	state.Hashes.Config = config.Hash()
 	for _, exp := range config.Parse.ExperimentalDir {
@@ -1,8 +1,10 @@
 package core
 
 import (
-	"github.com/thought-machine/please/src/cli"
 	"path"
+	"strings"
+
+	"github.com/thought-machine/please/src/cli"
 )
 
 // A Subrepo stores information about a registered subrepository, typically one
@@ -33,6 +35,38 @@ func SubrepoForArch(state *BuildState, arch cli.Arch) *Subrepo {
 	}
 }
 
+// SubrepoForArchVariant creates a new subrepo that's a copy of the given one for a different
+// architecture; for example third_party/cc/gtest@linux_arm64 based on third_party/cc/gtest.
+// The new subrepo shares the same root & target but its packages are parsed for the new architecture.
+func SubrepoForArchVariant(base *Subrepo, arch cli.Arch) *Subrepo {
+	return &Subrepo{
+		Name:           ArchSubrepoName(base.Name, arch),
+		Root:           base.Root,
+		Target:         base.Target,
+		State:          base.State.ForArch(arch),
+		Arch:           arch,
+		IsCrossCompile: true,
+	}
+}
+
+// ArchSubrepoName returns the name of the variant of the given subrepo for an architecture.
+func ArchSubrepoName(subrepo string, arch cli.Arch) string {
+	return subrepo + "@" + arch.String()
+}
+
+// SplitArchSubrepoName splits an architecture-qualified subrepo name into the name of the
+// subrepo it's a variant of and the architecture. It returns false if the name isn't one.
+func SplitArchSubrepoName(name string) (string, cli.Arch, bool) {
+	var arch cli.Arch
+	idx := strings.LastIndexByte(name, '@')
+	if idx == -1 {
+		return "", arch, false
+	} else if err := arch.UnmarshalFlag(name[idx+1:]); err != nil {
+		return "", arch, false
+	}
+	return name[:idx], arch, true
+}
+
 // Dir returns the directory for a package of this name.
 func (s *Subrepo) Dir(dir string) string {
 	return path.Join(s.Root, dir)
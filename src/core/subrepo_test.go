@@ -4,9 +4,32 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
 )
 
 func TestDir(t *testing.T) {
 	s := &Subrepo{Name: "repo", Root: "plz-out/gen/repo"}
 	assert.Equal(t, "plz-out/gen/repo/package", s.Dir("package"))
 }
+
+func TestSplitArchSubrepoName(t *testing.T) {
+	name, arch, ok := SplitArchSubrepoName("third_party/cc/gtest@linux_arm64")
+	assert.True(t, ok)
+	assert.Equal(t, "third_party/cc/gtest", name)
+	assert.Equal(t, cli.NewArch("linux", "arm64"), arch)
+	_, _, ok = SplitArchSubrepoName("third_party/cc/gtest")
+	assert.False(t, ok)
+	_, _, ok = SplitArchSubrepoName("third_party/cc/gtest@wibble")
+	assert.False(t, ok)
+}
+
+func TestSubrepoForArchVariant(t *testing.T) {
+	state := NewDefaultBuildState()
+	base := &Subrepo{Name: "third_party/cc/gtest", Root: "plz-out/gen/third_party/cc/gtest", State: state, Arch: cli.HostArch()}
+	s := SubrepoForArchVariant(base, cli.NewArch("linux", "arm64"))
+	assert.Equal(t, "third_party/cc/gtest@linux_arm64", s.Name)
+	assert.Equal(t, base.Root, s.Root)
+	assert.True(t, s.IsCrossCompile)
+	assert.Equal(t, cli.NewArch("linux", "arm64"), s.State.Config.Build.Arch)
+}
@@ -146,7 +146,7 @@ func streamResources(state *core.BuildState, client pb.PlzEventsClient) {
 
 // runOutput is just a wrapper around output.MonitorState for convenience in testing.
 func runOutput(ctx context.Context, state *core.BuildState) bool {
-	output.MonitorState(ctx, state, true, false, false, "")
+	output.MonitorState(ctx, state, true, false, false, "", "", "", nil)
 	output.PrintDisconnectionMessage(state.Success, remoteClosed, remoteDisconnected)
 	return state.Success
 }
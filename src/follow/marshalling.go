@@ -19,12 +19,13 @@ import (
 func toProto(r *core.BuildResult) *pb.BuildEventResponse {
 	t := &r.Tests
 	return &pb.BuildEventResponse{
-		ThreadId:    int32(r.ThreadID),
-		Timestamp:   r.Time.UnixNano(),
-		BuildLabel:  toProtoBuildLabel(r.Label),
-		Status:      pb.BuildResultStatus(r.Status),
-		Error:       toProtoError(r.Err),
-		Description: r.Description,
+		ThreadId:        int32(r.ThreadID),
+		Timestamp:       r.Time.UnixNano(),
+		BuildLabel:      toProtoBuildLabel(r.Label),
+		Status:          pb.BuildResultStatus(r.Status),
+		Error:           toProtoError(r.Err),
+		Description:     r.Description,
+		StructuredError: toProtoBuildError(core.AsBuildError(r.Err, r.Label, r.Status)),
 		TestResults: &pb.TestSuite{
 			Package:    t.Package,
 			Name:       t.Name,
@@ -112,6 +113,24 @@ func toProtoError(err error) string {
 	return ""
 }
 
+// toProtoBuildError converts a structured error to the proto equivalent.
+func toProtoBuildError(err *core.BuildError) *pb.BuildError {
+	if err == nil {
+		return nil
+	}
+	ret := &pb.BuildError{
+		Code:       string(err.Code),
+		Package:    err.Package,
+		Target:     err.Target,
+		Message:    err.Message,
+		Suggestion: err.Suggestion,
+	}
+	if pos := err.Position; pos != nil {
+		ret.Position = &pb.ErrorPosition{Filename: pos.Filename, Line: int32(pos.Line), Column: int32(pos.Column)}
+	}
+	return ret
+}
+
 // fromProto converts from a proto type into the internal equivalent.
 func fromProto(r *pb.BuildEventResponse) *core.BuildResult {
 	t := r.TestResults
@@ -120,7 +139,7 @@ func fromProto(r *pb.BuildEventResponse) *core.BuildResult {
 		Time:        time.Unix(0, r.Timestamp),
 		Label:       fromProtoBuildLabel(r.BuildLabel),
 		Status:      core.BuildResultStatus(r.Status),
-		Err:         fromProtoError(r.Error),
+		Err:         fromProtoError(r.Error, r.StructuredError),
 		Description: r.Description,
 		Tests: core.TestSuite{
 			Package:    t.Package,
@@ -199,11 +218,22 @@ func fromProtoBuildLabels(labels []*pb.BuildLabel) []core.BuildLabel {
 }
 
 // fromProtoError converts a proto string into an error if it's non-empty.
-func fromProtoError(s string) error {
-	if s != "" {
+// If the structured error is given then the result carries that information too.
+func fromProtoError(s string, structured *pb.BuildError) error {
+	if s == "" {
+		return nil
+	} else if structured == nil {
 		return errors.New(s)
 	}
-	return nil
+	err := core.NewBuildError(core.ErrorCode(structured.Code), errors.New(s))
+	err.Package = structured.Package
+	err.Target = structured.Target
+	err.Message = structured.Message
+	err.Suggestion = structured.Suggestion
+	if pos := structured.Position; pos != nil {
+		err.Position = &core.ErrorPosition{Filename: pos.Filename, Line: int(pos.Line), Column: int(pos.Column)}
+	}
+	return err
 }
 
 // resourceToProto converts the internal resource stats to a proto message.
@@ -0,0 +1,137 @@
+// Package format implements autoformatting of BUILD files into a canonical style.
+//
+// Files are first parsed with the asp parser so that anything it would reject is reported
+// in the same way as during a build; the formatting itself is done with buildtools, which
+// retains comments (the asp AST does not).
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/bazelbuild/buildtools/build"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/parse/asp"
+	"github.com/thought-machine/please/src/utils"
+)
+
+var log = logging.MustGetLogger("format")
+
+// A Mode describes what to do with files that aren't formatted correctly.
+type Mode int
+
+const (
+	// List prints the names of any files that aren't correctly formatted.
+	List Mode = iota
+	// Diff prints a diff of the changes that would be made to each file.
+	Diff
+	// Write rewrites each file in place.
+	Write
+)
+
+// Format returns the canonically formatted version of the given file contents.
+// The filename is used for error messages and to determine whether it's a BUILD file or
+// a build_defs file (BUILD files get a little more rewriting, e.g. deps are sorted).
+func Format(config *core.Configuration, filename string, data []byte) ([]byte, error) {
+	return format(asp.NewParser(nil), config, filename, data)
+}
+
+// format implements Format using the given parser.
+func format(p *asp.Parser, config *core.Configuration, filename string, data []byte) ([]byte, error) {
+	if _, err := p.ParseData(data, filename); err != nil {
+		return nil, err
+	}
+	parse := build.ParseDefault
+	if config.IsABuildFile(path.Base(filename)) {
+		parse = build.ParseBuild
+	}
+	f, err := parse(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	build.Rewrite(f, nil)
+	return build.Format(f), nil
+}
+
+// FormatFiles formats the given files according to the given mode.
+// If no files are given, all BUILD files in the repo are formatted.
+// It returns true if all the files were already correctly formatted (in Write mode that means
+// nothing needed to be rewritten).
+func FormatFiles(config *core.Configuration, filenames []string, mode Mode) (bool, error) {
+	if len(filenames) == 0 {
+		filenames = allBuildFiles(config)
+	}
+	p := asp.NewParser(nil)
+	formatted := true
+	for _, filename := range filenames {
+		before, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return false, err
+		}
+		after, err := format(p, config, filename, before)
+		if err != nil {
+			return false, err
+		} else if bytes.Equal(before, after) {
+			continue
+		}
+		formatted = false
+		switch mode {
+		case List:
+			fmt.Println(filename)
+		case Diff:
+			if err := showDiff(filename, after); err != nil {
+				return false, err
+			}
+		case Write:
+			log.Notice("Reformatting %s", filename)
+			if err := ioutil.WriteFile(filename, after, 0644); err != nil {
+				return false, err
+			}
+		}
+	}
+	return formatted, nil
+}
+
+// showDiff prints a unified diff between the given file and its new contents.
+func showDiff(filename string, contents []byte) error {
+	f, err := ioutil.TempFile("", path.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	cmd := exec.Command("diff", "-u", "--label", filename, "--label", filename, filename, f.Name())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// diff exits with 1 when the files differ, which is what we expect here.
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			return err
+		}
+	}
+	return nil
+}
+
+// allBuildFiles returns the names of all the BUILD files in the repo.
+func allBuildFiles(config *core.Configuration) []string {
+	filenames := []string{}
+	for pkg := range utils.FindAllSubpackages(config, "", "") {
+		for _, name := range config.Parse.BuildFileName {
+			if filename := path.Join(pkg, name); fs.FileExists(filename) {
+				filenames = append(filenames, filename)
+			}
+		}
+	}
+	return filenames
+}
@@ -0,0 +1,52 @@
+package format
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestFormat(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.BuildFileName = []string{"unformatted.build"}
+	before, err := ioutil.ReadFile("src/format/test_data/unformatted.build")
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile("src/format/test_data/formatted.build")
+	require.NoError(t, err)
+	after, err := Format(config, "src/format/test_data/unformatted.build", before)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(after))
+}
+
+func TestFormatIsIdempotent(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.BuildFileName = []string{"formatted.build"}
+	before, err := ioutil.ReadFile("src/format/test_data/formatted.build")
+	require.NoError(t, err)
+	after, err := Format(config, "src/format/test_data/formatted.build", before)
+	assert.NoError(t, err)
+	assert.Equal(t, string(before), string(after))
+}
+
+func TestFormatInvalid(t *testing.T) {
+	config := core.DefaultConfiguration()
+	before, err := ioutil.ReadFile("src/format/test_data/invalid.build")
+	require.NoError(t, err)
+	_, err = Format(config, "src/format/test_data/invalid.build", before)
+	assert.Error(t, err)
+}
+
+func TestFormatFilesList(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Parse.BuildFileName = []string{"unformatted.build", "formatted.build"}
+	formatted, err := FormatFiles(config, []string{"src/format/test_data/formatted.build"}, List)
+	assert.NoError(t, err)
+	assert.True(t, formatted)
+	formatted, err = FormatFiles(config, []string{"src/format/test_data/unformatted.build"}, List)
+	assert.NoError(t, err)
+	assert.False(t, formatted)
+}
@@ -1,13 +1,18 @@
 package fs
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/pkg/xattr"
 )
@@ -20,10 +25,24 @@ type PathHasher struct {
 	new       func() hash.Hash
 	memo      map[string][]byte
 	wait      map[string]*pendingHash
+	files     map[fileKey][]byte
 	mutex     sync.RWMutex
+	workers   chan struct{}
 	root      string
 	xattrName string
 	useXattrs bool
+	useCache  bool
+	db        *hashDB
+}
+
+// A fileKey identifies a particular version of a file.
+// We use it to remember file hashes so unchanged files aren't rehashed, even when the path
+// containing them is (e.g. an output directory of a target that's been rebuilt).
+type fileKey struct {
+	Path  string
+	Mtime int64
+	Size  int64
+	Inode uint64
 }
 
 type pendingHash struct {
@@ -38,9 +57,13 @@ func NewPathHasher(root string, useXattrs bool, hash func() hash.Hash, hashSuffi
 		new:       hash,
 		memo:      map[string][]byte{},
 		wait:      map[string]*pendingHash{},
+		files:     map[fileKey][]byte{},
+		workers:   make(chan struct{}, runtime.NumCPU()),
 		root:      root,
 		useXattrs: useXattrs,
+		useCache:  true,
 		xattrName: "user.plz_hash" + hashSuffix,
+		db:        newHashDB(filepath.Join(root, "plz-out/.path_hashes"+hashSuffix)),
 	}
 }
 
@@ -54,11 +77,17 @@ func (hasher *PathHasher) NewHash() hash.Hash {
 	return hasher.new()
 }
 
-// DisableXattrs turns off xattr support, which bypasses using them to record file hashes.
+// DisableXattrs turns off xattr support; hashes of files are recorded in a separate database instead.
 func (hasher *PathHasher) DisableXattrs() {
 	hasher.useXattrs = false
 }
 
+// DisableCache turns off recording the hashes of output files, so they are always rehashed
+// by each new build.
+func (hasher *PathHasher) DisableCache() {
+	hasher.useCache = false
+}
+
 // Hash hashes a single path.
 // It is memoised and so will only hash each path once, unless recalc is true which will
 // then force a recalculation of it.
@@ -138,9 +167,9 @@ func (hasher *PathHasher) SetHash(path string, hash []byte) {
 }
 
 func (hasher *PathHasher) hash(path string, store, read bool) ([]byte, error) {
-	// Try to read xattrs first so we don't have to hash the whole thing.
-	if read && strings.HasPrefix(path, "plz-out/") && hasher.useXattrs {
-		if b, err := xattr.LGet(path, hasher.xattrName); err == nil {
+	// Try to read a previously stored hash first so we don't have to hash the whole thing.
+	if read {
+		if b := hasher.readHash(path); b != nil {
 			return b, nil
 		}
 	}
@@ -165,60 +194,204 @@ func (hasher *PathHasher) hash(path string, store, read bool) ([]byte, error) {
 			return h.Sum(nil), err
 		}
 		return h.Sum(nil), nil
-	} else if err == nil && info.IsDir() {
-		err = WalkMode(path, func(p string, isDir bool, mode os.FileMode) error {
-			if mode&os.ModeSymlink != 0 {
-				// Is a symlink, must verify that it's not a link outside the tmp dir.
-				deref, err := filepath.EvalSymlinks(p)
-				if err != nil {
-					return err
-				}
-				if !strings.HasPrefix(deref, path) {
-					return fmt.Errorf("Output %s links outside the build dir (to %s)", p, deref)
-				}
-				// Deliberately do not attempt to read it. We will read the contents later since
-				// it is a link within the temp dir anyway, and if it's a link to a directory
-				// it can introduce a cycle.
-				// Just write something to the hash indicating that we found something here,
-				// otherwise rules might be marked as unchanged if they added additional symlinks.
-				h.Write(boolTrueHashValue)
-			} else if !isDir {
-				return hasher.fileHash(h, p)
-			}
-			return nil
-		})
+	}
+	var hash []byte
+	if err == nil && info.IsDir() {
+		err = hasher.dirHash(h, path)
+		hash = h.Sum(nil)
+	} else if err == nil {
+		hash, err = hasher.memoFileHash(path, info)
 	} else {
 		err = hasher.fileHash(h, path) // let this handle any other errors
+		hash = h.Sum(nil)
 	}
-	hash := h.Sum(nil)
 	if err != nil {
 		return hash, err
-	} else if store && hasher.useXattrs {
+	} else if store {
 		hasher.storeHash(path, hash)
 	}
 	return hash, err
 }
 
-// storeHash stores the hash of a file on it as an xattr.
+// storeHash stores the hash of a file, along with a fingerprint of its metadata, so later builds
+// can reuse it as long as the file hasn't changed.
+// It's stored as an xattr on the file where possible, otherwise in our separate database.
 // This is best-effort since if it fails we can always fall back to a slower but reliable rehash.
 func (hasher *PathHasher) storeHash(path string, hash []byte) {
 	// Only ever store hashes on output files.
-	if !strings.HasPrefix(path, "plz-out/") {
+	if !hasher.useCache || !strings.HasPrefix(path, "plz-out/") {
 		return
 	}
-	if err := xattr.LSet(path, hasher.xattrName, hash); err != nil && os.IsPermission(err) {
+	fingerprint, err := fileFingerprint(path)
+	if err != nil {
+		return
+	}
+	value := append(append(make([]byte, 0, len(hash)+len(fingerprint)), hash...), fingerprint...)
+	if !hasher.useXattrs {
+		hasher.db.Set(path, value)
+	} else if err := xattr.LSet(path, hasher.xattrName, value); err != nil && os.IsPermission(err) {
 		// If we get a permission denied, that may be because the output file was readonly.
 		// Cheekily attempt to chmod it into submission.
 		if info, err := os.Lstat(path); err == nil {
 			if err := os.Chmod(path, info.Mode()|0220); err == nil {
-				xattr.LSet(path, hasher.xattrName, hash)
+				xattr.LSet(path, hasher.xattrName, value)
 				os.Chmod(path, info.Mode())
 			}
 		}
 	}
 }
 
-// Calculate the hash of a single file
+// readHash reads a hash previously recorded by storeHash.
+// It returns nil if there isn't one or the file has changed since it was recorded.
+func (hasher *PathHasher) readHash(path string) []byte {
+	if !hasher.useCache || !strings.HasPrefix(path, "plz-out/") {
+		return nil
+	}
+	var value []byte
+	if hasher.useXattrs {
+		value, _ = xattr.LGet(path, hasher.xattrName)
+	} else {
+		value = hasher.db.Get(path)
+	}
+	size := hasher.Size()
+	if len(value) != size+sha1.Size {
+		return nil // Includes hashes stored by older versions that didn't record a fingerprint.
+	} else if fingerprint, err := fileFingerprint(path); err != nil || !bytes.Equal(fingerprint, value[size:]) {
+		return nil
+	}
+	return value[:size]
+}
+
+// fileFingerprint returns a fingerprint of the metadata of a file, or of all the files in a directory.
+// It covers the modification time, size and inode of each; the ctime would be nice too but it
+// changes whenever we store a hash, since that's a metadata update in itself.
+// Names are taken relative to the given path so it survives the whole thing being moved
+// (e.g. from plz-out/tmp to plz-out/gen).
+func fileFingerprint(path string) ([]byte, error) {
+	h := sha1.New()
+	add := func(name string, info os.FileInfo) {
+		var b [24]byte
+		binary.LittleEndian.PutUint64(b[:8], uint64(info.ModTime().UnixNano()))
+		binary.LittleEndian.PutUint64(b[8:16], uint64(info.Size()))
+		if s, ok := info.Sys().(*syscall.Stat_t); ok {
+			binary.LittleEndian.PutUint64(b[16:], uint64(s.Ino))
+		}
+		h.Write([]byte(name))
+		h.Write(b[:])
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		add("", info)
+		return h.Sum(nil), nil
+	}
+	err = WalkMode(path, func(name string, isDir bool, mode os.FileMode) error {
+		if isDir {
+			return nil
+		}
+		info, err := os.Lstat(name)
+		if err != nil {
+			return err
+		}
+		add(strings.TrimPrefix(name, path), info)
+		return nil
+	})
+	return h.Sum(nil), err
+}
+
+// dirHash calculates the hash of a directory.
+// The files in it are hashed individually by a bounded set of workers, and the directory's hash
+// is then the hash of all those in order.
+func (hasher *PathHasher) dirHash(h hash.Hash, path string) error {
+	var wg sync.WaitGroup
+	var hashes [][]byte
+	var errs []error
+	var mutex sync.Mutex // guards hashes & errs
+	err := WalkMode(path, func(p string, isDir bool, mode os.FileMode) error {
+		if mode&os.ModeSymlink != 0 {
+			// Is a symlink, must verify that it's not a link outside the tmp dir.
+			deref, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(deref, path) {
+				return fmt.Errorf("Output %s links outside the build dir (to %s)", p, deref)
+			}
+			// Deliberately do not attempt to read it. We will read the contents later since
+			// it is a link within the temp dir anyway, and if it's a link to a directory
+			// it can introduce a cycle.
+			// Just write something to the hash indicating that we found something here,
+			// otherwise rules might be marked as unchanged if they added additional symlinks.
+			mutex.Lock()
+			hashes = append(hashes, boolTrueHashValue)
+			mutex.Unlock()
+		} else if !isDir {
+			mutex.Lock()
+			i := len(hashes)
+			hashes = append(hashes, nil)
+			mutex.Unlock()
+			hasher.workers <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-hasher.workers }()
+				hash, err := hasher.memoFileHash(p, nil)
+				mutex.Lock()
+				defer mutex.Unlock()
+				hashes[i] = hash
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}()
+		}
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		return err
+	} else if len(errs) > 0 {
+		return errs[0]
+	}
+	for _, hash := range hashes {
+		h.Write(hash)
+	}
+	return nil
+}
+
+// memoFileHash returns the hash of a single file, reusing a previous one if the file hasn't changed.
+// info is the result of a stat on the file, if the caller has one already.
+func (hasher *PathHasher) memoFileHash(filename string, info os.FileInfo) ([]byte, error) {
+	if info == nil {
+		i, err := os.Lstat(filename)
+		if err != nil {
+			return nil, err
+		}
+		info = i
+	}
+	key := fileKey{Path: filename, Mtime: info.ModTime().UnixNano(), Size: info.Size()}
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		key.Inode = uint64(s.Ino)
+	}
+	hasher.mutex.RLock()
+	hash, present := hasher.files[key]
+	hasher.mutex.RUnlock()
+	if present {
+		return hash, nil
+	}
+	h := hasher.new()
+	if err := hasher.fileHash(h, filename); err != nil {
+		return nil, err
+	}
+	hash = h.Sum(nil)
+	hasher.mutex.Lock()
+	hasher.files[key] = hash
+	hasher.mutex.Unlock()
+	return hash, nil
+}
+
+// Calculate the hash of a single file.
+// The contents are streamed through the hash rather than read into memory up front.
 func (hasher *PathHasher) fileHash(h hash.Hash, filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// A hashDB is a simple on-disk store of file hashes, which we use instead of xattrs on
+// filesystems that don't support them.
+// It's an append-only log, one line per entry, which is read once when it's first needed;
+// later entries for a path override earlier ones.
+type hashDB struct {
+	filename string
+	once     sync.Once
+	mutex    sync.Mutex
+	entries  map[string][]byte
+	file     *os.File
+}
+
+// compactThreshold is the number of superseded entries we tolerate in the file before
+// rewriting it without them.
+const compactThreshold = 10000
+
+// newHashDB returns a new hashDB backed by the given file.
+func newHashDB(filename string) *hashDB {
+	return &hashDB{
+		filename: filename,
+		entries:  map[string][]byte{},
+	}
+}
+
+// Get returns the value stored for a path, or nil if there isn't one.
+func (db *hashDB) Get(filename string) []byte {
+	db.once.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.entries[filename]
+}
+
+// Set stores a value for a path.
+// This is best-effort; if it can't be written it will be recalculated next time.
+func (db *hashDB) Set(filename string, value []byte) {
+	db.once.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.entries[filename] = value
+	if db.file == nil {
+		if err := os.MkdirAll(path.Dir(db.filename), DirPermissions); err != nil {
+			log.Warning("Failed to create hash database: %s", err)
+			return
+		}
+		f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Warning("Failed to open hash database: %s", err)
+			return
+		}
+		db.file = f
+	}
+	if _, err := db.file.WriteString(hex.EncodeToString(value) + " " + filename + "\n"); err != nil {
+		log.Warning("Failed to write to hash database: %s", err)
+	}
+}
+
+// load reads the existing contents of the file.
+func (db *hashDB) load() {
+	f, err := os.Open(db.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read hash database: %s", err)
+		}
+		return
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		if parts := strings.SplitN(scanner.Text(), " ", 2); len(parts) == 2 {
+			if value, err := hex.DecodeString(parts[0]); err == nil {
+				db.entries[parts[1]] = value
+			}
+		}
+	}
+	if lines-len(db.entries) > compactThreshold {
+		db.compact()
+	}
+}
+
+// compact rewrites the file with only the current entries, dropping any for paths that no longer exist.
+func (db *hashDB) compact() {
+	tmp := db.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Warning("Failed to compact hash database: %s", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	for filename, value := range db.entries {
+		if _, err := os.Lstat(filename); os.IsNotExist(err) {
+			delete(db.entries, filename)
+			continue
+		}
+		w.WriteString(hex.EncodeToString(value) + " " + filename + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		log.Warning("Failed to compact hash database: %s", err)
+	} else if err := f.Close(); err != nil {
+		log.Warning("Failed to compact hash database: %s", err)
+	} else if err := os.Rename(tmp, db.filename); err != nil {
+		log.Warning("Failed to compact hash database: %s", err)
+	}
+}
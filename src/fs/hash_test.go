@@ -4,7 +4,9 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,6 +48,127 @@ func TestSetHash(t *testing.T) {
 	assert.EqualValues(t, b1, b2)
 }
 
+func TestHashDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "sub"), DirPermissions))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "sub/b.txt"), []byte("b"), 0644))
+	h := NewPathHasher("/wibble", false, sha1.New, "")
+	b, err := h.Hash(dir, false, false)
+	assert.NoError(t, err)
+	// The directory's hash is the hash of the hashes of each file in it.
+	a := sha1.Sum([]byte("a"))
+	bb := sha1.Sum([]byte("b"))
+	expected := sha1.Sum(append(a[:], bb[:]...))
+	assert.Equal(t, expected[:], b)
+}
+
+func TestHashMemoisesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "a.txt")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("a"), 0644))
+	h := NewPathHasher("/wibble", false, sha1.New, "")
+	b1, err := h.Hash(filename, false, false)
+	assert.NoError(t, err)
+	// Recalculating an unchanged file reuses the previous hash.
+	b2, err := h.Hash(filename, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, b1, b2)
+	assert.Equal(t, 1, len(h.files))
+	// But if it's changed it gets rehashed.
+	require.NoError(t, ioutil.WriteFile(filename, []byte("abc"), 0644))
+	b3, err := h.Hash(filename, true, false)
+	assert.NoError(t, err)
+	assert.NotEqual(t, b1, b3)
+	assert.Equal(t, 2, len(h.files))
+}
+
+func TestStoredHash(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	filename := "plz-out/gen/hash_test/stored.txt"
+	require.NoError(t, os.MkdirAll(path.Dir(filename), DirPermissions))
+	require.NoError(t, ioutil.WriteFile(filename, []byte("stored"), 0644))
+	for _, xattrs := range []bool{true, false} {
+		h := NewPathHasher(wd, xattrs, sha1.New, "_test")
+		b1, err := h.Hash(filename, false, true)
+		require.NoError(t, err)
+		// A new hasher (e.g. in the next build) should pick it up again without rehashing.
+		h = NewPathHasher(wd, xattrs, sha1.New, "_test")
+		assert.Equal(t, b1, h.readHash(filename))
+		// It shouldn't be used if the cache is disabled.
+		h.DisableCache()
+		assert.Nil(t, h.readHash(filename))
+	}
+	// Nor if the file has changed since.
+	require.NoError(t, ioutil.WriteFile(filename, []byte("changed"), 0644))
+	h := NewPathHasher(wd, false, sha1.New, "_test")
+	assert.Nil(t, h.readHash(filename))
+	b, err := h.Hash(filename, false, true)
+	assert.NoError(t, err)
+	expected := sha1.Sum([]byte("changed"))
+	assert.Equal(t, expected[:], b)
+}
+
+func TestHashDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash_db_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db := newHashDB(path.Join(dir, "hashes"))
+	assert.Nil(t, db.Get("plz-out/a.txt"))
+	db.Set("plz-out/a.txt", []byte{1, 2, 3})
+	db.Set("plz-out/b c.txt", []byte{4, 5, 6})
+	db.Set("plz-out/a.txt", []byte{7, 8, 9})
+	assert.Equal(t, []byte{7, 8, 9}, db.Get("plz-out/a.txt"))
+	// Reading it back later should give the latest values.
+	db = newHashDB(path.Join(dir, "hashes"))
+	assert.Equal(t, []byte{7, 8, 9}, db.Get("plz-out/a.txt"))
+	assert.Equal(t, []byte{4, 5, 6}, db.Get("plz-out/b c.txt"))
+}
+
+func TestHashDBCompactDropsMissingPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hash_db_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	existing := path.Join(dir, "exists.txt")
+	require.NoError(t, ioutil.WriteFile(existing, []byte("exists"), 0644))
+	missing := path.Join(dir, "missing.txt")
+	db := newHashDB(path.Join(dir, "hashes"))
+	db.Set(existing, []byte{1, 2, 3})
+	db.Set(missing, []byte{4, 5, 6})
+	db.compact()
+	db = newHashDB(path.Join(dir, "hashes"))
+	assert.Equal(t, []byte{1, 2, 3}, db.Get(existing))
+	assert.Nil(t, db.Get(missing))
+}
+
+func TestFingerprintSurvivesMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fingerprint_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	before := path.Join(dir, "tmp/out")
+	require.NoError(t, os.MkdirAll(path.Join(before, "sub"), DirPermissions))
+	require.NoError(t, ioutil.WriteFile(path.Join(before, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(before, "sub/b.txt"), []byte("b"), 0644))
+	f1, err := fileFingerprint(before)
+	require.NoError(t, err)
+	after := path.Join(dir, "gen/out")
+	require.NoError(t, os.MkdirAll(path.Dir(after), DirPermissions))
+	require.NoError(t, os.Rename(before, after))
+	f2, err := fileFingerprint(after)
+	require.NoError(t, err)
+	assert.Equal(t, f1, f2)
+	// But it should change if the contents get renamed.
+	require.NoError(t, os.Rename(path.Join(after, "a.txt"), path.Join(after, "c.txt")))
+	f3, err := fileFingerprint(after)
+	require.NoError(t, err)
+	assert.NotEqual(t, f1, f3)
+}
+
 func TestHashConstructorSHA1(t *testing.T) {
 	wd, err := os.Getwd()
 	require.NoError(t, err)
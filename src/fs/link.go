@@ -0,0 +1,164 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// A linkMethod is a way of making a file available at a second location.
+type linkMethod int
+
+const (
+	reflinkMethod linkMethod = iota
+	hardlinkMethod
+	copyMethod
+)
+
+// linkMethods maps the names of link modes to the methods they try, in order.
+var linkMethods = map[string][]linkMethod{
+	"auto":     {reflinkMethod, hardlinkMethod, copyMethod},
+	"reflink":  {reflinkMethod, copyMethod},
+	"hardlink": {hardlinkMethod, copyMethod},
+	"copy":     {copyMethod},
+}
+
+// A Linker makes files available at other locations (e.g. for the outputs of filegroups)
+// as cheaply as the filesystems involved allow.
+// Reflinks share the underlying data but are otherwise independent files, so they're preferred
+// where supported; hard links come next and copying is the last resort (for example, across
+// filesystems, where neither of the others work). Once it's found a method that works between
+// two filesystems it remembers it and uses it for everything else between them.
+type Linker struct {
+	methods []linkMethod
+	mutex   sync.Mutex
+	devices map[[2]uint64]linkMethod
+}
+
+// NewLinker returns a new Linker using the given mode, which is one of "auto", "reflink",
+// "hardlink" or "copy". All but "copy" will fall back to copying files if they need to.
+func NewLinker(mode string) *Linker {
+	methods, present := linkMethods[mode]
+	if !present {
+		methods = linkMethods["auto"]
+	}
+	return &Linker{
+		methods: methods,
+		devices: map[[2]uint64]linkMethod{},
+	}
+}
+
+// Link makes either a single file or a directory available at a new location.
+// 'mode' is the mode of the destination files where they aren't hard links.
+func (l *Linker) Link(from, to string, mode os.FileMode) error {
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return l.linkFile(from, to, info.Mode(), mode)
+	}
+	return WalkMode(from, func(name string, isDir bool, fileMode os.FileMode) error {
+		dest := path.Join(to, name[len(from):])
+		if isDir {
+			return os.MkdirAll(dest, DirPermissions)
+		}
+		return l.linkFile(name, dest, fileMode, mode)
+	})
+}
+
+// linkFile makes a single file available at a new location.
+func (l *Linker) linkFile(from, to string, fromMode, toMode os.FileMode) error {
+	if (fromMode & os.ModeSymlink) != 0 {
+		// As in CopyOrLinkFile, just recreate an equivalent symlink in the new location.
+		dest, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(dest, to)
+	}
+	key, err := deviceKey(from, to)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	method, present := l.devices[key]
+	l.mutex.Unlock()
+	if present {
+		if err := method.link(from, to, toMode); err == nil || method == copyMethod {
+			return err
+		}
+		// Might be something odd about this particular file; fall back to a copy.
+		return CopyFile(from, to, toMode)
+	}
+	remember := true
+	for _, method := range l.methods {
+		if err = method.link(from, to, toMode); err == nil {
+			if remember {
+				l.mutex.Lock()
+				l.devices[key] = method
+				l.mutex.Unlock()
+			}
+			return nil
+		}
+		log.Debug("Failed to %s %s to %s: %s", method, from, to, err)
+		// Only remember a fallback if this method can't work between these filesystems at all, not if
+		// it failed for something specific to this file (e.g. the destination already exists).
+		remember = remember && isUnsupported(err)
+	}
+	return err
+}
+
+// isUnsupported returns true if the given error indicates that a link method isn't supported
+// between two filesystems.
+func isUnsupported(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EPERM)
+}
+
+// link links a single file using this method.
+func (method linkMethod) link(from, to string, mode os.FileMode) error {
+	switch method {
+	case reflinkMethod:
+		return reflink(from, to, mode)
+	case hardlinkMethod:
+		return os.Link(from, to)
+	}
+	return CopyFile(from, to, mode)
+}
+
+// String implements the fmt.Stringer interface.
+func (method linkMethod) String() string {
+	switch method {
+	case reflinkMethod:
+		return "reflink"
+	case hardlinkMethod:
+		return "hard link"
+	}
+	return "copy"
+}
+
+// deviceKey returns a key identifying the filesystems that a file and the directory
+// it's being linked into are on.
+func deviceKey(from, to string) ([2]uint64, error) {
+	d1, err := getDevice(from)
+	if err != nil {
+		return [2]uint64{}, err
+	}
+	d2, err := getDevice(path.Dir(to))
+	return [2]uint64{d1, d2}, err
+}
+
+// getDevice returns the device that a file is on.
+func getDevice(filename string) (uint64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("Not a syscall.Stat_t")
+	}
+	return uint64(s.Dev), nil
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkHardlink(t *testing.T) {
+	dir := linkTestDir(t)
+	l := NewLinker("hardlink")
+	assert.NoError(t, l.Link(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt"), 0444))
+	assert.True(t, IsSameFile(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt")))
+}
+
+func TestLinkCopy(t *testing.T) {
+	dir := linkTestDir(t)
+	l := NewLinker("copy")
+	assert.NoError(t, l.Link(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt"), 0444))
+	assert.False(t, IsSameFile(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt")))
+	assertLinkContents(t, path.Join(dir, "a.txt"), "a")
+	info, err := os.Stat(path.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0444), info.Mode())
+}
+
+func TestLinkAuto(t *testing.T) {
+	// Whatever the filesystem supports, it should end up with the same contents.
+	dir := linkTestDir(t)
+	l := NewLinker("auto")
+	assert.NoError(t, l.Link(path.Join(dir, "src"), path.Join(dir, "out"), 0444))
+	assertLinkContents(t, path.Join(dir, "out/a.txt"), "a")
+	assertLinkContents(t, path.Join(dir, "out/sub/b.txt"), "b")
+	// It should have remembered what worked for this filesystem.
+	assert.Equal(t, 1, len(l.devices))
+}
+
+func TestLinkFallsBackToCopy(t *testing.T) {
+	dir := linkTestDir(t)
+	l := NewLinker("auto")
+	// Hard links work on this filesystem, but not if there's something in the way.
+	key, err := deviceKey(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	l.devices[key] = hardlinkMethod
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("wobble"), 0644))
+	require.NoError(t, os.Symlink("wibble", path.Join(dir, "dangling")))
+	assert.NoError(t, l.Link(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt"), 0444))
+	assertLinkContents(t, path.Join(dir, "a.txt"), "a")
+	// Symlinks are recreated as they are.
+	assert.NoError(t, l.Link(path.Join(dir, "dangling"), path.Join(dir, "dangling2"), 0444))
+	dest, err := os.Readlink(path.Join(dir, "dangling2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "wibble", dest)
+}
+
+func TestLinkDoesNotRememberPerFileFailures(t *testing.T) {
+	dir := linkTestDir(t)
+	l := NewLinker("hardlink")
+	// The hard link fails because the destination exists, which says nothing about the filesystem.
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("wobble"), 0644))
+	assert.NoError(t, l.Link(path.Join(dir, "src/a.txt"), path.Join(dir, "a.txt"), 0444))
+	assertLinkContents(t, path.Join(dir, "a.txt"), "a")
+	assert.Equal(t, 0, len(l.devices))
+	// So the next file should still be hard linked.
+	assert.NoError(t, l.Link(path.Join(dir, "src/sub/b.txt"), path.Join(dir, "b.txt"), 0444))
+	assert.True(t, IsSameFile(path.Join(dir, "src/sub/b.txt"), path.Join(dir, "b.txt")))
+	assert.Equal(t, 1, len(l.devices))
+}
+
+func linkTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "link_test")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "src/sub"), DirPermissions))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "src/a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "src/sub/b.txt"), []byte("b"), 0644))
+	return dir
+}
+
+func assertLinkContents(t *testing.T, filename, contents string) {
+	b, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(b))
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes one file share the data of another.
+// It's supported on btrfs and XFS (amongst others) but not on ext4.
+const ficlone = 0x40049409
+
+// reflink creates a copy-on-write clone of a file.
+func reflink(from, to string, mode os.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if mode == 0 {
+		mode = 0664
+	}
+	dest, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dest.Fd(), ficlone, src.Fd()); errno != 0 {
+		dest.Close()
+		os.Remove(to)
+		return errno
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(to, mode) // Don't let the umask apply, for consistency with CopyFile.
+}
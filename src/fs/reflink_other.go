@@ -0,0 +1,14 @@
+// +build !linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// reflink creates a copy-on-write clone of a file.
+// It's currently only supported on Linux.
+func reflink(from, to string, mode os.FileMode) error {
+	return &os.LinkError{Op: "reflink", Old: from, New: to, Err: syscall.EOPNOTSUPP}
+}
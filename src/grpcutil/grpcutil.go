@@ -0,0 +1,98 @@
+// Package grpcutil contains utilities for the gRPC connections that Please makes to remote
+// servers, which are shared between the various clients for them (remote execution, the RPC cache etc).
+package grpcutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var log = logging.MustGetLogger("grpcutil")
+
+// DialOptions returns the dial options for connections to remote servers, as configured
+// in the [grpc] section of the config.
+func DialOptions(config *core.Configuration) []grpc.DialOption {
+	opts := []grpc.DialOption{}
+	if params, ok := keepaliveParams(config); ok {
+		opts = append(opts, grpc.WithKeepaliveParams(params))
+	}
+	if size := int(config.Grpc.MaxMessageSize); size > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(size), grpc.MaxCallSendMsgSize(size)))
+	}
+	if sc := serviceConfig(config); sc != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(sc))
+	}
+	return opts
+}
+
+// keepaliveParams returns the keepalive parameters to use, and false if keepalives are disabled.
+func keepaliveParams(config *core.Configuration) (keepalive.ClientParameters, bool) {
+	return keepalive.ClientParameters{
+		Time:    time.Duration(config.Grpc.KeepaliveTime),
+		Timeout: time.Duration(config.Grpc.KeepaliveTimeout),
+		// The whole point is to keep connections alive while they aren't in use.
+		PermitWithoutStream: true,
+	}, config.Grpc.KeepaliveTime > 0
+}
+
+// serviceConfig returns the default service config to use, or the empty string if there isn't one.
+func serviceConfig(config *core.Configuration) string {
+	if config.Grpc.LoadBalancingPolicy == "" {
+		return ""
+	}
+	return fmt.Sprintf(`{"loadBalancingPolicy": %q}`, config.Grpc.LoadBalancingPolicy)
+}
+
+// A Pool holds connections to remote servers so they can be shared.
+// gRPC connections are multiplexed so there's little point having more than one to each server,
+// and keeping them around lets us avoid redialling when a client reconnects.
+type Pool struct {
+	mutex sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewPool creates a new, empty, connection pool.
+func NewPool() *Pool {
+	return &Pool{conns: map[string]*grpc.ClientConn{}}
+}
+
+// DefaultPool is the pool that's shared between all clients in this process.
+var DefaultPool = NewPool()
+
+// Dial returns a connection to the given URL, dialling it with the given options if there
+// isn't one already. Since connections are shared, all callers for the same URL should give
+// the same options, and they shouldn't carry any state specific to one client (e.g. interceptors
+// or stats handlers); clients that need those should dial their own connections instead.
+func (p *Pool) Dial(url string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if conn, present := p.conns[url]; present {
+		return conn, nil
+	}
+	log.Debug("Dialling %s", url)
+	conn, err := grpc.Dial(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[url] = conn
+	return conn, nil
+}
+
+// Close closes all the connections in this pool.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for url, conn := range p.conns {
+		if err := conn.Close(); err != nil {
+			log.Warning("Failed to close connection to %s: %s", url, err)
+		}
+		delete(p.conns, url)
+	}
+}
@@ -0,0 +1,84 @@
+package grpcutil
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	pb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestKeepaliveParams(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Grpc.KeepaliveTime = 0
+	_, ok := keepaliveParams(config)
+	assert.False(t, ok)
+	config.Grpc.KeepaliveTime = cli.Duration(time.Minute)
+	config.Grpc.KeepaliveTimeout = cli.Duration(20 * time.Second)
+	params, ok := keepaliveParams(config)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, params.Time)
+	assert.Equal(t, 20*time.Second, params.Timeout)
+	assert.True(t, params.PermitWithoutStream)
+}
+
+func TestServiceConfig(t *testing.T) {
+	config := core.DefaultConfiguration()
+	assert.Equal(t, "", serviceConfig(config))
+	config.Grpc.LoadBalancingPolicy = "round_robin"
+	assert.Equal(t, `{"loadBalancingPolicy": "round_robin"}`, serviceConfig(config))
+}
+
+func TestDialOptionsMaxMessageSize(t *testing.T) {
+	s, url := startServer(t)
+	defer s.Stop()
+	config := core.DefaultConfiguration()
+	assert.NoError(t, check(t, url, config))
+	// The response won't fit in a single byte, so this should fail.
+	config.Grpc.MaxMessageSize = 1
+	assert.Equal(t, codes.ResourceExhausted, status.Code(check(t, url, config)))
+}
+
+func TestPoolSharesConnections(t *testing.T) {
+	p := NewPool()
+	defer p.Close()
+	conn1, err := p.Dial("127.0.0.1:9987", grpc.WithInsecure())
+	assert.NoError(t, err)
+	conn2, err := p.Dial("127.0.0.1:9987", grpc.WithInsecure())
+	assert.NoError(t, err)
+	assert.Equal(t, conn1, conn2)
+	conn3, err := p.Dial("127.0.0.1:9988", grpc.WithInsecure())
+	assert.NoError(t, err)
+	assert.NotEqual(t, conn1, conn3)
+}
+
+// startServer starts a gRPC server with a health service on a free port and returns it and its address.
+func startServer(t *testing.T) (*grpc.Server, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	return s, lis.Addr().String()
+}
+
+// check makes a health check call to the given server using the dial options for the given config.
+func check(t *testing.T, url string, config *core.Configuration) error {
+	conn, err := grpc.Dial(url, append(DialOptions(config), grpc.WithInsecure())...)
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = pb.NewHealthClient(conn).Check(ctx, &pb.HealthCheckRequest{})
+	return err
+}
@@ -23,6 +23,8 @@ func TestRewriteHashes(t *testing.T) {
 		"test2": "bd79dd61c1494072271f3d13350ccbc26c25a09e",
 		"test3": "94ead0b0422cad925910e5f8b6f9bd93b309f8f0",
 		"test4": "ab2649b7e58f7e32b0c75be95d11e2979399d392",
+		"test5": "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed",
+		"test6": "7b502c3a1f48c8609ae212cdfb639dee39673f5e",
 	}))
 	rewritten, err := ioutil.ReadFile("test.build")
 	assert.NoError(t, err)
@@ -30,3 +32,19 @@ func TestRewriteHashes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.EqualValues(t, string(after), string(rewritten))
 }
+
+func TestNeedsHash(t *testing.T) {
+	// A macro like python_wheel that has a remote_file child but no hash of its own.
+	parent := core.NewBuildTarget(core.BuildLabel{PackageName: "third_party/python", Name: "six"})
+	child := core.NewBuildTarget(core.BuildLabel{PackageName: "third_party/python", Name: "_six#download"})
+	child.IsRemoteFile = true
+	assert.False(t, needsHash(parent))
+	assert.False(t, needsHash(child))
+	// If the macro has been given a hash, the child will have it too, and should be updated.
+	child.Hashes = []string{"b9643f8154a9e9912d730a931d329afc82a44a52"}
+	assert.True(t, needsHash(child))
+	// A remote_file declared directly in the BUILD file should get a hash added.
+	rf := core.NewBuildTarget(core.BuildLabel{PackageName: "third_party/python", Name: "six_file"})
+	rf.IsRemoteFile = true
+	assert.True(t, needsHash(rf))
+}
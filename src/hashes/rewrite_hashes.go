@@ -25,8 +25,7 @@ func RewriteHashes(state *core.BuildState, labels []core.BuildLabel) {
 	for _, l := range labels {
 		pkg := state.Graph.PackageOrDie(l)
 		for _, target := range pkg.AllChildren(state.Graph.TargetOrDie(l)) {
-			// Ignore targets with no hash specified.
-			if len(target.Hashes) == 0 {
+			if !needsHash(target) {
 				continue
 			}
 			h, err := state.TargetHasher.OutputHash(target)
@@ -50,6 +49,19 @@ func RewriteHashes(state *core.BuildState, labels []core.BuildLabel) {
 	}
 }
 
+// needsHash returns true if we should write a hash for the given target.
+// Targets with no hash specified are ignored unless they fetch things (in which case they should have one),
+// but only if they appear in the BUILD file directly; an interior remote_file (e.g. python_wheel's download
+// rule) would otherwise add a hash to its parent, which doesn't necessarily accept one.
+func needsHash(target *core.BuildTarget) bool {
+	return len(target.Hashes) > 0 || (isFetchTarget(target) && target.Label.Parent() == target.Label)
+}
+
+// isFetchTarget returns true if the given target downloads something from elsewhere (i.e. a remote_file or go_get).
+func isFetchTarget(target *core.BuildTarget) bool {
+	return target.IsRemoteFile || len(target.PrefixedLabels("go_get:")) > 0
+}
+
 // rewriteHashes rewrites hashes in a single file.
 func rewriteHashes(state *core.BuildState, filename, platform string, hashes map[string]string) error {
 	log.Notice("Rewriting hashes in %s...", filename)
@@ -76,21 +88,23 @@ func rewriteHash(lines [][]byte, stmts []*asp.Statement, platform, name, hash st
 	stmt := asp.FindTarget(stmts, name)
 	if stmt == nil {
 		return fmt.Errorf("Can't find target %s to rewrite", name)
-	} else if arg := asp.FindArgument(stmt, "hash", "hashes"); arg != nil {
-		if arg.Value.Val != nil && arg.Value.Val.List != nil {
-			for _, h := range arg.Value.Val.List.Values {
-				if line, ok := rewriteLine(lines[h.Pos.Line-1], h.Pos.Column, platform, h.Val.String, hash); ok {
-					lines[h.Pos.Line-1] = line
-					return nil
-				}
-			}
-		} else if arg.Value.Val != nil && arg.Value.Val.String != "" {
-			h := arg.Value
+	}
+	arg := asp.FindArgument(stmt, "hash", "hashes")
+	if arg == nil {
+		return addHashes(lines, stmt, hash)
+	} else if arg.Value.Val != nil && arg.Value.Val.List != nil {
+		for _, h := range arg.Value.Val.List.Values {
 			if line, ok := rewriteLine(lines[h.Pos.Line-1], h.Pos.Column, platform, h.Val.String, hash); ok {
 				lines[h.Pos.Line-1] = line
 				return nil
 			}
 		}
+	} else if arg.Value.Val != nil && arg.Value.Val.String != "" {
+		h := arg.Value
+		if line, ok := rewriteLine(lines[h.Pos.Line-1], h.Pos.Column, platform, h.Val.String, hash); ok {
+			lines[h.Pos.Line-1] = line
+			return nil
+		}
 	}
 	if platform != "" {
 		return rewriteHash(lines, stmts, "", name, hash)
@@ -98,6 +112,40 @@ func rewriteHash(lines [][]byte, stmts []*asp.Statement, platform, name, hash st
 	return fmt.Errorf("Can't find hash or hashes argument on %s", name)
 }
 
+// addHashes adds a new hashes argument to a statement that doesn't have one, after its last argument.
+// Note that any new lines are added within the existing entries in lines so that the positions of
+// any later statements remain correct.
+func addHashes(lines [][]byte, stmt *asp.Statement, hash string) error {
+	args := stmt.Ident.Action.Call.Arguments
+	if len(args) == 0 {
+		return fmt.Errorf("Can't find anywhere to add hashes to %s", stmt.Ident.Name)
+	}
+	quote := byte('"')
+	if name := asp.FindArgument(stmt, "name"); name != nil {
+		quote = lines[name.Value.Pos.Line-1][name.Value.Pos.Column-1]
+	}
+	hashes := fmt.Sprintf("hashes = [%c%s%c]", quote, hash, quote)
+	last := args[len(args)-1]
+	idx := last.Value.EndPos.Line - 1
+	line := lines[idx]
+	end := last.Value.EndPos.Column - 1
+	if last.Value.EndPos.Line == stmt.EndPos.Line {
+		// Everything's on one line, add it inline.
+		lines[idx] = bytes.Join([][]byte{line[:end], []byte(", " + hashes), line[end:]}, nil)
+		return nil
+	}
+	// Add it on a new line, following the indentation of the previous argument and whether it has a trailing comma.
+	argLine := lines[last.Pos.Line-1]
+	indent := argLine[:len(argLine)-len(bytes.TrimLeft(argLine, " \t"))]
+	if rest := bytes.TrimSpace(line[end:]); bytes.HasPrefix(rest, []byte{','}) {
+		hashes += ","
+	} else {
+		line = bytes.Join([][]byte{line[:end], []byte{','}, line[end:]}, nil)
+	}
+	lines[idx] = bytes.Join([][]byte{line, []byte{'\n'}, indent, []byte(hashes)}, nil)
+	return nil
+}
+
 // rewriteLine implements the rewriting logic within a single line.
 // It returns the new line and true if it should be replaced, or false if not.
 func rewriteLine(line []byte, start int, platform, current, new string) ([]byte, bool) {
@@ -0,0 +1,163 @@
+// Package compdb generates compilation databases (compile_commands.json) for C and C++ targets.
+// These are understood by most C/C++ tooling (e.g. clangd) and tell it how each source file
+// is compiled, so it can find headers, macros etc the same way the build does.
+package compdb
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var log = logging.MustGetLogger("compdb")
+
+// Filename is the name of the file we write, which is the name that tools look for.
+const Filename = "compile_commands.json"
+
+// A Command is a single entry in the compilation database.
+type Command struct {
+	Directory string `json:"directory"`
+	File      string `json:"file"`
+	Command   string `json:"command"`
+}
+
+// sourceExtensions are the file extensions that we consider to be compilable sources.
+var sourceExtensions = map[string]bool{
+	".c":   true,
+	".cc":  true,
+	".cpp": true,
+	".cxx": true,
+	".c++": true,
+	".C":   true,
+}
+
+// WriteFile writes the compilation database for the given targets and their dependencies to
+// compile_commands.json in the repo root.
+func WriteFile(state *core.BuildState, labels []core.BuildLabel) error {
+	f, err := os.Create(path.Join(core.RepoRoot, Filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Write(state, labels, f)
+}
+
+// Write writes the compilation database for the given targets and their dependencies.
+func Write(state *core.BuildState, labels []core.BuildLabel, w io.Writer) error {
+	commands := Commands(state, labels)
+	log.Notice("Writing %d compile commands", len(commands))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(commands)
+}
+
+// Commands returns the compile commands for the given targets and their dependencies, sorted by filename.
+func Commands(state *core.BuildState, labels []core.BuildLabel) []Command {
+	commands := []Command{}
+	done := map[*core.BuildTarget]bool{}
+	var visit func(target *core.BuildTarget)
+	visit = func(target *core.BuildTarget) {
+		if done[target] {
+			return
+		}
+		done[target] = true
+		commands = append(commands, targetCommands(state, target)...)
+		for _, dep := range target.Dependencies() {
+			visit(dep)
+		}
+	}
+	for _, label := range labels {
+		visit(state.Graph.TargetOrDie(label))
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].File < commands[j].File })
+	return commands
+}
+
+// targetCommands returns the compile commands for a single target.
+// Only targets that compile sources (i.e. that have both sources and a compiler tool) have any.
+func targetCommands(state *core.BuildState, target *core.BuildTarget) []Command {
+	srcs := target.NamedSources["srcs"]
+	tools := target.NamedTools("cc")
+	if len(srcs) == 0 || len(tools) == 0 {
+		return nil
+	}
+	compiler := toolPath(state.Graph, tools[0])
+	if compiler == "" {
+		return nil
+	}
+	cmd := target.GetCommand(state)
+	if idx := strings.Index(cmd, " && "); idx != -1 {
+		cmd = cmd[:idx] // Anything after this is archiving etc, which we don't care about.
+	}
+	// Generated headers are in plz-out/gen; the build has those in the same directory as everything else.
+	cmd += " -I " + core.GenDir + " " + strings.Join(transitiveFlags(target), " ")
+	commands := []Command{}
+	for _, src := range srcs {
+		for _, file := range src.FullPaths(state.Graph) {
+			if sourceExtensions[path.Ext(file)] {
+				c := strings.Replace(cmd, "$TOOLS_CC", compiler, 1)
+				c = strings.Replace(c, "${SRCS_SRCS}", file, 1)
+				commands = append(commands, Command{
+					Directory: core.RepoRoot,
+					File:      file,
+					Command:   strings.TrimSpace(c),
+				})
+			}
+		}
+	}
+	return commands
+}
+
+// toolPath returns the path to a tool, or an empty string if it can't be found.
+func toolPath(graph *core.BuildGraph, tool core.BuildInput) string {
+	if l, ok := tool.(core.SystemPathLabel); ok {
+		// FullPaths panics if the tool doesn't exist, but there's no reason for us to die
+		// on it; we aren't going to run it, and it might well exist wherever the IDE is.
+		if p, err := core.LookPath(l.Name, l.Path); err == nil {
+			return p
+		}
+		return l.Name
+	} else if paths := tool.FullPaths(graph); len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+// transitiveFlags returns the compiler flags that a target picks up from the labels of its dependencies.
+// This mirrors what the C++ rules do at build time, which we haven't got to yet since we only parse.
+func transitiveFlags(target *core.BuildTarget) []string {
+	labels := map[string]bool{}
+	done := map[*core.BuildTarget]bool{}
+	var visit func(t *core.BuildTarget)
+	visit = func(t *core.BuildTarget) {
+		done[t] = true
+		for _, label := range t.PrefixedLabels("cc:") {
+			labels[label] = true
+		}
+		if !t.OutputIsComplete || t == target {
+			for _, dep := range t.Dependencies() {
+				if !done[dep] {
+					visit(dep)
+				}
+			}
+		}
+	}
+	visit(target)
+	flags := []string{}
+	for label := range labels {
+		if strings.HasPrefix(label, "inc:") {
+			flags = append(flags, "-isystem "+label[4:], "-isystem "+path.Join(core.GenDir, label[4:]))
+		} else if strings.HasPrefix(label, "def:") {
+			flags = append(flags, "-D"+label[4:])
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
@@ -0,0 +1,60 @@
+package compdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestCommands(t *testing.T) {
+	state, lib := newState()
+	assert.Equal(t, []Command{
+		{
+			Directory: core.RepoRoot,
+			File:      "src/lib/lib.cc",
+			Command:   "/usr/bin/g++ -c -I . src/lib/lib.cc -O2 -I plz-out/gen -DLIB_VERSION=2 -isystem plz-out/gen/third_party/include -isystem third_party/include",
+		},
+		{
+			Directory: core.RepoRoot,
+			File:      "third_party/dep.cc",
+			Command:   "/usr/bin/g++ -c -I . third_party/dep.cc -O2 -I plz-out/gen -isystem plz-out/gen/third_party/include -isystem third_party/include",
+		},
+	}, Commands(state, []core.BuildLabel{lib.Label}))
+}
+
+func TestWrite(t *testing.T) {
+	state, lib := newState()
+	var buf bytes.Buffer
+	require.NoError(t, Write(state, []core.BuildLabel{lib.Label}, &buf))
+	commands := []Command{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &commands))
+	assert.Equal(t, 2, len(commands))
+}
+
+// newState returns a build state with a couple of cc_library-like rules in it.
+func newState() (*core.BuildState, *core.BuildTarget) {
+	state := core.NewDefaultBuildState()
+	dep := addTarget(state, "//third_party:dep", "dep.cc")
+	dep.AddLabel("cc:inc:third_party/include")
+	lib := addTarget(state, "//src/lib:lib", "lib.cc", "lib.h")
+	lib.AddLabel("cc:def:LIB_VERSION=2")
+	lib.AddDependency(dep.Label)
+	state.Graph.AddDependency(lib.Label, dep.Label)
+	return state, lib
+}
+
+func addTarget(state *core.BuildState, label string, srcs ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	for _, src := range srcs {
+		target.AddNamedSource("srcs", core.FileLabel{File: src, Package: target.Label.PackageName})
+	}
+	target.AddNamedTool("cc", core.SystemPathLabel{Name: "/usr/bin/g++"})
+	target.Command = "$TOOLS_CC -c -I . ${SRCS_SRCS} -O2 && $TOOLS_AR s $OUT"
+	state.Graph.AddTarget(target)
+	return target
+}
@@ -0,0 +1,283 @@
+// Package gopackages implements a driver for golang.org/x/tools/go/packages, which is how gopls
+// and most other Go tooling load packages. Pointing GOPACKAGESDRIVER at `plz ide gopackagesdriver`
+// makes them understand the repo from the build graph, without needing a go.mod or for the
+// repo to be laid out in a GOPATH.
+package gopackages
+
+import (
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+var log = logging.MustGetLogger("gopackages")
+
+// A DriverRequest is the request that the go/packages library sends to a driver on stdin.
+type DriverRequest struct {
+	Mode       int               `json:"mode"`
+	Env        []string          `json:"env"`
+	BuildFlags []string          `json:"build_flags"`
+	Tests      bool              `json:"tests"`
+	Overlay    map[string][]byte `json:"overlay"`
+}
+
+// A DriverResponse is the response we send back on stdout.
+type DriverResponse struct {
+	NotHandled bool
+	Sizes      *types.StdSizes
+	Roots      []string `json:",omitempty"`
+	Packages   []*Package
+}
+
+// A Package is a single Go package. It's the serialised form of go/packages' Package.
+type Package struct {
+	ID              string
+	Name            string            `json:",omitempty"`
+	PkgPath         string            `json:",omitempty"`
+	GoFiles         []string          `json:",omitempty"`
+	CompiledGoFiles []string          `json:",omitempty"`
+	OtherFiles      []string          `json:",omitempty"`
+	Imports         map[string]string `json:",omitempty"`
+}
+
+// Run runs the driver for the given patterns, reading a request from the given reader and
+// writing the response to the given writer.
+func Run(state *core.BuildState, patterns []string, r io.Reader, w io.Writer) error {
+	req := &DriverRequest{}
+	if err := json.NewDecoder(r).Decode(req); err != nil && err != io.EOF {
+		return err
+	}
+	return json.NewEncoder(w).Encode(Packages(state, patterns, req.Tests))
+}
+
+// Packages returns the driver response describing the given patterns.
+// These can be any of the patterns that `go list` accepts (e.g. import paths, ./...) or file=<filename>.
+// Packages in the repo are described from the build graph; anything they import from elsewhere
+// (i.e. the standard library and third-party code) is loaded with `go list`.
+func Packages(state *core.BuildState, patterns []string, tests bool) *DriverResponse {
+	pkgs := repoPackages(state, tests)
+	byPath := map[string]*Package{}
+	for _, pkg := range pkgs {
+		if !isInternal(pkg.ID) {
+			byPath[pkg.PkgPath] = pkg
+		}
+	}
+	roots, external := matchPatterns(pkgs, patterns)
+	for _, pkg := range pkgs {
+		for imp := range pkg.Imports {
+			if p, present := byPath[imp]; present {
+				pkg.Imports[imp] = p.ID
+			} else {
+				external = append(external, imp)
+			}
+		}
+	}
+	if len(external) > 0 {
+		ext, err := goList(state, external)
+		if err != nil {
+			log.Warning("Failed to load packages from outside the repo: %s", err)
+		}
+		for _, pkg := range ext {
+			if _, present := byPath[pkg.PkgPath]; !present {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+		for _, pattern := range patterns {
+			for _, pkg := range ext {
+				if pkg.PkgPath == pattern {
+					roots = append(roots, pkg.ID)
+				}
+			}
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].ID < pkgs[j].ID })
+	return &DriverResponse{
+		Sizes:    sizes(state.Config.Build.Arch.Arch),
+		Roots:    roots,
+		Packages: pkgs,
+	}
+}
+
+// repoPackages returns all the Go packages defined in the repo.
+// Their Imports are populated with the import paths they use, mapped to themselves; the caller
+// needs to resolve them to package IDs.
+func repoPackages(state *core.BuildState, tests bool) []*Package {
+	pkgs := []*Package{}
+	for _, target := range state.Graph.AllTargets() {
+		if !isGoPackage(state.Graph, target, tests) {
+			continue
+		}
+		files := goFiles(state.Graph, state.Graph.TargetOrDie(target.Provides["go_src"]))
+		pkg := &Package{
+			ID:              target.Label.String(),
+			PkgPath:         importPath(state, target),
+			GoFiles:         files,
+			CompiledGoFiles: files,
+			Imports:         map[string]string{},
+		}
+		if isInternal(pkg.ID) {
+			// This is the library of a test or binary, which is named after the directory it's in.
+			pkg.PkgPath = path.Join(state.Config.Go.ImportPath, target.Label.PackageName)
+			parseFiles(pkg)
+			// Tests that are in the same package as the library they test are compiled together
+			// with it, so need to include its files too.
+			for _, dep := range target.Dependencies() {
+				if dep.Label.PackageName == target.Label.PackageName && isGoPackage(state.Graph, dep, false) {
+					if libFiles := goFiles(state.Graph, state.Graph.TargetOrDie(dep.Provides["go_src"])); len(libFiles) > 0 && packageName(libFiles[0]) == pkg.Name {
+						pkg.GoFiles = append(libFiles, pkg.GoFiles...)
+						pkg.CompiledGoFiles = pkg.GoFiles
+						pkg.PkgPath = importPath(state, dep)
+					}
+				}
+			}
+			if strings.HasSuffix(pkg.Name, "_test") {
+				pkg.PkgPath += "_test"
+			}
+		}
+		parseFiles(pkg)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// isGoPackage returns true if the given target compiles a Go package that we should describe.
+// That's libraries, and the libraries that binaries (and tests, if requested) are compiled from.
+func isGoPackage(graph *core.BuildGraph, target *core.BuildTarget, tests bool) bool {
+	if target.IsFilegroup || target.Provides == nil || target.Provides["go"] != target.Label {
+		return false
+	} else if _, present := target.Provides["go_src"]; !present {
+		return false
+	} else if name := target.Label.Name; name[0] == '_' {
+		// This is an internal part of another rule; we only want the libraries of binaries & tests.
+		idx := strings.IndexByte(name, '#')
+		if idx == -1 || name[idx+1:] != "lib" {
+			return false
+		}
+		owner := graph.Target(core.BuildLabel{PackageName: target.Label.PackageName, Name: name[1:idx], Subrepo: target.Label.Subrepo})
+		if owner == nil || (owner.Provides != nil && owner.Provides["go"] == owner.Label) {
+			return false // The owner describes the package (e.g. a library with assembly)
+		}
+		return tests || !owner.IsTest
+	}
+	return true
+}
+
+// isInternal returns true if the given package ID is one of the internal libraries of a binary or test.
+func isInternal(id string) bool {
+	return strings.Contains(id, ":_")
+}
+
+// goFiles returns the Go source files of a target, as absolute paths.
+func goFiles(graph *core.BuildGraph, target *core.BuildTarget) []string {
+	files := []string{}
+	for _, src := range target.AllFullSourcePaths(graph) {
+		if strings.HasSuffix(src, ".go") {
+			files = append(files, path.Join(core.RepoRoot, src))
+		}
+	}
+	return files
+}
+
+// importPath returns the import path of a Go library.
+func importPath(state *core.BuildState, target *core.BuildTarget) string {
+	p := path.Join(state.Config.Go.ImportPath, target.Label.PackageName)
+	if outs := target.Outputs(); len(outs) == 1 && !strings.HasPrefix(outs[0], "_") {
+		// Libraries not named after their directory are linked into a subdirectory of it.
+		if libname := strings.TrimSuffix(outs[0], ".a"); libname != path.Base(target.Label.PackageName) {
+			p = path.Join(p, libname)
+		}
+	}
+	return p
+}
+
+// parseFiles reads the package name and imports of a package from its files.
+// Files that don't exist yet (e.g. because they're generated) are skipped.
+func parseFiles(pkg *Package) {
+	fset := token.NewFileSet()
+	for _, filename := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly)
+		if err != nil {
+			log.Debug("Failed to parse %s: %s", filename, err)
+			continue
+		}
+		pkg.Name = f.Name.Name
+		for _, imp := range f.Imports {
+			if p, err := strconv.Unquote(imp.Path.Value); err == nil && p != "C" {
+				pkg.Imports[p] = p
+			}
+		}
+	}
+	if pkg.Name == "" {
+		pkg.Name = path.Base(pkg.PkgPath)
+	}
+}
+
+// packageName returns the package name of a Go file, or the empty string if it can't be parsed.
+func packageName(filename string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return f.Name.Name
+}
+
+// matchPatterns returns the IDs of packages in the repo that match the given patterns, and
+// any patterns that don't match anything in it.
+func matchPatterns(pkgs []*Package, patterns []string) ([]string, []string) {
+	roots := []string{}
+	unmatched := []string{}
+	for _, pattern := range patterns {
+		matched := false
+		for _, pkg := range pkgs {
+			if matchPattern(pkg, pattern) {
+				roots = append(roots, pkg.ID)
+				matched = true
+			}
+		}
+		if !matched && !strings.HasPrefix(pattern, "file=") && !strings.HasPrefix(pattern, ".") {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	return roots, unmatched
+}
+
+// matchPattern returns true if a package matches a single pattern.
+func matchPattern(pkg *Package, pattern string) bool {
+	if strings.HasPrefix(pattern, "file=") {
+		filename := strings.TrimPrefix(pattern, "file=")
+		for _, f := range pkg.GoFiles {
+			if f == filename {
+				return true
+			}
+		}
+		return false
+	} else if pattern == "./..." || pattern == "..." {
+		return true
+	} else if strings.HasSuffix(pattern, "/...") {
+		prefix := strings.TrimSuffix(pattern, "/...")
+		return pkg.PkgPath == prefix || strings.HasPrefix(pkg.PkgPath, prefix+"/")
+	}
+	return pkg.PkgPath == pattern
+}
+
+// sizes returns the sizes of types for the given architecture.
+func sizes(arch string) *types.StdSizes {
+	s := types.SizesFor("gc", arch)
+	if s == nil {
+		s = types.SizesFor("gc", "amd64")
+	}
+	return &types.StdSizes{
+		WordSize: s.Sizeof(types.Typ[types.Int]),
+		MaxAlign: s.Alignof(types.Typ[types.Int64]),
+	}
+}
@@ -0,0 +1,204 @@
+package gopackages
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const libSrc = `package lib
+
+import "strings"
+
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+`
+
+const libTestSrc = `package lib
+
+import "testing"
+
+func TestUpper(t *testing.T) {}
+`
+
+const mainSrc = `package main
+
+import (
+	"fmt"
+
+	"github.com/example/repo/src/lib"
+)
+
+func main() {
+	fmt.Println(lib.Upper("hello"))
+}
+`
+
+func TestPackages(t *testing.T) {
+	state := newState(t)
+	resp := Packages(state, []string{"./..."}, false)
+	assert.False(t, resp.NotHandled)
+	assert.EqualValues(t, 8, resp.Sizes.WordSize)
+	assert.Equal(t, []string{"//src/cmd:_main#lib", "//src/lib:lib"}, resp.Roots)
+	pkgs := packagesByID(resp)
+	lib := pkgs["//src/lib:lib"]
+	require.NotNil(t, lib)
+	assert.Equal(t, "lib", lib.Name)
+	assert.Equal(t, "github.com/example/repo/src/lib", lib.PkgPath)
+	assert.Equal(t, []string{path.Join(core.RepoRoot, "src/lib/lib.go")}, lib.GoFiles)
+	assert.Equal(t, map[string]string{"strings": "strings"}, lib.Imports)
+	main := pkgs["//src/cmd:_main#lib"]
+	require.NotNil(t, main)
+	assert.Equal(t, "main", main.Name)
+	assert.Equal(t, "github.com/example/repo/src/cmd", main.PkgPath)
+	assert.Equal(t, map[string]string{
+		"fmt":                             "fmt",
+		"github.com/example/repo/src/lib": "//src/lib:lib",
+	}, main.Imports)
+	assert.NotContains(t, pkgs, "//src/lib:_lib_test#lib")
+}
+
+func TestPackagesWithTests(t *testing.T) {
+	state := newState(t)
+	resp := Packages(state, []string{"github.com/example/repo/src/lib"}, true)
+	assert.Equal(t, []string{"//src/lib:_lib_test#lib", "//src/lib:lib"}, resp.Roots)
+	test := packagesByID(resp)["//src/lib:_lib_test#lib"]
+	require.NotNil(t, test)
+	assert.Equal(t, "lib", test.Name)
+	assert.Equal(t, "github.com/example/repo/src/lib", test.PkgPath)
+	assert.Equal(t, []string{
+		path.Join(core.RepoRoot, "src/lib/lib.go"),
+		path.Join(core.RepoRoot, "src/lib/lib_test.go"),
+	}, test.GoFiles)
+	assert.Equal(t, map[string]string{"strings": "strings", "testing": "testing"}, test.Imports)
+}
+
+func TestPackagesFilePattern(t *testing.T) {
+	state := newState(t)
+	resp := Packages(state, []string{"file=" + path.Join(core.RepoRoot, "src/cmd/main.go")}, false)
+	assert.Equal(t, []string{"//src/cmd:_main#lib"}, resp.Roots)
+}
+
+func TestRun(t *testing.T) {
+	state := newState(t)
+	var buf bytes.Buffer
+	err := Run(state, []string{"github.com/example/repo/src/lib"}, strings.NewReader(`{"mode": 1023, "tests": false}`), &buf)
+	require.NoError(t, err)
+	resp := &DriverResponse{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), resp))
+	assert.Equal(t, []string{"//src/lib:lib"}, resp.Roots)
+}
+
+func TestParseGoList(t *testing.T) {
+	pkgs, err := parseGoList(strings.NewReader(`{
+	"Dir": "/usr/lib/go/src/strings",
+	"ImportPath": "strings",
+	"Name": "strings",
+	"GoFiles": ["builder.go", "strings.go"],
+	"Imports": ["errors", "unicode"]
+}
+{
+	"Dir": "/repo/plz-out/go/src/github.com/example/thing",
+	"ImportPath": "github.com/example/thing",
+	"Name": "thing",
+	"GoFiles": ["thing.go"],
+	"Imports": ["github.com/example/thing/vendor/github.com/example/dep"],
+	"ImportMap": {"github.com/example/dep": "github.com/example/thing/vendor/github.com/example/dep"}
+}`))
+	require.NoError(t, err)
+	assert.Equal(t, []*Package{
+		{
+			ID:              "strings",
+			Name:            "strings",
+			PkgPath:         "strings",
+			GoFiles:         []string{"/usr/lib/go/src/strings/builder.go", "/usr/lib/go/src/strings/strings.go"},
+			CompiledGoFiles: []string{"/usr/lib/go/src/strings/builder.go", "/usr/lib/go/src/strings/strings.go"},
+			Imports:         map[string]string{"errors": "errors", "unicode": "unicode"},
+		},
+		{
+			ID:              "github.com/example/thing",
+			Name:            "thing",
+			PkgPath:         "github.com/example/thing",
+			GoFiles:         []string{"/repo/plz-out/go/src/github.com/example/thing/thing.go"},
+			CompiledGoFiles: []string{"/repo/plz-out/go/src/github.com/example/thing/thing.go"},
+			Imports:         map[string]string{"github.com/example/dep": "github.com/example/thing/vendor/github.com/example/dep"},
+		},
+	}, pkgs)
+}
+
+// newState returns a build state with a small graph of Go rules in it, laid out the way the
+// build definitions do it, and their sources in a temporary repo root.
+func newState(t *testing.T) *core.BuildState {
+	dir, err := ioutil.TempDir("", "gopackages")
+	require.NoError(t, err)
+	core.RepoRoot = dir
+	writeFile(t, "src/lib/lib.go", libSrc)
+	writeFile(t, "src/lib/lib_test.go", libTestSrc)
+	writeFile(t, "src/cmd/main.go", mainSrc)
+
+	state := core.NewDefaultBuildState()
+	state.Config.Go.ImportPath = "github.com/example/repo"
+	state.Config.Go.GoTool = "/this/go/does/not/exist"
+	state.Config.Build.Arch.Arch = "amd64"
+	lib := addLibrary(state, "//src/lib:lib", "//src/lib:_lib#srcs", "lib.go")
+	lib.AddOutput("lib.a")
+	test := addLibrary(state, "//src/lib:_lib_test#lib", "//src/lib:_lib_test#srcs", "lib_test.go")
+	addDependency(state, test, lib)
+	addOwner(state, "//src/lib:lib_test", test).IsTest = true
+	main := addLibrary(state, "//src/cmd:_main#lib", "//src/cmd:_main#srcs", "main.go")
+	addDependency(state, main, lib)
+	addOwner(state, "//src/cmd:main", main).IsBinary = true
+	return state
+}
+
+// addLibrary adds a go_library-like rule and the filegroup of its sources to the graph.
+func addLibrary(state *core.BuildState, label, srcsLabel string, srcs ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	fg := core.NewBuildTarget(core.ParseBuildLabel(srcsLabel, ""))
+	fg.IsFilegroup = true
+	for _, src := range srcs {
+		fg.AddSource(core.FileLabel{File: src, Package: fg.Label.PackageName})
+	}
+	target.AddProvide("go", target.Label)
+	target.AddProvide("go_src", fg.Label)
+	state.Graph.AddTarget(fg)
+	state.Graph.AddTarget(target)
+	return target
+}
+
+// addOwner adds the binary or test that a library belongs to.
+func addOwner(state *core.BuildState, label string, lib *core.BuildTarget) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	state.Graph.AddTarget(target)
+	addDependency(state, target, lib)
+	return target
+}
+
+func addDependency(state *core.BuildState, from, to *core.BuildTarget) {
+	from.AddDependency(to.Label)
+	state.Graph.AddDependency(from.Label, to.Label)
+}
+
+func writeFile(t *testing.T, filename, contents string) {
+	filename = path.Join(core.RepoRoot, filename)
+	require.NoError(t, os.MkdirAll(path.Dir(filename), core.DirPermissions))
+	require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+}
+
+func packagesByID(resp *DriverResponse) map[string]*Package {
+	pkgs := map[string]*Package{}
+	for _, pkg := range resp.Packages {
+		pkgs[pkg.ID] = pkg
+	}
+	return pkgs
+}
@@ -0,0 +1,86 @@
+package gopackages
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A listPackage is the subset of `go list -json` output that we're interested in.
+type listPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	GoFiles    []string
+	CgoFiles   []string
+	Imports    []string
+	ImportMap  map[string]string
+}
+
+// goList loads the given packages (and everything they depend on) using `go list`.
+// Third-party packages are found in plz-out/go, which is where go_get rules put them.
+func goList(state *core.BuildState, patterns []string) ([]*Package, error) {
+	tool := state.Config.Go.GoTool
+	if tool == "" {
+		tool = "go"
+	}
+	cmd := exec.Command(tool, append([]string{"list", "-e", "-json", "-deps"}, patterns...)...)
+	cmd.Dir = core.RepoRoot
+	cmd.Env = append(os.Environ(), "GOPATH="+path.Join(core.RepoRoot, "plz-out/go"), "GO111MODULE=off")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		log.Debug("go list failed: %s", stderr.String())
+		// With -e it's still worth trying to use whatever it managed to output.
+	}
+	pkgs, err2 := parseGoList(bytes.NewReader(out))
+	if err == nil {
+		err = err2
+	}
+	return pkgs, err
+}
+
+// parseGoList parses the output of `go list -json`, which is a stream of JSON objects.
+func parseGoList(r io.Reader) ([]*Package, error) {
+	pkgs := []*Package{}
+	dec := json.NewDecoder(r)
+	for {
+		lp := &listPackage{}
+		if err := dec.Decode(lp); err == io.EOF {
+			return pkgs, nil
+		} else if err != nil {
+			return pkgs, err
+		}
+		pkg := &Package{
+			ID:      lp.ImportPath,
+			Name:    lp.Name,
+			PkgPath: lp.ImportPath,
+			Imports: map[string]string{},
+		}
+		for _, files := range [][]string{lp.GoFiles, lp.CgoFiles} {
+			for _, f := range files {
+				pkg.GoFiles = append(pkg.GoFiles, path.Join(lp.Dir, f))
+			}
+		}
+		pkg.CompiledGoFiles = pkg.GoFiles
+		// Imports is the resolved paths (e.g. after vendoring); ImportMap maps them back to what the source says.
+		sources := map[string]string{}
+		for src, resolved := range lp.ImportMap {
+			sources[resolved] = src
+		}
+		for _, imp := range lp.Imports {
+			if src, present := sources[imp]; present {
+				pkg.Imports[src] = imp
+			} else if imp != "C" {
+				pkg.Imports[imp] = imp
+			}
+		}
+		pkgs = append(pkgs, pkg)
+	}
+}
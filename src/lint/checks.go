@@ -0,0 +1,355 @@
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+func init() {
+	Register(unusedArguments{})
+	Register(deprecated{})
+	Register(labelForm{})
+	Register(duplicateDeps{})
+	Register(unsortedLists{})
+	Register(typeErrors{})
+}
+
+// typeErrors finds calls passing arguments of the wrong type, using the same type checker as the language server.
+type typeErrors struct{}
+
+func (typeErrors) Name() string { return "type-error" }
+func (typeErrors) Description() string {
+	return "Arguments to functions whose type doesn't match the one declared for them"
+}
+
+func (typeErrors) Check(file *File) []*Issue {
+	tc := asp.NewTypeChecker()
+	tc.IntsAsBools = file.IntsAsBools
+	for _, f := range file.Functions {
+		tc.AddFunction(f)
+	}
+	issues := []*Issue{}
+	for _, err := range tc.Check(file.Statements) {
+		issues = append(issues, &Issue{
+			Pos:     err.Pos,
+			EndPos:  err.EndPos,
+			Message: fmt.Sprintf("Invalid type for argument %s to %s; expected %s, was %s", err.Argument, err.Function, strings.Join(err.Expected, " or "), err.Actual),
+		})
+	}
+	return issues
+}
+
+// unusedArguments finds arguments to functions that are never used in them.
+type unusedArguments struct{}
+
+func (unusedArguments) Name() string { return "unused-argument" }
+func (unusedArguments) Description() string {
+	return "Arguments to functions that are never used in their body"
+}
+
+func (unusedArguments) Check(file *File) []*Issue {
+	issues := []*Issue{}
+	for _, stmt := range file.Statements {
+		f := stmt.FuncDef
+		if f == nil || isStub(f) {
+			continue
+		}
+		used := usedNames(f.Statements)
+		for _, arg := range f.Arguments {
+			if !used[arg.Name] && !strings.HasPrefix(arg.Name, "_") {
+				issues = append(issues, &Issue{
+					Pos:     stmt.Pos,
+					EndPos:  stmt.EndPos,
+					Message: fmt.Sprintf("Argument %s to %s is never used", arg.Name, f.Name),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+// isStub returns true if a function has no body (e.g. the declarations of native builtins).
+func isStub(f *asp.FuncDef) bool {
+	for _, stmt := range f.Statements {
+		if !stmt.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+// usedNames returns all the names that are referred to in the given statements.
+// It's conservative; anything that might be a use of a variable is included.
+func usedNames(stmts []*asp.Statement) map[string]bool {
+	used := map[string]bool{}
+	asp.WalkAST(stmts, func(ident *asp.IdentExpr) bool {
+		used[ident.Name] = true
+		return true
+	})
+	asp.WalkAST(stmts, func(ident *asp.IdentStatement) bool {
+		used[ident.Name] = true
+		return true
+	})
+	asp.WalkAST(stmts, func(f *asp.FString) bool {
+		for _, v := range f.Vars {
+			used[v.Var] = true
+		}
+		return true
+	})
+	return used
+}
+
+// deprecated finds calls to deprecated functions, or that pass deprecated arguments to them.
+// Deprecations are found from the functions' docstrings.
+type deprecated struct{}
+
+func (deprecated) Name() string { return "deprecated" }
+func (deprecated) Description() string {
+	return "Calls to deprecated rules, or passing deprecated arguments to them"
+}
+
+func (deprecated) Check(file *File) []*Issue {
+	issues := []*Issue{}
+	walkCalls(file.Statements, func(name string, pos, endPos asp.Position, call *asp.Call) {
+		f, present := file.Functions[name]
+		if !present {
+			return
+		}
+		if isDeprecated(f.Docstring) {
+			issues = append(issues, &Issue{Pos: pos, EndPos: endPos, Message: name + " is deprecated"})
+		}
+		for _, arg := range call.Arguments {
+			if arg.Name != "" && argIsDeprecated(f.Docstring, arg.Name) {
+				issues = append(issues, &Issue{
+					Pos:     arg.Pos,
+					EndPos:  arg.Value.EndPos,
+					Message: fmt.Sprintf("Argument %s to %s is deprecated", arg.Name, name),
+				})
+			}
+		}
+	})
+	return issues
+}
+
+// isDeprecated returns true if a docstring describes its function as deprecated.
+func isDeprecated(docstring string) bool {
+	return strings.HasPrefix(strings.TrimLeft(docstring, "\"' \n"), "Deprecated")
+}
+
+// argIsDeprecated returns true if a docstring describes the given argument as deprecated.
+func argIsDeprecated(docstring, arg string) bool {
+	return regexp.MustCompile(`\n\s*` + regexp.QuoteMeta(arg) + `(?: \([^)]*\))?: *Deprecated`).MatchString(docstring)
+}
+
+// labelForm finds build labels that aren't written in their canonical (i.e. shortest) form.
+type labelForm struct{}
+
+func (labelForm) Name() string { return "label-form" }
+func (labelForm) Description() string {
+	return "Build labels that aren't in their shortest form, e.g. //src/core:core instead of //src/core"
+}
+
+func (labelForm) Check(file *File) []*Issue {
+	issues := []*Issue{}
+	if !file.IsBuildFile {
+		return issues // We don't know what package labels in build_defs files are relative to.
+	}
+	context := core.BuildLabel{PackageName: file.Package}
+	walkCalls(file.Statements, func(name string, pos, endPos asp.Position, call *asp.Call) {
+		for _, arg := range call.Arguments {
+			for _, expr := range stringExprs(&arg.Value) {
+				s := stringLiteral(expr)
+				label, ok := parseLabel(s, file.Package)
+				if !ok || label.IsAllSubpackages() || label.IsAllTargets() {
+					continue
+				} else if short := label.ShortString(context); short != s {
+					issues = append(issues, &Issue{
+						Pos:     expr.Pos,
+						EndPos:  expr.EndPos,
+						Message: fmt.Sprintf("%s can be written as %s", s, short),
+					})
+				}
+			}
+		}
+	})
+	return issues
+}
+
+// duplicateDeps finds duplicate entries in lists passed to functions (e.g. deps or srcs).
+type duplicateDeps struct{}
+
+func (duplicateDeps) Name() string { return "duplicate-deps" }
+func (duplicateDeps) Description() string {
+	return "Duplicate entries in lists of dependencies, sources etc"
+}
+
+func (duplicateDeps) Check(file *File) []*Issue {
+	issues := []*Issue{}
+	walkCalls(file.Statements, func(name string, pos, endPos asp.Position, call *asp.Call) {
+		for _, arg := range call.Arguments {
+			seen := map[string]bool{}
+			for _, expr := range listStrings(&arg.Value) {
+				s := stringLiteral(expr)
+				key := s
+				if label, ok := parseLabel(s, file.Package); ok {
+					key = label.String()
+				}
+				if seen[key] {
+					issues = append(issues, &Issue{
+						Pos:     expr.Pos,
+						EndPos:  expr.EndPos,
+						Message: fmt.Sprintf("%s appears more than once in %s", s, arg.Name),
+					})
+				}
+				seen[key] = true
+			}
+		}
+	})
+	return issues
+}
+
+// unsortedLists finds lists of dependencies, sources etc that aren't sorted.
+// They're sorted in the same order that plz fmt puts them in.
+type unsortedLists struct{}
+
+// sortedArgs are the names of the arguments that we expect to be sorted.
+var sortedArgs = map[string]bool{
+	"deps":          true,
+	"exported_deps": true,
+	"srcs":          true,
+	"hdrs":          true,
+	"data":          true,
+	"visibility":    true,
+}
+
+func (unsortedLists) Name() string { return "unsorted-lists" }
+func (unsortedLists) Description() string {
+	return "Lists of dependencies, sources etc that aren't sorted (plz fmt will sort them)"
+}
+
+func (unsortedLists) Check(file *File) []*Issue {
+	issues := []*Issue{}
+	if !file.IsBuildFile {
+		return issues
+	}
+	walkCalls(file.Statements, func(name string, pos, endPos asp.Position, call *asp.Call) {
+		for _, arg := range call.Arguments {
+			if !sortedArgs[arg.Name] {
+				continue
+			}
+			exprs := listStrings(&arg.Value)
+			if len(exprs) == 0 || len(exprs) != len(arg.Value.Val.List.Values) {
+				continue // Only lists made up entirely of strings can be sorted.
+			}
+			for i := 1; i < len(exprs); i++ {
+				if lessForSort(stringLiteral(exprs[i]), stringLiteral(exprs[i-1])) {
+					issues = append(issues, &Issue{
+						Pos:     arg.Value.Pos,
+						EndPos:  arg.Value.EndPos,
+						Message: fmt.Sprintf("%s of %s aren't sorted", arg.Name, name),
+					})
+					break
+				}
+			}
+		}
+	})
+	return issues
+}
+
+// lessForSort returns true if a should be sorted before b. This mirrors how buildtools (and
+// hence plz fmt) sorts lists; local labels come first, then absolute ones, then everything else.
+func lessForSort(a, b string) bool {
+	pa, pb := sortPhase(a), sortPhase(b)
+	if pa != pb {
+		return pa < pb
+	}
+	sa := strings.Split(strings.Replace(a, ":", ".", -1), ".")
+	sb := strings.Split(strings.Replace(b, ":", ".", -1), ".")
+	for i := 0; i < len(sa) && i < len(sb); i++ {
+		if sa[i] != sb[i] {
+			return sa[i] < sb[i]
+		}
+	}
+	if len(sa) != len(sb) {
+		return len(sa) < len(sb)
+	}
+	return a < b
+}
+
+// sortPhase returns which group a string is sorted into.
+func sortPhase(s string) int {
+	if strings.HasPrefix(s, ":") {
+		return 1
+	} else if strings.HasPrefix(s, "//") {
+		return 2
+	} else if strings.HasPrefix(s, "@") {
+		return 3
+	}
+	return 0
+}
+
+// walkCalls calls the given function for every function call in the given statements.
+func walkCalls(stmts []*asp.Statement, f func(name string, pos, endPos asp.Position, call *asp.Call)) {
+	for _, stmt := range stmts {
+		asp.WalkAST([]*asp.Statement{stmt}, func(ident *asp.IdentStatement) bool {
+			if ident.Action != nil && ident.Action.Call != nil {
+				f(ident.Name, stmt.Pos, stmt.EndPos, ident.Action.Call)
+			}
+			return true
+		})
+		asp.WalkAST([]*asp.Statement{stmt}, func(ident *asp.IdentExpr) bool {
+			if len(ident.Action) > 0 && ident.Action[0].Call != nil {
+				f(ident.Name, ident.Pos, ident.EndPos, ident.Action[0].Call)
+			}
+			return true
+		})
+	}
+}
+
+// listStrings returns the string literals in an expression, if it's a list literal.
+func listStrings(expr *asp.Expression) []*asp.Expression {
+	if expr.Val == nil || expr.Val.List == nil || expr.Val.List.Comprehension != nil {
+		return nil
+	}
+	ret := []*asp.Expression{}
+	for _, v := range expr.Val.List.Values {
+		if isStringLiteral(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// stringExprs returns the string literals in an expression, which can be either a single string
+// or a list of them.
+func stringExprs(expr *asp.Expression) []*asp.Expression {
+	if isStringLiteral(expr) {
+		return []*asp.Expression{expr}
+	}
+	return listStrings(expr)
+}
+
+// isStringLiteral returns true if the given expression is just a plain string.
+func isStringLiteral(expr *asp.Expression) bool {
+	return expr.Val != nil && expr.Val.String != "" && expr.UnaryOp == nil && len(expr.Op) == 0 && expr.If == nil &&
+		len(expr.Val.Slices) == 0 && expr.Val.Property == nil && expr.Val.Call == nil
+}
+
+// stringLiteral returns the value of a string literal expression, without its quotes.
+func stringLiteral(expr *asp.Expression) string {
+	s := expr.Val.String
+	return s[1 : len(s)-1]
+}
+
+// parseLabel parses a string as a build label, if it looks like one.
+func parseLabel(s, pkg string) (core.BuildLabel, bool) {
+	if !strings.HasPrefix(s, ":") && !strings.HasPrefix(s, "//") || strings.HasPrefix(s, "///") || strings.ContainsAny(s, "|$") {
+		return core.BuildLabel{}, false
+	}
+	label, err := core.TryParseBuildLabel(s, pkg, "")
+	return label, err == nil && label.Subrepo == ""
+}
@@ -0,0 +1,181 @@
+// Package lint implements checks for common problems in BUILD files, for plz lint.
+//
+// Checks work on the asp AST, so files are only parsed, never interpreted. Each one is
+// registered under a name which can be used to enable or disable it in the [lint] section
+// of the config.
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/parse/asp"
+	"github.com/thought-machine/please/src/utils"
+)
+
+var log = logging.MustGetLogger("lint")
+
+// An Issue is a single problem found by a check.
+type Issue struct {
+	Check   string
+	Pos     asp.Position
+	EndPos  asp.Position
+	Message string
+}
+
+// String implements the fmt.Stringer interface.
+func (issue *Issue) String() string {
+	return fmt.Sprintf("%s: %s [%s]", issue.Pos, issue.Message, issue.Check)
+}
+
+// A Check is a single lint check.
+type Check interface {
+	// Name returns the name of this check, which is how it's referred to in the config.
+	Name() string
+	// Description returns a short description of what the check finds.
+	Description() string
+	// Check checks a single file and returns any issues it finds.
+	Check(file *File) []*Issue
+}
+
+// A File is a single file being linted.
+type File struct {
+	Filename   string
+	Package    string
+	Statements []*asp.Statement
+	// IsBuildFile is true if this is a BUILD file (as opposed to a build_defs file).
+	IsBuildFile bool
+	// Functions are the definitions of the builtin & preloaded functions that it can call.
+	Functions map[string]*asp.FuncDef
+	// IntsAsBools is true if integers can be passed for boolean arguments (i.e. Bazel compatibility is on).
+	IntsAsBools bool
+}
+
+var checks = map[string]Check{}
+
+// Register registers a new check. It panics if there's already one with the same name.
+func Register(check Check) {
+	if _, present := checks[check.Name()]; present {
+		panic("duplicate lint check: " + check.Name())
+	}
+	checks[check.Name()] = check
+}
+
+// Checks returns all the registered checks, sorted by name.
+func Checks() []Check {
+	ret := make([]Check, 0, len(checks))
+	for _, check := range checks {
+		ret = append(ret, check)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret
+}
+
+// EnabledChecks returns the checks that are enabled by the given config.
+func EnabledChecks(config *core.Configuration) ([]Check, error) {
+	for _, name := range append(config.Lint.Enable, config.Lint.Disable...) {
+		if _, present := checks[name]; !present {
+			return nil, fmt.Errorf("unknown lint check %s", name)
+		}
+	}
+	ret := []Check{}
+	for _, check := range Checks() {
+		if len(config.Lint.Enable) > 0 && !contains(config.Lint.Enable, check.Name()) {
+			continue
+		} else if contains(config.Lint.Disable, check.Name()) {
+			continue
+		}
+		ret = append(ret, check)
+	}
+	return ret, nil
+}
+
+// Lint runs all the enabled checks on the given files and returns any issues found.
+// If no files are given, all the BUILD files in the repo are linted.
+func Lint(state *core.BuildState, filenames []string) ([]*Issue, error) {
+	enabled, err := EnabledChecks(state.Config)
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		filenames = allBuildFiles(state.Config)
+	}
+	functions := map[string]*asp.FuncDef{}
+	for name, stmt := range help.AllBuiltinFunctions(state) {
+		functions[name] = stmt.FuncDef
+	}
+	p := asp.NewParser(nil)
+	issues := []*Issue{}
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		stmts, err := p.ParseData(data, filename)
+		if err != nil {
+			return nil, err
+		}
+		file := &File{
+			Filename:    filename,
+			Package:     path.Dir(filename),
+			Statements:  stmts,
+			IsBuildFile: state.Config.IsABuildFile(path.Base(filename)),
+			Functions:   functions,
+			IntsAsBools: state.Config.Bazel.Compatibility,
+		}
+		if file.Package == "." {
+			file.Package = ""
+		}
+		issues = append(issues, CheckFile(enabled, file)...)
+	}
+	log.Debug("Found %d issues in %d files", len(issues), len(filenames))
+	return issues, nil
+}
+
+// CheckFile runs the given checks on a single file, returning the issues they find in the
+// order they occur in it.
+func CheckFile(checks []Check, file *File) []*Issue {
+	issues := []*Issue{}
+	for _, check := range checks {
+		for _, issue := range check.Check(file) {
+			issue.Check = check.Name()
+			issues = append(issues, issue)
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Pos.Line != issues[j].Pos.Line {
+			return issues[i].Pos.Line < issues[j].Pos.Line
+		}
+		return issues[i].Pos.Column < issues[j].Pos.Column
+	})
+	return issues
+}
+
+// allBuildFiles returns the names of all the BUILD files in the repo.
+func allBuildFiles(config *core.Configuration) []string {
+	filenames := []string{}
+	for pkg := range utils.FindAllSubpackages(config, "", "") {
+		for _, name := range config.Parse.BuildFileName {
+			if filename := path.Join(pkg, name); fs.FileExists(filename) {
+				filenames = append(filenames, filename)
+			}
+		}
+	}
+	return filenames
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+const buildDefs = `
+def my_rule(name:str, srcs:list=[], deps:list=[], old:bool=False, _private:str=None):
+    """Builds a thing.
+
+    Args:
+      name (str): Name of the rule.
+      srcs (list): Sources.
+      deps (list): Dependencies.
+      old (bool): Deprecated, has no effect.
+    """
+    return genrule(
+        name = name,
+        srcs = srcs,
+        cmd = f"cp $SRCS $OUT && echo {name}",
+    )
+
+def old_rule(name:str):
+    """Deprecated, use my_rule instead."""
+    return my_rule(name = name)
+`
+
+const buildFile = `
+my_rule(
+    name = "a",
+    srcs = ["b.txt", "a.txt"],
+    deps = [
+        ":c",
+        "//src/lint:c",
+        "//src/lint:lint",
+    ],
+    old = True,
+)
+
+old_rule(
+    name = "c",
+)
+
+my_rule(
+    name = "d",
+    srcs = ["a.txt"],
+    deps = [
+        ":a",
+        "//src/core",
+        "//src/core:core",
+    ],
+)
+`
+
+func TestUnusedArguments(t *testing.T) {
+	issues := CheckFile([]Check{unusedArguments{}}, parseFile(t, "build_defs/my_rule.build_defs", buildDefs))
+	require.Equal(t, 2, len(issues))
+	assert.Equal(t, "Argument deps to my_rule is never used", issues[0].Message)
+	assert.Equal(t, "unused-argument", issues[0].Check)
+	assert.Equal(t, 2, issues[0].Pos.Line)
+	assert.Equal(t, "Argument old to my_rule is never used", issues[1].Message)
+}
+
+func TestDeprecated(t *testing.T) {
+	issues := CheckFile([]Check{deprecated{}}, parseFile(t, "src/lint/BUILD", buildFile))
+	require.Equal(t, 2, len(issues))
+	assert.Equal(t, "Argument old to my_rule is deprecated", issues[0].Message)
+	assert.Equal(t, 10, issues[0].Pos.Line)
+	assert.Equal(t, "old_rule is deprecated", issues[1].Message)
+	assert.Equal(t, 13, issues[1].Pos.Line)
+}
+
+func TestLabelForm(t *testing.T) {
+	issues := CheckFile([]Check{labelForm{}}, parseFile(t, "src/lint/BUILD", buildFile))
+	require.Equal(t, 3, len(issues))
+	assert.Equal(t, "//src/lint:c can be written as :c", issues[0].Message)
+	assert.Equal(t, 7, issues[0].Pos.Line)
+	assert.Equal(t, "//src/lint:lint can be written as :lint", issues[1].Message)
+	assert.Equal(t, "//src/core:core can be written as //src/core", issues[2].Message)
+	assert.Equal(t, 23, issues[2].Pos.Line)
+}
+
+func TestDuplicateDeps(t *testing.T) {
+	issues := CheckFile([]Check{duplicateDeps{}}, parseFile(t, "src/lint/BUILD", buildFile))
+	require.Equal(t, 2, len(issues))
+	assert.Equal(t, "//src/lint:c appears more than once in deps", issues[0].Message)
+	assert.Equal(t, 7, issues[0].Pos.Line)
+	assert.Equal(t, "//src/core:core appears more than once in deps", issues[1].Message)
+	assert.Equal(t, 23, issues[1].Pos.Line)
+}
+
+func TestUnsortedLists(t *testing.T) {
+	issues := CheckFile([]Check{unsortedLists{}}, parseFile(t, "src/lint/BUILD", buildFile))
+	require.Equal(t, 1, len(issues))
+	assert.Equal(t, "srcs of my_rule aren't sorted", issues[0].Message)
+	assert.Equal(t, 4, issues[0].Pos.Line)
+}
+
+func TestUnsortedListsOnlyInBuildFiles(t *testing.T) {
+	file := parseFile(t, "src/lint/BUILD", buildFile)
+	file.IsBuildFile = false
+	assert.Equal(t, 0, len(CheckFile([]Check{unsortedLists{}}, file)))
+}
+
+func TestTypeErrors(t *testing.T) {
+	file := parseFile(t, "src/lint/BUILD", `
+my_rule(
+    name = "a",
+    srcs = "a.txt",
+)
+
+my_rule(
+    name = "b",
+    old = 1,
+)
+`)
+	issues := CheckFile([]Check{typeErrors{}}, file)
+	require.Equal(t, 2, len(issues))
+	assert.Equal(t, "Invalid type for argument srcs to my_rule; expected list, was str", issues[0].Message)
+	assert.Equal(t, "type-error", issues[0].Check)
+	assert.Equal(t, 4, issues[0].Pos.Line)
+	assert.Equal(t, "Invalid type for argument old to my_rule; expected bool, was int", issues[1].Message)
+	assert.Equal(t, 9, issues[1].Pos.Line)
+
+	file.IntsAsBools = true
+	issues = CheckFile([]Check{typeErrors{}}, file)
+	require.Equal(t, 1, len(issues))
+	assert.Equal(t, 4, issues[0].Pos.Line)
+}
+
+func TestLessForSort(t *testing.T) {
+	assert.True(t, lessForSort("a.txt", ":a"))
+	assert.True(t, lessForSort(":b", "//a"))
+	assert.True(t, lessForSort("//src/core", "//src/core:core"))
+	assert.True(t, lessForSort("//src/core:a", "//src/fs"))
+	assert.False(t, lessForSort("b.txt", "a.txt"))
+}
+
+func TestEnabledChecks(t *testing.T) {
+	config := core.DefaultConfiguration()
+	checks, err := EnabledChecks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deprecated", "duplicate-deps", "label-form", "type-error", "unsorted-lists", "unused-argument"}, checkNames(checks))
+
+	config.Lint.Disable = []string{"unsorted-lists"}
+	checks, err = EnabledChecks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deprecated", "duplicate-deps", "label-form", "type-error", "unused-argument"}, checkNames(checks))
+
+	config.Lint.Enable = []string{"label-form", "unsorted-lists"}
+	checks, err = EnabledChecks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"label-form"}, checkNames(checks))
+
+	config.Lint.Enable = []string{"wibble"}
+	_, err = EnabledChecks(config)
+	assert.Error(t, err)
+}
+
+func TestWriteSARIF(t *testing.T) {
+	checks := []Check{unsortedLists{}}
+	issues := CheckFile(checks, parseFile(t, "src/lint/BUILD", buildFile))
+	var buf bytes.Buffer
+	require.NoError(t, WriteSARIF(&buf, checks, issues))
+	log := sarifLog{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Equal(t, 1, len(log.Runs))
+	run := log.Runs[0]
+	assert.Equal(t, []sarifRule{{ID: "unsorted-lists", ShortDescription: sarifMessage{Text: unsortedLists{}.Description()}}}, run.Tool.Driver.Rules)
+	require.Equal(t, 1, len(run.Results))
+	assert.Equal(t, "unsorted-lists", run.Results[0].RuleID)
+	assert.Equal(t, "src/lint/BUILD", run.Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, 4, run.Results[0].Locations[0].PhysicalLocation.Region.StartLine)
+}
+
+// parseFile parses some BUILD file contents, with the functions in buildDefs available to call.
+func parseFile(t *testing.T, filename, contents string) *File {
+	p := asp.NewParser(nil)
+	defs, err := p.ParseData([]byte(buildDefs), "my_rule.build_defs")
+	require.NoError(t, err)
+	functions := map[string]*asp.FuncDef{}
+	for _, stmt := range defs {
+		functions[stmt.FuncDef.Name] = stmt.FuncDef
+	}
+	stmts, err := p.ParseData([]byte(contents), filename)
+	require.NoError(t, err)
+	return &File{
+		Filename:    filename,
+		Package:     "src/lint",
+		Statements:  stmts,
+		IsBuildFile: filename == "src/lint/BUILD",
+		Functions:   functions,
+	}
+}
+
+func checkNames(checks []Check) []string {
+	names := make([]string, len(checks))
+	for i, check := range checks {
+		names[i] = check.Name()
+	}
+	return names
+}
@@ -0,0 +1,107 @@
+package lint
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// These types are the subset of SARIF (https://sarifweb.azurewebsites.net) that we need to
+// report issues in a way that CI systems can annotate them onto the files they apply to.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// WriteSARIF writes the given issues to a writer as a SARIF log.
+// The checks are those that were run, which are described in it as its rules.
+func WriteSARIF(w io.Writer, checks []Check, issues []*Issue) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "please",
+			InformationURI: "https://please.build",
+			Rules:          make([]sarifRule, len(checks)),
+		}},
+		Results: make([]sarifResult, len(issues)),
+	}
+	for i, check := range checks {
+		run.Tool.Driver.Rules[i] = sarifRule{ID: check.Name(), ShortDescription: sarifMessage{Text: check.Description()}}
+	}
+	for i, issue := range issues {
+		run.Results[i] = sarifResult{
+			RuleID:  issue.Check,
+			Level:   "warning",
+			Message: sarifMessage{Text: issue.Message},
+			Locations: []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: issue.Pos.Filename},
+					Region: sarifRegion{
+						StartLine:   issue.Pos.Line,
+						StartColumn: issue.Pos.Column,
+						EndLine:     issue.EndPos.Line,
+						EndColumn:   issue.EndPos.Column,
+					},
+				},
+			}},
+		}
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
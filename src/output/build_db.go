@@ -0,0 +1,200 @@
+// Export of per-target build metadata into a SQLite database, so it can be analysed offline
+// with standard tooling. Each build is added to the database so trends can be seen over time.
+//
+// The database is written via the sqlite3 command-line tool rather than a driver linked into
+// plz itself, since that would need cgo.
+
+package output
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// buildDBSchema is the schema of the database. It's applied on every build so must be idempotent.
+const buildDBSchema = `
+CREATE TABLE IF NOT EXISTS builds (
+    id INTEGER PRIMARY KEY,
+    start_time TIMESTAMP NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    version TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS builds_start_time ON builds (start_time);
+CREATE TABLE IF NOT EXISTS targets (
+    build_id INTEGER NOT NULL REFERENCES builds(id),
+    label TEXT NOT NULL,
+    package TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL,
+    cached BOOLEAN NOT NULL,
+    test BOOLEAN NOT NULL,
+    hash TEXT NOT NULL,
+    build_duration_ms INTEGER NOT NULL,
+    test_duration_ms INTEGER NOT NULL,
+    num_sources INTEGER NOT NULL,
+    num_deps INTEGER NOT NULL,
+    num_outputs INTEGER NOT NULL,
+    PRIMARY KEY (build_id, label)
+);
+CREATE INDEX IF NOT EXISTS targets_label ON targets (label);
+CREATE INDEX IF NOT EXISTS targets_package ON targets (package);
+CREATE INDEX IF NOT EXISTS targets_kind ON targets (kind);
+`
+
+// buildDBTool is the command-line tool used to write the database.
+const buildDBTool = "sqlite3"
+
+// A buildDB records metadata about each target built, and writes it out at the end of the build.
+type buildDB struct {
+	filename string
+	targets  map[core.BuildLabel]*buildDBTarget
+}
+
+// A buildDBTarget is the information we track about a target as the build goes on.
+type buildDBTarget struct {
+	BuildStart, BuildEnd time.Time
+	TestStart, TestEnd   time.Time
+}
+
+// newBuildDB returns a new buildDB that will write to the given file.
+// The filename may be empty in which case it will silently discard all information given.
+func newBuildDB(filename string) *buildDB {
+	return &buildDB{
+		filename: filename,
+		targets:  map[core.BuildLabel]*buildDBTarget{},
+	}
+}
+
+// AddResult records a single build result.
+func (db *buildDB) AddResult(result *core.BuildResult) {
+	if db.filename == "" {
+		return
+	}
+	switch result.Status {
+	case core.PackageParsing, core.PackageParsed, core.ParseFailed:
+		return
+	}
+	t, present := db.targets[result.Label]
+	if !present {
+		t = &buildDBTarget{}
+		db.targets[result.Label] = t
+	}
+	switch result.Status {
+	case core.TargetBuilding:
+		if t.BuildStart.IsZero() {
+			t.BuildStart = result.Time
+		}
+	case core.TargetBuilt, core.TargetCached, core.TargetBuildFailed, core.TargetBuildStopped:
+		t.BuildEnd = result.Time
+	case core.TargetTesting:
+		if t.TestStart.IsZero() {
+			t.TestStart = result.Time
+		}
+	case core.TargetTested, core.TargetTestFailed, core.TargetTestStopped:
+		t.TestEnd = result.Time
+	}
+}
+
+// Close writes out everything that's been recorded into the database.
+func (db *buildDB) Close(state *core.BuildState) error {
+	if db.filename == "" {
+		return nil
+	}
+	tool, err := exec.LookPath(buildDBTool)
+	if err != nil {
+		return fmt.Errorf("--build_db requires %s to be installed: %s", buildDBTool, err)
+	}
+	var script bytes.Buffer
+	db.write(&script, state)
+	cmd := exec.Command(tool, "-bail", db.filename)
+	cmd.Stdin = &script
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to write build database: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// write writes a SQL script that records the build and its targets in a single transaction.
+// Rows are upserted so that writing the same build again updates it rather than failing.
+func (db *buildDB) write(w io.Writer, state *core.BuildState) {
+	labels := make(core.BuildLabels, 0, len(db.targets))
+	for label := range db.targets {
+		labels = append(labels, label)
+	}
+	sort.Sort(labels)
+	id := state.StartTime.UnixNano()
+	fmt.Fprintf(w, "BEGIN;\n%s", buildDBSchema)
+	fmt.Fprintf(w, "INSERT INTO builds VALUES (%d, %s, %d, %s)\n"+
+		"  ON CONFLICT (id) DO UPDATE SET duration_ms = excluded.duration_ms, version = excluded.version;\n",
+		id, sqlString(state.StartTime.UTC().Format(time.RFC3339Nano)), time.Since(state.StartTime).Milliseconds(), sqlString(core.PleaseVersion.String()))
+	for _, label := range labels {
+		target := state.Graph.Target(label)
+		if target == nil {
+			continue
+		}
+		t := db.targets[label]
+		targetState := target.State()
+		fmt.Fprintf(w, "INSERT INTO targets VALUES (%d, %s, %s, %s, %s, %d, %d, %s, %d, %d, %d, %d, %d)\n"+
+			"  ON CONFLICT (build_id, label) DO UPDATE SET kind = excluded.kind, status = excluded.status, "+
+			"cached = excluded.cached, test = excluded.test, hash = excluded.hash, "+
+			"build_duration_ms = excluded.build_duration_ms, test_duration_ms = excluded.test_duration_ms, "+
+			"num_sources = excluded.num_sources, num_deps = excluded.num_deps, num_outputs = excluded.num_outputs;\n",
+			id,
+			sqlString(label.String()),
+			sqlString(label.PackageName),
+			sqlString(target.Kind),
+			sqlString(targetState.String()),
+			sqlBool(targetState == core.Cached),
+			sqlBool(!t.TestStart.IsZero()),
+			sqlString(db.hash(state, target)),
+			spanDuration(t.BuildStart, t.BuildEnd).Milliseconds(),
+			spanDuration(t.TestStart, t.TestEnd).Milliseconds(),
+			len(target.AllSources()),
+			len(target.Dependencies()),
+			len(target.Outputs()),
+		)
+	}
+	io.WriteString(w, "COMMIT;\n")
+}
+
+// sqlString quotes a string as a SQL literal.
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// sqlBool converts a bool to a SQL literal.
+func sqlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// hash returns the output hash of a target, or the empty string if it doesn't have one.
+func (db *buildDB) hash(state *core.BuildState, target *core.BuildTarget) string {
+	if state.TargetHasher == nil || target.State() < core.Built || target.State() == core.Failed {
+		return ""
+	}
+	h, err := state.TargetHasher.OutputHash(target)
+	if err != nil {
+		log.Warning("Failed to calculate hash of %s: %s", target, err)
+		return ""
+	}
+	return hex.EncodeToString(h)
+}
+
+// spanDuration returns the time between two points, or zero if either isn't set.
+func spanDuration(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
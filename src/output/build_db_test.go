@@ -0,0 +1,82 @@
+package output
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestBuildDB(t *testing.T) {
+	if _, err := exec.LookPath(buildDBTool); err != nil {
+		t.Skipf("%s not available", buildDBTool)
+	}
+	dir, err := ioutil.TempDir("", "build_db")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "build.db")
+
+	state := core.NewDefaultBuildState()
+	lib := core.NewBuildTarget(core.ParseBuildLabel("//src/output:lib", ""))
+	lib.Kind = "go_library"
+	lib.AddSource(core.FileLabel{File: "lib.go", Package: "src/output"})
+	lib.SetState(core.Built)
+	state.Graph.AddTarget(lib)
+	test := core.NewBuildTarget(core.ParseBuildLabel("//src/output:test", ""))
+	test.Kind = "go_test"
+	test.IsTest = true
+	test.SetState(core.Cached)
+	state.Graph.AddTarget(test)
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	// Write three times; the first two are separate builds which should accumulate and the
+	// third repeats the second which should update it in place.
+	for i := 0; i < 3; i++ {
+		if i < 2 {
+			state.StartTime = start.Add(time.Duration(i) * time.Second)
+		}
+		db := newBuildDB(filename)
+		db.AddResult(&core.BuildResult{Time: at(0), Label: lib.Label, Status: core.TargetBuilding, Description: "Checking cache..."})
+		db.AddResult(&core.BuildResult{Time: at(10), Label: lib.Label, Status: core.TargetBuilding, Description: "Building..."})
+		db.AddResult(&core.BuildResult{Time: at(50), Label: lib.Label, Status: core.TargetBuilt, Description: "Built"})
+		db.AddResult(&core.BuildResult{Time: at(50), Label: test.Label, Status: core.TargetBuilding, Description: "Checking cache..."})
+		db.AddResult(&core.BuildResult{Time: at(60), Label: test.Label, Status: core.TargetCached, Description: "Cached"})
+		db.AddResult(&core.BuildResult{Time: at(60), Label: test.Label, Status: core.TargetTesting, Description: "Testing..."})
+		db.AddResult(&core.BuildResult{Time: at(160), Label: test.Label, Status: core.TargetTested, Description: "Tested"})
+		require.NoError(t, db.Close(state))
+	}
+
+	assert.Equal(t, [][]string{{"2"}}, query(t, filename, "SELECT COUNT(*) FROM builds"))
+	assert.Equal(t, [][]string{{"4"}}, query(t, filename, "SELECT COUNT(*) FROM targets"))
+	rows := query(t, filename, fmt.Sprintf("SELECT label, package, kind, status, cached, test, build_duration_ms, test_duration_ms, num_sources FROM targets WHERE build_id = %d ORDER BY label", state.StartTime.UnixNano()))
+	assert.Equal(t, [][]string{
+		{"//src/output:lib", "src/output", "go_library", "Built", "0", "0", "50", "0", "1"},
+		{"//src/output:test", "src/output", "go_test", "Cached", "1", "1", "10", "100", "0"},
+	}, rows)
+}
+
+func TestSQLString(t *testing.T) {
+	assert.Equal(t, "'//src/output:lib'", sqlString("//src/output:lib"))
+	assert.Equal(t, "'it''s'", sqlString("it's"))
+}
+
+// query runs a query against the given database and returns the result rows.
+func query(t *testing.T, filename, sql string) [][]string {
+	out, err := exec.Command(buildDBTool, "-separator", "|", filename, sql).Output()
+	require.NoError(t, err)
+	rows := [][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		rows = append(rows, strings.Split(line, "|"))
+	}
+	return rows
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A cacheStatsTracker records how often targets of each kind of rule came from the cache, so we can
+// show which kinds are defeating caching most often.
+type cacheStatsTracker struct {
+	graph *core.BuildGraph
+	kinds map[string]*cacheStats
+}
+
+// cacheStats are the cache statistics for a single kind of rule.
+type cacheStats struct {
+	Kind                 string
+	Builds, CachedBuilds int
+	Tests, CachedTests   int
+}
+
+func newCacheStatsTracker(state *core.BuildState) *cacheStatsTracker {
+	return &cacheStatsTracker{
+		graph: state.Graph,
+		kinds: map[string]*cacheStats{},
+	}
+}
+
+// AddResult records a single build result.
+func (cst *cacheStatsTracker) AddResult(result *core.BuildResult) {
+	switch result.Status {
+	case core.TargetBuilt:
+		cst.stats(result.Label).Builds++
+	case core.TargetCached:
+		s := cst.stats(result.Label)
+		s.Builds++
+		s.CachedBuilds++
+	case core.TargetTested, core.TargetTestFailed:
+		s := cst.stats(result.Label)
+		s.Tests++
+		if result.Tests.Cached {
+			s.CachedTests++
+		}
+	}
+}
+
+// stats returns the stats for the kind of the given target.
+func (cst *cacheStatsTracker) stats(label core.BuildLabel) *cacheStats {
+	kind := "unknown"
+	if target := cst.graph.Target(label); target != nil && target.Kind != "" {
+		kind = target.Kind
+	}
+	s, present := cst.kinds[kind]
+	if !present {
+		s = &cacheStats{Kind: kind}
+		cst.kinds[kind] = s
+	}
+	return s
+}
+
+// Stats returns the stats for each kind of rule, with the ones that missed the cache most often first.
+func (cst *cacheStatsTracker) Stats() []*cacheStats {
+	stats := make([]*cacheStats, 0, len(cst.kinds))
+	for _, s := range cst.kinds {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if mi, mj := stats[i].misses(), stats[j].misses(); mi != mj {
+			return mi > mj
+		}
+		return stats[i].Kind < stats[j].Kind
+	})
+	return stats
+}
+
+// misses returns the total number of cache misses.
+func (s *cacheStats) misses() int {
+	return s.Builds - s.CachedBuilds + s.Tests - s.CachedTests
+}
+
+// Close writes the stats out to the requested file, if there is one.
+func (cst *cacheStatsTracker) Close(state *core.BuildState) error {
+	if state.CacheStatsFile == "" || len(cst.kinds) == 0 {
+		return nil
+	}
+	f, err := os.Create(state.CacheStatsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cst.writeMetrics(f)
+}
+
+// writeMetrics writes the stats in the Prometheus text format. This is suitable for e.g. the
+// textfile collector of node_exporter, or for pushing to a Pushgateway.
+func (cst *cacheStatsTracker) writeMetrics(w io.Writer) error {
+	stats := cst.Stats()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Kind < stats[j].Kind })
+	var buf bytes.Buffer
+	write := func(name, help string, f func(s *cacheStats) (int, int)) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, s := range stats {
+			builds, tests := f(s)
+			fmt.Fprintf(&buf, "%s{kind=%q,action=\"build\"} %d\n", name, s.Kind, builds)
+			fmt.Fprintf(&buf, "%s{kind=%q,action=\"test\"} %d\n", name, s.Kind, tests)
+		}
+	}
+	write("plz_cache_requests_total", "Number of targets built or tested, by kind of rule.", func(s *cacheStats) (int, int) {
+		return s.Builds, s.Tests
+	})
+	write("plz_cache_hits_total", "Number of targets retrieved from the cache, by kind of rule.", func(s *cacheStats) (int, int) {
+		return s.CachedBuilds, s.CachedTests
+	})
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Finish prints the stats, if requested.
+func (cst *cacheStatsTracker) Finish(state *core.BuildState) {
+	if !state.PrintCacheStats || len(cst.kinds) == 0 {
+		return
+	}
+	printf("${WHITE}Cache hit rates by rule kind:${RESET}\n")
+	printf("  ${BOLD_WHITE}%-30s %15s %15s${RESET}\n", "Kind", "Builds", "Tests")
+	for _, s := range cst.Stats() {
+		printf("  %-30s %15s %15s\n", s.Kind, hitRate(s.CachedBuilds, s.Builds), hitRate(s.CachedTests, s.Tests))
+	}
+}
+
+// hitRate formats a cache hit rate for display.
+func hitRate(hits, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d (%d%%)", hits, total, 100*hits/total)
+}
@@ -0,0 +1,63 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestCacheStats(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	addTarget := func(label, kind string) core.BuildLabel {
+		target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+		target.Kind = kind
+		state.Graph.AddTarget(target)
+		return target.Label
+	}
+	lib1 := addTarget("//src/output:lib1", "go_library")
+	lib2 := addTarget("//src/output:lib2", "go_library")
+	gen := addTarget("//src/output:gen", "genrule")
+	test := addTarget("//src/output:test", "go_test")
+
+	cst := newCacheStatsTracker(state)
+	cst.AddResult(&core.BuildResult{Label: lib1, Status: core.TargetBuilding})
+	cst.AddResult(&core.BuildResult{Label: lib1, Status: core.TargetCached})
+	cst.AddResult(&core.BuildResult{Label: lib2, Status: core.TargetBuilt})
+	cst.AddResult(&core.BuildResult{Label: gen, Status: core.TargetBuilt})
+	cst.AddResult(&core.BuildResult{Label: test, Status: core.TargetCached})
+	cst.AddResult(&core.BuildResult{Label: test, Status: core.TargetTested, Tests: core.TestSuite{Cached: true}})
+
+	assert.Equal(t, []*cacheStats{
+		{Kind: "genrule", Builds: 1},
+		{Kind: "go_library", Builds: 2, CachedBuilds: 1},
+		{Kind: "go_test", Builds: 1, CachedBuilds: 1, Tests: 1, CachedTests: 1},
+	}, cst.Stats())
+
+	var buf bytes.Buffer
+	assert.NoError(t, cst.writeMetrics(&buf))
+	assert.Equal(t, `# HELP plz_cache_requests_total Number of targets built or tested, by kind of rule.
+# TYPE plz_cache_requests_total counter
+plz_cache_requests_total{kind="genrule",action="build"} 1
+plz_cache_requests_total{kind="genrule",action="test"} 0
+plz_cache_requests_total{kind="go_library",action="build"} 2
+plz_cache_requests_total{kind="go_library",action="test"} 0
+plz_cache_requests_total{kind="go_test",action="build"} 1
+plz_cache_requests_total{kind="go_test",action="test"} 1
+# HELP plz_cache_hits_total Number of targets retrieved from the cache, by kind of rule.
+# TYPE plz_cache_hits_total counter
+plz_cache_hits_total{kind="genrule",action="build"} 0
+plz_cache_hits_total{kind="genrule",action="test"} 0
+plz_cache_hits_total{kind="go_library",action="build"} 1
+plz_cache_hits_total{kind="go_library",action="test"} 0
+plz_cache_hits_total{kind="go_test",action="build"} 1
+plz_cache_hits_total{kind="go_test",action="test"} 1
+`, buf.String())
+}
+
+func TestHitRate(t *testing.T) {
+	assert.Equal(t, "-", hitRate(0, 0))
+	assert.Equal(t, "1/3 (33%)", hitRate(1, 3))
+}
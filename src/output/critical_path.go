@@ -0,0 +1,63 @@
+package output
+
+import (
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A criticalPathTracker records how long each target took to build & test, so we can work
+// out the critical path through the build once it's finished.
+type criticalPathTracker struct {
+	starts    map[core.BuildLabel]time.Time
+	durations map[core.BuildLabel]time.Duration
+}
+
+func newCriticalPathTracker() *criticalPathTracker {
+	return &criticalPathTracker{
+		starts:    map[core.BuildLabel]time.Time{},
+		durations: map[core.BuildLabel]time.Duration{},
+	}
+}
+
+// AddResult records a single build result.
+func (cpt *criticalPathTracker) AddResult(result *core.BuildResult) {
+	switch result.Status {
+	case core.PackageParsing, core.PackageParsed, core.ParseFailed:
+		// Parsing isn't attributed to any individual target.
+	case core.TargetBuilding, core.TargetTesting:
+		if _, present := cpt.starts[result.Label]; !present {
+			cpt.starts[result.Label] = result.Time
+		}
+	default:
+		if start, present := cpt.starts[result.Label]; present {
+			cpt.durations[result.Label] += result.Time.Sub(start)
+			delete(cpt.starts, result.Label)
+		}
+	}
+}
+
+// Finish calculates the critical path, records it for later queries and prints it if requested.
+func (cpt *criticalPathTracker) Finish(state *core.BuildState) {
+	if len(cpt.durations) == 0 {
+		return
+	}
+	path := core.CriticalPath(state.Graph, cpt.durations)
+	if err := core.WriteCriticalPath(path); err != nil {
+		log.Warning("Failed to record critical path: %s", err)
+	}
+	if state.PrintCriticalPath {
+		printCriticalPath(path)
+	}
+}
+
+func printCriticalPath(path []core.CriticalPathEntry) {
+	var total time.Duration
+	for _, entry := range path {
+		total += entry.Duration
+	}
+	printf("${WHITE}Critical path (${BOLD_WHITE}%s${RESET}${WHITE}):${RESET}\n", total.Round(durationGranularity))
+	for _, entry := range path {
+		printf("  ${BOLD_WHITE}%s${RESET} %s\n", entry.Label, entry.Duration.Round(durationGranularity))
+	}
+}
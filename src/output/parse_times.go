@@ -0,0 +1,91 @@
+package output
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A parseTimeTracker records how long each package took to parse, so we can point out the
+// slowest ones once the build is finished.
+type parseTimeTracker struct {
+	starts    map[core.BuildLabel]time.Time
+	durations map[core.BuildLabel]time.Duration
+}
+
+// A packageParseTime is the time taken to parse a single package.
+type packageParseTime struct {
+	Package  core.BuildLabel
+	Duration time.Duration
+}
+
+func newParseTimeTracker() *parseTimeTracker {
+	return &parseTimeTracker{
+		starts:    map[core.BuildLabel]time.Time{},
+		durations: map[core.BuildLabel]time.Duration{},
+	}
+}
+
+// AddResult records a single build result.
+func (ptt *parseTimeTracker) AddResult(result *core.BuildResult) {
+	switch result.Status {
+	case core.PackageParsing:
+		pkg := packageLabel(result.Label)
+		if _, present := ptt.starts[pkg]; !present {
+			ptt.starts[pkg] = result.Time
+		}
+	case core.PackageParsed, core.ParseFailed:
+		pkg := packageLabel(result.Label)
+		if start, present := ptt.starts[pkg]; present {
+			d := result.Time.Sub(start)
+			log.Debug("Parsed %s in %s", packageName(pkg), d)
+			ptt.durations[pkg] += d
+			delete(ptt.starts, pkg)
+		}
+	}
+}
+
+// Slowest returns the n packages that took longest to parse, slowest first.
+func (ptt *parseTimeTracker) Slowest(n int) []packageParseTime {
+	times := make([]packageParseTime, 0, len(ptt.durations))
+	for pkg, d := range ptt.durations {
+		times = append(times, packageParseTime{Package: pkg, Duration: d})
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].Duration != times[j].Duration {
+			return times[i].Duration > times[j].Duration
+		}
+		return times[i].Package.Less(times[j].Package)
+	})
+	if len(times) > n {
+		return times[:n]
+	}
+	return times
+}
+
+// Finish prints the slowest packages to parse, if requested.
+func (ptt *parseTimeTracker) Finish(state *core.BuildState) {
+	if state.PrintSlowestPackages <= 0 || len(ptt.durations) == 0 {
+		return
+	}
+	printSlowestPackages(ptt.Slowest(state.PrintSlowestPackages))
+}
+
+func printSlowestPackages(times []packageParseTime) {
+	printf("${WHITE}Slowest packages to parse:${RESET}\n")
+	for _, t := range times {
+		printf("  ${BOLD_WHITE}%s${RESET} %s\n", packageName(t.Package), t.Duration.Round(durationGranularity))
+	}
+}
+
+// packageLabel returns the label identifying the package that the given label is in.
+func packageLabel(label core.BuildLabel) core.BuildLabel {
+	return core.BuildLabel{Subrepo: label.Subrepo, PackageName: label.PackageName, Name: "all"}
+}
+
+// packageName returns the name of a package, as the user would refer to it.
+func packageName(pkg core.BuildLabel) string {
+	return strings.TrimSuffix(pkg.String(), ":all")
+}
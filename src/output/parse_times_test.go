@@ -0,0 +1,37 @@
+package output
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestParseTimes(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	core1 := core.ParseBuildLabel("//src/core:core", "")
+	core2 := core.ParseBuildLabel("//src/core:test_data", "")
+	output := core.ParseBuildLabel("//src/output:output", "")
+	parse := core.ParseBuildLabel("//src/parse:parse", "")
+	ptt := newParseTimeTracker()
+	ptt.AddResult(&core.BuildResult{Time: at(0), Label: core1, Status: core.PackageParsing})
+	ptt.AddResult(&core.BuildResult{Time: at(5), Label: core2, Status: core.PackageParsing})
+	ptt.AddResult(&core.BuildResult{Time: at(10), Label: output, Status: core.PackageParsing})
+	ptt.AddResult(&core.BuildResult{Time: at(20), Label: output, Status: core.PackageParsed})
+	ptt.AddResult(&core.BuildResult{Time: at(30), Label: core1, Status: core.PackageParsed})
+	ptt.AddResult(&core.BuildResult{Time: at(30), Label: parse, Status: core.PackageParsing})
+	ptt.AddResult(&core.BuildResult{Time: at(50), Label: parse, Status: core.ParseFailed})
+	// Building targets doesn't count towards the parse.
+	ptt.AddResult(&core.BuildResult{Time: at(50), Label: core1, Status: core.TargetBuilding})
+	ptt.AddResult(&core.BuildResult{Time: at(90), Label: core1, Status: core.TargetBuilt})
+
+	assert.Equal(t, []packageParseTime{
+		{Package: packageLabel(core1), Duration: 30 * time.Millisecond},
+		{Package: packageLabel(parse), Duration: 20 * time.Millisecond},
+	}, ptt.Slowest(2))
+	assert.Equal(t, 3, len(ptt.Slowest(5)))
+	assert.Equal(t, "//src/core", packageName(packageLabel(core2)))
+}
@@ -0,0 +1,168 @@
+// Per-target profiling of the build. Unlike the trace file (which mirrors what's displayed
+// while building), this breaks each target's time down into phases (e.g. waiting for the cache,
+// downloading outputs) so it's easier to see where the wall-clock time went.
+
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// foldedSuffix is the suffix of the summary file written alongside the profile.
+const foldedSuffix = ".folded"
+
+// A profiler records the time spent by each target in each phase of the build.
+type profiler struct {
+	filename string
+	threads  map[int]*profileSpan
+	parses   map[core.BuildLabel]*profileSpan
+	spans    []*profileSpan
+}
+
+// A profileSpan is a single period of time that a target spent in one phase.
+type profileSpan struct {
+	Label      core.BuildLabel
+	Phase      string
+	Thread     string
+	Start, End time.Time
+}
+
+// newProfiler returns a new profiler that will write to the given file.
+// The filename may be empty in which case it will silently discard all information given.
+func newProfiler(filename string) *profiler {
+	return &profiler{
+		filename: filename,
+		threads:  map[int]*profileSpan{},
+		parses:   map[core.BuildLabel]*profileSpan{},
+	}
+}
+
+// AddResult records a single build result.
+func (p *profiler) AddResult(result *core.BuildResult) {
+	if p.filename == "" {
+		return
+	}
+	switch result.Status {
+	case core.PackageParsing:
+		// Parses don't necessarily happen on a single thread, so we track them per package.
+		p.parses[result.Label] = &profileSpan{Label: result.Label, Phase: "parse", Thread: "Parser", Start: result.Time}
+	case core.PackageParsed, core.ParseFailed:
+		if span, present := p.parses[result.Label]; present {
+			span.End = result.Time
+			p.spans = append(p.spans, span)
+			delete(p.parses, result.Label)
+		}
+	default:
+		if span, present := p.threads[result.ThreadID]; present {
+			span.End = result.Time
+			p.spans = append(p.spans, span)
+			delete(p.threads, result.ThreadID)
+		}
+		if result.Status.IsActive() {
+			p.threads[result.ThreadID] = &profileSpan{
+				Label:  result.Label,
+				Phase:  profilePhase(result),
+				Thread: fmt.Sprintf("Builder %d", result.ThreadID),
+				Start:  result.Time,
+			}
+		}
+	}
+}
+
+// profilePhase returns the phase of the build that a result represents.
+func profilePhase(result *core.BuildResult) string {
+	switch desc := result.Description; {
+	case strings.HasPrefix(desc, "Checking cache"), strings.HasPrefix(desc, "Checking remote"), strings.HasPrefix(desc, "Storing"):
+		return "cache"
+	case strings.HasPrefix(desc, "Downloading"):
+		return "download"
+	case desc == "Queued":
+		return "queued"
+	}
+	return strings.ToLower(result.Status.Category())
+}
+
+// Close writes out the profile and the summary. Anything that's still in progress is ignored.
+func (p *profiler) Close() error {
+	if p.filename == "" {
+		return nil
+	} else if err := p.writeTrace(); err != nil {
+		return err
+	}
+	return p.writeSummary()
+}
+
+// writeTrace writes the profile in Chrome's trace event format.
+func (p *profiler) writeTrace() error {
+	f, err := os.Create(p.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := bufio.NewWriter(f)
+	b.WriteString("[\n")
+	for i, span := range p.spans {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		e := profileEvent{
+			Name: span.Label.String(),
+			Cat:  span.Phase,
+			Ph:   "X",
+			Tid:  span.Thread,
+			Ts:   span.Start.UnixNano() / 1000,
+			Dur:  span.End.Sub(span.Start).Microseconds(),
+		}
+		e.Args.Phase = span.Phase
+		data, _ := json.Marshal(e)
+		b.Write(data)
+	}
+	b.WriteString("\n]\n")
+	return b.Flush()
+}
+
+// writeSummary writes a summary of the profile in the folded stack format understood by most
+// flamegraph tools; each line is package;target;phase followed by the total milliseconds spent.
+func (p *profiler) writeSummary() error {
+	totals := map[string]time.Duration{}
+	for _, span := range p.spans {
+		key := fmt.Sprintf("//%s;%s;%s", span.Label.PackageName, span.Label, span.Phase)
+		totals[key] += span.End.Sub(span.Start)
+	}
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f, err := os.Create(p.filename + foldedSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := bufio.NewWriter(f)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s %d\n", k, totals[k].Milliseconds())
+	}
+	return b.Flush()
+}
+
+type profileEvent struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat"`
+	Ph   string `json:"ph"`
+	Pid  int32  `json:"pid"`
+	Tid  string `json:"tid"`
+	Ts   int64  `json:"ts"`
+	Dur  int64  `json:"dur"`
+	Args struct {
+		Phase string `json:"phase"`
+	} `json:"args"`
+}
@@ -0,0 +1,62 @@
+package output
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "profile.json")
+
+	label := core.ParseBuildLabel("//src/output:target", "")
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	p := newProfiler(filename)
+	p.AddResult(&core.BuildResult{ThreadID: 7, Time: at(0), Label: label, Status: core.PackageParsing, Description: "Parsing..."})
+	p.AddResult(&core.BuildResult{ThreadID: 8, Time: at(10), Label: label, Status: core.PackageParsed, Description: "Parsed package"})
+	p.AddResult(&core.BuildResult{ThreadID: 1, Time: at(10), Label: label, Status: core.TargetBuilding, Description: "Checking cache..."})
+	p.AddResult(&core.BuildResult{ThreadID: 1, Time: at(15), Label: label, Status: core.TargetBuilding, Description: "Building..."})
+	p.AddResult(&core.BuildResult{ThreadID: 1, Time: at(45), Label: label, Status: core.TargetBuilding, Description: "Downloading..."})
+	p.AddResult(&core.BuildResult{ThreadID: 1, Time: at(50), Label: label, Status: core.TargetBuilt, Description: "Built"})
+	require.NoError(t, p.Close())
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	events := []profileEvent{}
+	require.NoError(t, json.Unmarshal(data, &events))
+	require.Equal(t, 4, len(events))
+	assert.Equal(t, "parse", events[0].Cat)
+	assert.Equal(t, "Parser", events[0].Tid)
+	assert.EqualValues(t, 10000, events[0].Dur)
+	assert.Equal(t, "cache", events[1].Cat)
+	assert.Equal(t, "Builder 1", events[1].Tid)
+	assert.Equal(t, "build", events[2].Cat)
+	assert.EqualValues(t, 30000, events[2].Dur)
+	assert.Equal(t, "download", events[3].Cat)
+
+	data, err = ioutil.ReadFile(filename + foldedSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, `//src/output;//src/output:target;build 30
+//src/output;//src/output:target;cache 5
+//src/output;//src/output:target;download 5
+//src/output;//src/output:target;parse 10
+`, string(data))
+}
+
+func TestProfileDisabled(t *testing.T) {
+	p := newProfiler("")
+	p.AddResult(&core.BuildResult{ThreadID: 1, Time: time.Now(), Status: core.TargetBuilding})
+	assert.NoError(t, p.Close())
+}
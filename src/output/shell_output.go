@@ -13,6 +13,8 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -54,7 +56,9 @@ type buildingTargetData struct {
 
 // MonitorState monitors the build while it's running and prints output.
 // The caller must cancel the given context once they want this function to stop displaying things.
-func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, detailedTests, streamTestResults bool, traceFile string) {
+// If profileFile is given, a profile of the time spent on each target is written to it.
+// Any webhooks given are notified when the build starts and finishes.
+func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, detailedTests, streamTestResults bool, traceFile, profileFile, dbFile string, webhooks []cli.URL) {
 	initPrintf(state.Config)
 	failedTargetMap := map[core.BuildLabel]error{}
 	buildingTargets := make([]buildingTarget, state.Config.Please.NumThreads+state.Config.NumRemoteExecutors())
@@ -79,7 +83,19 @@ func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, deta
 	failedTargets := []core.BuildLabel{}
 	failedNonTests := []core.BuildLabel{}
 	tw := newTraceWriter(traceFile)
+	p := newProfiler(profileFile)
+	db := newBuildDB(dbFile)
+	wh := newWebhookNotifier(state, webhooks)
+	cpt := newCriticalPathTracker()
+	ptt := newParseTimeTracker()
+	cst := newCacheStatsTracker(state)
 	for result := range state.Results() {
+		p.AddResult(result)
+		db.AddResult(result)
+		wh.AddResult(result)
+		cpt.AddResult(result)
+		ptt.AddResult(result)
+		cst.AddResult(result)
 		if state.DebugTests && result.Status == core.TargetTesting {
 			cancel() // signals the interactive display goroutines to stop
 		}
@@ -90,6 +106,16 @@ func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, deta
 	if err := tw.Close(); err != nil {
 		log.Error("Failed to write trace data: %s", err)
 	}
+	if err := p.Close(); err != nil {
+		log.Error("Failed to write profile: %s", err)
+	}
+	if err := db.Close(state); err != nil {
+		log.Error("Failed to write build metadata database: %s", err)
+	}
+	if err := cst.Close(state); err != nil {
+		log.Error("Failed to write cache stats: %s", err)
+	}
+	wh.Close(state)
 	duration := time.Since(state.StartTime).Round(durationGranularity)
 	if len(failedNonTests) > 0 { // Something failed in the build step.
 		printFailedBuildResults(failedNonTests, failedTargetMap, duration)
@@ -118,6 +144,9 @@ func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, deta
 		} else if !state.NeedRun { // Must be plz build or similar, report build outputs.
 			printBuildResults(state, duration)
 		}
+		cpt.Finish(state)
+		ptt.Finish(state)
+		cst.Finish(state)
 	}
 }
 
@@ -480,7 +509,10 @@ func printTempDirs(state *core.BuildState, duration time.Duration) {
 		target := state.Graph.TargetOrDie(label)
 		cmd := target.GetCommand(state)
 		dir := target.TmpDir()
-		env := core.StampedBuildEnvironment(state, target, nil, path.Join(core.RepoRoot, target.TmpDir()))
+		env, err := core.StampedBuildEnvironment(state, target, nil, path.Join(core.RepoRoot, target.TmpDir()))
+		if err != nil {
+			log.Error("Failed to set up build environment for %s: %s", label, err)
+		}
 		if state.NeedTests {
 			cmd = target.GetTestCommand(state)
 			dir = path.Join(core.RepoRoot, target.TestDir())
@@ -634,6 +666,36 @@ func PrintCoverage(state *core.BuildState, includeFiles []string) {
 // PrintIncrementalCoverage prints the given incremental coverage statistics.
 func PrintIncrementalCoverage(stats *test.IncrementalStats) {
 	printf("${BOLD_WHITE}Incremental coverage: %s${RESET}\n", coveragePercentage(stats.CoveredLines, stats.ModifiedLines, ""))
+	if len(stats.UncoveredLines) == 0 {
+		return
+	}
+	printf("${BOLD_WHITE}Modified lines that aren't covered:${RESET}\n")
+	files := make([]string, 0, len(stats.UncoveredLines))
+	for file := range stats.UncoveredLines {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		printf("  ${WHITE}%s:${RESET} ${RED}%s${RESET}\n", file, lineRanges(stats.UncoveredLines[file]))
+	}
+}
+
+// lineRanges formats a sorted list of line numbers into a more compact set of ranges, e.g. 1-3, 5, 7-8
+func lineRanges(lines []int) string {
+	ranges := []string{}
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
 }
 
 // PrintLineCoverageReport writes out line-by-line coverage metrics after a test run.
@@ -39,6 +39,12 @@ func TestColouriseError(t *testing.T) {
 	assert.EqualValues(t, expected, colouriseError(err))
 }
 
+func TestLineRanges(t *testing.T) {
+	assert.Equal(t, "", lineRanges(nil))
+	assert.Equal(t, "4", lineRanges([]int{4}))
+	assert.Equal(t, "1-3, 5, 7-8", lineRanges([]int{1, 2, 3, 5, 7, 8}))
+}
+
 // Factory function for build targets
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
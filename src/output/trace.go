@@ -89,6 +89,7 @@ func (tw *traceWriter) writeEvent(result *core.BuildResult, phase string) {
 	entry.Args.Description = result.Description
 	if result.Err != nil {
 		entry.Args.Err = fmt.Sprintf("%s", result.Err)
+		entry.Args.Error = core.AsBuildError(result.Err, result.Label, result.Status)
 		entry.Cname = "terrible"
 	} else if entry.Cat == "Test" {
 		entry.Cname = "good"
@@ -106,7 +107,8 @@ type traceEntry struct {
 	Ts    int64  `json:"ts"`
 	Cname string `json:"cname,omitempty"`
 	Args  struct {
-		Description string `json:"description"`
-		Err         string `json:"err,omitempty"`
+		Description string           `json:"description"`
+		Err         string           `json:"err,omitempty"`
+		Error       *core.BuildError `json:"error,omitempty"`
 	} `json:"args"`
 }
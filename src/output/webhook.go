@@ -0,0 +1,184 @@
+// Webhook notifications, which POST a JSON summary of the build to a set of URLs when it starts
+// and finishes. The messages include a text field that chat services (e.g. Slack or Teams) can
+// display as-is, as well as more structured information for anything else consuming them.
+
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+// actionURLRegex extracts links to remote actions from the errors of targets that failed remotely.
+var actionURLRegex = regexp.MustCompile(`Action URL: (\S+)`)
+
+// A webhookNotifier sends notifications about the build to a set of webhooks.
+type webhookNotifier struct {
+	urls     []cli.URL
+	client   *http.Client
+	wg       sync.WaitGroup
+	command  string
+	started  map[core.BuildLabel]time.Time
+	failures []webhookTarget
+	built    int
+	cached   int
+}
+
+// A webhookMessage is the body of each request we send.
+type webhookMessage struct {
+	Event      string          `json:"event"`
+	Text       string          `json:"text"`
+	Time       time.Time       `json:"time"`
+	Command    string          `json:"command"`
+	Targets    []string        `json:"targets,omitempty"`
+	Success    *bool           `json:"success,omitempty"`
+	DurationMs int64           `json:"duration_ms,omitempty"`
+	Built      int             `json:"built,omitempty"`
+	Cached     int             `json:"cached,omitempty"`
+	Failures   []webhookTarget `json:"failures,omitempty"`
+}
+
+// A webhookTarget describes a single target that failed.
+type webhookTarget struct {
+	Label       string `json:"label"`
+	Test        bool   `json:"test"`
+	Description string `json:"description"`
+	DurationMs  int64  `json:"duration_ms"`
+	Error       string `json:"error,omitempty"`
+	ActionURL   string `json:"action_url,omitempty"`
+}
+
+// newWebhookNotifier creates a new webhookNotifier and notifies the webhooks that the build has started.
+// If there are no webhooks it silently discards everything given to it.
+func newWebhookNotifier(state *core.BuildState, urls []cli.URL) *webhookNotifier {
+	n := &webhookNotifier{
+		urls:    urls,
+		client:  &http.Client{Timeout: time.Duration(state.Config.Events.WebhookTimeout)},
+		command: "plz " + strings.Join(os.Args[1:], " "),
+		started: map[core.BuildLabel]time.Time{},
+	}
+	if len(urls) == 0 {
+		return n
+	}
+	// Don't hold up the build starting while we send this.
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.send(&webhookMessage{
+			Event:   "started",
+			Text:    "Build started: " + n.command,
+			Time:    state.StartTime,
+			Command: n.command,
+		})
+	}()
+	return n
+}
+
+// AddResult records a single build result.
+func (n *webhookNotifier) AddResult(result *core.BuildResult) {
+	if len(n.urls) == 0 {
+		return
+	}
+	switch result.Status {
+	case core.TargetBuilding, core.TargetTesting:
+		if _, present := n.started[result.Label]; !present {
+			n.started[result.Label] = result.Time
+		}
+	case core.TargetBuilt:
+		n.built++
+	case core.TargetCached:
+		n.cached++
+	case core.TargetBuildFailed, core.TargetTestFailed:
+		t := webhookTarget{
+			Label:       result.Label.String(),
+			Test:        result.Status == core.TargetTestFailed,
+			Description: result.Description,
+		}
+		if start, present := n.started[result.Label]; present {
+			t.DurationMs = result.Time.Sub(start).Milliseconds()
+		}
+		if result.Err != nil {
+			t.Error = result.Err.Error()
+			if match := actionURLRegex.FindStringSubmatch(t.Error); match != nil {
+				t.ActionURL = match[1]
+			}
+		}
+		n.failures = append(n.failures, t)
+	}
+}
+
+// Close notifies the webhooks that the build has finished. It blocks until they've all been sent.
+func (n *webhookNotifier) Close(state *core.BuildState) {
+	if len(n.urls) == 0 {
+		return
+	}
+	n.wg.Wait() // Make sure the start message is always sent first.
+	duration := time.Since(state.StartTime)
+	// The original targets aren't all known until the build is underway, so we only send them now.
+	targets := make([]string, len(state.OriginalTargets))
+	for i, label := range state.OriginalTargets {
+		targets[i] = label.String()
+	}
+	msg := &webhookMessage{
+		Event:      "finished",
+		Time:       time.Now(),
+		Command:    n.command,
+		Targets:    targets,
+		Success:    &state.Success,
+		DurationMs: duration.Milliseconds(),
+		Built:      n.built,
+		Cached:     n.cached,
+		Failures:   n.failures,
+	}
+	if state.Success {
+		msg.Text = fmt.Sprintf("Build succeeded in %s: %s", duration.Round(durationGranularity), n.command)
+	} else {
+		lines := []string{fmt.Sprintf("Build failed after %s: %s", duration.Round(durationGranularity), n.command)}
+		for _, failure := range n.failures {
+			if failure.ActionURL != "" {
+				lines = append(lines, fmt.Sprintf("%s: %s (%s)", failure.Label, failure.Description, failure.ActionURL))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s: %s", failure.Label, failure.Description))
+			}
+		}
+		msg.Text = strings.Join(lines, "\n")
+	}
+	n.send(msg)
+}
+
+// send sends a message to all the webhooks. Failures are logged but otherwise ignored.
+func (n *webhookNotifier) send(msg *webhookMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("Failed to encode webhook message: %s", err)
+		return
+	}
+	for _, url := range n.urls {
+		if err := n.post(url.String(), b); err != nil {
+			log.Warning("Failed to send %s notification to webhook %s: %s", msg.Event, url, err)
+		}
+	}
+}
+
+// post sends a single request to a webhook.
+func (n *webhookNotifier) post(url string, body []byte) error {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
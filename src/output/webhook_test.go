@@ -0,0 +1,67 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestWebhooks(t *testing.T) {
+	messages := make(chan *webhookMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := &webhookMessage{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(msg))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		messages <- msg
+	}))
+	defer server.Close()
+
+	state := core.NewDefaultBuildState()
+	state.OriginalTargets = []core.BuildLabel{core.ParseBuildLabel("//src/output:all", "")}
+	lib := core.ParseBuildLabel("//src/output:lib", "")
+	test := core.ParseBuildLabel("//src/output:test", "")
+	n := newWebhookNotifier(state, []cli.URL{cli.URL(server.URL)})
+	start := time.Now()
+	err := fmt.Errorf("exit status 1\nAction URL: https://buildbarn/action/main/1234/56/")
+	n.AddResult(&core.BuildResult{Time: start, Label: lib, Status: core.TargetBuilding, Description: "Building..."})
+	n.AddResult(&core.BuildResult{Time: start.Add(50 * time.Millisecond), Label: lib, Status: core.TargetBuilt, Description: "Built"})
+	n.AddResult(&core.BuildResult{Time: start, Label: test, Status: core.TargetBuilding, Description: "Building..."})
+	n.AddResult(&core.BuildResult{Time: start.Add(100 * time.Millisecond), Label: test, Status: core.TargetBuildFailed, Description: "Failed to build", Err: err})
+	state.Success = false
+	n.Close(state)
+
+	require.Equal(t, 2, len(messages))
+	msg := <-messages
+	assert.Equal(t, "started", msg.Event)
+	assert.Nil(t, msg.Success)
+
+	msg = <-messages
+	assert.Equal(t, "finished", msg.Event)
+	assert.Equal(t, []string{"//src/output:all"}, msg.Targets)
+	require.NotNil(t, msg.Success)
+	assert.False(t, *msg.Success)
+	assert.Equal(t, 1, msg.Built)
+	assert.Equal(t, []webhookTarget{{
+		Label:       "//src/output:test",
+		Description: "Failed to build",
+		DurationMs:  100,
+		Error:       err.Error(),
+		ActionURL:   "https://buildbarn/action/main/1234/56/",
+	}}, msg.Failures)
+	assert.Contains(t, msg.Text, "//src/output:test: Failed to build (https://buildbarn/action/main/1234/56/)")
+}
+
+func TestWebhooksNoURLs(t *testing.T) {
+	n := newWebhookNotifier(core.NewDefaultBuildState(), nil)
+	n.AddResult(&core.BuildResult{Label: core.ParseBuildLabel("//src/output:lib", ""), Status: core.TargetBuilt})
+	assert.Equal(t, 0, n.built)
+}
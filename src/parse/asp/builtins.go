@@ -9,16 +9,17 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/manifoldco/promptui"
 
 	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
-	"github.com/thought-machine/please/src/fs"
 )
 
 // A few sneaky globals for when we don't have a scope handy
-var stringMethods, dictMethods, configMethods map[string]*pyFunc
+var stringMethods, dictMethods, setMethods, structMethods, depsetMethods, configMethods map[string]*pyFunc
 
 // A nativeFunc is a function that implements a builtin function natively.
 type nativeFunc func(*scope, []pyObject) pyObject
@@ -32,6 +33,8 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "load", bazelLoad).varargs = true
 	setNativeCode(s, "package", pkg).kwargs = true
 	setNativeCode(s, "sorted", sorted)
+	setNativeCode(s, "min", minFunc)
+	setNativeCode(s, "max", maxFunc)
 	setNativeCode(s, "isinstance", isinstance)
 	setNativeCode(s, "range", pyRange)
 	setNativeCode(s, "enumerate", enumerate)
@@ -40,7 +43,12 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "glob", glob)
 	setNativeCode(s, "bool", boolType)
 	setNativeCode(s, "int", intType)
+	setNativeCode(s, "float", floatType)
 	setNativeCode(s, "str", strType)
+	setNativeCode(s, "set", setType)
+	setNativeCode(s, "frozenset", frozenSetType)
+	setNativeCode(s, "struct", structType).kwargs = true
+	setNativeCode(s, "depset", depsetType)
 	setNativeCode(s, "join_path", joinPath).varargs = true
 	setNativeCode(s, "get_base_path", packageName)
 	setNativeCode(s, "package_name", packageName)
@@ -57,6 +65,8 @@ func registerBuiltins(s *scope) {
 	stringMethods = map[string]*pyFunc{
 		"join":       setNativeCode(s, "join", strJoin),
 		"split":      setNativeCode(s, "split", strSplit),
+		"rsplit":     setNativeCode(s, "rsplit", strRSplit),
+		"splitlines": setNativeCode(s, "splitlines", strSplitLines),
 		"replace":    setNativeCode(s, "replace", strReplace),
 		"partition":  setNativeCode(s, "partition", strPartition),
 		"rpartition": setNativeCode(s, "rpartition", strRPartition),
@@ -71,6 +81,9 @@ func registerBuiltins(s *scope) {
 		"count":      setNativeCode(s, "count", strCount),
 		"upper":      setNativeCode(s, "upper", strUpper),
 		"lower":      setNativeCode(s, "lower", strLower),
+		"title":      setNativeCode(s, "title", strTitle),
+		"zfill":      setNativeCode(s, "zfill", strZFill),
+		"center":     setNativeCode(s, "center", strCenter),
 	}
 	stringMethods["format"].kwargs = true
 	dictMethods = map[string]*pyFunc{
@@ -81,6 +94,17 @@ func registerBuiltins(s *scope) {
 		"values":     setNativeCode(s, "values", dictValues),
 		"copy":       setNativeCode(s, "copy", dictCopy),
 	}
+	setMethods = map[string]*pyFunc{
+		"add":        setNativeCode(s, "add", setAdd),
+		"union":      setNativeCode(s, "union", setUnion),
+		"difference": setNativeCode(s, "difference", setDifference),
+	}
+	structMethods = map[string]*pyFunc{
+		"to_dict": setNativeCode(s, "to_dict", structToDict),
+	}
+	depsetMethods = map[string]*pyFunc{
+		"to_list": setNativeCode(s, "to_list", depsetToList),
+	}
 	configMethods = map[string]*pyFunc{
 		"get":        setNativeCode(s, "config_get", configGet),
 		"setdefault": s.Lookup("setdefault").(*pyFunc),
@@ -189,7 +213,8 @@ func defaultFromConfig(config *pyConfig, arg pyObject, name string) pyObject {
 // pkg implements the package() builtin function.
 func pkg(s *scope, args []pyObject) pyObject {
 	s.Assert(s.pkg.NumTargets() == 0, "package() must be called before any build targets are defined")
-	for k, v := range s.locals {
+	for _, k := range s.locals.Keys() {
+		v := s.locals.items[k]
 		k = strings.ToUpper(k)
 		s.Assert(s.config.Get(k, nil) != nil, "error calling package(): %s is not a known config value", k)
 		s.config.IndexAssign(pyString(k), v)
@@ -225,7 +250,7 @@ func bazelLoad(s *scope, args []pyObject) pyObject {
 		}
 		filename = subrepo.Dir(filename)
 	}
-	s.SetAll(s.interpreter.Subinclude(filename, s.contextPkg), false)
+	s.subinclude(filename, s.contextPkg)
 	return None
 }
 
@@ -250,7 +275,7 @@ func subinclude(s *scope, args []pyObject) pyObject {
 	l := pkg.Label()
 	s.Assert(l.CanSee(s.state, t), "Target %s isn't visible to be subincluded into %s", t.Label, l)
 	for _, out := range t.Outputs() {
-		s.SetAll(s.interpreter.Subinclude(path.Join(t.OutDir(), out), pkg), false)
+		s.subinclude(path.Join(t.OutDir(), out), pkg)
 	}
 	return None
 }
@@ -265,9 +290,7 @@ func subincludeTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
 	}
 	s.NAssert(l.IsAllTargets() || l.IsAllSubpackages(), "Can't pass :all or /... to subinclude()")
 	t := s.state.WaitForBuiltTarget(l, pkgLabel)
-	// This is not quite right, if you subinclude from another subinclude we can basically
-	// lose track of it later on. It's hard to know what better to do at this point though.
-	s.contextPkg.RegisterSubinclude(l)
+	s.registerSubinclude(l)
 	return t
 }
 
@@ -279,10 +302,16 @@ func objLen(obj pyObject) pyInt {
 	switch t := obj.(type) {
 	case pyList:
 		return pyInt(len(t))
-	case pyDict:
-		return pyInt(len(t))
+	case *pyDict:
+		return pyInt(t.Len())
+	case pyFrozenDict:
+		return pyInt(t.Len())
 	case pyString:
 		return pyInt(len(t))
+	case *pySet:
+		return pyInt(len(t.items))
+	case pyFrozenSet:
+		return pyInt(len(t.items))
 	}
 	panic("object of type " + obj.Type() + " has no len()")
 }
@@ -311,12 +340,22 @@ func isType(obj pyObject, name string) bool {
 		return name == "bool" || name == "int" // N.B. For compatibility with old assert statements
 	case pyInt:
 		return name == "int"
+	case pyFloat:
+		return name == "float"
 	case pyString:
 		return name == "str"
 	case pyList:
 		return name == "list"
-	case pyDict:
+	case *pyDict, pyFrozenDict:
 		return name == "dict"
+	case *pySet:
+		return name == "set"
+	case pyFrozenSet:
+		return name == "set" || name == "frozenset"
+	case *pyStruct:
+		return name == "struct"
+	case *pyDepset:
+		return name == "depset"
 	case *pyConfig:
 		return name == "config"
 	}
@@ -335,6 +374,55 @@ func strSplit(s *scope, args []pyObject) pyObject {
 	return fromStringList(strings.Split(string(self), string(on)))
 }
 
+func strRSplit(s *scope, args []pyObject) pyObject {
+	self := string(args[0].(pyString))
+	on := string(args[1].(pyString))
+	maxsplit := int(args[2].(pyInt))
+	s.Assert(on != "", "empty separator")
+	if maxsplit < 0 {
+		return fromStringList(strings.Split(self, on))
+	}
+	ret := []string{}
+	for ; maxsplit > 0; maxsplit-- {
+		idx := strings.LastIndex(self, on)
+		if idx == -1 {
+			break
+		}
+		ret = append(ret, self[idx+len(on):])
+		self = self[:idx]
+	}
+	ret = append(ret, self)
+	// We built it up backwards, so reverse it now.
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return fromStringList(ret)
+}
+
+func strSplitLines(s *scope, args []pyObject) pyObject {
+	self := string(args[0].(pyString))
+	keepends := args[1].IsTruthy()
+	ret := pyList{}
+	for len(self) > 0 {
+		idx := strings.IndexAny(self, "\r\n")
+		if idx == -1 {
+			ret = append(ret, pyString(self))
+			break
+		}
+		end := idx + 1
+		if self[idx] == '\r' && end < len(self) && self[end] == '\n' {
+			end++
+		}
+		if keepends {
+			ret = append(ret, pyString(self[:end]))
+		} else {
+			ret = append(ret, pyString(self[:idx]))
+		}
+		self = self[end:]
+	}
+	return ret
+}
+
 func strReplace(s *scope, args []pyObject) pyObject {
 	self := args[0].(pyString)
 	old := args[1].(pyString)
@@ -355,7 +443,7 @@ func strRPartition(s *scope, args []pyObject) pyObject {
 	self := args[0].(pyString)
 	sep := args[1].(pyString)
 	if idx := strings.LastIndex(string(self), string(sep)); idx != -1 {
-		return pyList{self[:idx], self[idx : idx+1], self[idx+1:]}
+		return pyList{self[:idx], self[idx : idx+len(sep)], self[idx+len(sep):]}
 	}
 	return pyList{pyString(""), pyString(""), self}
 }
@@ -404,8 +492,8 @@ func strRFind(s *scope, args []pyObject) pyObject {
 
 func strFormat(s *scope, args []pyObject) pyObject {
 	self := string(args[0].(pyString))
-	for k, v := range s.locals {
-		self = strings.Replace(self, "{"+k+"}", v.String(), -1)
+	for _, k := range s.locals.Keys() {
+		self = strings.Replace(self, "{"+k+"}", s.locals.items[k].String(), -1)
 	}
 	return pyString(strings.Replace(strings.Replace(self, "{{", "{", -1), "}}", "}", -1))
 }
@@ -426,16 +514,78 @@ func strLower(s *scope, args []pyObject) pyObject {
 	return pyString(strings.ToLower(self))
 }
 
+func strTitle(s *scope, args []pyObject) pyObject {
+	self := args[0].(pyString)
+	var b strings.Builder
+	b.Grow(len(self))
+	prevCased := false
+	for _, r := range self {
+		if prevCased {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToTitle(r))
+		}
+		prevCased = unicode.IsUpper(r) || unicode.IsLower(r) || unicode.IsTitle(r)
+	}
+	return pyString(b.String())
+}
+
+func strZFill(s *scope, args []pyObject) pyObject {
+	self := string(args[0].(pyString))
+	width := int(args[1].(pyInt))
+	length := utf8.RuneCountInString(self)
+	if length >= width {
+		return args[0]
+	}
+	padding := strings.Repeat("0", width-length)
+	if len(self) > 0 && (self[0] == '+' || self[0] == '-') {
+		return pyString(self[:1] + padding + self[1:])
+	}
+	return pyString(padding + self)
+}
+
+func strCenter(s *scope, args []pyObject) pyObject {
+	self := string(args[0].(pyString))
+	width := int(args[1].(pyInt))
+	fillchar := string(args[2].(pyString))
+	s.Assert(utf8.RuneCountInString(fillchar) == 1, "The fill character must be exactly one character long")
+	marg := width - utf8.RuneCountInString(self)
+	if marg <= 0 {
+		return args[0]
+	}
+	// This matches Python's behaviour of where to put the extra character when the margin is odd.
+	left := marg/2 + (marg & width & 1)
+	return pyString(strings.Repeat(fillchar, left) + self + strings.Repeat(fillchar, marg-left))
+}
+
 func boolType(s *scope, args []pyObject) pyObject {
 	return newPyBool(args[0].IsTruthy())
 }
 
 func intType(s *scope, args []pyObject) pyObject {
+	switch arg := args[0].(type) {
+	case pyInt:
+		return arg
+	case pyFloat:
+		return pyInt(arg) // Truncates towards zero, as in Python
+	}
 	i, err := strconv.Atoi(string(args[0].(pyString)))
 	s.Assert(err == nil, "%s", err)
 	return pyInt(i)
 }
 
+func floatType(s *scope, args []pyObject) pyObject {
+	switch arg := args[0].(type) {
+	case pyInt:
+		return pyFloat(arg)
+	case pyFloat:
+		return arg
+	}
+	f, err := strconv.ParseFloat(string(args[0].(pyString)), 64)
+	s.Assert(err == nil, "%s", err)
+	return pyFloat(f)
+}
+
 func strType(s *scope, args []pyObject) pyObject {
 	return pyString(args[0].String())
 }
@@ -445,7 +595,7 @@ func glob(s *scope, args []pyObject) pyObject {
 	exclude := asStringList(s, args[1], "exclude")
 	hidden := args[2].IsTruthy()
 	exclude = append(exclude, s.state.Config.Parse.BuildFileName...)
-	return fromStringList(fs.Glob(s.state.Config.Parse.BuildFileName, s.pkg.SourceRoot(), include, exclude, exclude, hidden))
+	return fromStringList(s.globs.Glob(s.state.Config.Parse.BuildFileName, s.pkg.SourceRoot(), include, exclude, hidden))
 }
 
 func asStringList(s *scope, arg pyObject, name string) []string {
@@ -474,18 +624,18 @@ func configGet(s *scope, args []pyObject) pyObject {
 }
 
 func dictGet(s *scope, args []pyObject) pyObject {
-	self := args[0].(pyDict)
+	self := args[0].(*pyDict)
 	sk, ok := args[1].(pyString)
 	s.Assert(ok, "dict keys must be strings, not %s", args[1].Type())
-	if ret, present := self[string(sk)]; present {
+	if ret, present := self.Get(string(sk)); present {
 		return ret
 	}
 	return args[2]
 }
 
 func dictKeys(s *scope, args []pyObject) pyObject {
-	self := args[0].(pyDict)
-	ret := make(pyList, len(self))
+	self := args[0].(*pyDict)
+	ret := make(pyList, self.Len())
 	for i, k := range self.Keys() {
 		ret[i] = pyString(k)
 	}
@@ -493,38 +643,164 @@ func dictKeys(s *scope, args []pyObject) pyObject {
 }
 
 func dictValues(s *scope, args []pyObject) pyObject {
-	self := args[0].(pyDict)
-	ret := make(pyList, len(self))
+	self := args[0].(*pyDict)
+	ret := make(pyList, self.Len())
 	for i, k := range self.Keys() {
-		ret[i] = self[k]
+		ret[i] = self.items[k]
 	}
 	return ret
 }
 
 func dictItems(s *scope, args []pyObject) pyObject {
-	self := args[0].(pyDict)
-	ret := make(pyList, len(self))
+	self := args[0].(*pyDict)
+	ret := make(pyList, self.Len())
 	for i, k := range self.Keys() {
-		ret[i] = pyList{pyString(k), self[k]}
+		ret[i] = pyList{pyString(k), self.items[k]}
 	}
 	return ret
 }
 
 func dictCopy(s *scope, args []pyObject) pyObject {
-	self := args[0].(pyDict)
-	ret := make(pyDict, len(self))
-	for k, v := range self {
-		ret[k] = v
+	return args[0].(*pyDict).Copy()
+}
+
+func sorted(s *scope, args []pyObject) pyObject {
+	l := sequence(s, args[0])
+	keys := applyKey(s, args[1], l)
+	reverse := args[2].IsTruthy()
+	indices := make([]int, len(l))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		if reverse {
+			return keys[indices[j]].Operator(LessThan, keys[indices[i]]).IsTruthy()
+		}
+		return keys[indices[i]].Operator(LessThan, keys[indices[j]]).IsTruthy()
+	})
+	ret := make(pyList, len(l))
+	for i, idx := range indices {
+		ret[i] = l[idx]
 	}
 	return ret
 }
 
-func sorted(s *scope, args []pyObject) pyObject {
-	l, ok := args[0].(pyList)
-	s.Assert(ok, "unsortable type %s", args[0].Type())
-	l = l[:]
-	sort.Slice(l, func(i, j int) bool { return l[i].Operator(LessThan, l[j]).IsTruthy() })
-	return l
+func minFunc(s *scope, args []pyObject) pyObject {
+	return extreme(s, args, "min", false)
+}
+
+func maxFunc(s *scope, args []pyObject) pyObject {
+	return extreme(s, args, "max", true)
+}
+
+// extreme implements min() and max(); it returns the first of the smallest or largest items.
+func extreme(s *scope, args []pyObject, name string, max bool) pyObject {
+	l := sequence(s, args[0])
+	s.Assert(len(l) > 0, "%s() arg is an empty sequence", name)
+	keys := applyKey(s, args[1], l)
+	ret := 0
+	for i := 1; i < len(l); i++ {
+		if max && keys[ret].Operator(LessThan, keys[i]).IsTruthy() {
+			ret = i
+		} else if !max && keys[i].Operator(LessThan, keys[ret]).IsTruthy() {
+			ret = i
+		}
+	}
+	return l[ret]
+}
+
+// sequence returns the items of a list, set or dict (in which case it's the keys, as in Python).
+func sequence(s *scope, obj pyObject) pyList {
+	if l, ok := asList(obj); ok {
+		return l
+	} else if set, ok := asIterableSet(obj); ok {
+		return set.items
+	} else if d, ok := asDict(obj); ok {
+		return fromStringList(d.Keys())
+	}
+	s.Error("Non-iterable type %s", obj.Type())
+	return nil
+}
+
+// applyKey applies a key function (as passed to sorted() etc) to each item in a list.
+// If the key is None the items are their own keys.
+func applyKey(s *scope, key pyObject, l pyList) pyList {
+	if key == None {
+		return l
+	}
+	f, ok := key.(*pyFunc)
+	s.Assert(ok, "key must be a function, not %s", key.Type())
+	ret := make(pyList, len(l))
+	for i, li := range l {
+		ret[i] = f.Call(s, &Call{Arguments: []CallArgument{{
+			Value: Expression{Optimised: &OptimisedExpression{Constant: li}},
+		}}})
+	}
+	return ret
+}
+
+func setType(s *scope, args []pyObject) pyObject {
+	return toSet(s, args[0])
+}
+
+func frozenSetType(s *scope, args []pyObject) pyObject {
+	return toSet(s, args[0]).Freeze()
+}
+
+func setAdd(s *scope, args []pyObject) pyObject {
+	args[0].(*pySet).Add(args[1])
+	return None
+}
+
+func setUnion(s *scope, args []pyObject) pyObject {
+	return args[0].(*pySet).Union(toSet(s, args[1]))
+}
+
+func setDifference(s *scope, args []pyObject) pyObject {
+	return args[0].(*pySet).Difference(toSet(s, args[1]))
+}
+
+// toSet converts the given list or set to a new set.
+func toSet(s *scope, obj pyObject) *pySet {
+	switch t := obj.(type) {
+	case pyList:
+		return newPySet(t)
+	case pyFrozenList:
+		return newPySet(t.pyList)
+	}
+	set, ok := asIterableSet(obj)
+	s.Assert(ok, "Cannot convert %s to a set", obj.Type())
+	return newPySet(set.items)
+}
+
+// structType implements the struct() builtin, which creates a struct from its keyword arguments.
+func structType(s *scope, args []pyObject) pyObject {
+	return newPyStruct(s.locals)
+}
+
+func structToDict(s *scope, args []pyObject) pyObject {
+	return args[0].(*pyStruct).ToDict()
+}
+
+// depsetType implements the depset() builtin.
+func depsetType(s *scope, args []pyObject) pyObject {
+	direct := toSet(s, args[0]).items
+	l, ok := args[1].(pyList)
+	if !ok {
+		l = args[1].(pyFrozenList).pyList
+	}
+	transitive := make([]*pyDepset, len(l))
+	for i, t := range l {
+		d, ok := t.(*pyDepset)
+		s.Assert(ok, "Items of transitive must be depsets, not %s", t.Type())
+		transitive[i] = d
+	}
+	return newPyDepset(string(args[2].(pyString)), direct, transitive)
+}
+
+func depsetToList(s *scope, args []pyObject) pyObject {
+	// Copy it since the original is cached and lists are mutable.
+	return append(pyList{}, args[0].(*pyDepset).ToList()...)
 }
 
 func joinPath(s *scope, args []pyObject) pyObject {
@@ -729,20 +1005,44 @@ func selectFunc(s *scope, args []pyObject) pyObject {
 	if s.pkg != nil {
 		pkgName = s.pkg.Name
 	}
-	// This is not really the same as Bazel's order-of-matching rules, but is at least deterministic.
-	keys := d.Keys()
+	// Where several conditions match we follow Bazel in choosing the one that specialises all the
+	// others. Failing that we use the last in sorted order, which is at least deterministic.
+	keys := append([]string{}, d.Keys()...)
+	sort.Strings(keys)
+	var match *core.BuildTarget
+	var matchKey string
 	for i := len(keys) - 1; i >= 0; i-- {
 		k := keys[i]
 		if k == "//conditions:default" || k == "default" {
-			def = d[k]
-		} else if selectTarget(s, core.ParseBuildLabel(k, pkgName)).HasLabel("config:on") {
-			return d[k]
+			def = d.items[k]
+		} else if t := selectTarget(s, core.ParseBuildLabel(k, pkgName)); t.HasLabel("config:on") {
+			if match == nil || (specialises(t, match) && !specialises(match, t)) {
+				match = t
+				matchKey = k
+			}
+		}
+	}
+	if match != nil {
+		return d.items[matchKey]
+	} else if def == nil {
+		if msg := string(args[1].(pyString)); msg != "" {
+			s.Error("%s", msg)
 		}
+		s.Error("None of the select() conditions matched")
 	}
-	s.NAssert(def == nil, "None of the select() conditions matched")
 	return def
 }
 
+// specialises returns true if the config_setting t1 has all the conditions that t2 does.
+func specialises(t1, t2 *core.BuildTarget) bool {
+	for _, condition := range t2.PrefixedLabels("config_condition:") {
+		if !t1.HasLabel("config_condition:" + condition) {
+			return false
+		}
+	}
+	return true
+}
+
 // selectTarget returns the target to be used for a select() call.
 // It panics appropriately if the target isn't built yet.
 func selectTarget(s *scope, l core.BuildLabel) *core.BuildTarget {
@@ -798,6 +1098,11 @@ func subrepo(s *scope, args []pyObject) pyObject {
 	if s.state.Config.Bazel.Compatibility && s.pkg.Name == "workspace" {
 		sr.Name = s.pkg.SubrepoArchName(name)
 	}
+	s.pkg.NoWarmStart = true // Restoring the package wouldn't register the subrepo again.
+	if s.pkg.Subrepo != nil && s.pkg.Subrepo.IsCrossCompile && s.state.Graph.Subrepo(sr.Name) != nil {
+		// It's already been created as a variant of the host subrepo, which takes priority.
+		return pyString("///" + sr.Name)
+	}
 	log.Debug("Registering subrepo %s in package %s", sr.Name, s.pkg.Label())
 	s.state.Graph.MaybeAddSubrepo(sr)
 	return pyString("///" + sr.Name)
@@ -2,6 +2,7 @@ package asp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -34,12 +35,16 @@ type errorStack struct {
 	Readers []io.ReadSeeker
 	// The original error that was encountered.
 	err error
+	// Code classifying the error. If empty it is assumed to be an evaluation error.
+	code core.ErrorCode
 }
 
 // fail panics on lex/parse errors in a file.
 // For convenience we reuse errorStack although there is of course not really a call stack at this point.
 func fail(pos Position, message string, args ...interface{}) {
-	panic(AddStackFrame(pos, fmt.Errorf(message, args...)))
+	stack := AddStackFrame(pos, fmt.Errorf(message, args...)).(*errorStack)
+	stack.code = core.ErrorSyntax
+	panic(stack)
 }
 
 // AddStackFrame adds a new stack frame to the given errorStack, or wraps an existing error if not.
@@ -80,6 +85,28 @@ func (stack *errorStack) ShortError() string {
 	return stack.err.Error()
 }
 
+// BuildError returns a structured description of this error.
+func (stack *errorStack) BuildError() *core.BuildError {
+	code := stack.code
+	if code == "" {
+		code = core.ErrorEvaluation
+	}
+	err := core.NewBuildError(code, stack)
+	err.Message = stack.ShortError()
+	var inner *core.BuildError
+	if errors.As(stack.err, &inner) {
+		// Something called from the BUILD file failed in a way we know more about (e.g. a subinclude).
+		err.Code = inner.Code
+		err.Message = inner.Message
+		err.Suggestion = inner.Suggestion
+	}
+	if len(stack.Stack) > 0 {
+		frame := stack.Stack[0]
+		err.Position = &core.ErrorPosition{Filename: frame.Filename, Line: frame.Line, Column: frame.Column}
+	}
+	return err
+}
+
 // stackTrace returns the lines of stacktrace from the error.
 func (stack *errorStack) stackTrace() string {
 	ret := make([]string, len(stack.Stack))
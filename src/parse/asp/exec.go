@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -60,6 +61,14 @@ func doExec(s *scope, cmdIn pyObject, wantStdout bool, wantStderr bool, cacheOut
 		return s.Error("exec() must have at least stdout or stderr set to true, both can not be false"), false, nil
 	}
 
+	// Whatever the command outputs isn't something we can check later, so whatever depends on it
+	// can't be restored from the graph cache.
+	if s.pkg != nil {
+		s.pkg.NoWarmStart = true
+	} else {
+		atomic.StoreInt32(&s.interpreter.ranCommands, 1)
+	}
+
 	var argv []string
 	if isType(cmdIn, "str") {
 		argv = strings.Fields(string(cmdIn.(pyString)))
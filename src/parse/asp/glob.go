@@ -0,0 +1,76 @@
+package asp
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/thought-machine/please/src/fs"
+)
+
+// A globCache memoises the results of glob() calls while parsing a single package.
+// Large packages often contain many globs of the same patterns (e.g. one per target), each
+// of which would otherwise walk the same directories again.
+// It isn't kept for the lifetime of the interpreter since that can be long-lived (e.g. in the
+// language server), and files may be added or removed before the package is parsed again.
+type globCache struct {
+	mutex   sync.Mutex
+	entries map[globKey]*globEntry
+}
+
+// A globKey identifies a single glob pattern within a directory.
+type globKey struct {
+	dir, include, exclude string
+	hidden                bool
+}
+
+// A globEntry is a single entry in the cache. Concurrent callers of the same glob wait for the
+// first one to complete it rather than walking the directory tree themselves.
+type globEntry struct {
+	once  sync.Once
+	files []string
+	err   interface{}
+}
+
+// newGlobCache creates a new, empty globCache.
+func newGlobCache() *globCache {
+	return &globCache{entries: map[globKey]*globEntry{}}
+}
+
+// Glob is equivalent to fs.Glob, but each include pattern is only globbed once for each set
+// of excludes. The returned slice must not be modified.
+// A nil cache is valid and doesn't memoise anything.
+func (c *globCache) Glob(buildFileNames []string, rootPath string, includes, excludes []string, includeHidden bool) []string {
+	if c == nil {
+		return fs.Glob(buildFileNames, rootPath, includes, excludes, excludes, includeHidden)
+	}
+	if len(includes) == 1 {
+		return c.glob(buildFileNames, rootPath, includes[0], excludes, includeHidden)
+	}
+	filenames := []string{}
+	for _, include := range includes {
+		filenames = append(filenames, c.glob(buildFileNames, rootPath, include, excludes, includeHidden)...)
+	}
+	return filenames
+}
+
+// glob returns the results of globbing a single include pattern.
+func (c *globCache) glob(buildFileNames []string, rootPath, include string, excludes []string, includeHidden bool) []string {
+	key := globKey{dir: rootPath, include: include, exclude: strings.Join(excludes, "\x00"), hidden: includeHidden}
+	c.mutex.Lock()
+	entry, present := c.entries[key]
+	if !present {
+		entry = &globEntry{}
+		c.entries[key] = entry
+	}
+	c.mutex.Unlock()
+	entry.once.Do(func() {
+		defer func() {
+			entry.err = recover()
+		}()
+		entry.files = fs.Glob(buildFileNames, rootPath, []string{include}, excludes, excludes, includeHidden)
+	})
+	if entry.err != nil {
+		panic(entry.err) // fs.Glob panics on failure, so we do the same for everyone waiting on it.
+	}
+	return entry.files
+}
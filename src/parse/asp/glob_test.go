@@ -0,0 +1,46 @@
+package asp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/fs"
+)
+
+var globBuildFileNames = []string{"BUILD"}
+
+func TestGlobCache(t *testing.T) {
+	c := newGlobCache()
+	const root = "src/parse/asp/test_data"
+	includes := []string{"*.build", "interpreter/*.build"}
+	excludes := []string{"example*.build"}
+	expected := fs.Glob(globBuildFileNames, root, includes, excludes, excludes, false)
+	assert.Equal(t, expected, c.Glob(globBuildFileNames, root, includes, excludes, false))
+	assert.Equal(t, 2, len(c.entries))
+	// Globbing the same thing again shouldn't add any more entries.
+	assert.Equal(t, expected, c.Glob(globBuildFileNames, root, includes, excludes, false))
+	assert.Equal(t, 2, len(c.entries))
+	// A single pattern in common with the above should reuse its entry.
+	assert.Equal(t, fs.Glob(globBuildFileNames, root, includes[:1], excludes, excludes, false), c.Glob(globBuildFileNames, root, includes[:1], excludes, false))
+	assert.Equal(t, 2, len(c.entries))
+	// But different excludes should not.
+	assert.Equal(t, fs.Glob(globBuildFileNames, root, includes[:1], nil, nil, false), c.Glob(globBuildFileNames, root, includes[:1], nil, false))
+	assert.Equal(t, 3, len(c.entries))
+}
+
+func TestGlobCacheConcurrent(t *testing.T) {
+	c := newGlobCache()
+	const root = "src/parse/asp/test_data"
+	expected := fs.Glob(globBuildFileNames, root, []string{"**/*.build"}, nil, nil, false)
+	results := make(chan []string, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			results <- c.Glob(globBuildFileNames, root, []string{"**/*.build"}, nil, false)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, <-results)
+	}
+	assert.Equal(t, 1, len(c.entries))
+}
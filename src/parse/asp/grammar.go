@@ -134,9 +134,13 @@ type ValueExpression struct {
 	Int     *struct {
 		Int int
 	} // Should just be *int, but https://github.com/golang/go/issues/23498 :(
+	Float *struct {
+		Float float64
+	} // Similarly for *float64
 	Bool     string
 	List     *List
 	Dict     *Dict
+	Set      *List
 	Tuple    *List
 	Lambda   *Lambda
 	Ident    *IdentExpr
@@ -265,8 +269,14 @@ type Operator rune
 const (
 	// Add etc are arithmetic operators - these are implemented on a per-type basis
 	Add Operator = '+'
-	// Subtract implements binary - (only works on integers)
+	// Subtract implements binary - (only works on numbers)
 	Subtract = '-'
+	// Multiply implements * (only works on numbers)
+	Multiply = '*'
+	// Divide implements / which always gives a float, as in Python 3.
+	Divide = '/'
+	// FloorDivide implements //
+	FloorDivide = '⌊'
 	// Modulo implements % (including string interpolation)
 	Modulo = '%'
 	// LessThan implements <
@@ -311,6 +321,9 @@ func (o Operator) String() string {
 var operators = map[string]Operator{
 	"+":      Add,
 	"-":      Subtract,
+	"*":      Multiply,
+	"/":      Divide,
+	"//":     FloorDivide,
 	"%":      Modulo,
 	"<":      LessThan,
 	">":      GreaterThan,
@@ -231,7 +231,7 @@ func (p *parser) parseFuncDef() *FuncDef {
 		p.next('-')
 		p.next('>')
 
-		tok := p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+		tok := p.oneofval("bool", "str", "int", "float", "list", "dict", "set", "struct", "depset", "function", "config")
 		fd.Return = tok.Value
 	}
 
@@ -266,7 +266,7 @@ func (p *parser) parseArgument() Argument {
 	if tok.Type == ':' {
 		// Type annotations
 		for {
-			tok = p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+			tok = p.oneofval("bool", "str", "int", "float", "list", "dict", "set", "struct", "depset", "function", "config")
 			a.Type = append(a.Type, tok.Value)
 			if !p.optional('|') {
 				break
@@ -386,40 +386,59 @@ func (p *parser) parseUnconditionalExpression() *Expression {
 }
 
 func (p *parser) parseUnconditionalExpressionInPlace(e *Expression) {
-	if tok := p.l.Peek(); tok.Type == '-' || tok.Value == "not" {
-		p.l.Next()
-		var valueExp *ValueExpression
-		valueExp = p.parseValueExpression()
-		e.UnaryOp = &UnaryOp{
-			Op:   tok.Value,
-			Expr: *valueExp,
+	p.parseUnaryExpressionInPlace(e)
+	for {
+		tok := p.l.Peek()
+		if tok.Value == "not" {
+			// Hack for "not in" which needs an extra token.
+			p.l.Next()
+			tok = p.l.Peek()
+			p.assert(tok.Value == "in", tok, "expected 'in', not %s", tok.Value)
+			tok.Value = "not in"
+			p.endPos = tok.EndPos()
+		}
+		op, present := operators[tok.Value]
+		if !present {
+			return
 		}
-	} else {
-		e.Val = p.parseValueExpression()
-	}
-	tok := p.l.Peek()
-	if tok.Value == "not" {
-		// Hack for "not in" which needs an extra token.
-		p.l.Next()
-		tok = p.l.Peek()
-		p.assert(tok.Value == "in", tok, "expected 'in', not %s", tok.Value)
-		tok.Value = "not in"
-		p.endPos = tok.EndPos()
-	}
-	if op, present := operators[tok.Value]; present {
 		tok = p.l.Next()
 		o := &e.Op[p.newElement(&e.Op)]
 		o.Op = op
+		if op == Multiply || op == Divide || op == FloorDivide {
+			// These bind more tightly than anything else, so they only take the immediately following
+			// value and we carry on looking for more operators afterwards.
+			o.Expr = &Expression{Pos: p.l.Peek().Pos}
+			p.parseUnaryExpressionInPlace(o.Expr)
+			o.Expr.EndPos = p.endPos
+			continue
+		}
 		o.Expr = p.parseUnconditionalExpression()
-		if len(o.Expr.Op) > 0 {
-			if op := o.Expr.Op[0].Op; op == And || op == Or || op == Is {
+		for i, op := range o.Expr.Op {
+			if op.Op == And || op.Op == Or || op.Op == Is {
 				// Hoist logical operator back up here to fix precedence. This is a bit of a hack and
 				// might not be perfect in all cases...
-				e.Op = append(e.Op, o.Expr.Op...)
-				o.Expr.Op = nil
+				e.Op = append(e.Op, o.Expr.Op[i:]...)
+				o.Expr.Op = o.Expr.Op[:i]
+				break
 			}
 		}
 		p.l.Peek()
+		return
+	}
+}
+
+// parseUnaryExpressionInPlace parses a value expression, possibly preceded by a unary operator.
+func (p *parser) parseUnaryExpressionInPlace(e *Expression) {
+	if tok := p.l.Peek(); tok.Type == '-' || tok.Value == "not" {
+		p.l.Next()
+		var valueExp *ValueExpression
+		valueExp = p.parseValueExpression()
+		e.UnaryOp = &UnaryOp{
+			Op:   tok.Value,
+			Expr: *valueExp,
+		}
+	} else {
+		e.Val = p.parseValueExpression()
 	}
 }
 
@@ -441,6 +460,12 @@ func (p *parser) parseValueExpression() *ValueExpression {
 		p.assert(err == nil, tok, "invalid int value %s", tok) // Theoretically the lexer shouldn't have fed us this...
 		ve.Int.Int = i
 		p.endPos = p.l.Next().EndPos()
+	} else if tok.Type == Float {
+		p.initField(&ve.Float)
+		f, err := strconv.ParseFloat(tok.Value, 64)
+		p.assert(err == nil, tok, "invalid float value %s", tok)
+		ve.Float.Float = f
+		p.endPos = p.l.Next().EndPos()
 	} else if tok.Value == "False" || tok.Value == "True" || tok.Value == "None" {
 		ve.Bool = tok.Value
 		p.endPos = p.l.Next().EndPos()
@@ -449,7 +474,7 @@ func (p *parser) parseValueExpression() *ValueExpression {
 	} else if tok.Type == '(' {
 		ve.Tuple = p.parseList('(', ')')
 	} else if tok.Type == '{' {
-		ve.Dict = p.parseDict()
+		p.parseDictOrSet(ve)
 	} else if tok.Value == "lambda" {
 		ve.Lambda = p.parseLambda()
 	} else if tok.Type == Ident {
@@ -585,12 +610,51 @@ func (p *parser) parseList(opening, closing rune) *List {
 	return l
 }
 
-func (p *parser) parseDict() *Dict {
-	d := &Dict{}
+// parseDictOrSet parses either a dict or a set literal, which we can't tell apart until after
+// the first item. As in Python, {} is an empty dict.
+func (p *parser) parseDictOrSet(ve *ValueExpression) {
 	p.next('{')
+	if p.l.Peek().Type == '}' {
+		ve.Dict = &Dict{}
+		p.endPos = p.l.Next().EndPos()
+		return
+	}
+	first := p.parseExpression()
+	if p.l.Peek().Type == ':' {
+		ve.Dict = p.parseDict(first)
+	} else {
+		ve.Set = p.parseSet(first)
+	}
+}
+
+func (p *parser) parseSet(first *Expression) *List {
+	l := &List{Values: []*Expression{first}}
+	if p.optional(',') {
+		for tok := p.l.Peek(); tok.Type != '}'; tok = p.l.Peek() {
+			l.Values = append(l.Values, p.parseExpression())
+			if !p.optional(',') {
+				break
+			}
+		}
+	}
+	if tok := p.l.Peek(); tok.Value == "for" {
+		p.assert(len(l.Values) == 1, tok, "Must have exactly 1 item in a set comprehension")
+		l.Comprehension = p.parseComprehension()
+	}
+	p.endPos = p.next('}').EndPos()
+	return l
+}
+
+func (p *parser) parseDict(firstKey *Expression) *Dict {
+	d := &Dict{}
 	for tok := p.l.Peek(); tok.Type != '}'; tok = p.l.Peek() {
 		di := &DictItem{}
-		p.parseExpressionInPlace(&di.Key)
+		if firstKey != nil {
+			di.Key = *firstKey
+			firstKey = nil
+		} else {
+			p.parseExpressionInPlace(&di.Key)
+		}
 		p.next(':')
 		p.parseExpressionInPlace(&di.Value)
 		d.Items = append(d.Items, di)
@@ -13,11 +13,14 @@ import (
 type interpreter struct {
 	scope           *scope
 	parser          *Parser
-	subincludes     map[string]pyDict
+	subincludes     map[string]*subincludeResult
 	config          map[*core.Configuration]*pyConfig
 	mutex           sync.RWMutex
 	configMutex     sync.RWMutex
 	breakpointMutex sync.Mutex
+	// Set if we've run commands outside of any package (e.g. at the top level of a subinclude),
+	// which we can't attribute to the packages that depend on them.
+	ranCommands int32
 }
 
 // newInterpreter creates and returns a new interpreter instance.
@@ -25,12 +28,12 @@ type interpreter struct {
 func newInterpreter(state *core.BuildState, p *Parser) *interpreter {
 	s := &scope{
 		state:  state,
-		locals: map[string]pyObject{},
+		locals: newPyDict(0),
 	}
 	i := &interpreter{
 		scope:       s,
 		parser:      p,
-		subincludes: map[string]pyDict{},
+		subincludes: map[string]*subincludeResult{},
 		config:      map[*core.Configuration]*pyConfig{},
 	}
 	s.interpreter = i
@@ -77,6 +80,7 @@ func (i *interpreter) loadBuiltinStatements(s *scope, statements []*Statement, e
 // The first return value is for testing only.
 func (i *interpreter) interpretAll(pkg *core.Package, statements []*Statement) (s *scope, err error) {
 	s = i.scope.NewPackagedScope(pkg)
+	s.globs = newGlobCache()
 	// Config needs a little separate tweaking.
 	// Annoyingly we'd like to not have to do this at all, but it's very hard to handle
 	// mutating operations like .setdefault() otherwise.
@@ -103,13 +107,21 @@ func (i *interpreter) interpretStatements(s *scope, statements []*Statement) (re
 	return s.interpretStatements(statements), nil // Would have panicked if there was an error
 }
 
-// Subinclude returns the global values corresponding to subincluding the given file.
-func (i *interpreter) Subinclude(path string, pkg *core.Package) pyDict {
+// A subincludeResult is what we remember about a file that's been subincluded.
+type subincludeResult struct {
+	globals *pyDict
+	// Labels of any subincludes made while loading it; anything that subincludes it depends on those too.
+	labels []core.BuildLabel
+}
+
+// Subinclude returns the global values corresponding to subincluding the given file, along with
+// the labels of any other subincludes that it made itself (transitively).
+func (i *interpreter) Subinclude(path string, pkg *core.Package) (*pyDict, []core.BuildLabel) {
 	i.mutex.RLock()
-	globals, present := i.subincludes[path]
+	result, present := i.subincludes[path]
 	i.mutex.RUnlock()
 	if present {
-		return globals
+		return result.globals, result.labels
 	}
 	// If we get here, it's not been subincluded already. Parse it now.
 	// Note that there is a race here whereby it's possible for two packages to parse the same
@@ -122,6 +134,7 @@ func (i *interpreter) Subinclude(path string, pkg *core.Package) pyDict {
 	stmts = i.parser.optimise(stmts)
 	s := i.scope.NewScope()
 	s.contextPkg = pkg
+	s.subincludes = &[]core.BuildLabel{}
 	// Scope needs a local version of CONFIG
 	s.config = i.scope.config.Copy()
 	s.Set("CONFIG", s.config)
@@ -129,12 +142,12 @@ func (i *interpreter) Subinclude(path string, pkg *core.Package) pyDict {
 	s.interpretStatements(stmts)
 	locals := s.Freeze()
 	if s.config.overlay == nil {
-		delete(locals, "CONFIG") // Config doesn't have any local modifications
+		locals.Delete("CONFIG") // Config doesn't have any local modifications
 	}
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
-	i.subincludes[path] = locals
-	return s.locals
+	i.subincludes[path] = &subincludeResult{globals: locals, labels: *s.subincludes}
+	return s.locals, *s.subincludes
 }
 
 // getConfig returns a new configuration object for the given configuration object.
@@ -189,10 +202,15 @@ type scope struct {
 	pkg         *core.Package
 	contextPkg  *core.Package // used during subincludes
 	parent      *scope
-	locals      pyDict
+	locals      *pyDict
 	config      *pyConfig
+	globs       *globCache
+	// If set, records the labels of any subincludes made while loading a subincluded file.
+	subincludes *[]core.BuildLabel
 	// True if this scope is for a pre- or post-build callback.
 	Callback bool
+	// The function called from the BUILD file that we're currently within, if any.
+	rule string
 }
 
 // NewScope creates a new child scope of this one.
@@ -208,9 +226,12 @@ func (s *scope) NewPackagedScope(pkg *core.Package) *scope {
 		pkg:         pkg,
 		contextPkg:  pkg,
 		parent:      s,
-		locals:      pyDict{},
+		locals:      newPyDict(0),
 		config:      s.config,
+		globs:       s.globs,
+		subincludes: s.subincludes,
 		Callback:    s.Callback,
+		rule:        s.rule,
 	}
 	if pkg != nil && pkg.Subrepo != nil && pkg.Subrepo.State != nil {
 		s2.state = pkg.Subrepo.State
@@ -218,6 +239,24 @@ func (s *scope) NewPackagedScope(pkg *core.Package) *scope {
 	return s2
 }
 
+// registerSubinclude records that the current package subincludes the given label, as does
+// the file being subincluded if there is one (so other packages that subinclude it pick it up too).
+func (s *scope) registerSubinclude(l core.BuildLabel) {
+	s.contextPkg.RegisterSubinclude(l)
+	if s.subincludes != nil {
+		*s.subincludes = append(*s.subincludes, l)
+	}
+}
+
+// subinclude loads the given file and sets all its globals into this scope.
+func (s *scope) subinclude(filename string, pkg *core.Package) {
+	globals, labels := s.interpreter.Subinclude(filename, pkg)
+	for _, l := range labels {
+		s.registerSubinclude(l)
+	}
+	s.SetAll(globals, false)
+}
+
 // Error emits an error that stops further interpretation.
 // For convenience it is declared to return a pyObject but it never actually returns.
 func (s *scope) Error(msg string, args ...interface{}) pyObject {
@@ -241,7 +280,7 @@ func (s *scope) NAssert(condition bool, msg string, args ...interface{}) {
 // Lookup looks up a variable name in this scope, walking back up its ancestor scopes as needed.
 // It panics if the variable is not defined.
 func (s *scope) Lookup(name string) pyObject {
-	if obj, present := s.locals[name]; present {
+	if obj, present := s.locals.Get(name); present {
 		return obj
 	} else if s.parent != nil {
 		return s.parent.Lookup(name)
@@ -254,35 +293,37 @@ func (s *scope) Lookup(name string) pyObject {
 // This is typically used for things like function arguments where we're only interested in variables
 // in immediate scope.
 func (s *scope) LocalLookup(name string) pyObject {
-	return s.locals[name]
+	obj, _ := s.locals.Get(name)
+	return obj
 }
 
 // Set sets the given variable in this scope.
 func (s *scope) Set(name string, value pyObject) {
-	s.locals[name] = value
+	s.locals.Set(name, value)
 }
 
 // SetAll sets all contents of the given dict in this scope.
 // Optionally it can filter to just public objects (i.e. those not prefixed with an underscore)
-func (s *scope) SetAll(d pyDict, publicOnly bool) {
-	for k, v := range d {
+func (s *scope) SetAll(d *pyDict, publicOnly bool) {
+	for _, k := range d.Keys() {
+		v := d.items[k]
 		if k == "CONFIG" {
 			// Special case; need to merge config entries rather than overwriting the entire object.
 			c, ok := v.(*pyFrozenConfig)
 			s.Assert(ok, "incoming CONFIG isn't a config object")
 			s.config.Merge(c)
 		} else if !publicOnly || k[0] != '_' {
-			s.locals[k] = v
+			s.locals.Set(k, v)
 		}
 	}
 }
 
 // Freeze freezes the contents of this scope, preventing mutable objects from being changed.
 // It returns the newly frozen set of locals.
-func (s *scope) Freeze() pyDict {
-	for k, v := range s.locals {
-		if f, ok := v.(freezable); ok {
-			s.locals[k] = f.Freeze()
+func (s *scope) Freeze() *pyDict {
+	for _, k := range s.locals.Keys() {
+		if f, ok := s.locals.items[k].(freezable); ok {
+			s.locals.Set(k, f.Freeze())
 		}
 	}
 	return s.locals
@@ -407,9 +448,11 @@ func (s *scope) interpretExpression(expr *Expression) pyObject {
 			} else {
 				obj = True
 			}
+		} else if f, ok := obj.(pyFloat); ok {
+			obj = -f
 		} else {
 			i, ok := obj.(pyInt)
-			s.Assert(ok, "Unary - can only be applied to an integer")
+			s.Assert(ok, "Unary - can only be applied to a number")
 			obj = pyInt(-int(i))
 		}
 	}
@@ -421,9 +464,9 @@ func (s *scope) interpretExpression(expr *Expression) pyObject {
 				obj = s.interpretExpression(op.Expr)
 			}
 		case Equal:
-			obj = newPyBool(reflect.DeepEqual(obj, s.interpretExpression(op.Expr)))
+			obj = newPyBool(equal(obj, s.interpretExpression(op.Expr)))
 		case NotEqual:
-			obj = newPyBool(!reflect.DeepEqual(obj, s.interpretExpression(op.Expr)))
+			obj = newPyBool(!equal(obj, s.interpretExpression(op.Expr)))
 		case Is:
 			// Is only works None or boolean types.
 			expr := s.interpretExpression(op.Expr)
@@ -480,12 +523,16 @@ func (s *scope) interpretValueExpressionPart(expr *ValueExpression) pyObject {
 		return s.interpretFString(expr.FString)
 	} else if expr.Int != nil {
 		return pyInt(expr.Int.Int)
+	} else if expr.Float != nil {
+		return pyFloat(expr.Float.Float)
 	} else if expr.Bool != "" {
 		return s.Lookup(expr.Bool)
 	} else if expr.List != nil {
 		return s.interpretList(expr.List)
 	} else if expr.Dict != nil {
 		return s.interpretDict(expr.Dict)
+	} else if expr.Set != nil {
+		return newPySet(s.interpretList(expr.Set))
 	} else if expr.Tuple != nil {
 		// Parentheses can also indicate precedence; a single parenthesised expression does not create a list object.
 		l := s.interpretList(expr.Tuple)
@@ -615,7 +662,7 @@ func (s *scope) interpretList(expr *List) pyList {
 
 func (s *scope) interpretDict(expr *Dict) pyObject {
 	if expr.Comprehension == nil {
-		d := make(pyDict, len(expr.Items))
+		d := newPyDict(len(expr.Items))
 		for _, v := range expr.Items {
 			d.IndexAssign(s.interpretExpression(&v.Key), s.interpretExpression(&v.Value))
 		}
@@ -623,7 +670,7 @@ func (s *scope) interpretDict(expr *Dict) pyObject {
 	}
 	cs := s.NewScope()
 	l := cs.iterate(expr.Comprehension.Expr)
-	ret := make(pyDict, len(l))
+	ret := newPyDict(len(l))
 	cs.evaluateComprehension(l, expr.Comprehension, func(li pyObject) {
 		ret.IndexAssign(cs.interpretExpression(&expr.Items[0].Key), cs.interpretExpression(&expr.Items[0].Value))
 	})
@@ -672,19 +719,54 @@ func (s *scope) unpackNames(names []string, obj pyObject) {
 	}
 }
 
-// iterate returns the result of the given expression as a pyList, which is our only iterable type.
+// iterate returns the result of the given expression as a pyList, which is our only iterable type
+// (sets are iterated as a list of their items).
 func (s *scope) iterate(expr *Expression) pyList {
 	o := s.interpretExpression(expr)
 	l, ok := o.(pyList)
 	if !ok {
 		if l, ok := o.(pyFrozenList); ok {
 			return l.pyList
+		} else if set, ok := asIterableSet(o); ok {
+			return set.items
 		}
 	}
 	s.Assert(ok, "Non-iterable type %s; must be a list", o.Type())
 	return l
 }
 
+// equal returns true if the two objects are equal.
+func equal(a, b pyObject) bool {
+	if sa, ok := asIterableSet(a); ok {
+		sb, ok := asIterableSet(b)
+		return ok && sa.Equals(sb)
+	} else if da, ok := asDict(a); ok {
+		// Dicts are equal regardless of their iteration order.
+		db, ok := asDict(b)
+		return ok && reflect.DeepEqual(da.items, db.items)
+	} else if sa, ok := a.(*pyStruct); ok {
+		sb, ok := b.(*pyStruct)
+		return ok && sa.Equals(sb)
+	} else if fa, ok := asFloat(a); ok {
+		// Ints and floats compare equal if they have the same value, as in Python.
+		fb, ok := asFloat(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// asFloat returns the value of the given object as a float, if it is a number.
+// Note that booleans are not considered to be numbers here.
+func asFloat(obj pyObject) (pyFloat, bool) {
+	switch t := obj.(type) {
+	case pyFloat:
+		return t, true
+	case pyInt:
+		return pyFloat(t), true
+	}
+	return 0, false
+}
+
 // evaluateExpressions runs a series of Python expressions in this scope and creates a series of concrete objects from them.
 func (s *scope) evaluateExpressions(exprs []*Expression) []pyObject {
 	l := make(pyList, len(exprs))
@@ -719,7 +801,7 @@ func (s *scope) Constant(expr *Expression) pyObject {
 		return expr.Optimised.Constant
 	} else if expr.Val == nil || len(expr.Val.Slices) != 0 || expr.Val.Property != nil || expr.Val.Call != nil || expr.Op != nil || expr.If != nil {
 		return nil
-	} else if expr.Val.Bool != "" || expr.Val.String != "" || expr.Val.Int != nil {
+	} else if expr.Val.Bool != "" || expr.Val.String != "" || expr.Val.Int != nil || expr.Val.Float != nil {
 		return s.interpretValueExpression(expr.Val)
 	} else if expr.Val.List != nil && expr.Val.List.Comprehension == nil {
 		// Lists can be constant if all their elements are also.
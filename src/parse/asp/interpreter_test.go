@@ -4,12 +4,17 @@
 package asp
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 )
 
@@ -67,6 +72,35 @@ func TestOperators(t *testing.T) {
 	assert.True(t, s.Lookup("z").IsTruthy())
 }
 
+func TestFloats(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/floats.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3.5, s.Lookup("a"))
+	assert.EqualValues(t, 3.5, s.Lookup("b"))
+	assert.EqualValues(t, 3, s.Lookup("c"))
+	assert.EqualValues(t, -4, s.Lookup("d"))
+	assert.EqualValues(t, 10, s.Lookup("e"))
+	assert.EqualValues(t, 14, s.Lookup("f"))
+	assert.EqualValues(t, True, s.Lookup("g"))
+	assert.EqualValues(t, True, s.Lookup("h"))
+	assert.EqualValues(t, "timeout: 3.5", s.Lookup("i"))
+	assert.EqualValues(t, "2.0", s.Lookup("j"))
+	assert.EqualValues(t, 2, s.Lookup("k"))
+	assert.EqualValues(t, 1.25, s.Lookup("l"))
+	assert.EqualValues(t, "0.33", s.Lookup("m"))
+	assert.EqualValues(t, -3.0, s.Lookup("n"))
+	assert.EqualValues(t, 3.0, s.Lookup("o"))
+	assert.EqualValues(t, 0.5, s.Lookup("p"))
+	assert.EqualValues(t, -0.5, s.Lookup("q"))
+	assert.EqualValues(t, 1.5, s.Lookup("r"))
+}
+
+func TestFloatDivisionByZero(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/division_by_zero.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "float division by zero")
+}
+
 func TestInterpolation(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/interpolation.build")
 	require.NoError(t, err)
@@ -225,6 +259,28 @@ func TestStrings(t *testing.T) {
 	assert.EqualValues(t, "acpi base64 basename blkid blockdev bunzip2 bzcat cal cat catv chattr\nwhoami xargs xxd yes", s.Lookup("TOYS3"))
 }
 
+func TestStringMethods(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/string_methods.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, pyList{pyString("a/b/c"), pyString("d")}, s.Lookup("a"))
+	assert.EqualValues(t, pyList{pyString("a"), pyString("b"), pyString("c"), pyString("d")}, s.Lookup("b"))
+	assert.EqualValues(t, pyList{pyString("a"), pyString("b"), pyString("c")}, s.Lookup("c"))
+	assert.EqualValues(t, pyList{pyString("mickey"), pyString("donald"), pyString(""), pyString("goofy")}, s.Lookup("d"))
+	assert.EqualValues(t, pyList{pyString("mickey\n"), pyString("donald")}, s.Lookup("e"))
+	assert.EqualValues(t, pyList{}, s.Lookup("f"))
+	assert.EqualValues(t, "00042", s.Lookup("g"))
+	assert.EqualValues(t, "-0042", s.Lookup("h"))
+	assert.EqualValues(t, "12345", s.Lookup("i"))
+	assert.EqualValues(t, " abc  ", s.Lookup("j"))
+	assert.EqualValues(t, "**abc**", s.Lookup("k"))
+	assert.EqualValues(t, "Hello World It'S 2Pm", s.Lookup("l"))
+	assert.EqualValues(t, pyList{pyString("python.pkg"), pyString("."), pyString("module")}, s.Lookup("m"))
+	assert.EqualValues(t, pyList{pyString("a--b"), pyString("--"), pyString("c")}, s.Lookup("n"))
+	// The lexer doesn't support \r escapes, so check the other line endings directly.
+	assert.EqualValues(t, pyList{pyString("a"), pyString("b"), pyString("c")}, strSplitLines(nil, []pyObject{pyString("a\r\nb\rc"), False}))
+	assert.EqualValues(t, pyList{pyString("a\r\n"), pyString("b\r")}, strSplitLines(nil, []pyObject{pyString("a\r\nb\r"), True}))
+}
+
 func TestArgumentCompatibility(t *testing.T) {
 	// This isn't a totally obvious property of the interpreter, but when an argument specifies
 	// a type and is given None, we adopt the default. This allows external functions to use None
@@ -264,7 +320,8 @@ func TestSubincludeConfig(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/partition.build")
 	assert.NoError(t, err)
 	pkg := core.NewPackage("test")
-	s.SetAll(s.interpreter.Subinclude("src/parse/asp/test_data/interpreter/subinclude_config.build", pkg), false)
+	globals, _ := s.interpreter.Subinclude("src/parse/asp/test_data/interpreter/subinclude_config.build", pkg)
+	s.SetAll(globals, false)
 	assert.EqualValues(t, "test test", s.config.Get("test", None))
 }
 
@@ -274,6 +331,14 @@ func TestValidateReturnVal(t *testing.T) {
 	assert.Error(t, err, "Invalid return type str from function dict_val, expecting dict")
 }
 
+func TestEvaluationErrorCode(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/return_type.build")
+	assert.Error(t, err)
+	be := core.AsBuildError(err, core.BuildLabel{PackageName: "test/package", Name: "all"}, core.ParseFailed)
+	assert.Equal(t, core.ErrorEvaluation, be.Code)
+	assert.NotNil(t, be.Position)
+}
+
 func TestLen(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/len.build")
 	assert.NoError(t, err)
@@ -300,9 +365,248 @@ func TestSubincludeAll(t *testing.T) {
 func TestDictUnion(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/dict_union.build")
 	assert.NoError(t, err)
-	assert.EqualValues(t, pyDict{
+	z := s.Lookup("z").(*pyDict)
+	assert.Equal(t, []string{"goofy", "donald", "mickey"}, z.Keys())
+	assert.EqualValues(t, map[string]pyObject{
 		"mickey": pyInt(1),
 		"donald": pyInt(2),
 		"goofy":  pyInt(3),
-	}, s.Lookup("z"))
+	}, z.items)
+}
+
+func TestDictOrdering(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/dict_ordering.build")
+	require.NoError(t, err)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("daisy")}, s.Lookup("keys"))
+	assert.Equal(t, pyList{pyInt(5), pyInt(2), pyInt(3), pyInt(4)}, s.Lookup("values"))
+	assert.Equal(t, pyList{
+		pyList{pyString("mickey"), pyInt(5)},
+		pyList{pyString("donald"), pyInt(2)},
+		pyList{pyString("goofy"), pyInt(3)},
+		pyList{pyString("daisy"), pyInt(4)},
+	}, s.Lookup("items"))
+	assert.Equal(t, []string{"mickey", "goofy", "daisy"}, s.Lookup("comprehension").(*pyDict).Keys())
+	assert.EqualValues(t, "mickey=5 donald=2 goofy=3 daisy=4", s.Lookup("cmd"))
+	assert.EqualValues(t, `{"mickey": 5, "donald": 2, "goofy": 3, "daisy": 4}`, s.Lookup("s"))
+	assert.EqualValues(t, `{"mickey":5,"donald":2,"goofy":3,"daisy":4}`, s.Lookup("j"))
+	assert.Equal(t, s.Lookup("keys"), fromStringList(s.Lookup("copied").(*pyDict).Keys()))
+	assert.EqualValues(t, True, s.Lookup("equal"))
+}
+
+func TestSortedKey(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sorted_key.build")
+	require.NoError(t, err)
+	assert.Equal(t, pyList{pyString("goofy"), pyString("daisy"), pyString("mickey"), pyString("donald")}, s.Lookup("by_len"))
+	assert.Equal(t, pyList{pyString("mickey"), pyString("goofy"), pyString("donald"), pyString("daisy")}, s.Lookup("rev"))
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("daisy")}, s.Lookup("by_len_reversed"))
+	assert.Equal(t, pyList{pyString("donald"), pyString("mickey"), pyString("goofy"), pyString("daisy")}, s.Lookup("by_last"))
+	assert.Equal(t, pyList{pyString("a"), pyString("b"), pyString("c")}, s.Lookup("dict_keys"))
+}
+
+func TestMinMax(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sorted_key.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "goofy", s.Lookup("shortest"))
+	assert.EqualValues(t, "mickey", s.Lookup("longest"))
+	assert.EqualValues(t, 1, s.Lookup("smallest"))
+	assert.EqualValues(t, "c", s.Lookup("largest"))
+}
+
+func TestSets(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sets.build")
+	require.NoError(t, err)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("daisy")}, s.Lookup("a").(*pySet).items)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("pluto")}, s.Lookup("c").(*pySet).items)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("goofy")}, s.Lookup("d").(*pySet).items)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("minnie")}, s.Lookup("e").(*pySet).items)
+	assert.Equal(t, pyList{pyString("mickey"), pyString("goofy")}, s.Lookup("f").(*pySet).items)
+	assert.Equal(t, True, s.Lookup("g"))
+	assert.Equal(t, True, s.Lookup("h"))
+	assert.EqualValues(t, 4, s.Lookup("i"))
+	assert.Equal(t, pyList{pyString("donald"), pyString("goofy"), pyString("mickey"), pyString("pluto")}, s.Lookup("j"))
+	assert.Equal(t, pyList{pyString("mickey"), pyString("donald"), pyString("goofy"), pyString("daisy")}, s.Lookup("k"))
+	assert.Equal(t, pyList{pyString("DONALD"), pyString("PLUTO")}, s.Lookup("l").(*pySet).items)
+	assert.Equal(t, True, s.Lookup("m"))
+	assert.Equal(t, True, s.Lookup("o"))
+	assert.EqualValues(t, `["mickey","donald","goofy","daisy"]`, s.Lookup("p"))
+}
+
+func TestFrozenSet(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/frozen_set.build")
+	assert.Error(t, err)
+}
+
+func TestStructs(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/structs.build")
+	require.NoError(t, err)
+	assert.Equal(t, "struct", s.Lookup("a").Type())
+	assert.EqualValues(t, "mickey", s.Lookup("b"))
+	assert.Equal(t, pyFrozenList{pyList{pyString("mickey.go")}}, s.Lookup("c"))
+	assert.Equal(t, True, s.Lookup("d"))
+	assert.Equal(t, True, s.Lookup("e"))
+	assert.Equal(t, []string{"name", "srcs", "visible"}, s.Lookup("f").(*pyDict).Keys())
+	assert.EqualValues(t, "mickey", s.Lookup("g"))
+	assert.Equal(t, True, s.Lookup("h"))
+	assert.EqualValues(t, `struct(x = 1, y = "y")`, s.Lookup("i"))
+	assert.EqualValues(t, `{"name":"mickey","srcs":["mickey.go"],"visible":true}`, s.Lookup("j"))
+	assert.Equal(t, 0, s.Lookup("k").(*pyStruct).fields.Len())
+}
+
+func TestStructImmutable(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/struct_immutable.build")
+	assert.Error(t, err)
+}
+
+func TestDepsets(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/depsets.build")
+	require.NoError(t, err)
+	assert.Equal(t, pyList{pyString("d"), pyString("b1"), pyString("b2"), pyString("c"), pyString("a")}, s.Lookup("postorder"))
+	assert.Equal(t, pyList{pyString("a"), pyString("b1"), pyString("b2"), pyString("d"), pyString("c")}, s.Lookup("preorder"))
+	assert.Equal(t, pyList{pyString("a"), pyString("b"), pyString("c"), pyString("d")}, s.Lookup("topological"))
+	assert.Equal(t, pyList{pyString("d"), pyString("b1"), pyString("b2"), pyString("c")}, s.Lookup("union"))
+	assert.Equal(t, True, s.Lookup("contains"))
+	assert.Equal(t, True, s.Lookup("not_contains"))
+	assert.Equal(t, True, s.Lookup("empty"))
+	assert.Equal(t, True, s.Lookup("nonempty"))
+	assert.EqualValues(t, `["x","y"]`, s.Lookup("j"))
+	assert.Equal(t, True, s.Lookup("i"))
+}
+
+func TestDepsetOrder(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/depset_order.build")
+	assert.Error(t, err)
+}
+
+func TestResourceLimits(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/resource_limits.build")
+	require.NoError(t, err)
+	target := s.pkg.Target("limited")
+	assert.Equal(t, 2, target.CPULimit)
+	assert.EqualValues(t, 2*1024*1024*1024, target.MemoryLimit)
+	target = s.pkg.Target("bytes")
+	assert.Equal(t, 0, target.CPULimit)
+	assert.EqualValues(t, 1048576, target.MemoryLimit)
+	target = s.pkg.Target("unlimited")
+	assert.Equal(t, 0, target.CPULimit)
+	assert.EqualValues(t, 0, target.MemoryLimit)
+}
+
+func TestBudgets(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/budgets.build")
+	require.NoError(t, err)
+	target := s.pkg.Target("budgeted")
+	assert.EqualValues(t, 50*1000*1000, target.OutputSizeBudget)
+	assert.Equal(t, 2*time.Minute, target.BuildDurationBudget)
+	assert.EqualValues(t, 0, target.TestDurationBudget)
+	target = s.pkg.Target("seconds")
+	assert.EqualValues(t, 0, target.OutputSizeBudget)
+	assert.Equal(t, 30*time.Second, target.BuildDurationBudget)
+	assert.Equal(t, 90*time.Second, target.TestDurationBudget)
+	target = s.pkg.Target("unbudgeted")
+	assert.EqualValues(t, 0, target.OutputSizeBudget)
+	assert.EqualValues(t, 0, target.BuildDurationBudget)
+}
+
+func TestTestEnvAndFixtures(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/test_env.build")
+	require.NoError(t, err)
+	target := s.pkg.Target("test")
+	assert.Equal(t, map[string]string{"DATABASE_URL": "postgres://localhost"}, target.TestEnv)
+	fixture := core.ParseBuildLabel("//test/package:fixture", "")
+	assert.Equal(t, []core.BuildLabel{fixture}, target.Fixtures)
+	assert.Equal(t, []core.BuildInput{fixture}, target.Data)
+}
+
+func TestExecProperties(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/exec_properties.build")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"gpu": "true", "pool": "large"}, s.pkg.Target("gpu").ExecProperties)
+	assert.Nil(t, s.pkg.Target("default").ExecProperties)
+}
+
+func TestRuleKind(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/rule_kind.build")
+	require.NoError(t, err)
+	assert.Equal(t, "build_rule", s.pkg.Target("direct").Kind)
+	assert.Equal(t, "my_library", s.pkg.Target("lib").Kind)
+	assert.Equal(t, "my_library", s.pkg.Target("lib#lib").Kind)
+}
+
+func parseConfigFile(filename string) (*scope, error) {
+	state := core.NewDefaultBuildState()
+	state.Config.Build.Arch = cli.NewArch("linux", "amd64")
+	state.Config.BuildConfig = map[string]string{"foo": "bar"}
+	parser := NewParser(state)
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	parser.MustLoadBuiltins("config_rules.build_defs", nil, rules.MustAsset("config_rules.build_defs.gob"))
+	statements, err := parser.parse(filename)
+	if err != nil {
+		panic(err)
+	}
+	return parser.interpreter.interpretAll(core.NewPackage("test/package"), statements)
+}
+
+func TestConfigSetting(t *testing.T) {
+	s, err := parseConfigFile("src/parse/asp/test_data/interpreter/config_setting.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, "linux", s.Lookup("os"))
+	assert.EqualValues(t, "linux_x86_64", s.Lookup("specialised"))
+	assert.EqualValues(t, "not arm", s.Lookup("arm"))
+	assert.EqualValues(t, "defined", s.Lookup("define"))
+}
+
+func TestSelectNoMatchError(t *testing.T) {
+	_, err := parseConfigFile("src/parse/asp/test_data/interpreter/select_no_match.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Only darwin is supported")
+}
+
+func TestGlobNotCachedBetweenParses(t *testing.T) {
+	const dir = "test_glob_reparse"
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), nil, 0644))
+	state := core.NewDefaultBuildState()
+	parser := NewParser(state)
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	statements, err := parser.ParseData([]byte(`files = glob(["*.txt"])`), path.Join(dir, "BUILD"))
+	require.NoError(t, err)
+	s, err := parser.interpreter.interpretAll(core.NewPackage(dir), statements)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyList{pyString("a.txt")}, s.Lookup("files"))
+	// Reparsing the package (e.g. in the language server) should see the new file.
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "b.txt"), nil, 0644))
+	s, err = parser.interpreter.interpretAll(core.NewPackage(dir), statements)
+	require.NoError(t, err)
+	assert.EqualValues(t, pyList{pyString("a.txt"), pyString("b.txt")}, s.Lookup("files"))
+}
+
+func TestNestedSubincludes(t *testing.T) {
+	const pkgName = "test_nested_subinclude"
+	state := core.NewDefaultBuildState()
+	addDefs := func(name, contents string) core.BuildLabel {
+		target := core.NewBuildTarget(core.BuildLabel{PackageName: pkgName, Name: name})
+		target.Visibility = core.WholeGraph
+		target.AddOutput(name + ".build_defs")
+		target.SetState(core.Built)
+		state.Graph.AddTarget(target)
+		require.NoError(t, os.MkdirAll(target.OutDir(), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), name+".build_defs"), []byte(contents), 0644))
+		return target.Label
+	}
+	defer os.RemoveAll(path.Join(core.GenDir, pkgName))
+	inner := addDefs("inner", "inner = 42\n")
+	outer := addDefs("outer", "subinclude(\"//test_nested_subinclude:inner\")\nouter = inner\n")
+	parser := NewParser(state)
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	// Both packages depend on both files, even though the inner one is only loaded once.
+	for _, name := range []string{"pkg1", "pkg2"} {
+		pkg := core.NewPackage(name)
+		statements, err := parser.ParseData([]byte(`subinclude("//test_nested_subinclude:outer")`), path.Join(name, "BUILD"))
+		require.NoError(t, err)
+		s, err := parser.interpreter.interpretAll(pkg, statements)
+		require.NoError(t, err)
+		assert.EqualValues(t, 42, s.Lookup("outer"))
+		assert.Equal(t, []core.BuildLabel{outer, inner}, pkg.Subincludes)
+	}
 }
@@ -3,6 +3,7 @@ package asp
 import (
 	"io"
 	"io/ioutil"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -12,6 +13,7 @@ const (
 	EOF = -(iota + 1)
 	Ident
 	Int
+	Float
 	String
 	LexOperator
 	EOL
@@ -73,7 +75,7 @@ func newLexer(r io.Reader) *lex {
 	l := &lex{
 		b:        append(b, 0, 0), // Null-terminating the buffer makes things easier later.
 		filename: NameOfReader(r),
-		indents:  []int{0},
+		indents:  []string{""},
 	}
 	l.Next() // Initial value is zero, this forces it to populate itself.
 	// Discard any leading newlines, they are just an annoyance.
@@ -83,13 +85,38 @@ func newLexer(r io.Reader) *lex {
 	return l
 }
 
+// Tokenize returns all the tokens in the given input, other than ends of lines, unindents and the
+// final end of file. Unlike the tokens seen by the parser, the Value of each is the raw text it
+// was lexed from, so strings retain their original quotes, prefixes and escapes. This is useful
+// for tools that need to relate tokens back to the source (e.g. for syntax highlighting).
+// If the input can't be lexed, the tokens up to that point are returned along with the error.
+func Tokenize(r io.Reader) (tokens []Token, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	l := newLexer(r)
+	// The lexer always looks one token ahead, so at this point its position is at the end of the next token.
+	for tok := l.Peek(); tok.Type != EOF; tok = l.Peek() {
+		if tok.Type != EOL && tok.Type != Unindent {
+			// Identifiers consume the space following them, but no token really ends in one.
+			tok.Value = strings.TrimRight(string(l.b[tok.Pos.Offset-1:l.i]), " ")
+			tokens = append(tokens, tok)
+		}
+		l.Next()
+	}
+	return tokens, nil
+}
+
 // A lex is a lexer for a single BUILD file.
 type lex struct {
-	b      []byte
-	i      int
-	line   int
-	col    int
-	indent int
+	b    []byte
+	i    int
+	line int
+	col  int
+	// The whitespace that the current line is indented with.
+	indent string
 	// The next token. We always look one token ahead in order to facilitate both Peek() and Next().
 	next     Token
 	filename string
@@ -98,8 +125,8 @@ type lex struct {
 	// Pending unindent tokens. This is a bit yuck but means the parser doesn't need to
 	// concern itself about indentation.
 	unindents int
-	// Current levels of indentation
-	indents []int
+	// Current levels of indentation. Each is an extension of the one before it.
+	indents []string
 	// Remember whether the last token we output was an end-of-line so we don't emit multiple in sequence.
 	lastEOL bool
 }
@@ -113,6 +140,8 @@ func reverseSymbol(sym rune) string {
 		return "identifier"
 	case Int:
 		return "integer"
+	case Float:
+		return "float"
 	case String:
 		return "string"
 	case LexOperator:
@@ -155,7 +184,7 @@ func (l *lex) AssignFollows() bool {
 }
 
 func (l *lex) stripSpaces() {
-	for l.b[l.i] == ' ' {
+	for l.b[l.i] == ' ' || l.b[l.i] == '\t' {
 		l.i++
 		l.col++
 	}
@@ -196,37 +225,44 @@ func (l *lex) nextToken() Token {
 		lastIndent := l.indent
 		l.line++
 		l.col = 0
-		indent := 0
-		for l.b[l.i] == ' ' {
+		start := l.i
+		for l.b[l.i] == ' ' || l.b[l.i] == '\t' {
 			l.i++
 			l.col++
-			indent++
 		}
 		if l.b[l.i] == '\n' {
 			return l.nextToken()
 		}
 		if l.braces == 0 {
-			l.indent = indent
+			l.indent = string(l.b[start:l.i])
 		}
-		if lastIndent > l.indent && l.braces == 0 {
-			pos.Line++ // Works better if it's at the new position
-			pos.Column = l.col + 1
-			for l.indents[len(l.indents)-1] > l.indent {
-				l.unindents++
-				l.indents = l.indents[:len(l.indents)-1]
-			}
-			if l.indent != l.indents[len(l.indents)-1] {
-				fail(pos, "Unexpected indent")
+		// Any indentation is allowed as long as it's consistent; i.e. a nested block must be indented
+		// with the same whitespace as its parent plus some more, as in Python.
+		if lastIndent != l.indent {
+			if strings.HasPrefix(l.indent, lastIndent) {
+				l.indents = append(l.indents, l.indent)
+			} else if strings.HasPrefix(lastIndent, l.indent) {
+				pos.Line++ // Works better if it's at the new position
+				pos.Column = l.col + 1
+				for len(l.indents[len(l.indents)-1]) > len(l.indent) {
+					l.unindents++
+					l.indents = l.indents[:len(l.indents)-1]
+				}
+				if l.indent != l.indents[len(l.indents)-1] {
+					fail(pos, "Unexpected indent")
+				}
+			} else {
+				pos.Line++
+				pos.Column = l.col + 1
+				fail(pos, "Inconsistent use of tabs and spaces in indentation")
 			}
-		} else if lastIndent != l.indent {
-			l.indents = append(l.indents, l.indent)
 		}
 		if l.braces == 0 && !l.lastEOL {
 			return Token{Type: EOL, Pos: pos}
 		}
 		return l.nextToken()
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		return l.consumeInteger(b, pos)
+		return l.consumeNumber(b, pos)
 	case '"', '\'':
 		// String literal, consume to end.
 		return l.consumePossiblyTripleQuotedString(b, pos, rawString, fString)
@@ -246,6 +282,14 @@ func (l *lex) nextToken() Token {
 			return Token{Type: LexOperator, Value: string([]byte{b, l.b[l.i-1]}), Pos: pos}
 		}
 		fallthrough
+	case '/':
+		// Look ahead one byte to see if this is floor division.
+		if l.b[l.i] == '/' {
+			l.i++
+			l.col++
+			return Token{Type: LexOperator, Value: "//", Pos: pos}
+		}
+		return Token{Type: rune(b), Value: string(b), Pos: pos}
 	case ',', '.', '%', '*', '|', '&', ':':
 		return Token{Type: rune(b), Value: string(b), Pos: pos}
 	case '#':
@@ -256,29 +300,58 @@ func (l *lex) nextToken() Token {
 		}
 		return l.nextToken() // Comments aren't tokens themselves.
 	case '-':
-		// We lex unary - with the integer if possible.
-		if l.b[l.i] >= '0' && l.b[l.i] <= '9' {
-			return l.consumeInteger(b, pos)
+		// We lex unary - with the number if possible.
+		if isDigit(l.b[l.i]) {
+			return l.consumeNumber(b, pos)
 		}
 		return Token{Type: rune(b), Value: string(b), Pos: pos}
-	case '\t':
-		fail(pos, "Tabs are not permitted in BUILD files, use space-based indentation instead")
 	default:
 		fail(pos, "Unknown symbol %c", b)
 	}
 	panic("unreachable")
 }
 
-// consumeInteger consumes all characters until the end of an integer literal is reached.
-func (l *lex) consumeInteger(initial byte, pos Position) Token {
+// consumeNumber consumes all characters until the end of an integer or float literal is reached.
+func (l *lex) consumeNumber(initial byte, pos Position) Token {
 	s := make([]byte, 1, 10)
 	s[0] = initial
-	for c := l.b[l.i]; c >= '0' && c <= '9'; c = l.b[l.i] {
-		l.i++
-		l.col++
-		s = append(s, c)
+	s = l.consumeDigits(s)
+	typ := rune(Int)
+	// We require a digit after the decimal point, otherwise it's ambiguous with a property access.
+	if l.b[l.i] == '.' && isDigit(l.b[l.i+1]) {
+		typ = Float
+		s = l.consumeDigits(append(s, l.consumeByte()))
+	}
+	if c := l.b[l.i]; c == 'e' || c == 'E' {
+		if isDigit(l.b[l.i+1]) {
+			typ = Float
+			s = l.consumeDigits(append(s, l.consumeByte()))
+		} else if c := l.b[l.i+1]; (c == '+' || c == '-') && isDigit(l.b[l.i+2]) {
+			typ = Float
+			s = l.consumeDigits(append(s, l.consumeByte(), l.consumeByte()))
+		}
+	}
+	return Token{Type: typ, Value: string(s), Pos: pos}
+}
+
+// consumeDigits consumes all digits until the next non-digit character, appending them to the given slice.
+func (l *lex) consumeDigits(s []byte) []byte {
+	for c := l.b[l.i]; isDigit(c); c = l.b[l.i] {
+		s = append(s, l.consumeByte())
 	}
-	return Token{Type: Int, Value: string(s), Pos: pos}
+	return s
+}
+
+// consumeByte consumes and returns the next character.
+func (l *lex) consumeByte() byte {
+	l.i++
+	l.col++
+	return l.b[l.i-1]
+}
+
+// isDigit returns true if the given character is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
 // consumePossiblyTripleQuotedString consumes all characters until the end of a string token.
@@ -330,6 +330,41 @@ func TestUnevenUnindent(t *testing.T) {
 	assertToken(t, l.Next(), EOF, "", 6, 1, 52)
 }
 
+const tabIndent = "def x():\n\tif True:\n\t\tpass\n\treturn\n"
+
+func TestTabIndent(t *testing.T) {
+	l := newLexer(strings.NewReader(tabIndent))
+	assertToken(t, l.Next(), Ident, "def", 1, 1, 1)
+	assertToken(t, l.Next(), Ident, "x", 1, 5, 5)
+	assertToken(t, l.Next(), '(', "(", 1, 6, 6)
+	assertToken(t, l.Next(), ')', ")", 1, 7, 7)
+	assertToken(t, l.Next(), ':', ":", 1, 8, 8)
+	assertToken(t, l.Next(), EOL, "", 1, 9, 9)
+	assertToken(t, l.Next(), Ident, "if", 2, 2, 11)
+	assertToken(t, l.Next(), Ident, "True", 2, 5, 14)
+	assertToken(t, l.Next(), ':', ":", 2, 9, 18)
+	assertToken(t, l.Next(), EOL, "", 2, 10, 19)
+	assertToken(t, l.Next(), Ident, "pass", 3, 3, 22)
+	assertToken(t, l.Next(), EOL, "", 4, 2, 26)
+	assertToken(t, l.Next(), Unindent, "", 4, 2, 28)
+	assertToken(t, l.Next(), Ident, "return", 4, 2, 28)
+	assertToken(t, l.Next(), EOL, "", 5, 1, 34)
+	assertToken(t, l.Next(), Unindent, "", 5, 1, 35)
+	assertToken(t, l.Next(), EOF, "", 5, 1, 35)
+}
+
+func TestTwoSpaceIndent(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("def x():\n  if True:\n    pass\n  return\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(tokens))
+}
+
+func TestInconsistentIndent(t *testing.T) {
+	_, err := Tokenize(strings.NewReader("def x():\n    if True:\n\tpass\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Inconsistent use of tabs and spaces in indentation")
+}
+
 const implicitStringConcatenation = `
 str('testing that we can carry these '
     'over multiple lines')
@@ -347,3 +382,43 @@ func TestImplicitStringConcatenationOnlyHappensInsideBraces(t *testing.T) {
 	assertToken(t, l.Next(), String, `"hello"`, 1, 1, 1)
 	assertToken(t, l.Next(), String, `"world"`, 1, 9, 9)
 }
+
+func TestLexFloats(t *testing.T) {
+	l := newLexer(strings.NewReader("x = 1.5 * -2e3 // 3.25e-2"))
+	assertToken(t, l.Next(), Ident, "x", 1, 1, 1)
+	assertToken(t, l.Next(), '=', "=", 1, 3, 3)
+	assertToken(t, l.Next(), Float, "1.5", 1, 5, 5)
+	assertToken(t, l.Next(), '*', "*", 1, 9, 9)
+	assertToken(t, l.Next(), Float, "-2e3", 1, 11, 11)
+	assertToken(t, l.Next(), LexOperator, "//", 1, 16, 16)
+	assertToken(t, l.Next(), Float, "3.25e-2", 1, 19, 19)
+}
+
+func TestLexIntProperty(t *testing.T) {
+	// A full stop after an integer is only part of it if there's another digit after it.
+	l := newLexer(strings.NewReader("1.x"))
+	assertToken(t, l.Next(), Int, "1", 1, 1, 1)
+	assertToken(t, l.Next(), '.', ".", 1, 2, 2)
+	assertToken(t, l.Next(), Ident, "x", 1, 3, 3)
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("x = f'{y}' + 'a\\n'  # comment\nif x:\n    pass\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(tokens))
+	assertToken(t, tokens[0], Ident, "x", 1, 1, 1)
+	assertToken(t, tokens[1], '=', "=", 1, 3, 3)
+	assertToken(t, tokens[2], String, "f'{y}'", 1, 5, 5)
+	assertToken(t, tokens[3], '+', "+", 1, 12, 12)
+	assertToken(t, tokens[4], String, "'a\\n'", 1, 14, 14)
+	assertToken(t, tokens[5], Ident, "if", 2, 1, 31)
+	assertToken(t, tokens[6], Ident, "x", 2, 4, 34)
+	assertToken(t, tokens[7], ':', ":", 2, 5, 35)
+	assertToken(t, tokens[8], Ident, "pass", 3, 5, 41)
+}
+
+func TestTokenizeError(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("x = 'abc\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(tokens))
+}
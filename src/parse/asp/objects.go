@@ -1,11 +1,15 @@
 package asp
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/thought-machine/please/src/core"
 )
@@ -183,6 +187,9 @@ func (i pyInt) Property(name string) pyObject {
 }
 
 func (i pyInt) Operator(operator Operator, operand pyObject) pyObject {
+	if f, ok := operand.(pyFloat); ok {
+		return pyFloat(i).Operator(operator, f)
+	}
 	i2, ok := operand.(pyInt)
 	if !ok {
 		panic("Cannot operate on int and " + operand.Type())
@@ -192,6 +199,18 @@ func (i pyInt) Operator(operator Operator, operand pyObject) pyObject {
 		return i + i2
 	case Subtract:
 		return i - i2
+	case Multiply:
+		return i * i2
+	case Divide:
+		return pyFloat(i).Operator(Divide, pyFloat(i2))
+	case FloorDivide:
+		if i2 == 0 {
+			panic("integer division by zero")
+		} else if q := i / i2; i%i2 != 0 && (i < 0) != (i2 < 0) {
+			return q - 1 // Go truncates towards zero, Python floors.
+		} else {
+			return q
+		}
 	case LessThan:
 		return newPyBool(i < i2)
 	case GreaterThan:
@@ -215,6 +234,94 @@ func (i pyInt) String() string {
 	return strconv.Itoa(int(i))
 }
 
+type pyFloat float64
+
+func (f pyFloat) Type() string {
+	return "float"
+}
+
+func (f pyFloat) IsTruthy() bool {
+	return f != 0
+}
+
+func (f pyFloat) Property(name string) pyObject {
+	panic("float object has no property " + name)
+}
+
+func (f pyFloat) Operator(operator Operator, operand pyObject) pyObject {
+	var f2 pyFloat
+	switch o := operand.(type) {
+	case pyFloat:
+		f2 = o
+	case pyInt:
+		f2 = pyFloat(o)
+	default:
+		panic("Cannot operate on float and " + operand.Type())
+	}
+	switch operator {
+	case Add:
+		return f + f2
+	case Subtract:
+		return f - f2
+	case Multiply:
+		return f * f2
+	case Divide:
+		if f2 == 0 {
+			panic("float division by zero")
+		}
+		return f / f2
+	case FloorDivide:
+		if f2 == 0 {
+			panic("float division by zero")
+		}
+		return pyFloat(math.Floor(float64(f / f2)))
+	case LessThan:
+		return newPyBool(f < f2)
+	case GreaterThan:
+		return newPyBool(f > f2)
+	case LessThanOrEqual:
+		return newPyBool(f <= f2)
+	case GreaterThanOrEqual:
+		return newPyBool(f >= f2)
+	case Modulo:
+		if f2 == 0 {
+			panic("float modulo by zero")
+		}
+		// As in Python, the result takes the sign of the divisor (unlike math.Mod, which takes the dividend's).
+		r := math.Mod(float64(f), float64(f2))
+		if r != 0 && (r < 0) != (f2 < 0) {
+			r += float64(f2)
+		} else if r == 0 {
+			r = math.Copysign(0, float64(f2))
+		}
+		return pyFloat(r)
+	case In:
+		panic("bad operator: 'in' float")
+	}
+	panic("unknown operator")
+}
+
+func (f pyFloat) IndexAssign(index, value pyObject) {
+	panic("float type is not indexable")
+}
+
+// String formats the float the same way Python does, i.e. always with a decimal point or an exponent.
+func (f pyFloat) String() string {
+	if math.IsInf(float64(f), 1) {
+		return "inf"
+	} else if math.IsInf(float64(f), -1) {
+		return "-inf"
+	} else if math.IsNaN(float64(f)) {
+		return "nan"
+	} else if abs := math.Abs(float64(f)); abs != 0 && (abs < 1e-4 || abs >= 1e16) {
+		return strconv.FormatFloat(float64(f), 'e', -1, 64)
+	} else if s := strconv.FormatFloat(float64(f), 'f', -1, 64); strings.ContainsRune(s, '.') {
+		return s
+	} else {
+		return s + ".0"
+	}
+}
+
 type pyString string
 
 func (s pyString) Type() string {
@@ -255,6 +362,9 @@ func (s pyString) Operator(operator Operator, operand pyObject) pyObject {
 		} else if i, ok := operand.(pyInt); ok {
 			// Another one: "%d" % 4
 			return pyString(fmt.Sprintf(string(s), i))
+		} else if f, ok := operand.(pyFloat); ok {
+			// And "%.2f" % 1.5
+			return pyString(fmt.Sprintf(string(s), float64(f)))
 		}
 		l, ok := operand.(pyList)
 		if !ok {
@@ -365,19 +475,39 @@ func (l pyFrozenList) IndexAssign(index, value pyObject) {
 	panic("list is immutable")
 }
 
-type pyDict map[string]pyObject // Dicts can only be keyed by strings
+// MarshalJSON implements json.Marshaler; without it the embedded list would be written as an object.
+func (l pyFrozenList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.pyList)
+}
+
+// A pyDict is a dict of string keys to objects. Dicts can only be keyed by strings.
+// As in newer versions of Python, iteration order is the order in which keys were first
+// inserted; that means commands etc. built up by iterating over a dict are reproducible
+// (so don't cause spurious rebuilds) and come out in the order the user wrote them.
+type pyDict struct {
+	keys  []string
+	items map[string]pyObject
+}
 
-func (d pyDict) Type() string {
+// newPyDict creates a new, empty dict with space for the given number of items.
+func newPyDict(size int) *pyDict {
+	return &pyDict{
+		keys:  make([]string, 0, size),
+		items: make(map[string]pyObject, size),
+	}
+}
+
+func (d *pyDict) Type() string {
 	return "dict"
 }
 
-func (d pyDict) IsTruthy() bool {
-	return len(d) > 0
+func (d *pyDict) IsTruthy() bool {
+	return len(d.keys) > 0
 }
 
-func (d pyDict) Property(name string) pyObject {
+func (d *pyDict) Property(name string) pyObject {
 	// We allow looking up dict members by . as well as by indexing in order to facilitate the config map.
-	if obj, present := d[name]; present {
+	if obj, present := d.items[name]; present {
 		return obj
 	} else if prop, present := dictMethods[name]; present {
 		return prop.Member(d)
@@ -385,10 +515,10 @@ func (d pyDict) Property(name string) pyObject {
 	panic("dict object has no property " + name)
 }
 
-func (d pyDict) Operator(operator Operator, operand pyObject) pyObject {
+func (d *pyDict) Operator(operator Operator, operand pyObject) pyObject {
 	if operator == In || operator == NotIn {
 		if s, ok := operand.(pyString); ok {
-			_, present := d[string(s)]
+			_, present := d.items[string(s)]
 			return newPyBool(present == (operator == In))
 		}
 		return newPyBool(operator == NotIn)
@@ -396,58 +526,138 @@ func (d pyDict) Operator(operator Operator, operand pyObject) pyObject {
 		s, ok := operand.(pyString)
 		if !ok {
 			panic("Dict keys must be strings, not " + operand.Type())
-		} else if v, present := d[string(s)]; present {
+		} else if v, present := d.items[string(s)]; present {
 			return v
 		}
 		panic("unknown dict key: " + s.String())
 	} else if operator == Union {
-		d2, ok := operand.(pyDict)
+		d2, ok := asDict(operand)
 		if !ok {
 			panic("Operator to | must be another dict, not " + operand.Type())
 		}
-		ret := make(pyDict, len(d)+len(d2))
-		for k, v := range d {
-			ret[k] = v
-		}
-		for k, v := range d2 {
-			ret[k] = v
+		ret := d.Copy()
+		for _, k := range d2.keys {
+			ret.Set(k, d2.items[k])
 		}
 		return ret
 	}
 	panic("Unsupported operator on dict")
 }
 
-func (d pyDict) IndexAssign(index, value pyObject) {
+func (d *pyDict) IndexAssign(index, value pyObject) {
 	key, ok := index.(pyString)
 	if !ok {
 		panic("Dict keys must be strings, not " + index.Type())
 	}
-	d[string(key)] = value
+	d.Set(string(key), value)
 }
 
-func (d pyDict) String() string {
+func (d *pyDict) String() string {
 	var b strings.Builder
 	b.WriteByte('{')
-	started := false
-	for _, k := range d.Keys() {
-		if started {
+	for i, k := range d.keys {
+		if i > 0 {
 			b.WriteString(", ")
 		}
-		started = true
 		b.WriteByte('"')
 		b.WriteString(k)
 		b.WriteString(`": `)
-		b.WriteString(d[k].String())
+		b.WriteString(d.items[k].String())
 	}
 	b.WriteByte('}')
 	return b.String()
 }
 
+// MarshalJSON implements json.Marshaler; the keys are written in iteration order.
+func (d *pyDict) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range d.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(d.items[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// GobEncode implements gob.GobEncoder, which is needed since the fields are unexported.
+func (d *pyDict) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	if err := enc.Encode(d.keys); err != nil {
+		return nil, err
+	}
+	values := make([]pyObject, len(d.keys))
+	for i, k := range d.keys {
+		values[i] = d.items[k]
+	}
+	err := enc.Encode(values)
+	return b.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder.
+func (d *pyDict) GobDecode(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	var keys []string
+	var values []pyObject
+	if err := dec.Decode(&keys); err != nil {
+		return err
+	} else if err := dec.Decode(&values); err != nil {
+		return err
+	}
+	*d = *newPyDict(len(keys))
+	for i, k := range keys {
+		d.Set(k, values[i])
+	}
+	return nil
+}
+
+// Len returns the number of items in this dict.
+func (d *pyDict) Len() int {
+	return len(d.keys)
+}
+
+// Get returns the item in this dict with the given key, and whether it was present or not.
+func (d *pyDict) Get(key string) (pyObject, bool) {
+	obj, present := d.items[key]
+	return obj, present
+}
+
+// Set sets the item with the given key. If it's a new key it goes at the end of the iteration order.
+func (d *pyDict) Set(key string, value pyObject) {
+	if _, present := d.items[key]; !present {
+		d.keys = append(d.keys, key)
+	}
+	d.items[key] = value
+}
+
+// Delete removes the item with the given key, if it is present.
+func (d *pyDict) Delete(key string) {
+	if _, present := d.items[key]; present {
+		delete(d.items, key)
+		for i, k := range d.keys {
+			if k == key {
+				d.keys = append(d.keys[:i], d.keys[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
 // Copy creates a shallow duplicate of this dictionary.
-func (d pyDict) Copy() pyDict {
-	m := make(pyDict, len(d))
-	for k, v := range d {
-		m[k] = v
+func (d *pyDict) Copy() *pyDict {
+	m := newPyDict(len(d.keys))
+	for _, k := range d.keys {
+		m.Set(k, d.items[k])
 	}
 	return m
 }
@@ -455,22 +665,18 @@ func (d pyDict) Copy() pyDict {
 // Freeze freezes this dict for further updates.
 // Note that this is a "soft" freeze; callers holding the original unfrozen
 // reference can still modify it.
-func (d pyDict) Freeze() pyObject {
+func (d *pyDict) Freeze() pyObject {
 	return pyFrozenDict{pyDict: d}
 }
 
-// Keys returns the keys of this dict, in order.
-func (d pyDict) Keys() []string {
-	ret := make([]string, 0, len(d))
-	for k := range d {
-		ret = append(ret, k)
-	}
-	sort.Strings(ret)
-	return ret
+// Keys returns the keys of this dict, in iteration order.
+// The returned slice must not be modified.
+func (d *pyDict) Keys() []string {
+	return d.keys
 }
 
 // A pyFrozenDict implements an immutable python dict.
-type pyFrozenDict struct{ pyDict }
+type pyFrozenDict struct{ *pyDict }
 
 func (d pyFrozenDict) Property(name string) pyObject {
 	if name == "setdefault" {
@@ -483,6 +689,412 @@ func (d pyFrozenDict) IndexAssign(index, value pyObject) {
 	panic("dict is immutable")
 }
 
+// A pySet is a set of hashable objects.
+// Unlike Python, iteration order is the order in which items were first added, so anything
+// derived from a set is reproducible.
+type pySet struct {
+	items   pyList
+	members map[pyObject]struct{}
+}
+
+// newPySet creates a new set from the given items.
+func newPySet(items pyList) *pySet {
+	set := &pySet{members: make(map[pyObject]struct{}, len(items))}
+	for _, item := range items {
+		set.Add(item)
+	}
+	return set
+}
+
+func (s *pySet) Type() string {
+	return "set"
+}
+
+func (s *pySet) IsTruthy() bool {
+	return len(s.items) > 0
+}
+
+func (s *pySet) Property(name string) pyObject {
+	if prop, present := setMethods[name]; present {
+		return prop.Member(s)
+	}
+	panic("set object has no property " + name)
+}
+
+func (s *pySet) Operator(operator Operator, operand pyObject) pyObject {
+	switch operator {
+	case In, NotIn:
+		if !isHashable(operand) {
+			return newPyBool(operator == NotIn)
+		}
+		_, present := s.members[operand]
+		return newPyBool(present == (operator == In))
+	case Union, Subtract:
+		other, ok := asIterableSet(operand)
+		if !ok {
+			panic(fmt.Sprintf("Operand to %s must be another set, not %s", operator, operand.Type()))
+		} else if operator == Union {
+			return s.Union(other)
+		}
+		return s.Difference(other)
+	}
+	panic("Unsupported operator on set: " + operator.String())
+}
+
+func (s *pySet) IndexAssign(index, value pyObject) {
+	panic("set object does not support item assignment")
+}
+
+func (s *pySet) String() string {
+	if len(s.items) == 0 {
+		return "set()"
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, item := range s.items {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(item.String())
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (s *pySet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.items)
+}
+
+// Add adds an item to this set, if it isn't already present.
+func (s *pySet) Add(item pyObject) {
+	if !isHashable(item) {
+		panic("unhashable type: " + item.Type())
+	} else if _, present := s.members[item]; !present {
+		s.members[item] = struct{}{}
+		s.items = append(s.items, item)
+	}
+}
+
+// Union returns a new set containing the items in either this set or the other one.
+func (s *pySet) Union(other *pySet) *pySet {
+	ret := newPySet(s.items)
+	for _, item := range other.items {
+		ret.Add(item)
+	}
+	return ret
+}
+
+// Difference returns a new set containing the items in this set that are not in the other one.
+func (s *pySet) Difference(other *pySet) *pySet {
+	ret := newPySet(nil)
+	for _, item := range s.items {
+		if _, present := other.members[item]; !present {
+			ret.Add(item)
+		}
+	}
+	return ret
+}
+
+// Equals returns true if the two sets contain the same items, regardless of order.
+func (s *pySet) Equals(other *pySet) bool {
+	if len(s.items) != len(other.items) {
+		return false
+	}
+	for _, item := range s.items {
+		if _, present := other.members[item]; !present {
+			return false
+		}
+	}
+	return true
+}
+
+// Freeze freezes this set for further updates.
+// As with lists, this is a "soft" freeze; callers holding the original unfrozen
+// reference can still modify it.
+func (s *pySet) Freeze() pyObject {
+	return pyFrozenSet{pySet: s}
+}
+
+// A pyFrozenSet implements an immutable set.
+type pyFrozenSet struct{ *pySet }
+
+func (s pyFrozenSet) Property(name string) pyObject {
+	if name == "add" {
+		panic("set is immutable")
+	}
+	return s.pySet.Property(name)
+}
+
+// A pyStruct is an immutable record of named fields, created by the struct() builtin.
+// Fields are accessed as properties; like dicts, they're kept in the order they were given.
+type pyStruct struct {
+	fields *pyDict
+}
+
+// newPyStruct creates a new struct from the given fields. Any of their values that can be frozen are.
+func newPyStruct(fields *pyDict) *pyStruct {
+	d := newPyDict(fields.Len())
+	for _, k := range fields.keys {
+		v := fields.items[k]
+		if f, ok := v.(freezable); ok {
+			v = f.Freeze()
+		}
+		d.Set(k, v)
+	}
+	return &pyStruct{fields: d}
+}
+
+func (s *pyStruct) Type() string {
+	return "struct"
+}
+
+func (s *pyStruct) IsTruthy() bool {
+	return true
+}
+
+func (s *pyStruct) Property(name string) pyObject {
+	if obj, present := s.fields.items[name]; present {
+		return obj
+	} else if prop, present := structMethods[name]; present {
+		return prop.Member(s)
+	}
+	panic("struct object has no property " + name)
+}
+
+func (s *pyStruct) Operator(operator Operator, operand pyObject) pyObject {
+	panic("Unsupported operator on struct: " + operator.String())
+}
+
+func (s *pyStruct) IndexAssign(index, value pyObject) {
+	panic("struct is immutable")
+}
+
+func (s *pyStruct) String() string {
+	var b strings.Builder
+	b.WriteString("struct(")
+	for i, k := range s.fields.keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteString(" = ")
+		if str, ok := s.fields.items[k].(pyString); ok {
+			b.WriteString(strconv.Quote(string(str)))
+		} else {
+			b.WriteString(s.fields.items[k].String())
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// MarshalJSON implements json.Marshaler; structs are written as objects, in field order.
+func (s *pyStruct) MarshalJSON() ([]byte, error) {
+	return s.fields.MarshalJSON()
+}
+
+// Equals returns true if the two structs have the same fields with equal values.
+// As with dicts, the order of the fields doesn't matter.
+func (s *pyStruct) Equals(other *pyStruct) bool {
+	if s.fields.Len() != other.fields.Len() {
+		return false
+	}
+	for k, v := range s.fields.items {
+		if v2, present := other.fields.items[k]; !present || !equal(v, v2) {
+			return false
+		}
+	}
+	return true
+}
+
+// ToDict returns a new (mutable) dict containing the fields of this struct.
+func (s *pyStruct) ToDict() *pyDict {
+	return s.fields.Copy()
+}
+
+// depsetOrders are the orders that the items of a depset can be flattened in.
+var depsetOrders = map[string]bool{
+	"default":     true,
+	"postorder":   true,
+	"preorder":    true,
+	"topological": true,
+}
+
+// A pyDepset is an immutable set that's built up from its own items and those of other depsets.
+// Merging them is cheap since the transitive sets are only referenced, not copied; they're only
+// flattened into a list (once) when the items are actually needed, which makes them a lot more
+// efficient than lists for accumulating transitive dependencies through a graph of macros.
+type pyDepset struct {
+	order      string
+	direct     pyList
+	transitive []*pyDepset
+	once       sync.Once
+	items      pyList
+}
+
+// newPyDepset creates a new depset. It panics if the items aren't hashable or the transitive
+// sets have an incompatible order.
+func newPyDepset(order string, direct pyList, transitive []*pyDepset) *pyDepset {
+	if !depsetOrders[order] {
+		panic("Invalid depset order " + order)
+	}
+	for _, item := range direct {
+		if !isHashable(item) {
+			panic("unhashable type: " + item.Type())
+		}
+	}
+	for _, t := range transitive {
+		if t.order != order && t.order != "default" && order != "default" {
+			panic(fmt.Sprintf("Cannot merge a depset with order %s into one with order %s", t.order, order))
+		}
+	}
+	return &pyDepset{order: order, direct: direct, transitive: transitive}
+}
+
+func (d *pyDepset) Type() string {
+	return "depset"
+}
+
+func (d *pyDepset) IsTruthy() bool {
+	if len(d.direct) > 0 {
+		return true
+	}
+	for _, t := range d.transitive {
+		if t.IsTruthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *pyDepset) Property(name string) pyObject {
+	if prop, present := depsetMethods[name]; present {
+		return prop.Member(d)
+	}
+	panic("depset object has no property " + name)
+}
+
+func (d *pyDepset) Operator(operator Operator, operand pyObject) pyObject {
+	switch operator {
+	case In, NotIn:
+		for _, item := range d.ToList() {
+			if item == operand {
+				return newPyBool(operator == In)
+			}
+		}
+		return newPyBool(operator == NotIn)
+	case Union:
+		other, ok := operand.(*pyDepset)
+		if !ok {
+			panic("Operand to | must be another depset, not " + operand.Type())
+		}
+		return newPyDepset(d.order, nil, []*pyDepset{d, other})
+	}
+	panic("Unsupported operator on depset: " + operator.String())
+}
+
+func (d *pyDepset) IndexAssign(index, value pyObject) {
+	panic("depset is immutable")
+}
+
+func (d *pyDepset) String() string {
+	return "depset(" + d.ToList().String() + ")"
+}
+
+// MarshalJSON implements json.Marshaler; depsets are written as their flattened list of items.
+func (d *pyDepset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.ToList())
+}
+
+// ToList returns the items in this depset, and all the ones it was built from, in its order.
+// Each item only appears once. The result is cached and must not be modified.
+func (d *pyDepset) ToList() pyList {
+	d.once.Do(func() {
+		seen := map[pyObject]bool{}
+		visited := map[*pyDepset]bool{}
+		add := func(item pyObject) {
+			if !seen[item] {
+				seen[item] = true
+				d.items = append(d.items, item)
+			}
+		}
+		switch d.order {
+		case "preorder":
+			d.preorder(visited, add)
+		case "topological":
+			// This is a reverse postorder, which guarantees that every set's items come before
+			// those of any of the sets it includes, even if they're reached by more than one path.
+			var items pyList
+			d.reversePostorder(visited, func(item pyObject) { items = append(items, item) })
+			for i := len(items) - 1; i >= 0; i-- {
+				add(items[i])
+			}
+		default:
+			d.postorder(visited, add)
+		}
+	})
+	return d.items
+}
+
+// postorder visits the items of the sets this one includes, then its own.
+func (d *pyDepset) postorder(visited map[*pyDepset]bool, f func(pyObject)) {
+	visited[d] = true
+	for _, t := range d.transitive {
+		if !visited[t] {
+			t.postorder(visited, f)
+		}
+	}
+	for _, item := range d.direct {
+		f(item)
+	}
+}
+
+// preorder visits this set's own items, then those of the sets it includes.
+func (d *pyDepset) preorder(visited map[*pyDepset]bool, f func(pyObject)) {
+	visited[d] = true
+	for _, item := range d.direct {
+		f(item)
+	}
+	for _, t := range d.transitive {
+		if !visited[t] {
+			t.preorder(visited, f)
+		}
+	}
+}
+
+// reversePostorder is like postorder but visits everything backwards.
+func (d *pyDepset) reversePostorder(visited map[*pyDepset]bool, f func(pyObject)) {
+	visited[d] = true
+	for i := len(d.transitive) - 1; i >= 0; i-- {
+		if t := d.transitive[i]; !visited[t] {
+			t.reversePostorder(visited, f)
+		}
+	}
+	for i := len(d.direct) - 1; i >= 0; i-- {
+		f(d.direct[i])
+	}
+}
+
+// isHashable returns true if the given object can be a member of a set.
+func isHashable(obj pyObject) bool {
+	switch obj.(type) {
+	case pyString, pyInt, pyFloat, pyBool, pyNone:
+		return true
+	}
+	return false
+}
+
+// asIterableSet returns the underlying set of the given object, if it is one.
+func asIterableSet(obj pyObject) (*pySet, bool) {
+	switch t := obj.(type) {
+	case *pySet:
+		return t, true
+	case pyFrozenSet:
+		return t.pySet, true
+	}
+	return nil, false
+}
+
 type pyFunc struct {
 	name       string
 	docstring  string
@@ -581,6 +1193,11 @@ func (f *pyFunc) Call(s *scope, c *Call) pyObject {
 	s2.config = s.config
 	s2.Set("CONFIG", s.config) // This needs to be copied across too :(
 	s2.Callback = s.Callback
+	s2.subincludes = s.subincludes
+	s2.rule = s.rule
+	if s2.rule == "" {
+		s2.rule = f.name
+	}
 	// Handle implicit 'self' parameter for bound functions.
 	args := c.Arguments
 	if f.self != nil {
@@ -705,6 +1322,10 @@ func (f *pyFunc) validateType(s *scope, i int, expr *Expression) pyObject {
 	if s.state.Config.Bazel.Compatibility && f.types[i][0] == "bool" && actual == "int" {
 		return val
 	}
+	// Integers can always be used in place of floats.
+	if actual == "int" && f.types[i][0] == "float" {
+		return val
+	}
 	defer func() {
 		panic(AddStackFrame(expr.Pos, recover()))
 	}()
@@ -716,8 +1337,8 @@ func (f *pyFunc) validateType(s *scope, i int, expr *Expression) pyObject {
 // copying & duplicating it - this structure instead requires very little to be copied
 // on each update.
 type pyConfig struct {
-	base    pyDict
-	overlay pyDict
+	base    *pyDict
+	overlay *pyDict
 }
 
 func (c *pyConfig) String() string {
@@ -761,10 +1382,9 @@ func (c *pyConfig) Operator(operator Operator, operand pyObject) pyObject {
 func (c *pyConfig) IndexAssign(index, value pyObject) {
 	key := string(index.(pyString))
 	if c.overlay == nil {
-		c.overlay = pyDict{key: value}
-	} else {
-		c.overlay[key] = value
+		c.overlay = newPyDict(1)
 	}
+	c.overlay.Set(key, value)
 }
 
 // Copy creates a copy of this config object. It does not copy the overlay config, so be careful
@@ -776,11 +1396,11 @@ func (c *pyConfig) Copy() *pyConfig {
 // Get implements the get() method, similarly to a dict but looks up in both internal maps.
 func (c *pyConfig) Get(key string, fallback pyObject) pyObject {
 	if c.overlay != nil {
-		if obj, present := c.overlay[key]; present {
+		if obj, present := c.overlay.Get(key); present {
 			return obj
 		}
 	}
-	if obj, present := c.base[key]; present {
+	if obj, present := c.base.Get(key); present {
 		return obj
 	}
 	return fallback
@@ -802,19 +1422,21 @@ func (c *pyConfig) Freeze() pyObject {
 
 // Merge merges the contents of the given config object into this one.
 func (c *pyConfig) Merge(other *pyFrozenConfig) {
-	if c.overlay == nil {
+	if other.overlay == nil {
+		return
+	} else if c.overlay == nil {
 		// N.B. We cannot directly copy since this might get mutated again later on.
-		c.overlay = make(pyDict, len(other.overlay))
+		c.overlay = newPyDict(other.overlay.Len())
 	}
-	for k, v := range other.overlay {
-		c.overlay[k] = v
+	for _, k := range other.overlay.Keys() {
+		c.overlay.Set(k, other.overlay.items[k])
 	}
 }
 
 // newConfig creates a new pyConfig object from the configuration.
 // This is typically only created once at global scope, other scopes copy it with .Copy()
 func newConfig(config *core.Configuration) *pyConfig {
-	c := make(pyDict, 100)
+	c := newPyDict(100)
 	v := reflect.ValueOf(config).Elem()
 	for i := 0; i < v.NumField(); i++ {
 		if field := v.Field(i); field.Kind() == reflect.Struct {
@@ -823,17 +1445,17 @@ func newConfig(config *core.Configuration) *pyConfig {
 					subfield := field.Field(j)
 					switch subfield.Kind() {
 					case reflect.String:
-						c[tag] = pyString(subfield.String())
+						c.Set(tag, pyString(subfield.String()))
 					case reflect.Bool:
-						c[tag] = newPyBool(subfield.Bool())
+						c.Set(tag, newPyBool(subfield.Bool()))
 					case reflect.Slice:
 						l := make(pyList, subfield.Len())
 						for i := 0; i < subfield.Len(); i++ {
 							l[i] = pyString(subfield.Index(i).String())
 						}
-						c[tag] = l
+						c.Set(tag, l)
 					case reflect.Struct:
-						c[tag] = pyString(subfield.Interface().(fmt.Stringer).String())
+						c.Set(tag, pyString(subfield.Interface().(fmt.Stringer).String()))
 					default:
 						log.Fatalf("Unknown config field type for %s", tag)
 					}
@@ -843,24 +1465,24 @@ func newConfig(config *core.Configuration) *pyConfig {
 	}
 	// Arbitrary build config stuff
 	for k, v := range config.BuildConfig {
-		c[strings.Replace(strings.ToUpper(k), "-", "_", -1)] = pyString(v)
+		c.Set(strings.Replace(strings.ToUpper(k), "-", "_", -1), pyString(v))
 	}
 	// Settings specific to package() which aren't in the config, but it's easier to
 	// just put them in now.
-	c["DEFAULT_VISIBILITY"] = None
-	c["DEFAULT_TESTONLY"] = False
-	c["DEFAULT_LICENCES"] = None
+	c.Set("DEFAULT_VISIBILITY", None)
+	c.Set("DEFAULT_TESTONLY", False)
+	c.Set("DEFAULT_LICENCES", None)
 	// Bazel supports a 'features' flag to toggle things on and off.
 	// We don't but at least let them call package() without blowing up.
 	if config.Bazel.Compatibility {
-		c["FEATURES"] = pyList{}
-	}
-	c["OS"] = pyString(config.Build.Arch.OS)
-	c["ARCH"] = pyString(config.Build.Arch.Arch)
-	c["HOSTOS"] = pyString(config.Build.Arch.HostOS())
-	c["HOSTARCH"] = pyString(config.Build.Arch.HostArch())
-	c["GOOS"] = pyString(config.Build.Arch.OS)
-	c["GOARCH"] = pyString(config.Build.Arch.GoArch())
+		c.Set("FEATURES", pyList{})
+	}
+	c.Set("OS", pyString(config.Build.Arch.OS))
+	c.Set("ARCH", pyString(config.Build.Arch.Arch))
+	c.Set("HOSTOS", pyString(config.Build.Arch.HostOS()))
+	c.Set("HOSTARCH", pyString(config.Build.Arch.HostArch()))
+	c.Set("GOOS", pyString(config.Build.Arch.OS))
+	c.Set("GOARCH", pyString(config.Build.Arch.GoArch()))
 	return &pyConfig{base: c}
 }
 
@@ -8,7 +8,9 @@ import (
 	"encoding/gob"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -22,9 +24,10 @@ func init() {
 	gob.Register(False)
 	gob.Register(None)
 	gob.Register(pyInt(0))
+	gob.Register(pyFloat(0))
 	gob.Register(pyString(""))
 	gob.Register(pyList{})
-	gob.Register(pyDict{})
+	gob.Register(&pyDict{})
 }
 
 // A Parser implements parsing of BUILD files.
@@ -46,6 +49,12 @@ func newParser() *Parser {
 	return &Parser{builtins: map[string][]byte{}}
 }
 
+// RanCommands returns true if any commands (e.g. git_commit()) have been run outside of the
+// context of a single package. Packages that run them themselves are marked as NoWarmStart instead.
+func (p *Parser) RanCommands() bool {
+	return atomic.LoadInt32(&p.interpreter.ranCommands) != 0
+}
+
 // LoadBuiltins instructs the parser to load rules from this file as built-ins.
 // Optionally the file contents can be supplied directly.
 // Also optionally a previously parsed form (acquired from ParseToFile) can be supplied.
@@ -132,6 +141,33 @@ func (p *Parser) ParseFileOnly(filename string) ([]*Statement, error) {
 	return p.parse(filename)
 }
 
+// ConfigValue returns the value of a CONFIG property, formatted as it would be written in a BUILD file.
+// The second return value is false if the property isn't defined.
+func (p *Parser) ConfigValue(name string) (string, bool) {
+	v := p.interpreter.getConfig(p.interpreter.scope.state.Config).Get(name, nil)
+	if v == nil {
+		return "", false
+	}
+	return formatValue(v), true
+}
+
+// formatValue formats a value as it would be written in a BUILD file.
+func formatValue(v pyObject) string {
+	switch v := v.(type) {
+	case pyString:
+		return strconv.Quote(string(v))
+	case pyFrozenList:
+		return formatValue(v.pyList)
+	case pyList:
+		values := make([]string, len(v))
+		for i, x := range v {
+			values[i] = formatValue(x)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	}
+	return v.String()
+}
+
 // parse reads the given file and parses it into a set of statements.
 func (p *Parser) parse(filename string) ([]*Statement, error) {
 	f, err := os.Open(filename)
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
 )
 
 func TestParseBasic(t *testing.T) {
@@ -614,6 +616,16 @@ func TestRepeatedArguments(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSyntaxErrorCode(t *testing.T) {
+	_, err := newParser().parse("src/parse/asp/test_data/repeated_arguments.build")
+	assert.Error(t, err)
+	be := core.AsBuildError(err, core.BuildLabel{PackageName: "src/parse/asp", Name: "all"}, core.ParseFailed)
+	assert.Equal(t, core.ErrorSyntax, be.Code)
+	assert.Equal(t, "src/parse/asp", be.Package)
+	assert.NotNil(t, be.Position)
+	assert.Equal(t, "src/parse/asp/test_data/repeated_arguments.build", be.Position.Filename)
+}
+
 func TestConstantAssignments(t *testing.T) {
 	_, err := newParser().parse("src/parse/asp/test_data/constant_assign.build")
 	assert.Error(t, err)
@@ -659,3 +671,44 @@ func TestFuncReturnTypes(t *testing.T) {
 	assert.Equal(t, "config", stmts[2].FuncDef.Return)
 	assert.Equal(t, "dict", stmts[3].FuncDef.Return)
 }
+
+func TestParseSetLiteral(t *testing.T) {
+	statements, err := newParser().parse("src/parse/asp/test_data/set_literal.build")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(statements))
+
+	assert.NotNil(t, statements[0].Ident.Action.Assign.Val.Set)
+	assert.Equal(t, 2, len(statements[0].Ident.Action.Assign.Val.Set.Values))
+	assert.NotNil(t, statements[1].Ident.Action.Assign.Val.Dict)
+	assert.Nil(t, statements[1].Ident.Action.Assign.Val.Set)
+	assert.NotNil(t, statements[2].Ident.Action.Assign.Val.Set)
+	assert.NotNil(t, statements[2].Ident.Action.Assign.Val.Set.Comprehension)
+	assert.NotNil(t, statements[3].Ident.Action.Assign.Val.Dict)
+	assert.Equal(t, 1, len(statements[3].Ident.Action.Assign.Val.Dict.Items))
+}
+
+func TestParseArithmetic(t *testing.T) {
+	statements, err := newParser().parse("src/parse/asp/test_data/arithmetic.build")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(statements))
+
+	assert.Equal(t, 1.5, statements[0].Ident.Action.Assign.Val.Float.Float)
+
+	// Multiplication binds more tightly, so these are applied left to right: (2 * 3) + 4
+	y := statements[1].Ident.Action.Assign
+	assert.Equal(t, 2, y.Val.Int.Int)
+	assert.Equal(t, 2, len(y.Op))
+	assert.EqualValues(t, Multiply, y.Op[0].Op)
+	assert.Equal(t, 3, y.Op[0].Expr.Val.Int.Int)
+	assert.Equal(t, Add, y.Op[1].Op)
+	assert.Equal(t, 4, y.Op[1].Expr.Val.Int.Int)
+
+	// The and should still be hoisted above the comparison.
+	z := statements[2].Ident.Action.Assign
+	assert.Equal(t, 2, len(z.Op))
+	assert.EqualValues(t, Equal, z.Op[0].Op)
+	assert.Equal(t, "b", z.Op[0].Expr.Val.Ident.Name)
+	assert.Equal(t, 1, len(z.Op[0].Expr.Op))
+	assert.EqualValues(t, Multiply, z.Op[0].Expr.Op[0].Op)
+	assert.Equal(t, And, z.Op[1].Op)
+}
@@ -51,6 +51,10 @@ func createTarget(s *scope, args []pyObject) *core.BuildTarget {
 	target.ShowProgress = isTruthy(36)
 	target.IsRemoteFile = isTruthy(38)
 	target.Local = isTruthy(41)
+	target.Kind = s.rule
+	if target.Kind == "" {
+		target.Kind = "build_rule"
+	}
 
 	var size *core.Size
 	if args[37] != None {
@@ -60,8 +64,24 @@ func createTarget(s *scope, args []pyObject) *core.BuildTarget {
 	}
 	if args[40] != None {
 		l := asStringList(s, args[40].(pyList), "pass_env")
+		for _, e := range l {
+			s.Assert(s.state.Config.AllowsEnv(e), "Environment variable %s can't be passed to %s, it is not in build.envallowlist", e, name)
+		}
 		target.PassEnv = &l
 	}
+	if args[42] != None {
+		target.Retention = string(args[42].(pyString))
+		s.Assert(target.Retention == core.RetentionRelease || target.Retention == core.RetentionEphemeral, "Unknown retention class %s", target.Retention)
+	}
+	if cpus, ok := args[43].(pyInt); ok {
+		s.Assert(cpus >= 0, "cpu_limit must not be negative")
+		target.CPULimit = int(cpus)
+	}
+	target.MemoryLimit = byteSize(s, args[44], "memory_limit")
+	target.OutputSizeBudget = byteSize(s, args[45], "output_size_budget")
+	target.BuildDurationBudget = durationBudget(s, args[46], "build_duration_budget")
+	target.TestDurationBudget = durationBudget(s, args[47], "test_duration_budget")
+	target.ExecProperties = stringDict(s, args[50], "exec_properties")
 
 	target.BuildTimeout = sizeAndTimeout(s, size, args[24], s.state.Config.Build.Timeout)
 	target.Stamp = isTruthy(33)
@@ -98,10 +118,27 @@ func createTarget(s *scope, args []pyObject) *core.BuildTarget {
 		target.TestTimeout = sizeAndTimeout(s, size, args[25], s.state.Config.Test.Timeout)
 		target.TestSandbox = isTruthy(21)
 		target.NoTestOutput = isTruthy(22)
+		target.TestEnv = stringDict(s, args[48], "test_env")
 	}
 	return target
 }
 
+// stringDict converts an optional argument that's a dict of strings to a map.
+func stringDict(s *scope, arg pyObject, name string) map[string]string {
+	if arg == None {
+		return nil
+	}
+	d, ok := asDict(arg)
+	s.Assert(ok, "Argument %s must be a dict, not %s", name, arg.Type())
+	m := make(map[string]string, len(d.items))
+	for _, k := range d.Keys() {
+		v, ok := d.items[k].(pyString)
+		s.Assert(ok, "%s values must be strings", name)
+		m[k] = string(v)
+	}
+	return m
+}
+
 // sizeAndTimeout handles the size and build/test timeout arguments.
 func sizeAndTimeout(s *scope, size *core.Size, timeout pyObject, defaultTimeout cli.Duration) time.Duration {
 	switch t := timeout.(type) {
@@ -118,6 +155,36 @@ func sizeAndTimeout(s *scope, size *core.Size, timeout pyObject, defaultTimeout
 	return time.Duration(defaultTimeout)
 }
 
+// byteSize handles arguments like memory_limit, which can be given either as a number of bytes
+// or a human-readable string.
+func byteSize(s *scope, obj pyObject, name string) uint64 {
+	switch l := obj.(type) {
+	case pyInt:
+		s.Assert(l >= 0, "%s must not be negative", name)
+		return uint64(l)
+	case pyString:
+		var size cli.ByteSize
+		s.Assert(size.UnmarshalFlag(string(l)) == nil, "Invalid %s %s", name, l)
+		return uint64(size)
+	}
+	return 0
+}
+
+// durationBudget handles the build & test duration budget arguments, which can be given either
+// as a number of seconds or a string like "2m30s".
+func durationBudget(s *scope, obj pyObject, name string) time.Duration {
+	switch d := obj.(type) {
+	case pyInt:
+		s.Assert(d >= 0, "%s must not be negative", name)
+		return time.Duration(d) * time.Second
+	case pyString:
+		var duration cli.Duration
+		s.Assert(duration.UnmarshalFlag(string(d)) == nil, "Invalid %s %s", name, d)
+		return time.Duration(duration)
+	}
+	return 0
+}
+
 // mustSize looks up a size by name. It panics if it cannot be found.
 func mustSize(s *scope, name string) *core.Size {
 	size, present := s.state.Config.Size[name]
@@ -135,8 +202,9 @@ func decodeCommands(s *scope, obj pyObject) (string, map[string]string) {
 	cmds, ok := asDict(obj)
 	s.Assert(ok, "Unknown type for command [%s]", obj.Type())
 	// Have to convert all the keys too
-	m := make(map[string]string, len(cmds))
-	for k, v := range cmds {
+	m := make(map[string]string, cmds.Len())
+	for _, k := range cmds.Keys() {
+		v := cmds.items[k]
 		if v != None {
 			sv, ok := v.(pyString)
 			s.Assert(ok, "Unknown type for command")
@@ -164,6 +232,11 @@ func populateTarget(s *scope, t *core.BuildTarget, args []pyObject) {
 	addDependencies(s, "deps", args[6], t, false, false)
 	addDependencies(s, "exported_deps", args[7], t, true, false)
 	addDependencies(s, "internal_deps", args[39], t, false, true)
+	if t.IsTest {
+		addStrings(s, "fixtures", args[49], func(str string) {
+			t.AddFixture(checkLabel(s, core.ParseBuildLabelContext(str, s.pkg)))
+		})
+	}
 	addStrings(s, "labels", args[10], t.AddLabel)
 	addStrings(s, "hashes", args[12], t.AddHash)
 	addStrings(s, "licences", args[30], t.AddLicence)
@@ -194,7 +267,8 @@ func addMaybeNamed(s *scope, name string, obj pyObject, anon func(core.BuildInpu
 		}
 	} else if d, ok := asDict(obj); ok {
 		s.Assert(named != nil, "%s cannot be given as a dict", name)
-		for k, v := range d {
+		for _, k := range d.Keys() {
+			v := d.items[k]
 			if v != None {
 				l, ok := asList(v)
 				s.Assert(ok, "Values of %s must be lists of strings", name)
@@ -229,7 +303,8 @@ func addMaybeNamedOutput(s *scope, name string, obj pyObject, anon func(string),
 		}
 	} else if d, ok := asDict(obj); ok {
 		s.Assert(named != nil, "%s cannot be given as a dict", name)
-		for k, v := range d {
+		for _, k := range d.Keys() {
+			v := d.items[k]
 			l, ok := asList(v)
 			s.Assert(ok, "Values must be lists of strings")
 			for _, li := range l {
@@ -272,7 +347,8 @@ func addMaybeNamedSecret(s *scope, name string, obj pyObject, anon func(string),
 		}
 	} else if d, ok := asDict(obj); ok {
 		s.Assert(named != nil, "%s cannot be given as a dict", name)
-		for k, v := range d {
+		for _, k := range d.Keys() {
+			v := d.items[k]
 			l, ok := asList(v)
 			s.Assert(ok, "Values must be lists of strings")
 			for _, li := range l {
@@ -320,7 +396,8 @@ func addProvides(s *scope, name string, obj pyObject, t *core.BuildTarget) {
 	if obj != nil && obj != None {
 		d, ok := asDict(obj)
 		s.Assert(ok, "Argument %s must be a dict, not %s", name, obj.Type())
-		for k, v := range d {
+		for _, k := range d.Keys() {
+			v := d.items[k]
 			str, ok := v.(pyString)
 			s.Assert(ok, "%s values must be strings", name)
 			t.AddProvide(k, checkLabel(s, core.ParseBuildLabelContext(string(str), s.pkg)))
@@ -467,8 +544,8 @@ func asList(obj pyObject) (pyList, bool) {
 }
 
 // asDict converts an object to a pyDict, accounting for frozen dicts.
-func asDict(obj pyObject) (pyDict, bool) {
-	if d, ok := obj.(pyDict); ok {
+func asDict(obj pyObject) (*pyDict, bool) {
+	if d, ok := obj.(*pyDict); ok {
 		return d, true
 	} else if d, ok := obj.(pyFrozenDict); ok {
 		return d.pyDict, true
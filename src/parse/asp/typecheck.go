@@ -0,0 +1,212 @@
+package asp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A TypeError describes an argument at a call site whose type doesn't match the one declared
+// for it by the function being called.
+type TypeError struct {
+	Pos      Position
+	EndPos   Position
+	Function string
+	Argument string
+	Expected []string
+	Actual   string
+}
+
+// Error implements the builtin error interface.
+// The message matches the one the interpreter would give when it encountered the same call.
+func (err *TypeError) Error() string {
+	return fmt.Sprintf("%s: Invalid type for argument %s to %s; expected %s, was %s", err.Pos, err.Argument, err.Function, strings.Join(err.Expected, " or "), err.Actual)
+}
+
+// A TypeChecker statically checks calls to functions against the types declared for their arguments.
+// The interpreter only enforces these when it actually makes the call; this lets us find
+// mismatches without running anything (e.g. for linting or in an editor).
+//
+// It's necessarily conservative; only arguments whose type is obvious from the source (i.e.
+// literals) are checked, so it will not find everything the interpreter would.
+type TypeChecker struct {
+	// IntsAsBools allows integers to be passed for boolean arguments, as the interpreter does when
+	// Bazel compatibility is enabled.
+	IntsAsBools bool
+	// Subinclude, if set, is called to load the statements for any subincludes encountered.
+	// Functions defined within them are then checked in the rest of the file.
+	Subinclude func(label string) ([]*Statement, error)
+	functions  map[string]*FuncDef
+}
+
+// NewTypeChecker creates a new TypeChecker.
+func NewTypeChecker() *TypeChecker {
+	return &TypeChecker{functions: map[string]*FuncDef{}}
+}
+
+// AddDefinitions adds all the top-level function definitions in the given statements
+// (for example from the builtin rules or a preloaded build_defs file).
+func (tc *TypeChecker) AddDefinitions(stmts []*Statement) {
+	addFunctionDefinitions(tc.functions, stmts)
+}
+
+// AddFunction adds a single function definition.
+func (tc *TypeChecker) AddFunction(f *FuncDef) {
+	tc.functions[f.Name] = f
+}
+
+// Check checks all the calls in the given statements and returns any type errors it finds.
+// Functions defined within the statements themselves (or subincluded by them) are taken into
+// account, but not retained for later calls.
+func (tc *TypeChecker) Check(stmts []*Statement) []*TypeError {
+	functions := make(map[string]*FuncDef, len(tc.functions))
+	for k, v := range tc.functions {
+		functions[k] = v
+	}
+	addFunctionDefinitions(functions, stmts)
+	errs := []*TypeError{}
+	for _, stmt := range stmts {
+		if ident := stmt.Ident; ident != nil && ident.Name == "subinclude" && ident.Action != nil && ident.Action.Call != nil {
+			tc.subinclude(functions, ident.Action.Call)
+		}
+		WalkAST([]*Statement{stmt}, func(ident *IdentStatement) bool {
+			if ident.Action != nil && ident.Action.Call != nil {
+				errs = tc.checkCall(errs, functions, ident.Name, ident.Action.Call)
+			}
+			return true
+		})
+		WalkAST([]*Statement{stmt}, func(ident *IdentExpr) bool {
+			if len(ident.Action) > 0 && ident.Action[0].Call != nil {
+				errs = tc.checkCall(errs, functions, ident.Name, ident.Action[0].Call)
+			}
+			return true
+		})
+	}
+	return errs
+}
+
+// subinclude loads the definitions from a subinclude call into the given set of functions.
+func (tc *TypeChecker) subinclude(functions map[string]*FuncDef, call *Call) {
+	if tc.Subinclude == nil {
+		return
+	}
+	for _, arg := range call.Arguments {
+		if arg.Value.Val == nil || arg.Value.Val.String == "" {
+			continue
+		}
+		if stmts, err := tc.Subinclude(stringLiteral(arg.Value.Val.String)); err != nil {
+			log.Debug("Failed to load subinclude %s for type checking: %s", arg.Value.Val.String, err)
+		} else {
+			addFunctionDefinitions(functions, stmts)
+		}
+	}
+}
+
+// checkCall checks a single call to the named function, appending any errors to the given slice.
+func (tc *TypeChecker) checkCall(errs []*TypeError, functions map[string]*FuncDef, name string, call *Call) []*TypeError {
+	f, present := functions[name]
+	if !present {
+		return errs
+	}
+	for i, arg := range call.Arguments {
+		var def *Argument
+		if arg.Name == "" {
+			if i < len(f.Arguments) {
+				def = &f.Arguments[i]
+			}
+		} else {
+			def = findArgument(f, arg.Name)
+		}
+		if def == nil || len(def.Type) == 0 {
+			continue
+		}
+		actual := staticType(&arg.Value)
+		if actual == "" || tc.typeMatches(def.Type, actual) {
+			continue
+		}
+		errs = append(errs, &TypeError{
+			Pos:      arg.Value.Pos,
+			EndPos:   arg.Value.EndPos,
+			Function: name,
+			Argument: def.Name,
+			Expected: def.Type,
+			Actual:   actual,
+		})
+	}
+	return errs
+}
+
+// typeMatches returns true if the given type is one of the expected ones.
+func (tc *TypeChecker) typeMatches(expected []string, actual string) bool {
+	for _, t := range expected {
+		if t == actual {
+			return true
+		}
+	}
+	// As in the interpreter, integers are always allowed in place of floats.
+	return actual == "int" && expected[0] == "float" || tc.IntsAsBools && expected[0] == "bool" && actual == "int"
+}
+
+// findArgument returns the argument of the given function that has the given name or alias.
+func findArgument(f *FuncDef, name string) *Argument {
+	for i, arg := range f.Arguments {
+		if arg.Name == name {
+			return &f.Arguments[i]
+		}
+		for _, alias := range arg.Aliases {
+			if alias == name {
+				return &f.Arguments[i]
+			}
+		}
+	}
+	return nil
+}
+
+// addFunctionDefinitions adds all top-level function definitions in the given statements to a map.
+func addFunctionDefinitions(functions map[string]*FuncDef, stmts []*Statement) {
+	for _, stmt := range stmts {
+		if stmt.FuncDef != nil {
+			functions[stmt.FuncDef.Name] = stmt.FuncDef
+		}
+	}
+}
+
+// staticType returns the type of the given expression if it can be determined without
+// evaluating it, or the empty string if not.
+// None is deliberately not given a type since the interpreter allows it for any argument.
+func staticType(expr *Expression) string {
+	if len(expr.Op) > 0 || expr.If != nil {
+		return ""
+	} else if expr.UnaryOp != nil {
+		if expr.UnaryOp.Op == "not" {
+			return "bool"
+		} else if expr.UnaryOp.Expr.Int != nil {
+			return "int"
+		} else if expr.UnaryOp.Expr.Float != nil {
+			return "float"
+		}
+		return ""
+	}
+	val := expr.Val
+	if val == nil || len(val.Slices) > 0 || val.Property != nil || val.Call != nil {
+		return ""
+	}
+	switch {
+	case val.String != "" || val.FString != nil:
+		return "str"
+	case val.Int != nil:
+		return "int"
+	case val.Float != nil:
+		return "float"
+	case val.Bool == "True" || val.Bool == "False":
+		return "bool"
+	case val.List != nil || val.Tuple != nil:
+		return "list"
+	case val.Dict != nil:
+		return "dict"
+	case val.Set != nil:
+		return "set"
+	case val.Lambda != nil:
+		return "function"
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package asp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTypeCheckFile(t *testing.T, filename string) []*Statement {
+	stmts, err := newParser().parse("src/parse/asp/test_data/typecheck/" + filename)
+	require.NoError(t, err)
+	return stmts
+}
+
+func TestTypeCheck(t *testing.T) {
+	tc := NewTypeChecker()
+	tc.Subinclude = func(label string) ([]*Statement, error) {
+		assert.Equal(t, "//src/parse/asp/test_data/typecheck:defs", label)
+		return parseTypeCheckFile(t, "defs.build_defs"), nil
+	}
+	errs := tc.Check(parseTypeCheckFile(t, "typecheck.build"))
+	require.Equal(t, 4, len(errs))
+
+	assert.Equal(t, "donald", errs[0].Function)
+	assert.Equal(t, "srcs", errs[0].Argument)
+	assert.Equal(t, "str", errs[0].Actual)
+	assert.Equal(t, []string{"list", "dict"}, errs[0].Expected)
+	assert.Equal(t, 8, errs[0].Pos.Line)
+	assert.Equal(t, 24, errs[0].EndPos.Column)
+	assert.Equal(t, "src/parse/asp/test_data/typecheck/typecheck.build:8:12: Invalid type for argument srcs to donald; expected list or dict, was str", errs[0].Error())
+
+	assert.Equal(t, "cmd", errs[1].Argument)
+	assert.Equal(t, "int", errs[1].Actual)
+	assert.Equal(t, 16, errs[1].Pos.Line)
+
+	assert.Equal(t, "mickey", errs[2].Function)
+	assert.Equal(t, "name", errs[2].Argument)
+	assert.Equal(t, "list", errs[2].Actual)
+	assert.Equal(t, 26, errs[2].Pos.Line)
+
+	assert.Equal(t, "enabled", errs[3].Argument)
+	assert.Equal(t, "int", errs[3].Actual)
+	assert.Equal(t, 30, errs[3].Pos.Line)
+}
+
+func TestTypeCheckIntsAsBools(t *testing.T) {
+	tc := NewTypeChecker()
+	tc.AddDefinitions(parseTypeCheckFile(t, "defs.build_defs"))
+	tc.IntsAsBools = true
+	errs := tc.Check(parseTypeCheckFile(t, "typecheck.build"))
+	// Without the subinclude being loaded, we still know about mickey from the definitions added above.
+	assert.Equal(t, 3, len(errs))
+	tc.IntsAsBools = false
+	errs = tc.Check(parseTypeCheckFile(t, "typecheck.build"))
+	assert.Equal(t, 4, len(errs))
+}
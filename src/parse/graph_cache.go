@@ -0,0 +1,195 @@
+package parse
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// A graphCache restores packages from a previous invocation, if they haven't changed since.
+// See core.GraphCache for more details of what's persisted.
+type graphCache struct {
+	cache *core.GraphCache
+	// Names of packages that were restored in this invocation (and hence are known to be valid).
+	restored sync.Map
+}
+
+// SaveGraphCache persists the build graph so later invocations can restore packages from it
+// rather than parsing them again. It has no effect unless warm starts are enabled.
+func SaveGraphCache(state *core.BuildState) {
+	if p, ok := state.Parser.(*aspParser); ok {
+		if err := p.graphCache.Save(state, p.asp.RanCommands()); err != nil {
+			log.Warning("Failed to write graph cache: %s", err)
+		}
+	}
+}
+
+// newGraphCache loads the graph cache from the previous invocation.
+// It returns nil if the feature isn't enabled or can't be used.
+func newGraphCache(state *core.BuildState) *graphCache {
+	if !state.Config.Parse.WarmStart {
+		return nil
+	}
+	key, err := graphCacheKey(state)
+	if err != nil {
+		log.Warning("Can't use graph cache: %s", err)
+		return nil
+	}
+	return &graphCache{cache: core.ReadGraphCache(core.GraphCacheFile, key)}
+}
+
+// graphCacheKey returns the key for everything that affects all packages.
+func graphCacheKey(state *core.BuildState) ([]byte, error) {
+	h := sha1.New()
+	h.Write([]byte(core.PleaseVersion.String()))
+	// Any part of the config could be read by a BUILD file, so we hash all of it.
+	if err := json.NewEncoder(h).Encode(state.Config); err != nil {
+		return nil, err
+	}
+	if err := hashFiles(h, state.Config.Parse.PreloadBuildDefs); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Restore restores the given package from the cache, if it's present and up to date.
+// It returns true if it was restored.
+func (gc *graphCache) Restore(state *core.BuildState, pkg *core.Package) bool {
+	if gc == nil || pkg.SubrepoName != "" {
+		return false
+	}
+	cp, present := gc.cache.Packages[pkg.Name]
+	if !present || cp.Filename != pkg.Filename {
+		return false
+	}
+	key, err := packageCacheKey(state, pkg.Name, cp.Files)
+	if err != nil {
+		log.Debug("Not restoring %s from graph cache: %s", pkg.Name, err)
+		return false
+	} else if string(key) != string(cp.Key) {
+		return false
+	}
+	log.Debug("Restoring package %s from graph cache", pkg.Name)
+	cp.Restore(state, pkg)
+	gc.restored.Store(pkg.Name, true)
+	return true
+}
+
+// Save writes out the packages in the given state's graph, along with any from the previous
+// invocation that weren't parsed in this one.
+func (gc *graphCache) Save(state *core.BuildState, ranCommands bool) error {
+	if gc == nil {
+		return nil
+	} else if ranCommands {
+		// We can't tell which packages depended on the commands that were run.
+		log.Debug("Not writing graph cache since commands were run while parsing")
+		return nil
+	}
+	cache := core.NewGraphCache(gc.cache.Key)
+	for name, cp := range gc.cache.Packages {
+		cache.Packages[name] = cp
+	}
+	for _, pkg := range state.Graph.PackageMap() {
+		if pkg.SubrepoName != "" {
+			continue
+		} else if _, restored := gc.restored.Load(pkg.Name); restored {
+			continue // Nothing's changed about it.
+		}
+		delete(cache.Packages, pkg.Name) // In case we reparsed it and can't cache it any more.
+		files, err := packageCacheFiles(state, pkg)
+		if err != nil {
+			log.Debug("Not caching %s: %s", pkg.Name, err)
+			continue
+		}
+		key, err := packageCacheKey(state, pkg.Name, files)
+		if err != nil {
+			log.Debug("Not caching %s: %s", pkg.Name, err)
+			continue
+		}
+		cp := core.NewCachedPackage(pkg)
+		cp.Files = files
+		cp.Key = key
+		cache.Packages[pkg.Name] = cp
+	}
+	return cache.Write(core.GraphCacheFile)
+}
+
+// packageCacheFiles returns the files that were read to create a package, or an error if it
+// can't be cached.
+func packageCacheFiles(state *core.BuildState, pkg *core.Package) ([]string, error) {
+	if pkg.Filename == "" {
+		return nil, fmt.Errorf("it has no BUILD file")
+	} else if pkg.NoWarmStart {
+		return nil, fmt.Errorf("it can't be restored")
+	}
+	for _, target := range pkg.AllTargets() {
+		if target.PreBuildFunction != nil || target.PostBuildFunction != nil {
+			return nil, fmt.Errorf("%s has a pre- or post-build function", target.Label)
+		}
+	}
+	files := []string{pkg.Filename}
+	for _, l := range pkg.Subincludes {
+		// We can only check subincludes that are plain files in the repo.
+		t := state.Graph.Target(l)
+		if t == nil || !t.IsFilegroup {
+			return nil, fmt.Errorf("subinclude %s isn't a filegroup", l)
+		}
+		for _, src := range t.AllSources() {
+			file, ok := src.(core.FileLabel)
+			if !ok {
+				return nil, fmt.Errorf("subinclude %s has a non-file source %s", l, src)
+			}
+			files = append(files, file.Paths(state.Graph)[0])
+		}
+	}
+	return files, nil
+}
+
+// packageCacheKey returns the key for a package, which identifies the contents of all the files
+// that were read to create it and the names of all the others in it (since they could be globbed).
+func packageCacheKey(state *core.BuildState, name string, files []string) ([]byte, error) {
+	h := sha1.New()
+	if err := hashFiles(h, files); err != nil {
+		return nil, err
+	}
+	dir := name
+	if dir == "" {
+		dir = "."
+	}
+	err := fs.Walk(dir, func(name string, isDir bool) error {
+		if isDir && name != dir && (fs.IsPackage(state.Config.Parse.BuildFileName, name) || path.Clean(name) == core.OutDir || path.Base(name) == ".git") {
+			return filepath.SkipDir
+		}
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		return nil
+	})
+	return h.Sum(nil), err
+}
+
+// hashFiles writes the names and contents of the given files into a hash.
+func hashFiles(h hash.Hash, files []string) error {
+	for _, filename := range files {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		h.Write([]byte(strings.TrimPrefix(filename, core.RepoRoot)))
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package parse
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestGraphCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graph_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	writeFile(t, "pkg/BUILD", "genrule(name = 'a')")
+	writeFile(t, "pkg/a.txt", "a")
+	writeFile(t, "pkg/sub/BUILD", "")
+	writeFile(t, "other/BUILD", "")
+
+	state := newGraphCacheState()
+	pkg := newGraphCachePackage("pkg")
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg:a", ""))
+	target.AddSource(core.FileLabel{File: "a.txt", Package: "pkg"})
+	target.AddOutput("a.out")
+	state.AddTarget(pkg, target)
+	state.Graph.AddPackage(pkg)
+	other := newGraphCachePackage("other")
+	other.NoWarmStart = true
+	state.Graph.AddPackage(other)
+	require.NoError(t, newGraphCache(state).Save(state, false))
+
+	// Nothing's changed, so it should be restored.
+	state = newGraphCacheState()
+	gc := newGraphCache(state)
+	pkg = newGraphCachePackage("pkg")
+	assert.True(t, gc.Restore(state, pkg))
+	target = pkg.Target("a")
+	require.NotNil(t, target)
+	assert.Equal(t, []string{"a.out"}, target.Outputs())
+	assert.Equal(t, target, state.Graph.Target(target.Label))
+	assert.False(t, gc.Restore(state, newGraphCachePackage("other")))
+
+	// Adding files to subpackages doesn't matter, but adding them to the package does.
+	writeFile(t, "pkg/sub/b.txt", "b")
+	assert.True(t, newGraphCache(state).Restore(newGraphCacheState(), newGraphCachePackage("pkg")))
+	writeFile(t, "pkg/b.txt", "b")
+	assert.False(t, newGraphCache(state).Restore(newGraphCacheState(), newGraphCachePackage("pkg")))
+	os.Remove("pkg/b.txt")
+	writeFile(t, "pkg/BUILD", "genrule(name = 'b')")
+	assert.False(t, newGraphCache(state).Restore(newGraphCacheState(), newGraphCachePackage("pkg")))
+	writeFile(t, "pkg/BUILD", "genrule(name = 'a')")
+	assert.True(t, newGraphCache(state).Restore(newGraphCacheState(), newGraphCachePackage("pkg")))
+
+	// Changing the config invalidates everything.
+	state = newGraphCacheState()
+	state.Config.Build.Lang = "en_US.UTF-8"
+	assert.False(t, newGraphCache(state).Restore(state, newGraphCachePackage("pkg")))
+}
+
+func TestGraphCacheDisabled(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	gc := newGraphCache(state)
+	assert.Nil(t, gc)
+	assert.False(t, gc.Restore(state, core.NewPackage("pkg")))
+	assert.NoError(t, gc.Save(state, false))
+}
+
+func newGraphCacheState() *core.BuildState {
+	state := core.NewDefaultBuildState()
+	state.Config.Parse.WarmStart = true
+	state.Config.Parse.BuildFileName = []string{"BUILD"}
+	return state
+}
+
+func newGraphCachePackage(name string) *core.Package {
+	pkg := core.NewPackage(name)
+	pkg.Filename = path.Join(name, "BUILD")
+	return pkg
+}
+
+func writeFile(t *testing.T, filename, contents string) {
+	require.NoError(t, os.MkdirAll(path.Dir(filename), core.DirPermissions))
+	require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+}
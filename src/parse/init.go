@@ -19,13 +19,14 @@ import (
 // InitParser initialises the parser engine. This is guaranteed to be called exactly once before any calls to Parse().
 func InitParser(state *core.BuildState) {
 	if state.Parser == nil {
-		state.Parser = &aspParser{asp: newAspParser(state)}
+		state.Parser = &aspParser{asp: newAspParser(state), graphCache: newGraphCache(state)}
 	}
 }
 
 // An aspParser implements the core.Parser interface around our asp package.
 type aspParser struct {
-	asp *asp.Parser
+	asp        *asp.Parser
+	graphCache *graphCache
 }
 
 // newAspParser returns a asp.Parser object with all the builtins loaded
@@ -51,6 +52,7 @@ func newAspParser(state *core.BuildState) *asp.Parser {
 		// Add a subrepo for @bazel_tools which appears to be one of their builtins.
 		// Mostly we only include build defs in there.
 		createBazelSubrepo(state)
+		createPlatformsSubrepo(state)
 	}
 
 	log.Debug("Parser initialised")
@@ -115,4 +117,72 @@ func createBazelSubrepo(state *core.BuildState) {
 			log.Fatalf("%s", err)
 		}
 	}
+	// These are the older versions of the constraints that now live in @platforms.
+	var platforms, conditions []string
+	for _, name := range append(append([]string{}, bazelOSes...), bazelCPUs...) {
+		platforms = append(platforms, configSetting(name, "@bazel_tools//platforms:"+name))
+	}
+	for _, condition := range bazelConditions {
+		conditions = append(conditions, configSetting(condition[0], condition[1:]...))
+	}
+	writeBuildFile(state, path.Join(core.OutDir, "bazel_tools/platforms"), platforms)
+	writeBuildFile(state, path.Join(core.OutDir, "bazel_tools/src/conditions"), conditions)
+}
+
+// bazelOSes and bazelCPUs are the names of the OS & CPU constraints in @platforms that we support.
+var bazelOSes = []string{"linux", "osx", "macos", "windows", "freebsd", "openbsd", "netbsd", "android", "ios"}
+var bazelCPUs = []string{"x86_64", "x86_32", "aarch64", "arm64", "arm", "armv7", "ppc", "s390x"}
+
+// bazelConditions are the settings in @bazel_tools//src/conditions, which a lot of upstream
+// BUILD files select on. Each is a name followed by the constraints it requires.
+var bazelConditions = [][]string{
+	{"linux", "@platforms//os:linux"},
+	{"linux_x86_64", "@platforms//os:linux", "@platforms//cpu:x86_64"},
+	{"linux_aarch64", "@platforms//os:linux", "@platforms//cpu:aarch64"},
+	{"linux_ppc", "@platforms//os:linux", "@platforms//cpu:ppc"},
+	{"linux_s390x", "@platforms//os:linux", "@platforms//cpu:s390x"},
+	{"darwin", "@platforms//os:osx"},
+	{"darwin_x86_64", "@platforms//os:osx", "@platforms//cpu:x86_64"},
+	{"darwin_arm64", "@platforms//os:osx", "@platforms//cpu:arm64"},
+	{"windows", "@platforms//os:windows"},
+	{"freebsd", "@platforms//os:freebsd"},
+	{"openbsd", "@platforms//os:openbsd"},
+}
+
+// createPlatformsSubrepo creates the @platforms subrepo, which defines config settings for
+// each of the OS and CPU constraints so they can be used in select() calls.
+func createPlatformsSubrepo(state *core.BuildState) {
+	dir := path.Join(core.OutDir, "platforms")
+	state.Graph.AddSubrepo(&core.Subrepo{
+		Name:  "platforms",
+		Root:  dir,
+		State: state,
+		Arch:  cli.HostArch(),
+	})
+	var oses, cpus []string
+	for _, name := range bazelOSes {
+		oses = append(oses, configSetting(name, "@platforms//os:"+name))
+	}
+	for _, name := range bazelCPUs {
+		cpus = append(cpus, configSetting(name, "@platforms//cpu:"+name))
+	}
+	writeBuildFile(state, path.Join(dir, "os"), oses)
+	writeBuildFile(state, path.Join(dir, "cpu"), cpus)
+}
+
+// configSetting returns the definition of a config_setting with the given constraints.
+func configSetting(name string, constraints ...string) string {
+	return fmt.Sprintf("config_setting(\n    name = \"%s\",\n    constraint_values = [\"%s\"],\n    visibility = [\"PUBLIC\"],\n)\n",
+		name, strings.Join(constraints, `", "`))
+}
+
+// writeBuildFile writes a BUILD file containing the given rules into a directory.
+func writeBuildFile(state *core.BuildState, dir string, rules []string) {
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		log.Fatalf("%s", err)
+	}
+	filename := path.Join(dir, state.Config.Parse.BuildFileName[0])
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(rules, "\n")), 0644); err != nil {
+		log.Fatalf("%s", err)
+	}
 }
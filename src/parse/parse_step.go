@@ -91,7 +91,7 @@ func checkSubrepo(tid int, state *core.BuildState, label, dependent core.BuildLa
 	if handled, err := parseSubrepoPackage(tid, state, sl.PackageName, dependent.Subrepo, label); handled && err == nil {
 		return state.Graph.Subrepo(label.Subrepo), nil
 	}
-	return nil, fmt.Errorf("Subrepo %s is not defined (referenced by %s)", label.Subrepo, dependent)
+	return nil, core.NewBuildError(core.ErrorUnknownSubrepo, fmt.Errorf("Subrepo %s is not defined (referenced by %s)", label.Subrepo, dependent))
 }
 
 // parseSubrepoPackage parses a package to make sure subrepos are available.
@@ -104,12 +104,17 @@ func parseSubrepoPackage(tid int, state *core.BuildState, pkg, subrepo string, d
 	return false, nil
 }
 
-// checkArchSubrepo checks if a target refers to a cross-compiling subrepo.
+// checkArchSubrepo checks if a target refers to a cross-compiling subrepo, either one for the whole
+// repo (e.g. ///linux_arm64//...) or a variant of another subrepo (e.g. ///third_party/cc/gtest@linux_arm64//...).
 // Those don't have to be explicitly defined - maybe we should insist on that, but it's nicer not to have to.
 func checkArchSubrepo(state *core.BuildState, name string) *core.Subrepo {
 	var arch cli.Arch
 	if err := arch.UnmarshalFlag(name); err == nil {
 		return state.Graph.MaybeAddSubrepo(core.SubrepoForArch(state, arch))
+	} else if base, arch, ok := core.SplitArchSubrepoName(name); ok {
+		if subrepo := state.Graph.Subrepo(base); subrepo != nil {
+			return state.Graph.MaybeAddSubrepo(core.SubrepoForArchVariant(subrepo, arch))
+		}
 	}
 	return nil
 }
@@ -133,7 +138,11 @@ func activateTarget(tid int, state *core.BuildState, pkg *core.Package, label, d
 			if dependent != core.OriginalTarget {
 				msg += fmt.Sprintf(" (depended on by %s)", dependent)
 			}
-			return fmt.Errorf(msg + suggestTargets(pkg, label, dependent))
+			suggestion := suggestTargets(pkg, label, dependent)
+			err := core.NewBuildError(core.ErrorMissingTarget, fmt.Errorf(msg+suggestion))
+			err.Message = msg
+			err.Suggestion = strings.TrimSpace(suggestion)
+			return err
 		}
 	}
 	if state.ParsePackageOnly && !forSubinclude {
@@ -184,17 +193,19 @@ func parsePackage(state *core.BuildState, label, dependent core.BuildLabel, subr
 			exists := core.PathExists(dir)
 			// Handle quite a few cases to provide more obvious error messages.
 			if dependent != core.OriginalTarget && exists {
-				return nil, fmt.Errorf("%s depends on %s, but there's no %s file in %s/", dependent, label, buildFileNames(state.Config.Parse.BuildFileName), dir)
+				return nil, core.NewBuildError(core.ErrorMissingPackage, fmt.Errorf("%s depends on %s, but there's no %s file in %s/", dependent, label, buildFileNames(state.Config.Parse.BuildFileName), dir))
 			} else if dependent != core.OriginalTarget {
-				return nil, fmt.Errorf("%s depends on %s, but the directory %s doesn't exist", dependent, label, dir)
+				return nil, core.NewBuildError(core.ErrorMissingPackage, fmt.Errorf("%s depends on %s, but the directory %s doesn't exist", dependent, label, dir))
 			} else if exists {
-				return nil, fmt.Errorf("Can't build %s; there's no %s file in %s/", label, buildFileNames(state.Config.Parse.BuildFileName), dir)
+				return nil, core.NewBuildError(core.ErrorMissingPackage, fmt.Errorf("Can't build %s; there's no %s file in %s/", label, buildFileNames(state.Config.Parse.BuildFileName), dir))
 			}
-			return nil, fmt.Errorf("Can't build %s; the directory %s doesn't exist", label, dir)
+			return nil, core.NewBuildError(core.ErrorMissingPackage, fmt.Errorf("Can't build %s; the directory %s doesn't exist", label, dir))
 		}
 	} else {
 		pkg.Filename = filename
-		if err := state.Parser.ParseFile(state, pkg, pkg.Filename); err != nil {
+		if p, ok := state.Parser.(*aspParser); ok && p.graphCache.Restore(state, pkg) {
+			// Nothing's changed since the last time we parsed it, so we don't need to again.
+		} else if err := state.Parser.ParseFile(state, pkg, pkg.Filename); err != nil {
 			return nil, err
 		}
 	}
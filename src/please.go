@@ -13,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/jessevdk/go-flags"
 	"gopkg.in/op/go-logging.v1"
 
@@ -23,15 +24,20 @@ import (
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/export"
 	"github.com/thought-machine/please/src/follow"
+	"github.com/thought-machine/please/src/format"
 	"github.com/thought-machine/please/src/gc"
 	"github.com/thought-machine/please/src/hashes"
 	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/ide/compdb"
+	"github.com/thought-machine/please/src/ide/gopackages"
 	"github.com/thought-machine/please/src/ide/intellij"
+	"github.com/thought-machine/please/src/lint"
 	"github.com/thought-machine/please/src/output"
 	"github.com/thought-machine/please/src/plz"
 	"github.com/thought-machine/please/src/query"
 	"github.com/thought-machine/please/src/run"
 	"github.com/thought-machine/please/src/scm"
+	"github.com/thought-machine/please/src/serve"
 	"github.com/thought-machine/please/src/test"
 	"github.com/thought-machine/please/src/tool"
 	"github.com/thought-machine/please/src/update"
@@ -67,7 +73,13 @@ var opts struct {
 		Colour            bool          `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool          `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         cli.Filepath  `long:"trace_file" description:"File to write Chrome tracing output into"`
+		BuildProfile      cli.Filepath  `long:"build_profile" description:"File to write a profile of the time spent in each phase of each target into"`
+		BuildDB           cli.Filepath  `long:"build_db" description:"SQLite database to record metadata about each target built into. Requires the sqlite3 tool."`
 		ShowAllOutput     bool          `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
+		CriticalPath      bool          `long:"critical_path" description:"Print the critical path through the build once it's finished."`
+		SlowestPackages   int           `long:"slowest_packages" description:"Print this many of the packages that took longest to parse once the build is finished."`
+		CacheStats        bool          `long:"cache_stats" description:"Print the cache hit rates for each kind of rule once the build is finished."`
+		CacheStatsFile    cli.Filepath  `long:"cache_stats_file" description:"File to write the cache hit rates for each kind of rule into, in the Prometheus text format"`
 		CompletionScript  bool          `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
 	} `group:"Options controlling output & logging"`
 
@@ -114,6 +126,7 @@ var opts struct {
 		FailingTestsOk  bool         `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
 		NumRuns         int          `long:"num_runs" short:"n" default:"1" description:"Number of times to run each test target."`
 		TestResultsFile cli.Filepath `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		TAPResultsFile  cli.Filepath `long:"tap_results_file" description:"File to additionally write combined test results to in TAP format."`
 		SurefireDir     cli.Filepath `long:"surefire_dir" default:"plz-out/surefire-reports" description:"Directory to copy XML test results to."`
 		ShowOutput      bool         `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
 		Debug           bool         `short:"d" long:"debug" description:"Allows starting an interactive debugger on test failure. Does not work with all test types (currently only python/pytest, C and C++). Implies -c dbg unless otherwise set."`
@@ -137,10 +150,14 @@ var opts struct {
 		IncludeAllFiles     bool          `short:"a" long:"include_all_files" description:"Include all dependent files in coverage (default is just those from relevant packages)"`
 		IncludeFile         cli.Filepaths `long:"include_file" description:"Filenames to filter coverage display to"`
 		TestResultsFile     cli.Filepath  `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		TAPResultsFile      cli.Filepath  `long:"tap_results_file" description:"File to additionally write combined test results to in TAP format."`
 		SurefireDir         cli.Filepath  `long:"surefire_dir" default:"plz-out/surefire-reports" description:"Directory to copy XML test results to."`
 		CoverageResultsFile cli.Filepath  `long:"coverage_results_file" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
 		CoverageXMLReport   cli.Filepath  `long:"coverage_xml_report" default:"plz-out/log/coverage.xml" description:"XML File to write combined coverage results to."`
+		CoverageHTMLReport  cli.Filepath  `long:"coverage_html_report" default:"plz-out/log/coverage.html" description:"HTML file to write a browsable coverage report to."`
 		Incremental         bool          `short:"i" long:"incremental" description:"Calculates summary statistics for incremental coverage, i.e. stats for just the lines currently modified."`
+		IncrementalSince    string        `long:"incremental_since" description:"Revision to calculate incremental coverage against. Defaults to origin/master. Implies --incremental."`
+		MinIncremental      float32       `long:"min_incremental_coverage" description:"Fails if incremental coverage is below this percentage. Implies --incremental."`
 		ShowOutput          bool          `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
 		Debug               bool          `short:"d" long:"debug" description:"Allows starting an interactive debugger on test failure. Does not work with all test types (currently only python/pytest, C and C++). Implies -c dbg unless otherwise set."`
 		Failed              bool          `short:"f" long:"failed" description:"Runs just the test cases that failed from the immediately previous run."`
@@ -180,6 +197,7 @@ var opts struct {
 	Clean struct {
 		NoBackground bool     `long:"nobackground" short:"f" description:"Don't fork & detach until clean is finished."`
 		Remote       bool     `long:"remote" description:"Clean entire remote cache when no targets are given (default is local only)"`
+		Cache        bool     `long:"cache" description:"Reduces the directory cache to within its configured size and age limits, rather than cleaning everything"`
 		Args         struct { // Inner nesting is necessary to make positional-args work :(
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to clean (default is to clean everything)"`
 		} `positional-args:"true"`
@@ -214,6 +232,22 @@ var opts struct {
 		} `command:"config" description:"Initialises specific attributes of config files"`
 	} `command:"init" subcommands-optional:"true" description:"Initialises a .plzconfig file in the current directory"`
 
+	Config struct {
+		Get struct {
+			Args struct {
+				Key string `positional-arg-name:"key" required:"true" description:"Setting to print, e.g. build.timeout"`
+			} `positional-args:"true" required:"true"`
+		} `command:"get" description:"Prints the value of a config setting, after merging all config files and profiles"`
+		Set struct {
+			User  bool `short:"u" long:"user" description:"Modifies the user-level config file"`
+			Local bool `short:"l" long:"local" description:"Modifies the local config file (.plzconfig.local)"`
+			Args  struct {
+				Key    string   `positional-arg-name:"key" required:"true" description:"Setting to modify, e.g. build.timeout"`
+				Values []string `positional-arg-name:"values" required:"true" description:"Value(s) to set it to"`
+			} `positional-args:"true" required:"true"`
+		} `command:"set" description:"Sets a config setting in one of the config files. With --profile, modifies that profile's file instead."`
+	} `command:"config" description:"Reads and writes config settings"`
+
 	Gc struct {
 		Conservative bool `short:"c" long:"conservative" description:"Runs a more conservative / safer GC."`
 		TargetsOnly  bool `short:"t" long:"targets_only" description:"Only print the targets to delete"`
@@ -226,6 +260,22 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"gc" description:"Analyzes the repo to determine unneeded targets."`
 
+	Fmt struct {
+		Diff  bool `short:"d" long:"diff" description:"Print a diff of the changes instead of listing the files that would change"`
+		Write bool `short:"w" long:"write" description:"Rewrite files in place"`
+		Args  struct {
+			Files cli.Filepaths `positional-arg-name:"files" description:"BUILD files to format. Defaults to all of them in the repo."`
+		} `positional-args:"true"`
+	} `command:"fmt" alias:"format" description:"Autoformats BUILD files into a canonical style."`
+
+	Lint struct {
+		Format string `long:"format" choice:"text" choice:"sarif" default:"text" description:"Format to print issues in"`
+		List   bool   `short:"l" long:"list" description:"List the available checks and exit"`
+		Args   struct {
+			Files cli.Filepaths `positional-arg-name:"files" description:"BUILD files to check. Defaults to all of them in the repo."`
+		} `positional-args:"true"`
+	} `command:"lint" description:"Checks BUILD files for common problems."`
+
 	Export struct {
 		Output string `short:"o" long:"output" required:"true" description:"Directory to export into"`
 		Args   struct {
@@ -247,6 +297,14 @@ var opts struct {
 		} `positional-args:"true" required:"yes"`
 	} `command:"follow" description:"Connects to a remote Please instance to stream build events from."`
 
+	Serve struct {
+		Host string `long:"host" default:"127.0.0.1" description:"Host to serve on. Defaults to loopback only; pass an empty string to listen on all interfaces."`
+		Port int    `short:"p" long:"port" default:"7778" description:"Port to serve on"`
+		Args struct {
+			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to load the graph for. Defaults to everything."`
+		} `positional-args:"true"`
+	} `command:"serve" description:"Parses the repo and serves queries about its build graph over gRPC, for use by IDEs and other tools."`
+
 	Help struct {
 		Args struct {
 			Topic help.Topic `positional-arg-name:"topic" description:"Topic to display help on"`
@@ -277,11 +335,21 @@ var opts struct {
 			} `positional-args:"true" required:"true"`
 		} `command:"revdeps" alias:"reverseDeps" description:"Queries all the reverse dependencies of a target."`
 		SomePath struct {
-			Args struct {
+			ExcludeLabel []string `long:"exclude_label" description:"Don't find paths through targets with this label"`
+			ExcludeKind  []string `long:"exclude_kind" description:"Don't find paths through targets of this kind of rule (e.g. go_library)"`
+			Args         struct {
 				Target1 core.BuildLabel `positional-arg-name:"target1" description:"First build target" required:"true"`
 				Target2 core.BuildLabel `positional-arg-name:"target2" description:"Second build target" required:"true"`
 			} `positional-args:"true" required:"true"`
 		} `command:"somepath" description:"Queries for a path between two targets"`
+		AllPaths struct {
+			ExcludeLabel []string `long:"exclude_label" description:"Don't find paths through targets with this label"`
+			ExcludeKind  []string `long:"exclude_kind" description:"Don't find paths through targets of this kind of rule (e.g. go_library)"`
+			Args         struct {
+				Target1 core.BuildLabel `positional-arg-name:"target1" description:"First build target" required:"true"`
+				Target2 core.BuildLabel `positional-arg-name:"target2" description:"Second build target" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"allpaths" description:"Queries for all the paths between two targets"`
 		AllTargets struct {
 			Hidden bool `long:"hidden" description:"Show hidden targets as well"`
 			Args   struct {
@@ -329,6 +397,13 @@ var opts struct {
 				Files cli.StdinStrings `positional-arg-name:"files" required:"true" description:"Files to query targets responsible for"`
 			} `positional-args:"true"`
 		} `command:"whatoutputs" description:"Prints out target(s) responsible for outputting provided file(s)"`
+		WhatInputs struct {
+			Hidden    bool `long:"hidden" short:"h" description:"Output internal / hidden targets too"`
+			EchoFiles bool `long:"echo_files" description:"Echo the file for which the printed targets are responsible."`
+			Args      struct {
+				Files cli.StdinStrings `positional-arg-name:"files" required:"true" description:"Files to query targets consuming"`
+			} `positional-args:"true"`
+		} `command:"whatinputs" description:"Prints out target(s) that consume provided file(s) as sources"`
 		Rules struct {
 			Args struct {
 				Targets []core.BuildLabel `hidden:"true" description:"deprecated, has no effect"`
@@ -357,6 +432,10 @@ var opts struct {
 			DiffSpec         string `long:"diffspec" description:"Calculate changes contained within given scm spec (commit range/sha/ref/etc)."`
 			IncludeDependees string `long:"include-dependees" default:"none" choice:"none" choice:"direct" choice:"transitive" description:"Include direct or transitive dependees of changed targets."`
 		} `command:"changed" description:"Show changed targets since some diffspec."`
+		CriticalPath struct {
+		} `command:"critpath" description:"Prints the critical path through the last build."`
+		Flakes struct {
+		} `command:"flakes" description:"Prints tests whose outcomes have differed between runs with identical inputs, according to the recorded test history."`
 	} `command:"query" description:"Queries information about the build graph"`
 
 	Ide struct {
@@ -365,7 +444,33 @@ var opts struct {
 				Labels []core.BuildLabel `positional-arg-name:"labels" description:"Targets to include."`
 			} `positional-args:"true"`
 		} `command:"intellij" description:"Export intellij structure for the given targets and their dependencies."`
+		CompDB struct {
+			Args struct {
+				Labels []core.BuildLabel `positional-arg-name:"labels" description:"Targets to include."`
+			} `positional-args:"true"`
+		} `command:"compdb" description:"Writes compile_commands.json for the given C/C++ targets and their dependencies."`
+		GoPackagesDriver struct {
+			Args struct {
+				Patterns []string `positional-arg-name:"patterns" description:"Go package patterns to load."`
+			} `positional-args:"true"`
+		} `command:"gopackagesdriver" description:"Acts as a driver for golang.org/x/tools/go/packages; set GOPACKAGESDRIVER to invoke it."`
 	} `command:"ide" description:"IDE Support and generation."`
+
+	Debug struct {
+		RemoteDiff struct {
+			Rebuild bool `long:"rebuild" description:"Rebuilds the targets locally rather than using any cached outputs."`
+			Args    struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to compare" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"remote-diff" description:"Builds targets locally and compares them to how they would be built remotely, reporting any differences in their commands, environment or outputs."`
+		Determinism struct {
+			Runs   int  `short:"n" long:"num_runs" default:"3" description:"Number of times to build the targets."`
+			active bool `no-flag:"true"`
+			Args   struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to check" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"determinism" description:"Builds targets several times with the cache disabled and their inputs & environment shuffled, and reports any differences between the outputs of each build."`
+	} `command:"debug" description:"Helps to debug problems with the build."`
 }
 
 // Definitions of what we do for each command.
@@ -394,7 +499,7 @@ var buildFunctions = map[string]func() int{
 	},
 	"test": func() int {
 		targets := testTargets(opts.Test.Args.Target, opts.Test.Args.Args, opts.Test.Failed, opts.Test.TestResultsFile)
-		success, state := doTest(targets, opts.Test.SurefireDir, opts.Test.TestResultsFile)
+		success, state := doTest(targets, opts.Test.SurefireDir, opts.Test.TestResultsFile, opts.Test.TAPResultsFile)
 		return toExitCode(success, state)
 	},
 	"cover": func() int {
@@ -406,13 +511,14 @@ var buildFunctions = map[string]func() int{
 		}
 		targets := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args, opts.Cover.Failed, opts.Cover.TestResultsFile)
 		os.RemoveAll(string(opts.Cover.CoverageResultsFile))
-		success, state := doTest(targets, opts.Cover.SurefireDir, opts.Cover.TestResultsFile)
+		success, state := doTest(targets, opts.Cover.SurefireDir, opts.Cover.TestResultsFile, opts.Cover.TAPResultsFile)
 		test.AddOriginalTargetsToCoverage(state, opts.Cover.IncludeAllFiles)
 		test.RemoveFilesFromCoverage(state.Coverage, state.Config.Cover.ExcludeExtension)
 
 		var stats *test.IncrementalStats
-		if opts.Cover.Incremental {
-			lines, err := scm.NewFallback(core.RepoRoot).ChangedLines()
+		incremental := opts.Cover.Incremental || opts.Cover.IncrementalSince != "" || opts.Cover.MinIncremental > 0
+		if incremental {
+			lines, err := scm.NewFallback(core.RepoRoot).ChangedLines(opts.Cover.IncrementalSince)
 			if err != nil {
 				log.Fatalf("Failed to determine changes: %s", err)
 			}
@@ -420,14 +526,19 @@ var buildFunctions = map[string]func() int{
 		}
 		test.WriteCoverageToFileOrDie(state.Coverage, string(opts.Cover.CoverageResultsFile), stats)
 		test.WriteXMLCoverageToFileOrDie(targets, state.Coverage, string(opts.Cover.CoverageXMLReport))
+		test.WriteHTMLCoverageToFileOrDie(state.Coverage, string(opts.Cover.CoverageHTMLReport))
 
 		if opts.Cover.LineCoverageReport {
 			output.PrintLineCoverageReport(state, opts.Cover.IncludeFile.AsStrings())
 		} else if !opts.Cover.NoCoverageReport {
 			output.PrintCoverage(state, opts.Cover.IncludeFile.AsStrings())
 		}
-		if opts.Cover.Incremental {
+		if incremental {
 			output.PrintIncrementalCoverage(stats)
+			if stats.ModifiedLines > 0 && stats.Percentage < opts.Cover.MinIncremental {
+				log.Errorf("Incremental coverage %0.1f%% is below the minimum of %0.1f%%", stats.Percentage, opts.Cover.MinIncremental)
+				return 1
+			}
 		}
 		return toExitCode(success, state)
 	},
@@ -451,6 +562,19 @@ var buildFunctions = map[string]func() int{
 	},
 	"clean": func() int {
 		config.Cache.DirClean = false // don't run the normal cleaner
+		if opts.Clean.Cache {
+			if config.Cache.Dir == "" {
+				log.Warning("No dir cache is configured, nothing to clean")
+				return 0
+			}
+			size, reclaimed, err := cache.CleanDirCache(config)
+			if err != nil {
+				log.Error("Failed to clean the dir cache: %s", err)
+				return 1
+			}
+			fmt.Printf("Reclaimed %s from the dir cache, it's now %s\n", humanize.Bytes(reclaimed), humanize.Bytes(size))
+			return 0
+		}
 		if len(opts.Clean.Args.Targets) == 0 && core.InitialPackage()[0].PackageName == "" {
 			if len(opts.BuildFlags.Include) == 0 && len(opts.BuildFlags.Exclude) == 0 {
 				// Clean everything, doesn't require parsing at all.
@@ -495,6 +619,52 @@ var buildFunctions = map[string]func() int{
 		}
 		return toExitCode(success, state)
 	},
+	"fmt": func() int {
+		mode := format.List
+		if opts.Fmt.Diff && opts.Fmt.Write {
+			log.Fatalf("--diff and --write are mutually exclusive")
+		} else if opts.Fmt.Diff {
+			mode = format.Diff
+		} else if opts.Fmt.Write {
+			mode = format.Write
+		}
+		formatted, err := format.FormatFiles(config, opts.Fmt.Args.Files.AsStrings(), mode)
+		if err != nil {
+			log.Fatalf("%s", err)
+		} else if !formatted && mode != format.Write {
+			return 1
+		}
+		return 0
+	},
+	"lint": func() int {
+		if opts.Lint.List {
+			for _, check := range lint.Checks() {
+				fmt.Printf("%s: %s\n", check.Name(), check.Description())
+			}
+			return 0
+		}
+		checks, err := lint.EnabledChecks(config)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		issues, err := lint.Lint(core.NewBuildState(config), opts.Lint.Args.Files.AsStrings())
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		if opts.Lint.Format == "sarif" {
+			if err := lint.WriteSARIF(os.Stdout, checks, issues); err != nil {
+				log.Fatalf("Failed to write SARIF: %s", err)
+			}
+		} else {
+			for _, issue := range issues {
+				fmt.Println(issue)
+			}
+		}
+		if len(issues) > 0 {
+			return 1
+		}
+		return 0
+	},
 	"init": func() int {
 		utils.InitConfig(string(opts.Init.Dir), opts.Init.BazelCompatibility)
 		return 0
@@ -509,6 +679,28 @@ var buildFunctions = map[string]func() int{
 		}
 		return 0
 	},
+	"get": func() int {
+		values, err := config.GetValue(opts.Config.Get.Args.Key)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		for _, v := range values {
+			fmt.Println(v)
+		}
+		return 0
+	},
+	"set": func() int {
+		filename := configFileToSet()
+		key, values := opts.Config.Set.Args.Key, opts.Config.Set.Args.Values
+		// Check it's a valid setting before we write it anywhere.
+		if err := core.DefaultConfiguration().ApplyOverrides(map[string]string{key: strings.Join(values, ",")}); err != nil {
+			log.Fatalf("%s", err)
+		} else if err := core.UpdateConfigFile(filename, key, values); err != nil {
+			log.Fatalf("Failed to update %s: %s", filename, err)
+		}
+		fmt.Printf("Set %s in %s\n", key, filename)
+		return 0
+	},
 	"export": func() int {
 		success, state := runBuild(opts.Export.Args.Targets, false, false, false)
 		if success {
@@ -528,6 +720,13 @@ var buildFunctions = map[string]func() int{
 		}
 		return toExitCode(success, state)
 	},
+	"serve": func() int {
+		return runQuery(true, opts.Serve.Args.Targets, func(state *core.BuildState) {
+			if err := serve.Serve(state, opts.Serve.Host, opts.Serve.Port); err != nil {
+				log.Fatalf("Failed to serve build graph: %s", err)
+			}
+		})
+	},
 	"help": func() int {
 		return toExitCode(help.Help(string(opts.Help.Args.Topic)), nil)
 	},
@@ -549,7 +748,21 @@ var buildFunctions = map[string]func() int{
 		return runQuery(true,
 			[]core.BuildLabel{opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2},
 			func(state *core.BuildState) {
-				query.SomePath(state.Graph, opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2)
+				query.SomePath(state.Graph, opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2, query.PathConstraints{
+					ExcludeLabels: opts.Query.SomePath.ExcludeLabel,
+					ExcludeKinds:  opts.Query.SomePath.ExcludeKind,
+				})
+			},
+		)
+	},
+	"allpaths": func() int {
+		return runQuery(true,
+			[]core.BuildLabel{opts.Query.AllPaths.Args.Target1, opts.Query.AllPaths.Args.Target2},
+			func(state *core.BuildState) {
+				query.AllPaths(state.Graph, opts.Query.AllPaths.Args.Target1, opts.Query.AllPaths.Args.Target2, query.PathConstraints{
+					ExcludeLabels: opts.Query.AllPaths.ExcludeLabel,
+					ExcludeKinds:  opts.Query.AllPaths.ExcludeKind,
+				})
 			},
 		)
 	},
@@ -624,6 +837,11 @@ var buildFunctions = map[string]func() int{
 			query.WhatOutputs(state.Graph, opts.Query.WhatOutputs.Args.Files.Get(), opts.Query.WhatOutputs.EchoFiles)
 		})
 	},
+	"whatinputs": func() int {
+		return runQuery(true, core.WholeGraph, func(state *core.BuildState) {
+			query.WhatInputs(state.Graph, opts.Query.WhatInputs.Args.Files.Get(), opts.Query.WhatInputs.Hidden, opts.Query.WhatInputs.EchoFiles)
+		})
+	},
 	"rules": func() int {
 		help.PrintRuleArgs()
 		return 0
@@ -685,6 +903,20 @@ var buildFunctions = map[string]func() int{
 			query.Filter(state, state.ExpandOriginalTargets())
 		})
 	},
+	"critpath": func() int {
+		if err := query.CriticalPath(); err != nil {
+			log.Errorf("Failed to read critical path of the last build: %s", err)
+			return 1
+		}
+		return 0
+	},
+	"flakes": func() int {
+		if err := query.Flakes(config); err != nil {
+			log.Errorf("Failed to read test history: %s", err)
+			return 1
+		}
+		return 0
+	},
 	"intellij": func() int {
 		success, state := runBuild(opts.Ide.IntelliJ.Args.Labels, false, false, false)
 		if success {
@@ -692,6 +924,75 @@ var buildFunctions = map[string]func() int{
 		}
 		return toExitCode(success, state)
 	},
+	"compdb": func() int {
+		return runQuery(true, opts.Ide.CompDB.Args.Labels, func(state *core.BuildState) {
+			if err := compdb.WriteFile(state, state.ExpandOriginalLabels()); err != nil {
+				log.Fatalf("Failed to write %s: %s", compdb.Filename, err)
+			}
+		})
+	},
+	"gopackagesdriver": func() int {
+		return runQuery(true, core.WholeGraph, func(state *core.BuildState) {
+			if err := gopackages.Run(state, opts.Ide.GoPackagesDriver.Args.Patterns, os.Stdin, os.Stdout); err != nil {
+				log.Fatalf("Failed to load packages: %s", err)
+			}
+		})
+	},
+	"remote-diff": func() int {
+		if config.Remote.URL == "" {
+			log.Fatalf("Remote execution isn't configured; set remote.url to compare against it")
+		}
+		if opts.Debug.RemoteDiff.Rebuild {
+			opts.FeatureFlags.NoCache = true
+		}
+		// Build everything locally; we still get a remote client that we can compare with.
+		config.Remote.NumExecutors = 0
+		success, state := runBuild(opts.Debug.RemoteDiff.Args.Targets, true, false, false)
+		if !success {
+			return toExitCode(success, state)
+		}
+		same := true
+		for _, label := range state.ExpandOriginalLabels() {
+			s, err := build.RemoteDiff(state, state.Graph.TargetOrDie(label), os.Stdout)
+			if err != nil {
+				log.Fatalf("Failed to compare %s: %s", label, err)
+			}
+			same = same && s
+		}
+		if !same {
+			return 1
+		}
+		return 0
+	},
+	"determinism": func() int {
+		if opts.Debug.Determinism.Runs < 2 {
+			log.Fatalf("Must build at least twice to check determinism")
+		}
+		opts.Debug.Determinism.active = true
+		opts.FeatureFlags.NoCache = true
+		config.Remote.NumExecutors = 0
+		dc, err := build.NewDeterminismChecker(path.Join(core.OutDir, "tmp", "determinism"))
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		for i := 0; i < opts.Debug.Determinism.Runs; i++ {
+			log.Notice("Building targets (run %d of %d)", i+1, opts.Debug.Determinism.Runs)
+			success, state := runBuild(opts.Debug.Determinism.Args.Targets, true, false, false)
+			if !success {
+				return toExitCode(success, state)
+			}
+			if err := dc.Record(state, state.ExpandOriginalLabels()); err != nil {
+				log.Fatalf("Failed to record outputs: %s", err)
+			}
+		}
+		same, err := dc.Report(os.Stdout)
+		if err != nil {
+			log.Fatalf("%s", err)
+		} else if !same {
+			return 1
+		}
+		return 0
+	},
 }
 
 // ConfigOverrides are used to implement completion on the -o flag.
@@ -717,13 +1018,16 @@ func runQuery(needFullParse bool, labels []core.BuildLabel, onSuccess func(state
 	return 1
 }
 
-func doTest(targets []core.BuildLabel, surefireDir cli.Filepath, resultsFile cli.Filepath) (bool, *core.BuildState) {
+func doTest(targets []core.BuildLabel, surefireDir, resultsFile, tapResultsFile cli.Filepath) (bool, *core.BuildState) {
 	os.RemoveAll(string(surefireDir))
 	os.RemoveAll(string(resultsFile))
 	os.MkdirAll(string(surefireDir), core.DirPermissions)
 	success, state := runBuild(targets, true, true, false)
 	test.CopySurefireXMLFilesToDir(state, string(surefireDir))
 	test.WriteResultsToFileOrDie(state.Graph, string(resultsFile))
+	if tapResultsFile != "" {
+		test.WriteTAPResultsToFileOrDie(state.Graph, string(tapResultsFile))
+	}
 	return success, state
 }
 
@@ -767,12 +1071,18 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	state.PrepareShell = opts.Build.Shell || opts.Test.Shell || opts.Cover.Shell
 	state.Watch = len(opts.Watch.Args.Targets) > 0
 	state.CleanWorkdirs = !opts.FeatureFlags.KeepWorkdirs
-	state.ForceRebuild = opts.Build.Rebuild
+	state.ForceRebuild = opts.Build.Rebuild || opts.Debug.Determinism.active
+	state.ShuffleInputs = opts.Debug.Determinism.active
 	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput
 	state.DebugTests = debugTests
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
+	state.PrintCriticalPath = opts.OutputFlags.CriticalPath
+	state.PrintSlowestPackages = opts.OutputFlags.SlowestPackages
+	state.PrintCacheStats = opts.OutputFlags.CacheStats
+	state.CacheStatsFile = string(opts.OutputFlags.CacheStatsFile)
 	state.ParsePackageOnly = opts.ParsePackageOnly
-	state.DownloadOutputs = (!opts.Build.NoDownload && len(targets) > 0 && !targets[0].IsAllSubpackages()) || opts.Build.Download
+	// Targets we're going to run must always be downloaded, since they run locally.
+	state.DownloadOutputs = (!opts.Build.NoDownload && len(targets) > 0 && !targets[0].IsAllSubpackages()) || opts.Build.Download || state.NeedRun
 	state.SetIncludeAndExclude(opts.BuildFlags.Include, opts.BuildFlags.Exclude)
 	if opts.BuildFlags.Arch.OS != "" {
 		state.OriginalArch = opts.BuildFlags.Arch
@@ -806,7 +1116,7 @@ func runPlease(state *core.BuildState, targets []core.BuildLabel) {
 	wg.Add(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		output.MonitorState(ctx, state, !pretty, detailedTests, streamTests, string(opts.OutputFlags.TraceFile))
+		output.MonitorState(ctx, state, !pretty, detailedTests, streamTests, string(opts.OutputFlags.TraceFile), string(opts.OutputFlags.BuildProfile), string(opts.OutputFlags.BuildDB), state.Config.Events.Webhook)
 		wg.Done()
 	}()
 
@@ -836,6 +1146,31 @@ func testTargets(target core.BuildLabel, args []string, failed bool, resultsFile
 	return []core.BuildLabel{target}
 }
 
+// configFileToSet returns the config file that plz config set should modify.
+func configFileToSet() string {
+	var filename string
+	if opts.Config.Set.User {
+		filename = core.ExpandHomePath(core.UserConfigFileName)
+	} else {
+		if opts.BuildFlags.RepoRoot == "" {
+			core.MustFindRepoRoot()
+		} else {
+			core.RepoRoot = string(opts.BuildFlags.RepoRoot)
+		}
+		if opts.Config.Set.Local {
+			filename = path.Join(core.RepoRoot, core.LocalConfigFileName)
+		} else {
+			filename = path.Join(core.RepoRoot, core.ConfigFileName)
+		}
+	}
+	if len(opts.BuildFlags.Profile) > 1 {
+		log.Fatalf("Can only set config in one profile at a time")
+	} else if len(opts.BuildFlags.Profile) == 1 {
+		filename += "." + opts.BuildFlags.Profile[0]
+	}
+	return filename
+}
+
 // readConfig reads the initial configuration files
 func readConfig(forceUpdate bool) *core.Configuration {
 	cfg, err := core.ReadDefaultConfigFiles(opts.BuildFlags.Profile)
@@ -960,7 +1295,7 @@ func initBuild(args []string) string {
 		opts.Query.Completions.Cmd = command
 		opts.Query.Completions.Args.Fragments = []string{opts.Complete}
 		command = "completions"
-	} else if command == "help" || command == "follow" || command == "init" || command == "config" || command == "tool" {
+	} else if command == "help" || command == "follow" || command == "init" || command == "config" || command == "set" || command == "tool" {
 		// These commands don't use a config file, allowing them to be run outside a repo.
 		if flagsErr != nil { // This error otherwise doesn't get checked until later.
 			cli.ParseFlagsFromArgsOrDie("Please", &opts, os.Args)
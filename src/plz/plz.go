@@ -61,12 +61,14 @@ func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *
 	}
 	// Wait until they've all exited, which they'll do once they have no tasks left.
 	wg.Wait()
+	parse.SaveGraphCache(state)
 	if state.Cache != nil {
 		state.Cache.Shutdown()
 	}
 	if state.RemoteClient != nil {
 		_, _, in, out := state.RemoteClient.DataRate()
 		log.Info("Total remote RPC data in: %d out: %d", in, out)
+		state.RemoteClient.Shutdown()
 	}
 	state.CloseResults()
 }
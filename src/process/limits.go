@@ -0,0 +1,73 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+)
+
+// cgroupPeriod is the period (in microseconds) we use when setting CPU quotas in cgroups.
+const cgroupPeriod = 100000
+
+// nextCgroup is used to give each cgroup we create a unique name.
+var nextCgroup int64
+
+// limitResources modifies the given command to enforce the resource limits of the given target.
+// It returns the new command and a function to call once it has completed.
+//
+// If we have a cgroup to work in, we create a child of it for this command, and the command
+// moves itself into it before executing the real thing (which is simpler than trying to move
+// it in from outside, since it can't have started any subprocesses yet).
+// Without one the limits aren't enforced; ulimit -v would be the obvious alternative but it limits
+// address space rather than memory actually used, which breaks things like the Go runtime and JVM
+// that reserve far more than they need, and Linux ignores RSS limits entirely.
+func (e *Executor) limitResources(target Target, argv []string) ([]string, func()) {
+	noop := func() {}
+	if target == nil {
+		return argv, noop
+	}
+	cpus, memory := target.ResourceLimits()
+	if cpus <= 0 && memory == 0 {
+		return argv, noop
+	}
+	if e.cgroup != "" {
+		dir, err := createCgroup(e.cgroup, cpus, memory)
+		if err == nil {
+			return append([]string{"sh", "-c", `echo $$ > "$0" && exec "$@"`, path.Join(dir, "cgroup.procs")}, argv...), func() {
+				if err := os.Remove(dir); err != nil {
+					log.Warning("Failed to remove cgroup %s: %s", dir, err)
+				}
+			}
+		}
+		log.Warning("Failed to create cgroup to limit resources for %s, they won't be enforced: %s", target, err)
+		return argv, noop
+	}
+	e.noCgroupWarning.Do(func() {
+		log.Warning("Resource limits on targets (e.g. %s) aren't enforced locally since build.cgroup isn't set", target)
+	})
+	return argv, noop
+}
+
+// createCgroup creates a new child of the given cgroup with the given limits set.
+func createCgroup(parent string, cpus int, memory uint64) (string, error) {
+	dir := path.Join(parent, fmt.Sprintf("plz-%d-%d", os.Getpid(), atomic.AddInt64(&nextCgroup, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	if cpus > 0 {
+		if err := ioutil.WriteFile(path.Join(dir, "cpu.max"), []byte(fmt.Sprintf("%d %d", cpus*cgroupPeriod, cgroupPeriod)), 0644); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	if memory > 0 {
+		if err := ioutil.WriteFile(path.Join(dir, "memory.max"), []byte(strconv.FormatUint(memory, 10)), 0644); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
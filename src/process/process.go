@@ -22,15 +22,20 @@ var log = logging.MustGetLogger("progress")
 // An Executor handles starting, running and monitoring a set of subprocesses.
 // It registers as a signal handler to attempt to terminate them all at process exit.
 type Executor struct {
-	sandboxCommand string
-	processes      map[*exec.Cmd]struct{}
-	mutex          sync.Mutex
+	sandboxCommand  string
+	cgroup          string
+	noCgroupWarning sync.Once
+	processes       map[*exec.Cmd]struct{}
+	mutex           sync.Mutex
 }
 
 // New returns a new Executor.
-func New(sandboxCommand string) *Executor {
+// If cgroup is non-empty, resource limits for each target are enforced by creating
+// a child of that cgroup for each process.
+func New(sandboxCommand, cgroup string) *Executor {
 	o := &Executor{
 		sandboxCommand: sandboxCommand,
+		cgroup:         cgroup,
 		processes:      map[*exec.Cmd]struct{}{},
 	}
 	cli.AtExit(o.killAll) // Kill any subprocess if we are ourselves killed
@@ -48,6 +53,9 @@ type Target interface {
 	SetProgress(float32)
 	// ProgressDescription returns a description of what the target is doing as it runs.
 	ProgressDescription() string
+	// ResourceLimits returns the maximum number of CPUs and bytes of memory the target may use
+	// (zero for either means it's unlimited).
+	ResourceLimits() (int, uint64)
 }
 
 // ExecWithTimeout runs an external command with a timeout.
@@ -55,10 +63,27 @@ type Target interface {
 // If showOutput is true then output will be printed to stderr as well as returned.
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
 func (e *Executor) ExecWithTimeout(target Target, dir string, env []string, timeout time.Duration, showOutput, attachStdin, attachStdout bool, argv []string) ([]byte, []byte, error) {
+	if showOutput {
+		return e.execWithTimeout(target, dir, env, timeout, os.Stderr, os.Stderr, attachStdin, attachStdout, argv)
+	}
+	return e.execWithTimeout(target, dir, env, timeout, nil, nil, attachStdin, attachStdout, argv)
+}
+
+// ExecWithOutput runs an external command with a timeout, writing its stdout and stderr to the
+// given writers as it runs. The return values are as ExecWithTimeout.
+func (e *Executor) ExecWithOutput(target Target, dir string, env []string, timeout time.Duration, stdout, stderr io.Writer, argv []string) ([]byte, []byte, error) {
+	return e.execWithTimeout(target, dir, env, timeout, stdout, stderr, false, false, argv)
+}
+
+// execWithTimeout implements ExecWithTimeout and ExecWithOutput. If stdout and stderr are non-nil
+// the command's output is written to them as well as being returned.
+func (e *Executor) execWithTimeout(target Target, dir string, env []string, timeout time.Duration, stdout, stderr io.Writer, attachStdin, attachStdout bool, argv []string) ([]byte, []byte, error) {
 	// We deliberately don't attach this context to the command, so we have better
 	// control over how the process gets terminated.
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	argv, cleanup := e.limitResources(target, argv)
+	defer cleanup()
 	cmd := e.ExecCommand(argv[0], argv[1:]...)
 	defer e.removeProcess(cmd)
 	cmd.Dir = dir
@@ -67,9 +92,9 @@ func (e *Executor) ExecWithTimeout(target Target, dir string, env []string, time
 	var out bytes.Buffer
 	var outerr safeBuffer
 	var progress *float32
-	if showOutput {
-		cmd.Stdout = io.MultiWriter(os.Stderr, &out, &outerr)
-		cmd.Stderr = io.MultiWriter(os.Stderr, &outerr)
+	if stdout != nil {
+		cmd.Stdout = io.MultiWriter(stdout, &out, &outerr)
+		cmd.Stderr = io.MultiWriter(stderr, &outerr)
 	} else {
 		cmd.Stdout = io.MultiWriter(&out, &outerr)
 		cmd.Stderr = &outerr
@@ -249,7 +274,7 @@ func (e *Executor) killAll() {
 
 // ExecCommand is a utility function that runs the given command with few options.
 func ExecCommand(args ...string) ([]byte, error) {
-	e := New("")
+	e := New("", "")
 	cmd := e.ExecCommand(args[0], args[1:]...)
 	defer e.removeProcess(cmd)
 	return cmd.CombinedOutput()
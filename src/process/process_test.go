@@ -1,6 +1,9 @@
 package process
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -9,40 +12,40 @@ import (
 )
 
 func TestExecWithTimeout(t *testing.T) {
-	out, _, err := New("").ExecWithTimeout(nil, "", nil, 10*time.Second, false, false, false, []string{"true"})
+	out, _, err := New("", "").ExecWithTimeout(nil, "", nil, 10*time.Second, false, false, false, []string{"true"})
 	assert.NoError(t, err)
 	assert.Equal(t, 0, len(out))
 }
 
 func TestExecWithTimeoutFailure(t *testing.T) {
-	out, _, err := New("").ExecWithTimeout(nil, "", nil, 10*time.Second, false, false, false, []string{"false"})
+	out, _, err := New("", "").ExecWithTimeout(nil, "", nil, 10*time.Second, false, false, false, []string{"false"})
 	assert.Error(t, err)
 	assert.Equal(t, 0, len(out))
 }
 
 func TestExecWithTimeoutDeadline(t *testing.T) {
-	out, _, err := New("").ExecWithTimeout(nil, "", nil, 1*time.Nanosecond, false, false, false, []string{"sleep", "10"})
+	out, _, err := New("", "").ExecWithTimeout(nil, "", nil, 1*time.Nanosecond, false, false, false, []string{"sleep", "10"})
 	assert.Error(t, err)
 	assert.True(t, strings.HasPrefix(err.Error(), "Timeout exceeded"))
 	assert.Equal(t, 0, len(out))
 }
 
 func TestExecWithTimeoutOutput(t *testing.T) {
-	out, stderr, err := New("").ExecWithTimeoutShell(nil, "", nil, 10*time.Second, false, "echo hello", false)
+	out, stderr, err := New("", "").ExecWithTimeoutShell(nil, "", nil, 10*time.Second, false, "echo hello", false)
 	assert.NoError(t, err)
 	assert.Equal(t, "hello\n", string(out))
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
 func TestExecWithTimeoutStderr(t *testing.T) {
-	out, stderr, err := New("").ExecWithTimeoutShell(nil, "", nil, 10*time.Second, false, "echo hello 1>&2", false)
+	out, stderr, err := New("", "").ExecWithTimeoutShell(nil, "", nil, 10*time.Second, false, "echo hello 1>&2", false)
 	assert.NoError(t, err)
 	assert.Equal(t, "", string(out))
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
 func TestKillSubprocesses(t *testing.T) {
-	e := New("")
+	e := New("", "")
 	cmd := e.ExecCommand("sleep", "infinity")
 	assert.Equal(t, 1, len(e.processes))
 	err := cmd.Start()
@@ -52,3 +55,35 @@ func TestKillSubprocesses(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, 0, len(e.processes))
 }
+
+func TestExecWithMemoryLimitNoCgroup(t *testing.T) {
+	// Without a cgroup the limit isn't enforced, in particular the address space isn't limited.
+	out, _, err := New("", "").ExecWithTimeoutShell(&limitedTarget{memory: 1 << 30}, "", nil, 10*time.Second, false, "ulimit -v", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "unlimited\n", string(out))
+}
+
+func TestCreateCgroup(t *testing.T) {
+	parent, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dir, err := createCgroup(parent, 2, 1<<30)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(path.Join(dir, "cpu.max"))
+	assert.NoError(t, err)
+	assert.Equal(t, "200000 100000", string(b))
+	b, err = ioutil.ReadFile(path.Join(dir, "memory.max"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1073741824", string(b))
+}
+
+type limitedTarget struct {
+	cpus   int
+	memory uint64
+}
+
+func (t *limitedTarget) String() string                { return "//src/process:limited" }
+func (t *limitedTarget) ShouldShowProgress() bool      { return false }
+func (t *limitedTarget) SetProgress(progress float32)  {}
+func (t *limitedTarget) ProgressDescription() string   { return "building" }
+func (t *limitedTarget) ResourceLimits() (int, uint64) { return t.cpus, t.memory }
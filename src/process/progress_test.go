@@ -47,7 +47,8 @@ type target struct {
 	Progress float32
 }
 
-func (t *target) String() string               { return "//src/core:progress_test" }
-func (t *target) ShouldShowProgress() bool     { return true }
-func (t *target) SetProgress(progress float32) { t.Progress = progress }
-func (t *target) ProgressDescription() string  { return "building" }
+func (t *target) String() string                { return "//src/core:progress_test" }
+func (t *target) ShouldShowProgress() bool      { return true }
+func (t *target) SetProgress(progress float32)  { t.Progress = progress }
+func (t *target) ProgressDescription() string   { return "building" }
+func (t *target) ResourceLimits() (int, uint64) { return 0, 0 }
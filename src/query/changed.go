@@ -1,6 +1,9 @@
 package query
 
 import (
+	"path"
+	"sort"
+
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/scm"
 )
@@ -45,23 +48,22 @@ func changedFiles(since string, diffSpec string) []string {
 
 func targetsForChangedFiles(graph *core.BuildGraph, files []string, includeDependees string) []*core.BuildTarget {
 	addresses := make(map[*core.BuildTarget]struct{})
+	owned := make(map[string]struct{})
 	for _, target := range graph.AllTargets() {
 		for _, file := range files {
 			if target.HasAbsoluteSource(file) {
 				addresses[target] = struct{}{}
+				owned[file] = struct{}{}
 			}
 		}
 	}
-	if includeDependees != "direct" && includeDependees != "transitive" {
-		keys := make([]*core.BuildTarget, len(addresses))
-
-		i := 0
-		for k := range addresses {
-			keys[i] = k
-			i++
+	for _, pkg := range changedPackages(graph, files, addresses, owned) {
+		for _, target := range pkg.AllTargets() {
+			addresses[target] = struct{}{}
 		}
-
-		return keys
+	}
+	if includeDependees != "direct" && includeDependees != "transitive" {
+		return sortedTargets(addresses)
 	}
 
 	dependents := make(map[*core.BuildTarget]struct{})
@@ -75,18 +77,81 @@ func targetsForChangedFiles(graph *core.BuildGraph, files []string, includeDepen
 		}
 	} else {
 		for target := range addresses {
+			dependents[target] = struct{}{}
 			visit(dependents, target, graph.ReverseDependencies)
 		}
 	}
-	keys := make([]*core.BuildTarget, len(dependents))
+	return sortedTargets(dependents)
+}
+
+// changedPackages returns the packages that must be considered changed in their entirety,
+// given a set of changed files and the targets that directly own them.
+// That is any package whose BUILD file changed, any that subinclude a changed target, and
+// any containing a deleted file that no target owns any more (it may have been picked up by a
+// glob that no longer matches it, so we can't tell which targets had it).
+func changedPackages(graph *core.BuildGraph, files []string, owners map[*core.BuildTarget]struct{}, owned map[string]struct{}) []*core.Package {
+	changed := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		changed[file] = struct{}{}
+	}
+	pkgs := []*core.Package{}
+	for _, pkg := range graph.PackageMap() {
+		if _, present := changed[pkg.Filename]; present || subincludesChanged(graph, pkg, changed, owners) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	for _, file := range files {
+		if _, present := owned[file]; present || file == "" || core.PathExists(file) {
+			continue
+		}
+		if pkg := owningPackage(graph, file); pkg != nil {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
 
-	i := 0
-	for k := range dependents {
-		keys[i] = k
-		i++
+// subincludesChanged returns true if anything subincluded by the given package has changed.
+func subincludesChanged(graph *core.BuildGraph, pkg *core.Package, changed map[string]struct{}, owners map[*core.BuildTarget]struct{}) bool {
+	for _, label := range pkg.Subincludes {
+		target := graph.Target(label)
+		if target == nil {
+			continue
+		} else if _, present := owners[target]; present {
+			return true
+		}
+		for _, source := range target.AllSourcePaths(graph) {
+			if _, present := changed[source]; present {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	return keys
+// owningPackage returns the package that the given file would belong to, i.e. the one in its
+// closest enclosing directory that has one. It returns nil if there isn't one.
+func owningPackage(graph *core.BuildGraph, file string) *core.Package {
+	for dir := path.Dir(file); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		if pkg := graph.Package(dir, ""); pkg != nil {
+			return pkg
+		} else if dir == "" {
+			return nil
+		}
+	}
+}
+
+// sortedTargets returns the keys of the given set of targets, in a consistent order.
+func sortedTargets(targets map[*core.BuildTarget]struct{}) []*core.BuildTarget {
+	ret := make(core.BuildTargets, 0, len(targets))
+	for target := range targets {
+		ret = append(ret, target)
+	}
+	sort.Sort(ret)
+	return ret
 }
 
 func visit(dependents map[*core.BuildTarget]struct{}, target *core.BuildTarget, f func(*core.BuildTarget) []*core.BuildTarget) {
@@ -0,0 +1,64 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestChangedSources(t *testing.T) {
+	graph, targets := changedTestGraph()
+	assert.Equal(t, []*core.BuildTarget{targets[0]}, targetsForChangedFiles(graph, []string{"src/query/changed.go"}, "none"))
+	assert.Equal(t, []*core.BuildTarget{targets[1], targets[0]}, targetsForChangedFiles(graph, []string{"src/query/changed.go"}, "direct"))
+	assert.Equal(t, []*core.BuildTarget{targets[2], targets[1], targets[0]}, targetsForChangedFiles(graph, []string{"src/query/changed.go"}, "transitive"))
+}
+
+func TestChangedBuildFile(t *testing.T) {
+	graph, targets := changedTestGraph()
+	assert.Equal(t, []*core.BuildTarget{targets[1], targets[0]}, targetsForChangedFiles(graph, []string{"src/query/BUILD"}, "none"))
+}
+
+func TestChangedSubinclude(t *testing.T) {
+	graph, targets := changedTestGraph()
+	assert.Equal(t, []*core.BuildTarget{targets[3], targets[2]}, targetsForChangedFiles(graph, []string{"build_defs/go.build_defs"}, "none"))
+}
+
+func TestChangedDeletedFile(t *testing.T) {
+	// The file doesn't exist, so it may have been removed from a glob; we have to assume
+	// everything in its package has changed.
+	graph, targets := changedTestGraph()
+	assert.Equal(t, []*core.BuildTarget{targets[1], targets[0]}, targetsForChangedFiles(graph, []string{"src/query/test_data/deleted.go"}, "none"))
+}
+
+// changedTestGraph returns a graph for testing changes against. The returned targets are
+// a library, its test, a binary in another package depending on the test, and a build_defs file
+// that the other package subincludes.
+func changedTestGraph() (*core.BuildGraph, []*core.BuildTarget) {
+	graph := core.NewGraph()
+	defs := addChangedTarget(graph, "//build_defs:go", "go.build_defs")
+	lib := addChangedTarget(graph, "//src/query:query", "changed.go")
+	test := addChangedTarget(graph, "//src/query:changed_test", "changed_test.go")
+	bin := addChangedTarget(graph, "//src:please", "please.go")
+	test.AddDependency(lib.Label)
+	graph.AddDependency(test.Label, lib.Label)
+	bin.AddDependency(test.Label)
+	graph.AddDependency(bin.Label, test.Label)
+	graph.PackageByLabel(bin.Label).RegisterSubinclude(defs.Label)
+	return graph, []*core.BuildTarget{lib, test, bin, defs}
+}
+
+func addChangedTarget(graph *core.BuildGraph, label, src string) *core.BuildTarget {
+	t := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	t.AddSource(core.FileLabel{File: src, Package: t.Label.PackageName})
+	pkg := graph.PackageByLabel(t.Label)
+	if pkg == nil {
+		pkg = core.NewPackage(t.Label.PackageName)
+		pkg.Filename = t.Label.PackageName + "/BUILD"
+		graph.AddPackage(pkg)
+	}
+	pkg.AddTarget(t)
+	graph.AddTarget(t)
+	return t
+}
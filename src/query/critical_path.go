@@ -0,0 +1,20 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// CriticalPath prints the critical path through the last build, along with how long each
+// target on it took. The path is read from the metadata recorded at the end of that build.
+func CriticalPath() error {
+	path, err := core.ReadCriticalPath()
+	if err != nil {
+		return err
+	}
+	for _, entry := range path {
+		fmt.Printf("%s %s\n", entry.Label, entry.Duration)
+	}
+	return nil
+}
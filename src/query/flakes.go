@@ -0,0 +1,21 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/test"
+)
+
+// Flakes prints any tests in the recorded test history that have both passed and failed
+// for identical inputs, with the worst offenders first.
+func Flakes(config *core.Configuration) error {
+	records, err := test.ReadHistory(config)
+	if err != nil {
+		return err
+	}
+	for _, flake := range test.FindFlakes(records) {
+		fmt.Printf("%s %s: failed %d of %d runs, flaky for %d input hashes\n", flake.Label, flake.Test, flake.Failures, flake.Runs, flake.Hashes)
+	}
+	return nil
+}
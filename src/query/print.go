@@ -210,6 +210,8 @@ func (p *printer) genericPrint(v reflect.Value) (string, bool) {
 		return "True", v.Bool()
 	case reflect.Int, reflect.Int32:
 		return fmt.Sprintf("%d", v.Int()), v.Int() > 0
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("%d", v.Uint()), v.Uint() > 0
 	case reflect.Struct, reflect.Interface:
 		if stringer, ok := v.Interface().(fmt.Stringer); ok {
 			return p.quote(stringer.String()), true
@@ -129,6 +129,20 @@ func TestPrintFields(t *testing.T) {
 	assert.Equal(t, "go\ntest\n", s)
 }
 
+func TestPrintMemoryLimit(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_print_memory_limit", ""))
+	target.MemoryLimit = 1024 * 1024 * 1024
+	s := testPrintFields(target, []string{"memory_limit"})
+	assert.Equal(t, "1073741824\n", s)
+}
+
+func TestPrintOutputSizeBudget(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_print_output_size_budget", ""))
+	target.OutputSizeBudget = 50 * 1024 * 1024
+	s := testPrintFields(target, []string{"output_size_budget"})
+	assert.Equal(t, "52428800\n", s)
+}
+
 func testPrint(target *core.BuildTarget) string {
 	var buf bytes.Buffer
 	newPrinter(&buf, target, 2).PrintTarget()
@@ -6,6 +6,8 @@
 //   'somepath': 'plz query somepath //src:please //rules:java_rules_pyc'
 //               finds a route between these two targets, if there is one.
 //               useful for saying 'why on earth do I depend on that thing?'
+//   'allpaths': 'plz query allpaths //src:please //rules:java_rules_pyc'
+//               finds all the routes between these two targets.
 //   'alltargets': 'plz query alltargets //src/...'
 //                 shows all targets currently in the graph. careful in large repos!
 //   'print': 'plz query print //src:please'
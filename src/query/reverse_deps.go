@@ -9,11 +9,21 @@ import (
 
 // ReverseDeps finds all transitive targets that depend on the set of input labels.
 func ReverseDeps(state *core.BuildState, labels []core.BuildLabel, level int, hidden bool) {
+	for _, target := range ReverseDepLabels(state, labels, level, hidden) {
+		fmt.Printf("%s\n", target)
+	}
+}
+
+// ReverseDepLabels returns the transitive reverse dependencies of the given labels, to the given depth.
+// Hidden targets are only included if hidden is true. All the labels must exist in the graph.
+func ReverseDepLabels(state *core.BuildState, labels []core.BuildLabel, level int, hidden bool) core.BuildLabels {
+	ret := core.BuildLabels{}
 	for _, target := range getRevDepTransitiveLabels(state, labels, map[core.BuildLabel]struct{}{}, level) {
 		if hidden || target.Name[0] != '_' {
-			fmt.Printf("%s\n", target)
+			ret = append(ret, target)
 		}
 	}
+	return ret
 }
 
 func getRevDepTransitiveLabels(state *core.BuildState, labels []core.BuildLabel, done map[core.BuildLabel]struct{}, level int) core.BuildLabels {
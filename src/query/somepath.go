@@ -1,63 +1,159 @@
 package query
 
-import "fmt"
+import (
+	"fmt"
 
-import "github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/core"
+)
 
-// SomePath finds and returns a path between two targets.
-// Useful for a "why on earth do I depend on this thing" type query.
-func SomePath(graph *core.BuildGraph, label1 core.BuildLabel, label2 core.BuildLabel) {
-	// Awkwardly either target can be :all. This is an extremely useful idiom though so despite
-	// trickiness is worth supporting.
-	// Of course this calculation is also quadratic but it's not very obvious how to avoid that.
-	if label1.IsAllTargets() {
-		for _, target := range graph.PackageOrDie(label1).AllTargets() {
-			if querySomePath1(graph, target, label2, false) {
-				return
-			}
+// PathConstraints restricts the targets that a dependency path can pass through.
+// They don't apply to the targets at either end of it.
+type PathConstraints struct {
+	// Paths can't pass through any target with one of these labels.
+	ExcludeLabels []string
+	// Paths can't pass through any target of one of these kinds (e.g. go_library).
+	ExcludeKinds []string
+}
+
+// excludes returns true if the given target can't be on a path.
+func (c PathConstraints) excludes(target *core.BuildTarget) bool {
+	if target.HasAnyLabel(c.ExcludeLabels) {
+		return true
+	}
+	for _, kind := range c.ExcludeKinds {
+		if target.Kind == kind {
+			return true
 		}
-		fmt.Printf("Couldn't find any dependency path between %s and %s\n", label1, label2)
+	}
+	return false
+}
+
+// SomePath finds and prints a path between two targets.
+// Useful for a "why on earth do I depend on this thing" type query.
+func SomePath(graph *core.BuildGraph, label1, label2 core.BuildLabel, constraints PathConstraints) {
+	if path := FindSomePath(graph, label1, label2, constraints); path != nil {
+		printPath(graph, path)
 	} else {
-		querySomePath1(graph, graph.TargetOrDie(label1), label2, true)
+		fmt.Printf("Couldn't find any dependency path between %s and %s\n", label1, label2)
+	}
+}
+
+// AllPaths finds and prints all the paths between two targets.
+func AllPaths(graph *core.BuildGraph, label1, label2 core.BuildLabel, constraints PathConstraints) {
+	paths := FindAllPaths(graph, label1, label2, constraints)
+	if len(paths) == 0 {
+		fmt.Printf("Couldn't find any dependency path between %s and %s\n", label1, label2)
+		return
+	}
+	for _, path := range paths {
+		printPath(graph, path)
 	}
 }
 
-func querySomePath1(graph *core.BuildGraph, target1 *core.BuildTarget, label2 core.BuildLabel, print bool) bool {
-	// Now we do the same for label2.
-	if label2.IsAllTargets() {
-		for _, target2 := range graph.PackageOrDie(label2).AllTargets() {
-			if querySomePath2(graph, target1, target2, false) {
-				return true
+// FindSomePath returns the shortest dependency path between two targets, in either direction,
+// or nil if there isn't one.
+// Awkwardly either target can be :all. This is an extremely useful idiom though so despite
+// trickiness is worth supporting. The calculation is quadratic in that case.
+func FindSomePath(graph *core.BuildGraph, label1, label2 core.BuildLabel, constraints PathConstraints) []*core.BuildTarget {
+	for _, target1 := range expandAll(graph, label1) {
+		for _, target2 := range expandAll(graph, label2) {
+			if target1 == target2 && (label1.IsAllTargets() || label2.IsAllTargets()) {
+				continue // Not an interesting path
+			} else if path := shortestPath(target1, target2, constraints); path != nil {
+				return path
+			} else if path := shortestPath(target2, target1, constraints); path != nil {
+				return path
 			}
 		}
-		return false
 	}
-	return querySomePath2(graph, target1, graph.TargetOrDie(label2), print)
+	return nil
 }
 
-func querySomePath2(graph *core.BuildGraph, target1, target2 *core.BuildTarget, print bool) bool {
-	if !printSomePath(graph, target1, target2) && !printSomePath(graph, target2, target1) {
-		if print {
-			fmt.Printf("Couldn't find any dependency path between %s and %s\n", target1.Label, target2.Label)
+// FindAllPaths returns all the dependency paths between two targets, in either direction.
+func FindAllPaths(graph *core.BuildGraph, label1, label2 core.BuildLabel, constraints PathConstraints) [][]*core.BuildTarget {
+	paths := [][]*core.BuildTarget{}
+	for _, target1 := range expandAll(graph, label1) {
+		for _, target2 := range expandAll(graph, label2) {
+			if target1 == target2 {
+				if !label1.IsAllTargets() && !label2.IsAllTargets() {
+					paths = append(paths, []*core.BuildTarget{target1})
+				}
+				continue // Otherwise it's not an interesting path
+			}
+			paths = append(paths, allPaths(target1, target2, constraints)...)
+			paths = append(paths, allPaths(target2, target1, constraints)...)
 		}
-		return false
 	}
-	return true
+	return paths
 }
 
-// This is just a simple DFS through the graph.
-func printSomePath(graph *core.BuildGraph, target1, target2 *core.BuildTarget) bool {
-	if target1 == target2 {
-		fmt.Printf("Found path:\n  %s\n", target1.Label)
-		return true
+// expandAll returns the targets a label refers to, which is all of them in its package for :all.
+func expandAll(graph *core.BuildGraph, label core.BuildLabel) []*core.BuildTarget {
+	if label.IsAllTargets() {
+		return graph.PackageOrDie(label).AllTargets()
 	}
-	for _, target := range graph.ReverseDependencies(target2) {
-		if printSomePath(graph, target1, target) {
-			if target2.Parent(graph) != target {
-				fmt.Printf("  %s\n", target2.Label)
+	return []*core.BuildTarget{graph.TargetOrDie(label)}
+}
+
+// shortestPath does a breadth-first search for a path from one target to another through its dependencies.
+func shortestPath(from, to *core.BuildTarget, constraints PathConstraints) []*core.BuildTarget {
+	previous := map[*core.BuildTarget]*core.BuildTarget{from: nil}
+	queue := []*core.BuildTarget{from}
+	for len(queue) > 0 {
+		target := queue[0]
+		queue = queue[1:]
+		if target == to {
+			path := []*core.BuildTarget{}
+			for ; target != nil; target = previous[target] {
+				path = append([]*core.BuildTarget{target}, path...)
 			}
+			return path
+		}
+		for _, dep := range target.Dependencies() {
+			if _, present := previous[dep]; !present && (dep == to || !constraints.excludes(dep)) {
+				previous[dep] = target
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// allPaths does a depth-first search for all paths from one target to another through its dependencies.
+func allPaths(from, to *core.BuildTarget, constraints PathConstraints) [][]*core.BuildTarget {
+	// Memoise which targets can't reach the destination so we don't keep searching beneath them.
+	deadEnds := map[*core.BuildTarget]bool{}
+	paths := [][]*core.BuildTarget{}
+	var visit func(target *core.BuildTarget, path []*core.BuildTarget) bool
+	visit = func(target *core.BuildTarget, path []*core.BuildTarget) bool {
+		path = append(path, target)
+		if target == to {
+			paths = append(paths, append([]*core.BuildTarget{}, path...))
 			return true
+		} else if deadEnds[target] {
+			return false
+		}
+		found := false
+		for _, dep := range target.Dependencies() {
+			if dep == to || !constraints.excludes(dep) {
+				found = visit(dep, path) || found
+			}
+		}
+		if !found {
+			deadEnds[target] = true
+		}
+		return found
+	}
+	visit(from, nil)
+	return paths
+}
+
+// printPath prints a single path. Internal targets are skipped when their parent precedes them.
+func printPath(graph *core.BuildGraph, path []*core.BuildTarget) {
+	fmt.Printf("Found path:\n")
+	for i, target := range path {
+		if i == 0 || target.Parent(graph) != path[i-1] {
+			fmt.Printf("  %s\n", target.Label)
 		}
 	}
-	return false
 }
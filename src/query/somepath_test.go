@@ -0,0 +1,78 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestSomePath(t *testing.T) {
+	graph := pathGraph()
+	path := FindSomePath(graph, pathLabel("bin"), pathLabel("leaf"), PathConstraints{})
+	assert.Equal(t, []string{"bin", "lib1", "leaf"}, pathNames(path))
+	// Either order should work.
+	path = FindSomePath(graph, pathLabel("leaf"), pathLabel("bin"), PathConstraints{})
+	assert.Equal(t, []string{"bin", "lib1", "leaf"}, pathNames(path))
+	path = FindSomePath(graph, pathLabel("bin"), pathLabel("leaf"), PathConstraints{ExcludeLabels: []string{"heavy"}})
+	assert.Equal(t, []string{"bin", "lib2", "lib3", "leaf"}, pathNames(path))
+	path = FindSomePath(graph, pathLabel("bin"), pathLabel("leaf"), PathConstraints{ExcludeKinds: []string{"go_library"}})
+	assert.Nil(t, path)
+	path = FindSomePath(graph, pathLabel("lib1"), pathLabel("lib2"), PathConstraints{})
+	assert.Nil(t, path)
+}
+
+func TestAllPaths(t *testing.T) {
+	graph := pathGraph()
+	paths := FindAllPaths(graph, pathLabel("bin"), pathLabel("leaf"), PathConstraints{})
+	assert.Equal(t, 2, len(paths))
+	assert.Equal(t, []string{"bin", "lib1", "leaf"}, pathNames(paths[0]))
+	assert.Equal(t, []string{"bin", "lib2", "lib3", "leaf"}, pathNames(paths[1]))
+	paths = FindAllPaths(graph, pathLabel("bin"), pathLabel("leaf"), PathConstraints{ExcludeLabels: []string{"heavy"}})
+	assert.Equal(t, 1, len(paths))
+	paths = FindAllPaths(graph, pathLabel("all"), pathLabel("leaf"), PathConstraints{})
+	assert.Equal(t, 5, len(paths)) // two from bin, and one each from lib1, lib2 and lib3
+}
+
+// pathGraph returns a graph looking like
+//   bin -> lib1 (labelled heavy) -> leaf
+//   bin -> lib2 -> lib3 -> leaf
+func pathGraph() *core.BuildGraph {
+	graph := core.NewGraph()
+	pkg := core.NewPackage("pkg")
+	add := func(name string, deps ...string) *core.BuildTarget {
+		target := core.NewBuildTarget(pathLabel(name))
+		target.Kind = "go_library"
+		for _, dep := range deps {
+			target.AddDependency(pathLabel(dep))
+		}
+		graph.AddTarget(target)
+		pkg.AddTarget(target)
+		return target
+	}
+	add("leaf")
+	add("lib3", "leaf")
+	add("lib2", "lib3")
+	add("lib1", "leaf").AddLabel("heavy")
+	add("bin", "lib1", "lib2").Kind = "go_binary"
+	graph.AddPackage(pkg)
+	for _, target := range graph.AllTargets() {
+		for _, dep := range target.DeclaredDependencies() {
+			graph.AddDependency(target.Label, dep)
+		}
+	}
+	return graph
+}
+
+func pathLabel(name string) core.BuildLabel {
+	return core.ParseBuildLabel("//pkg:"+name, "")
+}
+
+func pathNames(path []*core.BuildTarget) []string {
+	names := make([]string, len(path))
+	for i, target := range path {
+		names[i] = target.Label.Name
+	}
+	return names
+}
@@ -0,0 +1,62 @@
+package query
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// WhatInputs prints the targets that consume each of the provided files as a source.
+// That includes targets that have them in their srcs, and any that take them in via a filegroup.
+// The targets are printed in the same order as the provided files, separated by a newline.
+// Use printFiles to additionally echo the files themselves (i.e. print <file> <target>)
+func WhatInputs(graph *core.BuildGraph, files []string, hidden, printFiles bool) {
+	for _, f := range files {
+		if printFiles {
+			fmt.Printf("%s ", f)
+		}
+		if labels := WhatInputLabels(graph, f, hidden); len(labels) > 0 {
+			for _, l := range labels {
+				fmt.Printf("%s\n", l)
+			}
+		} else {
+			fmt.Println("Error: the file is not a source of any current target")
+		}
+	}
+}
+
+// WhatInputLabels returns the labels of the targets that consume the given file as a source.
+func WhatInputLabels(graph *core.BuildGraph, file string, hidden bool) []core.BuildLabel {
+	return whatInputs(graph, filepath.Clean(file), hidden)
+}
+
+func whatInputs(graph *core.BuildGraph, file string, hidden bool) []core.BuildLabel {
+	seen := map[*core.BuildTarget]bool{}
+	ret := core.BuildLabels{}
+	var add func(target *core.BuildTarget)
+	add = func(target *core.BuildTarget) {
+		if seen[target] {
+			return
+		}
+		seen[target] = true
+		if hidden || !target.HasParent() {
+			ret = append(ret, target.Label)
+		} else if parent := target.Parent(graph); parent != nil && !seen[parent] {
+			seen[parent] = true
+			ret = append(ret, parent.Label)
+		}
+		// Filegroups pass the file straight through, so anything depending on them consumes it too.
+		if target.IsFilegroup {
+			for _, revdep := range graph.ReverseDependencies(target) {
+				add(revdep)
+			}
+		}
+	}
+	for _, target := range graph.SourceOwners(file) {
+		add(target)
+	}
+	sort.Sort(ret)
+	return ret
+}
@@ -0,0 +1,46 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestWhatInputs(t *testing.T) {
+	graph := core.NewGraph()
+	lib := addSourceTarget(graph, "//package1:lib", false, "lib.go", "util.go")
+	addSourceTarget(graph, "//package1:test", false, "lib_test.go", "lib.go")
+	addSourceTarget(graph, "//package1:other", false, "other.go")
+	assert.Equal(t, []core.BuildLabel{lib.Label, core.ParseBuildLabel("//package1:test", "")}, whatInputs(graph, "package1/lib.go", false))
+	assert.Equal(t, []core.BuildLabel{lib.Label}, whatInputs(graph, "package1/util.go", false))
+	assert.Equal(t, 0, len(whatInputs(graph, "package1/missing.go", false)))
+}
+
+func TestWhatInputsFilegroup(t *testing.T) {
+	graph := core.NewGraph()
+	fg := addSourceTarget(graph, "//package1:files", true, "data.txt")
+	consumer := core.NewBuildTarget(core.ParseBuildLabel("//package2:consumer", ""))
+	consumer.AddDependency(fg.Label)
+	graph.AddTarget(consumer)
+	assert.Equal(t, []core.BuildLabel{fg.Label, consumer.Label}, whatInputs(graph, "package1/data.txt", false))
+}
+
+func TestWhatInputsHidden(t *testing.T) {
+	graph := core.NewGraph()
+	addSourceTarget(graph, "//package1:_lib#srcs", false, "lib.go")
+	addSourceTarget(graph, "//package1:lib", false)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//package1:lib", "")}, whatInputs(graph, "package1/lib.go", false))
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//package1:_lib#srcs", "")}, whatInputs(graph, "package1/lib.go", true))
+}
+
+func addSourceTarget(graph *core.BuildGraph, label string, filegroup bool, srcs ...string) *core.BuildTarget {
+	t := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	t.IsFilegroup = filegroup
+	for _, src := range srcs {
+		t.AddSource(core.FileLabel{File: src, Package: t.Label.PackageName})
+	}
+	graph.AddTarget(t)
+	return t
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,16 +18,23 @@ import (
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/tree"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/thought-machine/please/src/build"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/fs"
 )
 
 // uploadAction uploads a build action for a target and returns its digest.
-func (c *Client) uploadAction(target *core.BuildTarget, isTest bool) (*pb.Command, *pb.Digest, error) {
+// Progress of the upload is reported against the given thread id.
+func (c *Client) uploadAction(tid int, target *core.BuildTarget, isTest bool) (*pb.Command, *pb.Digest, error) {
 	var command *pb.Command
 	var digest *pb.Digest
-	err := c.uploadBlobs(func(ch chan<- *chunker.Chunker) error {
+	status := core.TargetBuilding
+	if isTest {
+		status = core.TargetTesting
+	}
+	err := c.uploadTargetBlobs(tid, target, status, func(ch chan<- *chunker.Chunker) error {
 		defer close(ch)
 		inputRoot, err := c.uploadInputs(ch, target, isTest)
 		if err != nil {
@@ -58,6 +66,11 @@ func (c *Client) buildAction(target *core.BuildTarget, isTest, stamp bool) (*pb.
 	if err != nil {
 		return nil, nil, err
 	}
+	return c.buildActionFromInputRoot(target, inputRoot, isTest, stamp)
+}
+
+// buildActionFromInputRoot creates a build action for a target from an already-constructed input root.
+func (c *Client) buildActionFromInputRoot(target *core.BuildTarget, inputRoot *pb.Directory, isTest, stamp bool) (*pb.Command, *pb.Digest, error) {
 	inputRootDigest := c.digestMessage(inputRoot)
 	command, err := c.buildCommand(target, inputRoot, isTest, stamp)
 	if err != nil {
@@ -74,13 +87,27 @@ func (c *Client) buildAction(target *core.BuildTarget, isTest, stamp bool) (*pb.
 
 // buildStampedAndUnstampedAction builds both a stamped and unstamped version of the action for a target, if it
 // needs stamping, otherwise it returns the same one twice.
+// The input root is only constructed once and the two actions are then built concurrently.
 func (c *Client) buildStampedAndUnstampedAction(target *core.BuildTarget) (command *pb.Command, stamped, unstamped *pb.Digest, err error) {
-	command, unstampedDigest, err := c.buildAction(target, false, false)
-	if !target.Stamp || err != nil {
-		return command, unstampedDigest, unstampedDigest, err
+	if !target.Stamp {
+		command, unstamped, err = c.buildAction(target, false, false)
+		return command, unstamped, unstamped, err
 	}
-	command, stampedDigest, err := c.buildAction(target, false, true)
-	return command, stampedDigest, unstampedDigest, err
+	inputRoot, err := c.uploadInputs(nil, target, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var g errgroup.Group
+	g.Go(func() (err error) {
+		_, unstamped, err = c.buildActionFromInputRoot(target, inputRoot, false, false)
+		return err
+	})
+	g.Go(func() (err error) {
+		command, stamped, err = c.buildActionFromInputRoot(target, inputRoot, false, true)
+		return err
+	})
+	err = g.Wait()
+	return command, stamped, unstamped, err
 }
 
 // buildCommand builds the command for a single target.
@@ -91,14 +118,17 @@ func (c *Client) buildCommand(target *core.BuildTarget, inputRoot *pb.Directory,
 	// We can't predict what variables like this should be so we sneakily bung something on
 	// the front of the command. It'd be nicer if there were a better way though...
 	var commandPrefix = "export TMP_DIR=\"`pwd`\" && "
-	// TODO(peterebden): Remove this nonsense once API v2.1 is released.
 	files, dirs := outputs(target)
 	if len(target.Outputs()) == 1 { // $OUT is relative when running remotely; make it absolute
 		commandPrefix += `export OUT="$TMP_DIR/$OUT" && `
 	}
+	env, err := c.stampedBuildEnvironment(target, inputRoot, stamp)
+	if err != nil {
+		return nil, err
+	}
 	cmd, err := core.ReplaceSequences(c.state, target, c.getCommand(target))
-	return &pb.Command{
-		Platform: c.platform,
+	return c.setCommandOutputs(&pb.Command{
+		Platform: addSecrets(addResourceLimits(addExecProperties(c.targetPlatform(target), target), target), target),
 		// We have to run everything through bash since our commands are arbitrary.
 		// Unfortunately we can't just say "bash", we need an absolute path which is
 		// a bit weird since it assumes that our absolute path is the same as the
@@ -107,17 +137,14 @@ func (c *Client) buildCommand(target *core.BuildTarget, inputRoot *pb.Directory,
 		Arguments: []string{
 			c.bashPath, "--noprofile", "--norc", "-u", "-o", "pipefail", "-c", commandPrefix + cmd,
 		},
-		EnvironmentVariables: c.buildEnv(target, c.stampedBuildEnvironment(target, inputRoot, stamp), target.Sandbox),
-		OutputFiles:          files,
-		OutputDirectories:    dirs,
-		OutputPaths:          append(files, dirs...),
-	}, err
+		EnvironmentVariables: c.buildEnv(target, append(env, c.toolchainEnv(target, false)...), target.Sandbox),
+	}, files, dirs), err
 }
 
 // stampedBuildEnvironment returns a build environment, optionally with a stamp if stamp is true.
-func (c *Client) stampedBuildEnvironment(target *core.BuildTarget, inputRoot *pb.Directory, stamp bool) []string {
+func (c *Client) stampedBuildEnvironment(target *core.BuildTarget, inputRoot *pb.Directory, stamp bool) (core.BuildEnv, error) {
 	if !stamp {
-		return core.BuildEnvironment(c.state, target, ".")
+		return core.BuildEnvironment(c.state, target, "."), nil
 	}
 	// We generate the stamp ourselves from the input root.
 	// TODO(peterebden): it should include the target properties too...
@@ -127,7 +154,6 @@ func (c *Client) stampedBuildEnvironment(target *core.BuildTarget, inputRoot *pb
 
 // buildTestCommand builds a command for a target when testing.
 func (c *Client) buildTestCommand(target *core.BuildTarget) (*pb.Command, error) {
-	// TODO(peterebden): Remove all this nonsense once API v2.1 is released.
 	files := make([]string, 0, 2)
 	dirs := []string{}
 	if target.NeedCoverage(c.state) {
@@ -142,23 +168,60 @@ func (c *Client) buildTestCommand(target *core.BuildTarget) (*pb.Command, error)
 	}
 	const commandPrefix = "export TMP_DIR=\"`pwd`\" TEST_DIR=\"`pwd`\" && "
 	cmd, err := core.ReplaceTestSequences(c.state, target, target.GetTestCommand(c.state))
-	return &pb.Command{
-		Platform: &pb.Platform{
+	if err != nil {
+		return nil, err
+	}
+	cmd, err = core.WrapTestFixtures(c.state, target, cmd)
+	env := append(core.TestEnvironment(c.state, target, "."), c.toolchainEnv(target, true)...)
+	sandbox := target.TestSandbox
+	if !sandbox && (c.state.Config.Test.NetworkNamespace || target.HasLabel(core.TestPortLabel)) {
+		// We can't know what ports are free on the worker, so tests that need one always get
+		// their own network namespace there.
+		env = append(env, core.SandboxNetworkOnlyEnv)
+		sandbox = true
+	}
+	if target.HasLabel(core.TestPortLabel) {
+		// Any port is free in a new network namespace, so they can all use the same one.
+		env = append(env, "TEST_PORT="+strconv.Itoa(remoteTestPort))
+	}
+	return c.setCommandOutputs(&pb.Command{
+		Platform: addSecrets(addResourceLimits(addExecProperties(&pb.Platform{
 			Properties: []*pb.Platform_Property{
 				{
 					Name:  "OSFamily",
 					Value: translateOS(target.Subrepo),
 				},
 			},
-		},
+		}, target), target), target),
 		Arguments: []string{
 			c.bashPath, "--noprofile", "--norc", "-u", "-o", "pipefail", "-c", commandPrefix + cmd,
 		},
-		EnvironmentVariables: c.buildEnv(nil, core.TestEnvironment(c.state, target, "."), target.TestSandbox),
-		OutputFiles:          files,
-		OutputDirectories:    dirs,
-		OutputPaths:          append(files, dirs...),
-	}, err
+		EnvironmentVariables: c.buildEnv(nil, env, sandbox),
+	}, files, dirs), err
+}
+
+// setCommandOutputs sets the outputs of a command. Servers that support v2.1 of the API only need
+// OutputPaths (and don't need us to guess which outputs are directories); older ones only
+// understand OutputFiles and OutputDirectories.
+func (c *Client) setCommandOutputs(cmd *pb.Command, files, dirs []string) *pb.Command {
+	if !c.outputPaths {
+		cmd.OutputFiles = files
+		cmd.OutputDirectories = dirs
+		return cmd
+	}
+	cmd.OutputPaths = make([]string, 0, len(files)+len(dirs))
+	cmd.OutputPaths = append(append(cmd.OutputPaths, files...), dirs...)
+	// The API requires these to be sorted.
+	sort.Strings(cmd.OutputPaths)
+	return cmd
+}
+
+// commandOutputs returns all the outputs of a command, however they were specified.
+func commandOutputs(cmd *pb.Command) []string {
+	if len(cmd.OutputPaths) > 0 {
+		return cmd.OutputPaths
+	}
+	return append(append([]string{}, cmd.OutputFiles...), cmd.OutputDirectories...)
 }
 
 // getCommand returns the appropriate command to use for a target.
@@ -194,6 +257,11 @@ func (c *Client) uploadInputDir(ch chan<- *chunker.Chunker, target *core.BuildTa
 	b := newDirBuilder(c)
 	for input := range c.iterInputs(target, isTest, target.IsFilegroup) {
 		if l := input.Label(); l != nil {
+			if dep := c.state.Graph.TargetOrDie(*l); c.linksToolchain(target, dep) {
+				// The workers already have this, so we link to it rather than uploading it.
+				addToolchainLinks(b, dep, l.PackageName)
+				continue
+			}
 			o := c.targetOutputs(*l)
 			if o == nil {
 				if dep := c.state.Graph.TargetOrDie(*l); dep.Local {
@@ -260,6 +328,50 @@ func (c *Client) uploadInputDir(ch chan<- *chunker.Chunker, target *core.BuildTa
 	return b, nil
 }
 
+// linksToolchain returns true if the given dependency of a target is a remote toolchain that
+// we'll link to rather than uploading.
+func (c *Client) linksToolchain(target, dep *core.BuildTarget) bool {
+	return dep.RemoteToolchainPath() != "" && !target.IsFilegroup && !c.noAbsoluteSymlinks
+}
+
+// toolchainEnv returns an environment variable identifying each remote toolchain that the target
+// links to. Their outputs aren't part of its input root, so without this the action wouldn't
+// change when they did.
+func (c *Client) toolchainEnv(target *core.BuildTarget, isTest bool) []string {
+	toolchains := []string{}
+	for input := range c.iterInputs(target, isTest, target.IsFilegroup) {
+		if l := input.Label(); l != nil {
+			if dep := c.state.Graph.Target(*l); dep != nil && c.linksToolchain(target, dep) {
+				toolchains = append(toolchains, l.String()+"="+hex.EncodeToString(build.RuleHash(c.state, dep, false, false)))
+			}
+		}
+	}
+	if len(toolchains) == 0 {
+		return nil
+	}
+	sort.Strings(toolchains)
+	return []string{"_REMOTE_TOOLCHAINS=" + strings.Join(toolchains, " ")}
+}
+
+// addToolchainLinks adds symlinks to the preinstalled location of a remote toolchain in place of
+// its outputs. If it has a single output then that's linked to the toolchain path, otherwise each
+// output is linked to a file of the same name within it.
+func addToolchainLinks(b *dirBuilder, toolchain *core.BuildTarget, pkgName string) {
+	root := toolchain.RemoteToolchainPath()
+	outs := toolchain.Outputs()
+	for _, out := range outs {
+		linkTarget := root
+		if len(outs) > 1 {
+			linkTarget = path.Join(root, out)
+		}
+		d := b.Dir(path.Join(pkgName, path.Dir(out)))
+		d.Symlinks = append(d.Symlinks, &pb.SymlinkNode{
+			Name:   path.Base(out),
+			Target: linkTarget,
+		})
+	}
+}
+
 // uploadInput finds and uploads a single input.
 func (c *Client) uploadInput(b *dirBuilder, ch chan<- *chunker.Chunker, input core.BuildInput) error {
 	fullPaths := input.FullPaths(c.state.Graph)
@@ -412,12 +524,7 @@ func (c *Client) verifyActionResult(target *core.BuildTarget, command *pb.Comman
 	for _, f := range ar.OutputDirectorySymlinks {
 		outs[f.Path] = true
 	}
-	for _, out := range command.OutputFiles {
-		if !outs[out] {
-			return fmt.Errorf("Remote build action for %s failed to produce output %s%s", target, out, c.actionURL(actionDigest, true))
-		}
-	}
-	for _, out := range command.OutputDirectories {
+	for _, out := range commandOutputs(command) {
 		if !outs[out] {
 			return fmt.Errorf("Remote build action for %s failed to produce output %s%s", target, out, c.actionURL(actionDigest, true))
 		}
@@ -463,14 +570,16 @@ func (c *Client) uploadLocalTarget(target *core.BuildTarget) error {
 	if err != nil {
 		return err
 	}
-	chomks := make([]*chunker.Chunker, 0, len(m))
-	for _, c := range m {
-		chomks = append(chomks, c)
-	}
-	if err := c.client.UploadIfMissing(context.Background(), chomks...); err != nil {
+	if err := c.uploadBlobs(func(ch chan<- *chunker.Chunker) error {
+		for _, chomk := range m {
+			ch <- chomk
+		}
+		close(ch)
+		return nil
+	}); err != nil {
 		return err
 	}
-	return c.setOutputs(target.Label, ar)
+	return c.setOutputs(target.Label, nil, ar)
 }
 
 // markOutputsAsExecutable updates an ActionResult for a binary rule.
@@ -2,23 +2,53 @@ package remote
 
 import (
 	"context"
+	"fmt"
+	"io"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/chunker"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"golang.org/x/sync/errgroup"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+
+	"github.com/thought-machine/please/src/core"
 )
 
+// streamThreshold is the size above which we stream blobs to the server ourselves rather than
+// handing them to the SDK. Streamed blobs are read a chunk at a time, only a little ahead of
+// what's been sent, so memory use is bounded however large they are.
+const streamThreshold = 16 * 1024 * 1024
+
+// streamReadahead is the number of chunks of a blob we read ahead of sending them.
+const streamReadahead = 4
+
+// maxConcurrentStreams is the maximum number of blobs we stream to the server at once.
+const maxConcurrentStreams = 4
+
 // uploadBlobs uploads a series of blobs to the remote.
 // It handles all the logic around the various upload methods etc.
 // The given function is a callback that receives a channel to send these blobs on; it
 // should close it when finished.
 func (c *Client) uploadBlobs(f func(ch chan<- *chunker.Chunker) error) error {
+	return c.uploadTargetBlobs(0, nil, core.TargetBuilding, f)
+}
+
+// uploadTargetBlobs is like uploadBlobs but reports the progress of the upload against the
+// given target. If target is nil no progress is reported.
+func (c *Client) uploadTargetBlobs(tid int, target *core.BuildTarget, status core.BuildResultStatus, f func(ch chan<- *chunker.Chunker) error) (err error) {
 	const buffer = 10 // Buffer it a bit but don't get too far ahead.
 	ch := make(chan *chunker.Chunker, buffer)
 	var g errgroup.Group
 	g.Go(func() error { return f(ch) })
 	chomks := []*chunker.Chunker{}
+	large := []*chunker.Chunker{}
+	total := 0
 	for chomk := range ch {
-		chomks = append(chomks, chomk)
+		if chomk.Digest().Size > streamThreshold {
+			large = append(large, chomk)
+		} else {
+			chomks = append(chomks, chomk)
+		}
+		total += int(chomk.Digest().Size)
 	}
 	if err := g.Wait(); err != nil {
 		return err
@@ -26,5 +56,117 @@ func (c *Client) uploadBlobs(f func(ch chan<- *chunker.Chunker) error) error {
 	// TODO(peterebden): This timeout is kind of arbitrary since it represents a lot of requests.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*c.reqTimeout)
 	defer cancel()
-	return c.client.UploadIfMissing(ctx, chomks...)
+	if target != nil {
+		var s *span
+		ctx, s = c.startSpan(ctx, target, "upload")
+		defer func() { s.Finish(err) }()
+		ctx = newUploadProgress(c.state, tid, target.Label, status, total).Context(ctx)
+	}
+	g.Go(func() error { return c.client.UploadIfMissing(ctx, chomks...) })
+	g.Go(func() error { return c.streamBlobs(ctx, large) })
+	return g.Wait()
+}
+
+// streamBlobs streams any of the given blobs that the server doesn't already have to it.
+func (c *Client) streamBlobs(ctx context.Context, chomks []*chunker.Chunker) error {
+	if len(chomks) == 0 {
+		return nil
+	}
+	m := make(map[digest.Digest]*chunker.Chunker, len(chomks))
+	digests := make([]digest.Digest, 0, len(chomks))
+	for _, chomk := range chomks {
+		if _, present := m[chomk.Digest()]; !present {
+			m[chomk.Digest()] = chomk
+			digests = append(digests, chomk.Digest())
+		}
+	}
+	missing, err := c.client.MissingBlobs(ctx, digests)
+	if err != nil {
+		return err
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for _, dg := range missing {
+		chomk := m[dg]
+		g.Go(func() error {
+			select {
+			case c.streamLimiter <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-c.streamLimiter }()
+			return c.streamBlob(ctx, chomk)
+		})
+	}
+	return g.Wait()
+}
+
+// streamBlob streams a single blob to the server using the ByteStream API.
+// Chunks are read on one goroutine and sent on another, with a bounded buffer between them.
+func (c *Client) streamBlob(ctx context.Context, chomk *chunker.Chunker) error {
+	dg := chomk.Digest()
+	name := c.client.ResourceNameWrite(dg.Hash, dg.Size)
+	return c.client.Retrier.Do(ctx, func() error {
+		chomk.Reset() // Retries start again from the beginning.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		chunks := make(chan *chunker.Chunk, streamReadahead)
+		var g errgroup.Group
+		g.Go(func() error {
+			defer close(chunks)
+			for chomk.HasNext() {
+				chunk, err := chomk.Next()
+				if err != nil {
+					return fmt.Errorf("Failed to read %s: %s", chomk, err)
+				}
+				select {
+				case chunks <- chunk:
+				case <-ctx.Done():
+					return nil // The sender has stopped, it will report why.
+				}
+			}
+			return nil
+		})
+		g.Go(func() error {
+			defer cancel()
+			return c.sendChunks(ctx, name, dg.Size, chunks)
+		})
+		return g.Wait()
+	})
+}
+
+// sendChunks sends a series of chunks to the server as a single ByteStream write.
+func (c *Client) sendChunks(ctx context.Context, name string, size int64, chunks <-chan *chunker.Chunk) error {
+	stream, err := c.byteStream.Write(ctx, c.client.RPCOpts()...)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	closed := false
+	for chunk := range chunks {
+		offset = chunk.Offset + int64(len(chunk.Data))
+		req := &bs.WriteRequest{
+			WriteOffset: chunk.Offset,
+			Data:        chunk.Data,
+			FinishWrite: offset == size,
+		}
+		if chunk.Offset == 0 {
+			req.ResourceName = name
+		}
+		if err := stream.Send(req); err == io.EOF {
+			closed = true // The server has closed the stream; CloseAndRecv will tell us why.
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if !closed && offset != size {
+		return nil // The reader failed; it'll report the error and our context will cancel the stream.
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	} else if resp.CommittedSize != size {
+		return fmt.Errorf("Server committed %d bytes of %s, expected %d", resp.CommittedSize, name, size)
+	}
+	return nil
 }
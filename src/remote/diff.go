@@ -0,0 +1,231 @@
+package remote
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// Diff compares a target that has been built locally with how it would be built remotely, and
+// writes a report of any differences to the given writer.
+// The local environment and command are what the target was built with; they're compared to the
+// remote Command proto, and the outputs on disk are compared to any result for the action in the
+// remote cache. It returns true if no differences were found.
+func (c *Client) Diff(target *core.BuildTarget, env core.BuildEnv, command string, w io.Writer) (bool, error) {
+	if err := c.CheckInitialised(); err != nil {
+		return false, err
+	}
+	remote, actionDigest, err := c.buildAction(target, false, false)
+	if err != nil {
+		return false, err
+	}
+	local := &pb.Command{
+		Arguments:            []string{"bash", "--noprofile", "--norc", "-u", "-o", "pipefail", "-c", command},
+		EnvironmentVariables: c.buildEnv(nil, env, false),
+	}
+	same := true
+	fmt.Fprintf(w, "%s:\n", target.Label)
+	fmt.Fprintf(w, "  Action: %s%s\n", actionDigest.Hash, c.actionURL(actionDigest, true))
+	if diff := diffLines(commandLines(local), commandLines(remote)); len(diff) > 0 {
+		same = false
+		fmt.Fprintf(w, "  Command differs (- local, + remote):\n")
+		for _, line := range diff {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	ar, err := c.client.GetActionResult(ctx, &pb.GetActionResultRequest{
+		InstanceName: c.instance,
+		ActionDigest: actionDigest,
+	})
+	if IsNotFound(err) {
+		fmt.Fprintf(w, "  No result for this action in the remote cache; the inputs or command differ from any remote build.\n")
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	localOuts, err := c.localOutputDigests(target)
+	if err != nil {
+		return false, err
+	}
+	remoteOuts, err := c.remoteOutputDigests(ar)
+	if err != nil {
+		return false, err
+	}
+	if diff := diffOutputs(localOuts, remoteOuts); len(diff) > 0 {
+		same = false
+		fmt.Fprintf(w, "  Outputs differ:\n")
+		for _, line := range diff {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	if same {
+		fmt.Fprintf(w, "  No differences found\n")
+	}
+	return same, nil
+}
+
+// commandLines renders a Command proto as a series of lines, one per argument, variable etc,
+// in a form that's easy to diff.
+func commandLines(cmd *pb.Command) []string {
+	outs := commandOutputs(cmd)
+	lines := make([]string, 0, len(cmd.Arguments)+len(cmd.EnvironmentVariables)+len(outs))
+	for _, arg := range cmd.Arguments {
+		lines = append(lines, "arg: "+arg)
+	}
+	for _, env := range cmd.EnvironmentVariables {
+		lines = append(lines, "env: "+env.Name+"="+env.Value)
+	}
+	for _, out := range outs {
+		lines = append(lines, "output: "+out)
+	}
+	if cmd.Platform != nil {
+		for _, prop := range cmd.Platform.Properties {
+			lines = append(lines, "platform: "+prop.Name+"="+prop.Value)
+		}
+	}
+	return lines
+}
+
+// diffLines returns a minimal diff between two sets of lines; lines only in a are prefixed with
+// "- " and lines only in b with "+ ". Lines common to both aren't included.
+func diffLines(a, b []string) []string {
+	// Standard longest common subsequence; the inputs here are never very large.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			diff = append(diff, "- "+a[i])
+			i++
+		} else {
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return diff
+}
+
+// localOutputDigests returns the digests of a target's outputs on disk, keyed by their path
+// relative to its output directory.
+func (c *Client) localOutputDigests(target *core.BuildTarget) (map[string]string, error) {
+	outDir := target.OutDir()
+	digests := map[string]string{}
+	for _, out := range target.FullOutputs() {
+		if err := fs.Walk(out, func(name string, isDir bool) error {
+			if isDir {
+				return nil
+			}
+			info, err := os.Lstat(name)
+			if err != nil {
+				return err
+			}
+			rel := strings.TrimPrefix(name, outDir+"/")
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err := os.Readlink(name)
+				digests[rel] = "-> " + link
+				return err
+			}
+			h, err := c.state.PathHasher.Hash(name, false, true)
+			if err != nil {
+				return err
+			}
+			digests[rel] = fmt.Sprintf("%s/%d", hex.EncodeToString(h), info.Size())
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// remoteOutputDigests returns the digests of the outputs in an action result, keyed by their path.
+func (c *Client) remoteOutputDigests(ar *pb.ActionResult) (map[string]string, error) {
+	digests := map[string]string{}
+	for _, f := range ar.OutputFiles {
+		digests[f.Path] = fmt.Sprintf("%s/%d", f.Digest.Hash, f.Digest.SizeBytes)
+	}
+	for _, s := range append(ar.OutputFileSymlinks, ar.OutputDirectorySymlinks...) {
+		digests[s.Path] = "-> " + s.Target
+	}
+	for _, d := range ar.OutputDirectories {
+		tree := &pb.Tree{}
+		if err := c.client.ReadProto(context.Background(), digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
+			return nil, wrap(err, "Downloading tree digest for %s [%s]", d.Path, d.TreeDigest.Hash)
+		}
+		children := make(map[string]*pb.Directory, len(tree.Children))
+		for _, child := range tree.Children {
+			children[c.digestMessage(child).Hash] = child
+		}
+		var walk func(dir *pb.Directory, prefix string)
+		walk = func(dir *pb.Directory, prefix string) {
+			for _, f := range dir.Files {
+				digests[path.Join(prefix, f.Name)] = fmt.Sprintf("%s/%d", f.Digest.Hash, f.Digest.SizeBytes)
+			}
+			for _, s := range dir.Symlinks {
+				digests[path.Join(prefix, s.Name)] = "-> " + s.Target
+			}
+			for _, d := range dir.Directories {
+				if child, present := children[d.Digest.Hash]; present {
+					walk(child, path.Join(prefix, d.Name))
+				}
+			}
+		}
+		walk(tree.Root, d.Path)
+	}
+	return digests, nil
+}
+
+// diffOutputs compares two sets of output digests and returns a description of any differences.
+func diffOutputs(local, remote map[string]string) []string {
+	diff := []string{}
+	for name, l := range local {
+		if r, present := remote[name]; !present {
+			diff = append(diff, name+": only exists locally")
+		} else if l != r {
+			diff = append(diff, fmt.Sprintf("%s: local %s, remote %s", name, l, r))
+		}
+	}
+	for name := range remote {
+		if _, present := local[name]; !present {
+			diff = append(diff, name+": only exists remotely")
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, []string{}, diffLines([]string{"a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{"- b", "+ c", "+ d"}, diffLines([]string{"a", "b"}, []string{"a", "c", "d"}))
+	assert.Equal(t, []string{"- a"}, diffLines([]string{"a", "b", "c"}, []string{"b", "c"}))
+}
+
+func TestDiffOutputs(t *testing.T) {
+	assert.Equal(t, []string{
+		"a.txt: local abc/3, remote def/3",
+		"b.txt: only exists locally",
+		"c.txt: only exists remotely",
+	}, diffOutputs(map[string]string{
+		"a.txt": "abc/3",
+		"b.txt": "abc/3",
+		"d.txt": "-> a.txt",
+	}, map[string]string{
+		"a.txt": "def/3",
+		"c.txt": "abc/3",
+		"d.txt": "-> a.txt",
+	}))
+}
+
+func TestDiff(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "diff"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("diff.txt")
+	target.Command = "echo hello > $OUT"
+	c.state.Graph.AddTarget(target)
+	require.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	require.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), "diff.txt"), []byte("hello\n"), 0644))
+	defer os.Remove(path.Join(target.OutDir(), "diff.txt"))
+
+	env := core.BuildEnvironment(c.state, target, ".")
+	var buf bytes.Buffer
+	same, err := c.Diff(target, env, target.Command, &buf)
+	assert.NoError(t, err)
+	assert.False(t, same)
+	assert.Contains(t, buf.String(), "+ arg: ")
+	assert.Contains(t, buf.String(), "+ env: _TARGET=//package:diff")
+	assert.Contains(t, buf.String(), "No result for this action in the remote cache")
+
+	_, digest, err := c.buildAction(target, false, false)
+	require.NoError(t, err)
+	server.actionResults[digest.Hash] = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: "diff.txt", Digest: c.digestBlob([]byte("hello\n"))}},
+	}
+	buf.Reset()
+	_, err = c.Diff(target, env, target.Command, &buf)
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "Outputs differ")
+
+	server.actionResults[digest.Hash] = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: "diff.txt", Digest: c.digestBlob([]byte("goodbye\n"))}},
+	}
+	buf.Reset()
+	_, err = c.Diff(target, env, target.Command, &buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Outputs differ")
+	assert.Contains(t, buf.String(), "diff.txt: local ")
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +25,7 @@ import (
 	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/thought-machine/please/src/core"
@@ -54,6 +56,9 @@ type testServer struct {
 	actionResults                 map[string]*pb.ActionResult
 	blobs                         map[string][]byte
 	bytestreams                   map[string][]byte
+	traceparent                   string
+	maxWriteSize                  int
+	actionResultRequests          int64
 }
 
 func (s *testServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
@@ -84,10 +89,15 @@ func (s *testServer) Reset() {
 	s.actionResults = map[string]*pb.ActionResult{}
 	s.blobs = map[string][]byte{}
 	s.bytestreams = map[string][]byte{}
+	s.maxWriteSize = 0
 }
 
 func (s *testServer) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
 	s.checkDigest(req.ActionDigest)
+	atomic.AddInt64(&s.actionResultRequests, 1)
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(traceparentHeader)) > 0 {
+		s.traceparent = md.Get(traceparentHeader)[0]
+	}
 	ar, present := s.actionResults[req.ActionDigest.Hash]
 	if !present {
 		return nil, status.Errorf(codes.NotFound, "action result not found")
@@ -207,6 +217,10 @@ func (s *testServer) Write(srv bs.ByteStream_WriteServer) error {
 			return status.Errorf(codes.InvalidArgument, "incorrect WriteOffset (was %d, should be %d)", req.WriteOffset, len(b))
 		}
 		b = append(b, req.Data...)
+		if s.maxWriteSize > 0 && len(b) > s.maxWriteSize {
+			delete(s.bytestreams, name)
+			return status.Errorf(codes.InvalidArgument, "write to %s exceeds maximum size of %d bytes", name, s.maxWriteSize)
+		}
 		if req.FinishWrite {
 			s.blobs[blobName] = b
 			delete(s.bytestreams, name)
@@ -283,6 +297,8 @@ func (s *testServer) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteSer
 
 	// Keep stdout as a blob to force the client to download it.
 	s.blobs["5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"] = []byte("hello\n")
+	// Keep the output too, so it can be found again later.
+	s.blobs["e348b3c3da7a11a1694aeda09a7a63fc901811f9756f1c83d8d6ece59baa4be3"] = []byte("hello from out2.txt")
 
 	// We use this to conveniently identify whether the request was a test or not.
 	if req.InstanceName == "test" {
@@ -341,7 +357,7 @@ func (s *testServer) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteSer
 						OutputFiles: []*pb.OutputFile{{
 							Path: "out2.txt",
 							Digest: &pb.Digest{
-								Hash:      "5fb3d47e893061ea6627334a8582c37398cfdc68fe7fa59c16912e4a3ab7a5d6",
+								Hash:      "e348b3c3da7a11a1694aeda09a7a63fc901811f9756f1c83d8d6ece59baa4be3",
 								SizeBytes: 19,
 							},
 						}},
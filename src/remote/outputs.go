@@ -0,0 +1,225 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// outputStoreFile is where we persist the outputs of remotely built targets between runs.
+const outputStoreFile = "plz-out/.remote_outputs"
+
+// outputStoreCompactThreshold is the number of superseded entries we tolerate in the file
+// before rewriting it without them.
+const outputStoreCompactThreshold = 10000
+
+// An outputStore persists the results of remote actions between invocations of plz.
+//
+// We need the outputs of every target to construct the actions of its dependents, but they are
+// not necessarily present locally, so without this every run has to look up each action result
+// again and read the trees of any output directories from the CAS just to find their digests.
+// With it, a target whose action hasn't changed since last time needs no RPCs at all.
+//
+// It's an append-only log, one line per entry, which is read once when it's first needed;
+// later entries for a target override earlier ones. Entries are checked against the CAS before
+// they're used, since the server may have evicted their outputs since.
+type outputStore struct {
+	filename string
+	server   string
+	once     sync.Once
+	mutex    sync.Mutex
+	entries  map[core.BuildLabel]*storedOutputs
+	file     *os.File
+}
+
+// storedOutputs is the persisted result of a single target's action.
+type storedOutputs struct {
+	Server  string
+	Action  *pb.Digest
+	Result  *pb.ActionResult
+	Outputs *pb.Directory
+}
+
+// newOutputStore returns a new outputStore backed by the given file.
+// Entries are only valid for the given server; they're ignored if it changes.
+func newOutputStore(filename, server string) *outputStore {
+	return &outputStore{
+		filename: filename,
+		server:   server,
+		entries:  map[core.BuildLabel]*storedOutputs{},
+	}
+}
+
+// Get returns the stored result for a target if its action is the same as given, otherwise nil.
+func (s *outputStore) Get(label core.BuildLabel, action *pb.Digest) *storedOutputs {
+	s.once.Do(s.load)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if o := s.entries[label]; o != nil && o.Server == s.server && sameDigest(o.Action, action) {
+		return o
+	}
+	return nil
+}
+
+// Outputs returns the output directory for a target if the given action result is the same as the stored one.
+func (s *outputStore) Outputs(label core.BuildLabel, ar *pb.ActionResult) *pb.Directory {
+	s.once.Do(s.load)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if o := s.entries[label]; o != nil && o.Server == s.server && proto.Equal(o.Result, ar) {
+		return o.Outputs
+	}
+	return nil
+}
+
+// Set stores the result of a target's action.
+// This is best-effort; if it can't be written the action will just be looked up again next time.
+func (s *outputStore) Set(label core.BuildLabel, action *pb.Digest, ar *pb.ActionResult, outputs *pb.Directory) {
+	s.once.Do(s.load)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o := &storedOutputs{Server: s.server, Action: action, Result: ar, Outputs: outputs}
+	if existing := s.entries[label]; existing != nil && existing.Server == o.Server && sameDigest(existing.Action, action) && proto.Equal(existing.Result, ar) {
+		return // Nothing has changed
+	}
+	s.entries[label] = o
+	s.write(o.line(label))
+}
+
+// Delete removes the stored result for a target, for example because its outputs no longer
+// exist remotely. A tombstone is written so it stays deleted for later runs too.
+func (s *outputStore) Delete(label core.BuildLabel) {
+	s.once.Do(s.load)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, present := s.entries[label]; !present {
+		return
+	}
+	delete(s.entries, label)
+	s.write(label.String() + "\n")
+}
+
+// write appends a line to the file. The mutex must be held.
+func (s *outputStore) write(line string) {
+	if s.file == nil {
+		if err := os.MkdirAll(path.Dir(s.filename), fs.DirPermissions); err != nil {
+			log.Warning("Failed to create remote output store: %s", err)
+			return
+		}
+		f, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Warning("Failed to open remote output store: %s", err)
+			return
+		}
+		s.file = f
+	}
+	if _, err := s.file.WriteString(line); err != nil {
+		log.Warning("Failed to write to remote output store: %s", err)
+	}
+}
+
+// load reads the existing contents of the file.
+func (s *outputStore) load() {
+	f, err := os.Open(s.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read remote output store: %s", err)
+		}
+		return
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024) // Lines can be long for targets with many outputs.
+	for scanner.Scan() {
+		lines++
+		if label, o, err := parseStoredOutputs(scanner.Text()); err != nil {
+			log.Debug("Invalid entry in remote output store: %s", err)
+		} else if o == nil {
+			delete(s.entries, label)
+		} else {
+			s.entries[label] = o
+		}
+	}
+	if lines-len(s.entries) > outputStoreCompactThreshold {
+		s.compact()
+	}
+}
+
+// compact rewrites the file with only the current entries.
+func (s *outputStore) compact() {
+	if err := fs.WriteFile(strings.NewReader(s.lines()), s.filename, 0644); err != nil {
+		log.Warning("Failed to compact remote output store: %s", err)
+	}
+}
+
+// lines returns the serialised form of all current entries.
+func (s *outputStore) lines() string {
+	var b strings.Builder
+	for label, o := range s.entries {
+		b.WriteString(o.line(label))
+	}
+	return b.String()
+}
+
+// line returns the serialised form of a single entry.
+func (o *storedOutputs) line(label core.BuildLabel) string {
+	return strings.Join([]string{
+		label.String(),
+		o.Server,
+		o.Action.Hash,
+		strconv.FormatInt(o.Action.SizeBytes, 10),
+		base64.RawStdEncoding.EncodeToString(mustMarshal(o.Result)),
+		base64.RawStdEncoding.EncodeToString(mustMarshal(o.Outputs)),
+	}, " ") + "\n"
+}
+
+// parseStoredOutputs parses a single line of the file.
+// A line with only a label is a tombstone for a deleted entry; it returns nil outputs.
+func parseStoredOutputs(line string) (core.BuildLabel, *storedOutputs, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) == 1 {
+		label, err := core.TryParseBuildLabel(parts[0], "", "")
+		return label, nil, err
+	} else if len(parts) != 6 {
+		return core.BuildLabel{}, nil, fmt.Errorf("Expected 6 fields, got %d", len(parts))
+	}
+	label, err := core.TryParseBuildLabel(parts[0], "", "")
+	if err != nil {
+		return label, nil, err
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return label, nil, err
+	}
+	o := &storedOutputs{
+		Server:  parts[1],
+		Action:  &pb.Digest{Hash: parts[2], SizeBytes: size},
+		Result:  &pb.ActionResult{},
+		Outputs: &pb.Directory{},
+	}
+	if err := unmarshalBase64(parts[4], o.Result); err != nil {
+		return label, nil, err
+	}
+	return label, o, unmarshalBase64(parts[5], o.Outputs)
+}
+
+// unmarshalBase64 decodes a base64-encoded proto message.
+func unmarshalBase64(s string, msg proto.Message) error {
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, msg)
+}
@@ -0,0 +1,133 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A cacheProber looks up action results on the remote server.
+//
+// The remote API has no batch equivalent of GetActionResult, so instead this runs lookups
+// concurrently on a bounded pool, deduplicates concurrent lookups for the same action and
+// remembers any results it finds for the rest of the build. That allows us to probe for
+// targets ahead of when they're built; on a build where little has changed most of the
+// lookups are then already done by the time a worker gets to each target.
+type cacheProber struct {
+	client  *Client
+	limiter chan struct{}
+	// Pending & successful lookups, keyed by probeKey.
+	results sync.Map
+	// Targets that we've already started probing ahead for.
+	probed sync.Map
+}
+
+// A probeKey identifies a single lookup.
+type probeKey struct {
+	Hash       string
+	Size       int64
+	NeedStdout bool
+}
+
+// A probeResult is the result of a single lookup. It's only valid once the sync.Once has completed.
+type probeResult struct {
+	once sync.Once
+	ar   *pb.ActionResult
+	err  error
+}
+
+// newCacheProber returns a new cacheProber that runs at most the given number of lookups at once.
+func newCacheProber(client *Client, parallelism int) *cacheProber {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &cacheProber{
+		client:  client,
+		limiter: make(chan struct{}, parallelism),
+	}
+}
+
+// Get returns the action result for the given target's action digest, if the server has one.
+func (p *cacheProber) Get(target *core.BuildTarget, digest *pb.Digest, needStdout bool) (*pb.ActionResult, error) {
+	key := probeKey{Hash: digest.Hash, Size: digest.SizeBytes, NeedStdout: needStdout}
+	v, _ := p.results.LoadOrStore(key, &probeResult{})
+	r := v.(*probeResult)
+	r.once.Do(func() {
+		p.limiter <- struct{}{}
+		defer func() { <-p.limiter }()
+		// N.B. This deliberately doesn't use a context from the caller, since other callers may
+		//      be waiting on this lookup too and it shouldn't fail for them if the first gives up.
+		ctx, cancel := context.WithTimeout(p.client.traceContext(context.Background(), target), p.client.reqTimeout)
+		defer cancel()
+		r.ar, r.err = p.client.client.GetActionResult(ctx, &pb.GetActionResultRequest{
+			InstanceName: p.client.instance,
+			ActionDigest: digest,
+			InlineStdout: needStdout,
+		})
+		if r.err != nil {
+			// Don't remember failures; the action may well be executed & stored later on,
+			// and the lookup could simply have timed out.
+			p.results.Delete(key)
+		}
+	})
+	return r.ar, r.err
+}
+
+// Forget forgets any result remembered for the given action digest, for example if it turns out
+// not to be usable, so the next Get will ask the server again.
+func (p *cacheProber) Forget(digest *pb.Digest, needStdout bool) {
+	p.results.Delete(probeKey{Hash: digest.Hash, Size: digest.SizeBytes, NeedStdout: needStdout})
+}
+
+// ProbeAhead starts looking up results for any reverse dependencies of the given target that
+// are ready to have their actions calculated, i.e. all the outputs of their dependencies are known.
+// The lookups happen in the background and this does not wait for them.
+func (p *cacheProber) ProbeAhead(target *core.BuildTarget) {
+	for _, revdep := range p.client.state.Graph.ReverseDependencies(target) {
+		if p.shouldProbe(revdep) {
+			if _, present := p.probed.LoadOrStore(revdep.Label, true); !present {
+				go p.probe(revdep)
+			}
+		}
+	}
+}
+
+// shouldProbe returns true if we should probe ahead for the given target.
+func (p *cacheProber) shouldProbe(target *core.BuildTarget) bool {
+	if state := target.State(); state < core.Active || state > core.Pending {
+		return false // Either it's not part of this build or it's already in progress.
+	} else if target.IsFilegroup || target.IsRemoteFile || target.Local {
+		return false // These aren't looked up in the remote cache.
+	}
+	for _, dep := range target.Dependencies() {
+		if p.client.targetOutputs(dep.Label) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// probe calculates the action for a target and looks it up on the server.
+func (p *cacheProber) probe(target *core.BuildTarget) {
+	if err := p.probeTarget(target); err != nil {
+		// This isn't a problem; we'll just look it up again once we come to build it.
+		log.Debug("Failed to probe remote cache ahead for %s: %s", target, err)
+	}
+}
+
+func (p *cacheProber) probeTarget(target *core.BuildTarget) error {
+	// Calculating the action involves hashing source files so we use the limiter for it too.
+	p.limiter <- struct{}{}
+	_, _, unstampedDigest, err := p.client.buildStampedAndUnstampedAction(target)
+	<-p.limiter
+	if err != nil {
+		return fmt.Errorf("Failed to create action: %s", err)
+	}
+	// This matches the first lookup that build() will make for the target.
+	_, err = p.Get(target, unstampedDigest, target.PostBuildFunction != nil)
+	return err
+}
@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,18 +20,21 @@ import (
 	fpb "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	"golang.org/x/sync/errgroup"
+	bs "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor at init
 	"google.golang.org/grpc/status"
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/grpcutil"
 )
 
 var log = logging.MustGetLogger("remote")
@@ -38,9 +42,15 @@ var log = logging.MustGetLogger("remote")
 // Timeout to initially contact the server.
 const dialTimeout = 5 * time.Second
 
+// The port given to remote tests labelled test_port. They're always run in their own network namespace.
+const remoteTestPort = 8080
+
 // The API version we support.
 var apiVersion = semver.SemVer{Major: 2}
 
+// The API version that introduced OutputPaths on Commands.
+var outputPathsVersion = semver.SemVer{Major: 2, Minor: 1}
+
 // A Client is the interface to the remote API.
 //
 // It provides a higher-level interface over the specific RPCs available.
@@ -58,6 +68,8 @@ type Client struct {
 	// have the files physically on disk.
 	outputs     map[core.BuildLabel]*pb.Directory
 	outputMutex sync.RWMutex
+	// Persists the above between runs.
+	outputStore *outputStore
 
 	// Used to control downloading targets (we must make sure we don't re-fetch them
 	// while another target is trying to use them).
@@ -66,6 +78,10 @@ type Client struct {
 	// Server-sent cache properties
 	maxBlobBatchSize int64
 	cacheWritable    bool
+	// True if the server won't accept absolute symlinks in input roots.
+	noAbsoluteSymlinks bool
+	// True if the server supports OutputPaths on Commands.
+	outputPaths bool
 
 	// Platform properties that we will request from the remote.
 	// TODO(peterebden): this will need some modification for cross-compiling support.
@@ -77,6 +93,16 @@ type Client struct {
 	// Stats used to report RPC data rates
 	byteRateIn, byteRateOut, totalBytesIn, totalBytesOut int
 	stats                                                *statsHandler
+
+	// Records spans for everything we do remotely, all of which are in a single trace for the build.
+	tracer *tracer
+
+	// Used to look up action results in the remote cache.
+	prober *cacheProber
+
+	// Used to stream large blobs to the server, and to limit how many we stream at once.
+	byteStream    bs.ByteStreamClient
+	streamLimiter chan struct{}
 }
 
 // A pendingDownload represents a pending download of a build target. It is used to
@@ -90,12 +116,16 @@ type pendingDownload struct {
 // It begins the process of contacting the remote server but does not wait for it.
 func New(state *core.BuildState) *Client {
 	c := &Client{
-		state:      state,
-		instance:   state.Config.Remote.Instance,
-		reqTimeout: time.Duration(state.Config.Remote.Timeout),
-		outputs:    map[core.BuildLabel]*pb.Directory{},
-	}
+		state:         state,
+		instance:      state.Config.Remote.Instance,
+		reqTimeout:    time.Duration(state.Config.Remote.Timeout),
+		outputs:       map[core.BuildLabel]*pb.Directory{},
+		tracer:        newTracer(state.Config),
+		streamLimiter: make(chan struct{}, maxConcurrentStreams),
+	}
+	c.outputStore = newOutputStore(outputStoreFile, state.Config.Remote.URL+"/"+c.instance)
 	c.stats = newStatsHandler(c)
+	c.prober = newCacheProber(c, state.Config.Remote.NumCacheProbes)
 	go c.CheckInitialised() // Kick off init now, but we don't have to wait for it.
 	return c
 }
@@ -124,21 +154,28 @@ func (c *Client) initExec() error {
 	// Create a copy of the state where we can modify the config
 	c.state = c.state.ForConfig()
 	c.state.Config.HomeDir = c.state.Config.Remote.HomeDir
-	client, err := client.NewClient(context.Background(), c.instance, client.DialParams{
+	params := client.DialParams{
 		Service:            c.state.Config.Remote.URL,
 		CASService:         c.state.Config.Remote.CASURL,
 		NoSecurity:         !c.state.Config.Remote.Secure,
 		TransportCredsOnly: c.state.Config.Remote.Secure,
-		DialOpts: []grpc.DialOption{
+		DialOpts: append([]grpc.DialOption{
 			grpc.WithStatsHandler(c.stats),
-			// Set an arbitrarily large (400MB) max message size so it isn't a limitation.
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(419430400)),
-		},
-	}, client.UseBatchOps(true), client.RetryTransient())
+			grpc.WithChainUnaryInterceptor(traceUnaryInterceptor(c.tracer.root)),
+			grpc.WithChainStreamInterceptor(traceStreamInterceptor(c.tracer.root)),
+		}, grpcutil.DialOptions(c.state.Config)...),
+	}
+	if c.customTLS() {
+		// See tlsDialer for why we have to tell the SDK the connection is insecure here.
+		params.NoSecurity = true
+		params.DialOpts = append(params.DialOpts, grpc.WithContextDialer(c.tlsDialer))
+	}
+	client, err := client.NewClient(context.Background(), c.instance, params, client.UseBatchOps(true), client.RetryTransient())
 	if err != nil {
 		return err
 	}
 	c.client = client
+	c.byteStream = bs.NewByteStreamClient(client.CASConnection)
 	// Query the server for its capabilities. This tells us whether it is capable of
 	// execution, caching or both.
 	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
@@ -150,6 +187,7 @@ func (c *Client) initExec() error {
 	if lessThan(&apiVersion, resp.LowApiVersion) || lessThan(resp.HighApiVersion, &apiVersion) {
 		return fmt.Errorf("Unsupported API version; we require %s but server only supports %s - %s", printVer(&apiVersion), printVer(resp.LowApiVersion), printVer(resp.HighApiVersion))
 	}
+	c.outputPaths = !lessThan(resp.HighApiVersion, &outputPathsVersion)
 	caps := resp.CacheCapabilities
 	if caps == nil {
 		return fmt.Errorf("Cache capabilities not supported by server (we do not support execution-only servers)")
@@ -160,6 +198,10 @@ func (c *Client) initExec() error {
 	if caps.ActionCacheUpdateCapabilities != nil {
 		c.cacheWritable = caps.ActionCacheUpdateCapabilities.UpdateEnabled
 	}
+	if caps.SymlinkAbsolutePathStrategy == pb.SymlinkAbsolutePathStrategy_DISALLOWED {
+		log.Debug("Server doesn't allow absolute symlinks, remote toolchains will be uploaded as normal inputs")
+		c.noAbsoluteSymlinks = true
+	}
 	c.maxBlobBatchSize = caps.MaxBatchTotalSizeBytes
 	if c.maxBlobBatchSize == 0 {
 		// No limit was set by the server, assume we are implicitly limited to 4MB (that's
@@ -170,7 +212,7 @@ func (c *Client) initExec() error {
 	// Look this up just once now.
 	bash, err := core.LookBuildPath("bash", c.state.Config)
 	c.bashPath = bash
-	log.Debug("Remote execution client initialised for storage")
+	log.Debug("Remote execution client initialised for storage, trace ID %x", c.tracer.root.TraceID)
 	// Now check if it can do remote execution
 	if resp.ExecutionCapabilities == nil {
 		return fmt.Errorf("Remote execution is configured but the build server doesn't support it")
@@ -190,16 +232,15 @@ func (c *Client) initFetch() error {
 	if c.state.Config.Remote.AssetURL == "" {
 		return fmt.Errorf("You must specify remote.asseturl in configuration to use remote execution")
 	}
-	tlsOption := func() grpc.DialOption {
-		if c.state.Config.Remote.Secure {
-			return grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
-		}
-		return grpc.WithInsecure()
+	tlsOption, err := c.tlsDialOption(c.state.Config.Remote.AssetURL)
+	if err != nil {
+		return err
 	}
-	conn, err := grpc.Dial(c.state.Config.Remote.AssetURL,
-		grpc.WithUnaryInterceptor(grpc_retry.UnaryClientInterceptor()),
-		tlsOption(),
-	)
+	// This isn't shared via grpcutil.DefaultPool since the interceptor is specific to this client.
+	conn, err := grpc.Dial(c.state.Config.Remote.AssetURL, append([]grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(traceUnaryInterceptor(c.tracer.root), grpc_retry.UnaryClientInterceptor()),
+		tlsOption,
+	}, grpcutil.DialOptions(c.state.Config)...)...)
 	if err != nil {
 		return fmt.Errorf("Failed to connect to the remote fetch server: %s", err)
 	}
@@ -231,10 +272,12 @@ func (c *Client) digestEnum(name string) pb.DigestFunction_Value {
 }
 
 // Build executes a remote build of the given target.
-func (c *Client) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata, error) {
+func (c *Client) Build(tid int, target *core.BuildTarget) (metadata *core.BuildMetadata, err error) {
 	if err := c.CheckInitialised(); err != nil {
 		return nil, err
 	}
+	span := c.startTargetSpan(target, "build")
+	defer func() { c.finishTargetSpan(target, span, err) }()
 	metadata, ar, digest, err := c.build(tid, target)
 	if err != nil {
 		return metadata, err
@@ -243,9 +286,15 @@ func (c *Client) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 	if c.state.TargetHasher != nil {
 		c.state.TargetHasher.SetHash(target, hash)
 	}
-	if err := c.setOutputs(target.Label, ar); err != nil {
+	if err := c.setOutputs(target.Label, digest, ar); err != nil {
 		return metadata, c.wrapActionErr(err, digest)
 	}
+	if budget, _, _ := c.state.Config.Budgets(target); budget > 0 {
+		if metadata.OutputSize, err = c.outputSize(ar); err != nil {
+			log.Warning("Failed to calculate output size of %s: %s", target, err)
+		}
+	}
+	c.prober.ProbeAhead(target)
 	// Need to download the target if it was originally requested (and the user didn't pass --nodownload).
 	// Also anything needed for subinclude needs to be local.
 	if (c.state.IsOriginalTarget(target.Label) && c.state.DownloadOutputs && !c.state.NeedTests) || target.NeededForSubinclude {
@@ -276,16 +325,19 @@ func (c *Client) build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 		}
 	}
 	metadata, ar, err := c.execute(tid, target, command, stampedDigest, target.BuildTimeout, false, needStdout)
-	if target.Stamp && err == nil {
+	if target.Stamp && err == nil && !sameDigest(stampedDigest, unstampedDigest) {
 		// Store results under unstamped digest too.
 		c.locallyCacheResults(target, unstampedDigest, metadata, ar)
 		ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
 		defer cancel()
-		c.client.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		if _, err := c.client.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
 			InstanceName: c.instance,
 			ActionDigest: unstampedDigest,
 			ActionResult: ar,
-		})
+		}); err != nil {
+			// The build itself succeeded so this isn't fatal, but it will cost us a rebuild next time.
+			log.Warning("Failed to store unstamped action result for %s: %s", target, err)
+		}
 	}
 	return metadata, ar, stampedDigest, err
 }
@@ -321,22 +373,55 @@ func (c *Client) reallyDownload(target *core.BuildTarget, digest *pb.Digest, ar
 	if err := removeOutputs(target); err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
-	defer cancel()
-	if err := c.client.DownloadActionOutputs(ctx, ar, target.OutDir()); err != nil {
-		return c.wrapActionErr(err, digest)
+	if linked, err := c.linkFilegroupOutputs(target); err != nil {
+		return err
+	} else if !linked {
+		ctx, span := c.startSpan(context.Background(), target, "download")
+		ctx, cancel := context.WithTimeout(ctx, c.reqTimeout)
+		defer cancel()
+		err := c.downloadActionOutputs(ctx, ar, target)
+		span.Finish(err)
+		if err != nil {
+			return c.wrapActionErr(err, digest)
+		}
 	}
 	c.recordAttrs(target, digest)
 	log.Debug("Downloaded outputs for %s", target)
 	return nil
 }
 
+// downloadActionOutputs downloads all the outputs of an action into the target's output directory.
+// Output symlinks are created separately since their targets may need adjusting to be correct locally.
+func (c *Client) downloadActionOutputs(ctx context.Context, ar *pb.ActionResult, target *core.BuildTarget) error {
+	symlinks := make([]*pb.OutputSymlink, 0, len(ar.OutputFileSymlinks)+len(ar.OutputDirectorySymlinks))
+	symlinks = append(append(symlinks, ar.OutputFileSymlinks...), ar.OutputDirectorySymlinks...)
+	if len(symlinks) == 0 {
+		return c.client.DownloadActionOutputs(ctx, ar, target.OutDir())
+	}
+	ar = proto.Clone(ar).(*pb.ActionResult)
+	ar.OutputFileSymlinks = nil
+	ar.OutputDirectorySymlinks = nil
+	if err := c.client.DownloadActionOutputs(ctx, ar, target.OutDir()); err != nil {
+		return err
+	}
+	// Create them in order so any that are beneath other directory symlinks don't fail.
+	sort.Slice(symlinks, func(i, j int) bool { return symlinks[i].Path < symlinks[j].Path })
+	for _, s := range symlinks {
+		if err := createOutputSymlink(target, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Test executes a remote test of the given target.
 // It returns the results (and coverage if appropriate) as bytes to be parsed elsewhere.
 func (c *Client) Test(tid int, target *core.BuildTarget) (metadata *core.BuildMetadata, results [][]byte, coverage []byte, err error) {
 	if err := c.CheckInitialised(); err != nil {
 		return nil, nil, nil, err
 	}
+	span := c.startTargetSpan(target, "test")
+	defer func() { c.finishTargetSpan(target, span, err) }()
 	command, digest, err := c.buildAction(target, true, false)
 	if err != nil {
 		return nil, nil, nil, err
@@ -367,19 +452,27 @@ func (c *Client) Test(tid int, target *core.BuildTarget) (metadata *core.BuildMe
 // retrieveResults retrieves target results from where it can (either from the local cache or from remote).
 // It returns nil if it cannot be retrieved.
 func (c *Client) retrieveResults(target *core.BuildTarget, command *pb.Command, digest *pb.Digest, needStdout bool) (*core.BuildMetadata, *pb.ActionResult) {
-	// First see if this execution is cached locally
-	if metadata, ar := c.retrieveLocalResults(target, digest); metadata != nil {
-		log.Debug("Got locally cached results for %s %s", target.Label, c.actionURL(digest, true))
+	// First see if we already had this result from a previous run.
+	if metadata, ar := c.retrieveStoredResults(target, digest, needStdout); metadata != nil {
+		log.Debug("Got stored results for %s %s", target.Label, c.actionURL(digest, true))
 		return metadata, ar
 	}
+	// Then see if this execution is cached locally
+	if metadata, ar := c.retrieveLocalResults(target, digest); metadata != nil {
+		if !needStdout || len(metadata.Stdout) > 0 {
+			log.Debug("Got locally cached results for %s %s", target.Label, c.actionURL(digest, true))
+			return metadata, ar
+		}
+		// This may have been cached by something that didn't need stdout (e.g. a download);
+		// in that case it has to come from the action result.
+		if m, err := c.buildMetadata(ar, true, false); err == nil {
+			log.Debug("Got locally cached results for %s %s", target.Label, c.actionURL(digest, true))
+			metadata.Stdout = m.Stdout
+			return metadata, ar
+		}
+	}
 	// Now see if it is cached on the remote server
-	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
-	defer cancel()
-	if ar, err := c.client.GetActionResult(ctx, &pb.GetActionResultRequest{
-		InstanceName: c.instance,
-		ActionDigest: digest,
-		InlineStdout: needStdout,
-	}); err == nil {
+	if ar, err := c.prober.Get(target, digest, needStdout); err == nil {
 		// This action already exists and has been cached.
 		if metadata, err := c.buildMetadata(ar, needStdout, false); err == nil {
 			log.Debug("Got remotely cached results for %s %s", target.Label, c.actionURL(digest, true))
@@ -390,6 +483,8 @@ func (c *Client) retrieveResults(target *core.BuildTarget, command *pb.Command,
 			}
 			log.Debug("Remotely cached results for %s were missing some outputs, forcing a rebuild: %s", target.Label, err)
 		}
+		// Don't reuse this result if we need to look it up again later.
+		c.prober.Forget(digest, needStdout)
 	}
 	return nil, nil
 }
@@ -413,7 +508,7 @@ func (c *Client) execute(tid int, target *core.BuildTarget, command *pb.Command,
 		return metadata, ar, nil
 	}
 	// We didn't actually upload the inputs before, so we must do so now.
-	command, digest, err := c.uploadAction(target, isTest)
+	command, digest, err := c.uploadAction(tid, target, isTest)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to upload build action: %s", err)
 	}
@@ -429,7 +524,8 @@ func (c *Client) execute(tid int, target *core.BuildTarget, command *pb.Command,
 		// take into account time to fetch inputs etc, so we might need to extend.
 		timeout = c.reqTimeout
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, span := c.startSpan(context.Background(), target, "execute")
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	resp, err := c.client.ExecuteAndWaitProgress(ctx, &pb.ExecuteRequest{
 		InstanceName:    c.instance,
@@ -438,6 +534,7 @@ func (c *Client) execute(tid int, target *core.BuildTarget, command *pb.Command,
 	}, func(metadata *pb.ExecuteOperationMetadata) {
 		c.updateProgress(tid, target, metadata)
 	})
+	span.Finish(err)
 	if err != nil {
 		// Handle timing issues if we try to resume an execution as it fails. If we get a
 		// "not found" we might find that it's already been completed and we can't resume.
@@ -589,6 +686,11 @@ func (c *Client) PrintHashes(target *core.BuildTarget, isTest bool) {
 	}
 }
 
+// Shutdown finishes the trace for this build and waits for any remaining spans to be exported.
+func (c *Client) Shutdown() {
+	c.tracer.Shutdown()
+}
+
 // DataRate returns an estimate of the current in/out RPC data rates in bytes per second.
 func (c *Client) DataRate() (int, int, int, int) {
 	return c.byteRateIn, c.byteRateOut, c.totalBytesIn, c.totalBytesOut
@@ -609,7 +711,7 @@ func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest
 			Value: sri,
 		}}
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), target.BuildTimeout)
+	ctx, cancel := context.WithTimeout(c.traceContext(context.Background(), target), target.BuildTimeout)
 	defer cancel()
 	resp, err := c.fetchClient.FetchBlob(ctx, req)
 	if err != nil {
@@ -647,7 +749,7 @@ func (c *Client) buildFilegroup(target *core.BuildTarget, command *pb.Command, a
 	if err := c.uploadBlobs(func(ch chan<- *chunker.Chunker) error {
 		defer close(ch)
 		b.Root(ch)
-		for _, out := range command.OutputPaths {
+		for _, out := range commandOutputs(command) {
 			if d, f := b.Node(path.Join(target.Label.PackageName, out)); d != nil {
 				chomk, _ := chunker.NewFromProto(b.Tree(path.Join(target.Label.PackageName, out)), int(c.client.ChunkMaxSize))
 				ch <- chomk
@@ -684,3 +786,30 @@ func (c *Client) buildFilegroup(target *core.BuildTarget, command *pb.Command, a
 	}
 	return &core.BuildMetadata{}, ar, nil
 }
+
+// linkFilegroupOutputs creates the outputs of a filegroup locally by linking them from its sources,
+// which avoids downloading (and storing) a second copy of them; for large data filegroups that can
+// be a lot of time and disk space. It only does so if all the sources are files in the repo, since
+// the outputs of other targets may not be present or up to date locally.
+// It returns false if the outputs weren't created, in which case they should be downloaded as usual.
+func (c *Client) linkFilegroupOutputs(target *core.BuildTarget) (bool, error) {
+	if !target.IsFilegroup || target.IsHashFilegroup {
+		return false, nil
+	}
+	for _, src := range target.AllSources() {
+		if src.Label() != nil {
+			return false, nil
+		}
+	}
+	outDir := target.OutDir()
+	localSources := target.AllLocalSourcePaths(c.state.Graph)
+	for i, source := range target.AllFullSourcePaths(c.state.Graph) {
+		out := path.Join(outDir, localSources[i])
+		if err := fs.EnsureDir(out); err != nil {
+			return true, err
+		} else if err := c.state.Linker.Link(source, out, target.OutMode()); err != nil {
+			return true, fmt.Errorf("Failed to link output %s for %s: %s", out, target, err)
+		}
+	}
+	return true, nil
+}
@@ -1,15 +1,31 @@
 package remote
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/chunker"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/thought-machine/please/src/build"
 	"github.com/thought-machine/please/src/core"
 )
 
@@ -29,6 +45,32 @@ func TestBadAPIVersion(t *testing.T) {
 	assert.Contains(t, c.CheckInitialised().Error(), "1.0.0 - 1.1.0")
 }
 
+func TestOutputPathsFallback(t *testing.T) {
+	defer server.Reset()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_outs"})
+	target.AddOutput("out.txt")
+	target.AddOutput("outdir")
+
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	cmd, err := c.buildCommand(target, &pb.Directory{}, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"out.txt", "outdir"}, cmd.OutputPaths)
+	assert.Nil(t, cmd.OutputFiles)
+	assert.Nil(t, cmd.OutputDirectories)
+
+	// A v2.0 server doesn't understand OutputPaths.
+	server.HighApiVersion.Minor = 0
+	c = newClient()
+	assert.NoError(t, c.CheckInitialised())
+	cmd, err = c.buildCommand(target, &pb.Directory{}, false, false)
+	assert.NoError(t, err)
+	assert.Nil(t, cmd.OutputPaths)
+	assert.Equal(t, []string{"out.txt"}, cmd.OutputFiles)
+	assert.Equal(t, []string{"outdir"}, cmd.OutputDirectories)
+	assert.Equal(t, []string{"out.txt", "outdir"}, commandOutputs(cmd))
+}
+
 func TestUnsupportedDigest(t *testing.T) {
 	defer server.Reset()
 	server.DigestFunction = []pb.DigestFunction_Value{
@@ -64,6 +106,23 @@ func TestExecuteBuild(t *testing.T) {
 	assert.Equal(t, []byte("hello\n"), metadata.Stdout)
 }
 
+func TestExecuteStampedBuild(t *testing.T) {
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_stamped"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Stamp = true
+	target.Command = "echo $STAMP > $OUT"
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	_, stamped, unstamped, err := c.buildStampedAndUnstampedAction(target)
+	assert.NoError(t, err)
+	assert.False(t, sameDigest(stamped, unstamped))
+	// The result should have been stored under the unstamped digest too.
+	assert.Contains(t, server.actionResults, unstamped.Hash)
+}
+
 type postBuildFunction func(*core.BuildTarget, string) error
 
 func (f postBuildFunction) Call(target *core.BuildTarget, output string) error {
@@ -136,6 +195,43 @@ func TestExecuteTestWithCoverage(t *testing.T) {
 	assert.Equal(t, coverageData, coverage)
 }
 
+func TestTestCommandEnvAndFixtures(t *testing.T) {
+	c := newClientInstance("test")
+	fixture := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "fixture"})
+	fixture.AddOutput("fixture.sh")
+	fixture.IsBinary = true
+	c.state.Graph.AddTarget(fixture)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_fixtures"})
+	target.AddOutput("remote_test")
+	target.TestCommand = "$TEST"
+	target.IsTest = true
+	target.IsBinary = true
+	target.TestEnv = map[string]string{"DATABASE_URL": "postgres://localhost"}
+	target.AddFixture(fixture.Label)
+	c.state.Graph.AddTarget(target)
+	c.state.Graph.AddDependency(target.Label, fixture.Label)
+	cmd, err := c.buildTestCommand(target)
+	assert.NoError(t, err)
+	assert.Contains(t, cmd.EnvironmentVariables, &pb.Command_EnvironmentVariable{Name: "DATABASE_URL", Value: "postgres://localhost"})
+	assert.Contains(t, cmd.Arguments[len(cmd.Arguments)-1], "package/fixture.sh setup && (")
+	assert.Contains(t, cmd.Arguments[len(cmd.Arguments)-1], "package/fixture.sh teardown")
+}
+
+func TestBuildTestCommandWithPort(t *testing.T) {
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_port"})
+	target.AddOutput("remote_test")
+	target.TestCommand = "$TEST"
+	target.IsTest = true
+	target.IsBinary = true
+	target.AddLabel(core.TestPortLabel)
+	cmd, err := c.buildTestCommand(target)
+	assert.NoError(t, err)
+	assert.Contains(t, cmd.EnvironmentVariables, &pb.Command_EnvironmentVariable{Name: "TEST_PORT", Value: "8080"})
+	assert.Contains(t, cmd.EnvironmentVariables, &pb.Command_EnvironmentVariable{Name: "SANDBOX", Value: "true"})
+	assert.Contains(t, cmd.EnvironmentVariables, &pb.Command_EnvironmentVariable{Name: "SANDBOX_NETWORK_ONLY", Value: "true"})
+}
+
 var testResults = [][]byte{[]byte(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>
 <testcase name="//src/remote:remote_test">
   <test name="testResults" success="true" time="172" type="SUCCESS"/>
@@ -207,3 +303,540 @@ func (c *Client) Store(target *core.BuildTarget) error {
 	}
 	return c.uploadLocalTarget(target)
 }
+
+func TestUploadProgress(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	results := state.Results()
+	label := core.BuildLabel{PackageName: "package", Name: "target"}
+	assert.Nil(t, newUploadProgress(state, 1, label, core.TargetBuilding, 1024))
+	p := newUploadProgress(state, 1, label, core.TargetBuilding, 112*1024*1024)
+	assert.NotNil(t, p)
+	assert.Equal(t, "Uploading (0/112MB)", (<-results).Description)
+	p.lastReport = time.Time{}
+	p.Add(34 * 1024 * 1024)
+	assert.Equal(t, "Uploading (34/112MB)", (<-results).Description)
+	p.lastReport = time.Time{}
+	p.Add(200 * 1024 * 1024)
+	assert.Equal(t, "Uploading (112/112MB)", (<-results).Description)
+}
+
+func TestDownloadOutputSymlinks(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "symlinks"})
+	target.AddOutput("out.txt")
+	target.AddOutput("link.txt")
+	target.AddOutput("src_link.txt")
+	target.AddOutput("dir_link")
+	target.AddOutput("dep_link.txt")
+	dep := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "dep"})
+	dep.AddOutput("out1.txt")
+	target.AddDependency(dep.Label)
+	c.state.Graph.AddTarget(dep)
+	c.state.Graph.AddTarget(target)
+	c.state.Graph.AddDependency(target.Label, dep.Label)
+	defer func() {
+		for _, out := range target.Outputs() {
+			os.Remove(path.Join(target.OutDir(), out))
+			os.Remove(path.Join(target.OutDir(), ".rule_hash_"+out)) // Symlinks can't take xattrs so they get one of these.
+		}
+	}()
+	server.blobs["5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"] = []byte("hello\n")
+	ar := &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{
+			Path: "out.txt",
+			Digest: &pb.Digest{
+				Hash:      "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+				SizeBytes: 6,
+			},
+		}},
+		OutputFileSymlinks: []*pb.OutputSymlink{
+			{Path: "link.txt", Target: "out.txt"},
+			{Path: "src_link.txt", Target: "package/src1.txt"},
+			{Path: "dep_link.txt", Target: "package/out1.txt"},
+		},
+		OutputDirectorySymlinks: []*pb.OutputSymlink{
+			{Path: "dir_link", Target: "package"},
+		},
+	}
+	// Write something in the way of one of the symlinks to make sure it gets replaced.
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, os.Symlink("wibble", path.Join(target.OutDir(), "link.txt")))
+	err := c.reallyDownload(target, &pb.Digest{Hash: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", SizeBytes: 6}, ar)
+	assert.NoError(t, err)
+
+	// Links between outputs are preserved as they are.
+	link, err := os.Readlink(path.Join(target.OutDir(), "link.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "out.txt", link)
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "link.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(b))
+
+	// Links to inputs need to be rewritten to where they are locally.
+	link, err = os.Readlink(path.Join(target.OutDir(), "src_link.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../../../package/src1.txt", link)
+	assert.True(t, core.PathExists(path.Join(target.OutDir(), "src_link.txt")))
+	link, err = os.Readlink(path.Join(target.OutDir(), "dir_link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../../../package", link)
+	assert.True(t, core.PathExists(path.Join(target.OutDir(), "dir_link", "src2.txt")))
+	link, err = os.Readlink(path.Join(target.OutDir(), "dep_link.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "out1.txt", link)
+	assert.True(t, core.PathExists(path.Join(target.OutDir(), "dep_link.txt")))
+}
+
+func TestDownloadFilegroupLinksSources(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "filegroup"})
+	target.IsFilegroup = true
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("src1.txt")
+	c.state.Graph.AddTarget(target)
+	defer os.RemoveAll(target.OutDir())
+	// The action result has nothing to download, so this can only work by linking the source.
+	err := c.reallyDownload(target, &pb.Digest{Hash: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", SizeBytes: 6}, &pb.ActionResult{})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "src1.txt"))
+	assert.NoError(t, err)
+	src, err := ioutil.ReadFile("package/src1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, src, b)
+
+	// Filegroups with outputs of other targets as sources still get downloaded.
+	dep := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "filegroup_dep"})
+	target2 := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "filegroup2"})
+	target2.IsFilegroup = true
+	target2.AddSource(dep.Label)
+	linked, err := c.linkFilegroupOutputs(target2)
+	assert.NoError(t, err)
+	assert.False(t, linked)
+}
+
+func TestTraceContext(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	span := c.startTargetSpan(target, "build")
+	assert.Regexp(t, "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$", span.String())
+	assert.Equal(t, c.tracer.root.TraceID, span.TraceID)
+	assert.Equal(t, c.tracer.root.SpanID, span.ParentID)
+	assert.NotEqual(t, c.tracer.root.SpanID, span.SpanID)
+
+	// The server should receive the span for the target.
+	metadata, ar := c.retrieveResults(target, &pb.Command{}, &pb.Digest{Hash: "e0ea9b2f9c5d0f3a3b1f1e0e2c8a7c0a8c8b6f6b8e0c1d9b6f1a8e0d3c2b1a09", SizeBytes: 10}, false)
+	assert.Nil(t, metadata)
+	assert.Nil(t, ar)
+	assert.Equal(t, span.String(), server.traceparent)
+
+	// Once it's finished, anything else is attributed to the root span.
+	c.finishTargetSpan(target, span, nil)
+	assert.Equal(t, c.tracer.root, c.tracer.TargetSpan(target))
+}
+
+func TestTraceExport(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.TraceExporter = "file"
+	config.Remote.TraceEndpoint = "trace_export.json"
+	defer os.Remove(config.Remote.TraceEndpoint)
+	c := &Client{tracer: newTracer(config)}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	build := c.startTargetSpan(target, "build")
+	_, upload := c.startSpan(context.Background(), target, "upload")
+	upload.Finish(nil)
+	_, execute := c.startSpan(context.Background(), target, "execute")
+	execute.Finish(fmt.Errorf("exited with code 1"))
+	c.finishTargetSpan(target, build, nil)
+	c.tracer.Shutdown()
+
+	b, err := ioutil.ReadFile(config.Remote.TraceEndpoint)
+	require.NoError(t, err)
+	req := &otlpTraces{}
+	require.NoError(t, json.Unmarshal(b, req))
+	require.Equal(t, 1, len(req.ResourceSpans))
+	require.Equal(t, 1, len(req.ResourceSpans[0].ScopeSpans))
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Equal(t, 4, len(spans))
+	assert.Equal(t, "upload", spans[0].Name)
+	assert.Equal(t, hex.EncodeToString(build.SpanID[:]), spans[0].ParentSpanID)
+	assert.Equal(t, []otlpAttribute{{Key: "plz.target", Value: otlpValue{StringValue: "//package:target"}}}, spans[0].Attributes)
+	assert.Equal(t, "execute", spans[1].Name)
+	assert.Equal(t, otlpStatus{Code: otlpStatusCodeError, Message: "exited with code 1"}, spans[1].Status)
+	assert.Equal(t, "build", spans[2].Name)
+	assert.Equal(t, hex.EncodeToString(c.tracer.root.SpanID[:]), spans[2].ParentSpanID)
+	assert.Equal(t, hex.EncodeToString(c.tracer.root.TraceID[:]), spans[2].TraceID)
+	assert.Equal(t, "", spans[3].ParentSpanID)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var req otlpTraces
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+	}))
+	defer srv.Close()
+	config := core.DefaultConfiguration()
+	config.Remote.TraceExporter = "otlp"
+	config.Remote.TraceEndpoint = srv.URL + "/v1/traces"
+	tracer := newTracer(config)
+	tracer.Shutdown()
+	require.Equal(t, 1, len(req.ResourceSpans))
+	assert.Equal(t, []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "please"}}}, req.ResourceSpans[0].Resource.Attributes)
+	assert.Equal(t, "build", req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+}
+
+func TestResourceLimitsPlatform(t *testing.T) {
+	platform := &pb.Platform{Properties: []*pb.Platform_Property{{Name: "OSFamily", Value: "linux"}}}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	assert.Equal(t, platform, addResourceLimits(platform, target))
+	target.CPULimit = 4
+	target.MemoryLimit = 1 << 30
+	assert.Equal(t, &pb.Platform{Properties: []*pb.Platform_Property{
+		{Name: "OSFamily", Value: "linux"},
+		{Name: "cpu_limit", Value: "4"},
+		{Name: "memory_limit", Value: "1073741824"},
+	}}, addResourceLimits(platform, target))
+	assert.Equal(t, 1, len(platform.Properties)) // Original should not be modified
+}
+
+func TestSecretsPlatform(t *testing.T) {
+	platform := &pb.Platform{Properties: []*pb.Platform_Property{{Name: "OSFamily", Value: "linux"}}}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	assert.Equal(t, platform, addSecrets(platform, target))
+	target.AddLabel("secret:signing-key")
+	target.AddLabel("secret:api-token")
+	assert.Equal(t, &pb.Platform{Properties: []*pb.Platform_Property{
+		{Name: "OSFamily", Value: "linux"},
+		{Name: "secrets", Value: "api-token,signing-key"},
+	}}, addSecrets(platform, target))
+	assert.Equal(t, 1, len(platform.Properties))
+}
+
+func TestExecPropertiesPlatform(t *testing.T) {
+	platform := &pb.Platform{Properties: []*pb.Platform_Property{
+		{Name: "OSFamily", Value: "linux"},
+		{Name: "pool", Value: "default"},
+	}}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	assert.Equal(t, platform, addExecProperties(platform, target))
+	target.ExecProperties = map[string]string{"pool": "gpu", "gpu": "true"}
+	assert.Equal(t, &pb.Platform{Properties: []*pb.Platform_Property{
+		{Name: "OSFamily", Value: "linux"},
+		{Name: "gpu", Value: "true"},
+		{Name: "pool", Value: "gpu"},
+	}}, addExecProperties(platform, target))
+	assert.Equal(t, "default", platform.Properties[1].Value) // Original should not be modified
+}
+
+func TestCacheProber(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "probed"})
+	digest := &pb.Digest{Hash: "2c0ff2c1ad2d5a8cbf4e6e1f1bba53c5c9d29c4bbdbd8d1c7a3b3a4f3f0e0d11", SizeBytes: 10}
+	requests := func() int64 { return atomic.LoadInt64(&server.actionResultRequests) }
+	before := requests()
+
+	// Misses aren't remembered, since the action could be stored later.
+	_, err := c.prober.Get(target, digest, false)
+	assert.Error(t, err)
+	_, err = c.prober.Get(target, digest, false)
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, requests()-before)
+
+	// Hits are, so we only ask the server once.
+	server.actionResults[digest.Hash] = &pb.ActionResult{ExitCode: 0}
+	defer delete(server.actionResults, digest.Hash)
+	ar, err := c.prober.Get(target, digest, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, ar)
+	ar, err = c.prober.Get(target, digest, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, ar)
+	assert.EqualValues(t, 3, requests()-before)
+
+	// Unless we find out that they're no good.
+	c.prober.Forget(digest, false)
+	ar, err = c.prober.Get(target, digest, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, ar)
+	assert.EqualValues(t, 4, requests()-before)
+}
+
+func TestLocallyCachedResultsWithoutStdout(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	c.state.Cache = &testCache{}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "cached_stdout"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.PostBuildFunction = testFunction{}
+	target.Command = "echo hello && echo test > $OUT"
+	command, digest, err := c.buildAction(target, false, false)
+	assert.NoError(t, err)
+	server.blobs["5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"] = []byte("hello\n")
+	ar := &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{
+			Path: "out2.txt",
+			Digest: &pb.Digest{
+				Hash:      "e348b3c3da7a11a1694aeda09a7a63fc901811f9756f1c83d8d6ece59baa4be3",
+				SizeBytes: 19,
+			},
+		}},
+		StdoutDigest: &pb.Digest{
+			Hash:      "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+			SizeBytes: 6,
+		},
+	}
+	// Simulate something that didn't need stdout (e.g. a download) having cached the results.
+	c.locallyCacheResults(target, digest, &core.BuildMetadata{}, ar)
+	metadata, _ := c.retrieveResults(target, command, digest, true)
+	assert.NotNil(t, metadata)
+	assert.Equal(t, []byte("hello\n"), metadata.Stdout)
+}
+
+func TestStoredOutputs(t *testing.T) {
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "stored"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "echo test > $OUT"
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	command, digest, err := c.buildAction(target, false, false)
+	assert.NoError(t, err)
+
+	// A new client (i.e. the next run) should find the results without asking the server.
+	c = newClient()
+	assert.NoError(t, c.CheckInitialised())
+	requests := func() int64 { return atomic.LoadInt64(&server.actionResultRequests) }
+	before := requests()
+	metadata, ar := c.retrieveResults(target, command, digest, false)
+	assert.NotNil(t, metadata)
+	assert.NotNil(t, ar)
+	assert.EqualValues(t, 0, requests()-before)
+	assert.NotNil(t, c.targetOutputs(target.Label))
+
+	// But not if the action has changed.
+	target.Command = "echo changed > $OUT"
+	command, digest, err = c.buildAction(target, false, false)
+	assert.NoError(t, err)
+	metadata, _ = c.retrieveResults(target, command, digest, false)
+	assert.Nil(t, metadata)
+	assert.EqualValues(t, 1, requests()-before)
+}
+
+func TestStoredOutputsEvicted(t *testing.T) {
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "evicted"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "echo evicted > $OUT"
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	_, digest, err := c.buildAction(target, false, false)
+	assert.NoError(t, err)
+	o := c.outputStore.Get(target.Label, digest)
+	if !assert.NotNil(t, o) || !assert.Equal(t, 1, len(o.Result.OutputFiles)) {
+		return
+	}
+
+	// Simulate the server evicting the output.
+	hash := o.Result.OutputFiles[0].Digest.Hash
+	blob := server.blobs[hash]
+	delete(server.blobs, hash)
+	defer func() { server.blobs[hash] = blob }()
+
+	// The next run shouldn't use the stored results, and should forget them.
+	c = newClient()
+	assert.NoError(t, c.CheckInitialised())
+	metadata, _ := c.retrieveStoredResults(target, digest, false)
+	assert.Nil(t, metadata)
+	assert.Nil(t, c.outputStore.Get(target.Label, digest))
+	assert.Nil(t, newOutputStore(outputStoreFile, c.outputStore.server).Get(target.Label, digest))
+}
+
+func TestOutputStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "outputs")
+	label := core.BuildLabel{PackageName: "package", Name: "dir"}
+	action := &pb.Digest{Hash: "2c0ff2c1ad2d5a8cbf4e6e1f1bba53c5c9d29c4bbdbd8d1c7a3b3a4f3f0e0d11", SizeBytes: 10}
+	ar := &pb.ActionResult{
+		OutputDirectories: []*pb.OutputDirectory{{
+			Path:       "out",
+			TreeDigest: &pb.Digest{Hash: "5fb3d47e893061ea6627334a8582c37398cfdc68fe7fa59c16912e4a3ab7a5d6", SizeBytes: 19},
+		}},
+	}
+	outputs := &pb.Directory{
+		Directories: []*pb.DirectoryNode{{
+			Name:   "out",
+			Digest: &pb.Digest{Hash: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", SizeBytes: 6},
+		}},
+	}
+	s := newOutputStore(filename, "server")
+	s.Set(label, action, ar, outputs)
+
+	s = newOutputStore(filename, "server")
+	o := s.Get(label, action)
+	assert.NotNil(t, o)
+	assert.True(t, proto.Equal(ar, o.Result))
+	assert.True(t, proto.Equal(outputs, o.Outputs))
+	assert.True(t, proto.Equal(outputs, s.Outputs(label, ar)))
+	assert.Nil(t, s.Get(label, &pb.Digest{Hash: action.Hash, SizeBytes: 11}))
+	assert.Nil(t, s.Outputs(label, &pb.ActionResult{}))
+
+	// Entries from a different server don't count.
+	s = newOutputStore(filename, "other_server")
+	assert.Nil(t, s.Get(label, action))
+	assert.Nil(t, s.Outputs(label, ar))
+}
+
+// A testCache is a minimal in-memory implementation of core.Cache that only stores metadata.
+type testCache struct {
+	mutex    sync.Mutex
+	metadata map[string]core.BuildMetadata
+}
+
+func (c *testCache) Store(target *core.BuildTarget, key []byte, metadata *core.BuildMetadata, files []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.metadata == nil {
+		c.metadata = map[string]core.BuildMetadata{}
+	}
+	c.metadata[target.Label.String()+string(key)] = *metadata
+}
+
+func (c *testCache) Retrieve(target *core.BuildTarget, key []byte, files []string) *core.BuildMetadata {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if metadata, present := c.metadata[target.Label.String()+string(key)]; present {
+		return &metadata
+	}
+	return nil
+}
+
+func (c *testCache) Clean(target *core.BuildTarget) {}
+func (c *testCache) CleanAll()                      {}
+func (c *testCache) Shutdown()                      {}
+
+func TestTLSConfig(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	// newClient turns off security, so we shouldn't get any TLS config by default.
+	config, err := c.tlsConfig("127.0.0.1:9987")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+	assert.False(t, c.customTLS())
+
+	// Overriding one endpoint should make it secure without affecting any others.
+	c.state.Config.RemoteTLS = map[string]*core.RemoteTLS{"cas.example.com:443": {}}
+	config, err = c.tlsConfig("cas.example.com:443")
+	assert.NoError(t, err)
+	assert.NotNil(t, config)
+	config, err = c.tlsConfig("127.0.0.1:9987")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+	assert.True(t, c.customTLS())
+
+	// A CA certificate that doesn't contain any certificates is an error.
+	c.state.Config.RemoteTLS["cas.example.com:443"].CACertFile = "package/src1.txt"
+	_, err = c.tlsConfig("cas.example.com:443")
+	assert.Error(t, err)
+}
+
+func TestStreamLargeBlob(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	// Big enough that it gets streamed, and with a partial chunk at the end.
+	chunkSize := int(c.client.ChunkMaxSize)
+	data := bytes.Repeat([]byte("please"), (streamThreshold+chunkSize)/6)
+	small := []byte("small blob")
+	chomk := chunker.NewFromBlob(data, chunkSize)
+	err := c.uploadBlobs(func(ch chan<- *chunker.Chunker) error {
+		ch <- chomk
+		ch <- chunker.NewFromBlob(small, chunkSize)
+		close(ch)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, data, server.blobs[chomk.Digest().Hash])
+	assert.Equal(t, small, server.blobs[chunker.NewFromBlob(small, 0).Digest().Hash])
+}
+
+func TestStreamBlobRejected(t *testing.T) {
+	c := newClient()
+	assert.NoError(t, c.CheckInitialised())
+	chunkSize := int(c.client.ChunkMaxSize)
+	// Big enough that it gets streamed; the server rejects the write after the first couple of chunks.
+	server.maxWriteSize = 2 * chunkSize
+	defer func() { server.maxWriteSize = 0 }()
+	data := bytes.Repeat([]byte("reject"), (streamThreshold+chunkSize)/6)
+	chomk := chunker.NewFromBlob(data, chunkSize)
+	err := c.uploadBlobs(func(ch chan<- *chunker.Chunker) error {
+		ch <- chomk
+		close(ch)
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.NotContains(t, server.blobs, chomk.Digest().Hash)
+}
+
+func TestArchSubrepoPlatform(t *testing.T) {
+	c := newClient()
+	c.platform = &pb.Platform{Properties: []*pb.Platform_Property{{Name: "ISA", Value: "x86-64"}}}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target"})
+	assert.Equal(t, c.platform, c.targetPlatform(target))
+	state := c.state.ForConfig()
+	state.Config.Remote.Platform = []string{"ISA=aarch64"}
+	target.Subrepo = &core.Subrepo{Name: "third_party/cc/gtest@linux_arm64", State: state, IsCrossCompile: true}
+	assert.Equal(t, &pb.Platform{Properties: []*pb.Platform_Property{{Name: "ISA", Value: "aarch64"}}}, c.targetPlatform(target))
+}
+
+func TestRemoteToolchainInputs(t *testing.T) {
+	c := newClientInstance("test")
+	tool := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "toolchain"})
+	tool.AddOutput("go")
+	tool.AddLabel("remote_toolchain:/usr/local/go")
+	c.state.Graph.AddTarget(tool)
+	jdk := core.NewBuildTarget(core.BuildLabel{PackageName: "third_party/java", Name: "jdk"})
+	jdk.AddOutput("bin")
+	jdk.AddOutput("lib")
+	jdk.AddLabel("remote_toolchain:/opt/jdk")
+	c.state.Graph.AddTarget(jdk)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target6"})
+	target.AddOutput("out6")
+	target.AddTool(tool.Label)
+	target.AddTool(jdk.Label)
+	// Neither toolchain has been built, so this would fail if we tried to upload their outputs.
+	b, err := c.uploadInputDir(nil, target, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "go", Target: "/usr/local/go"}}, b.Dir("package").Symlinks)
+	assert.Equal(t, []*pb.SymlinkNode{
+		{Name: "bin", Target: "/opt/jdk/bin"},
+		{Name: "lib", Target: "/opt/jdk/lib"},
+	}, b.Dir("third_party/java").Symlinks)
+	assert.Equal(t, 0, len(b.Dir("package").Files))
+	// The command should identify which toolchains it's using.
+	cmd, err := c.buildCommand(target, &pb.Directory{}, false, false)
+	assert.NoError(t, err)
+	assert.Contains(t, cmd.EnvironmentVariables, &pb.Command_EnvironmentVariable{
+		Name:  "_REMOTE_TOOLCHAINS",
+		Value: "//package:toolchain=" + hex.EncodeToString(build.RuleHash(c.state, tool, false, false)) + " //third_party/java:jdk=" + hex.EncodeToString(build.RuleHash(c.state, jdk, false, false)),
+	})
+	// If the server doesn't allow absolute symlinks, we have to upload them like anything else.
+	c.noAbsoluteSymlinks = true
+	_, err = c.uploadInputDir(nil, target, false)
+	assert.Error(t, err)
+	cmd, err = c.buildCommand(target, &pb.Directory{}, false, false)
+	assert.NoError(t, err)
+	for _, v := range cmd.EnvironmentVariables {
+		assert.NotEqual(t, "_REMOTE_TOOLCHAINS", v.Name)
+	}
+}
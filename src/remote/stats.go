@@ -2,10 +2,13 @@ package remote
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc/stats"
+
+	"github.com/thought-machine/please/src/core"
 )
 
 // The length of time we keep stats around for.
@@ -15,6 +18,12 @@ const windowDuration = -windowDurationSeconds * time.Second
 // updateFrequency is the rate at which we update stats internally (which is independent of display updates)
 const updateFrequency = 1 * time.Second
 
+// progressFrequency is the minimum interval between reporting upload progress for a single target.
+const progressFrequency = 250 * time.Millisecond
+
+// progressThreshold is the minimum size of an upload that we bother reporting progress for.
+const progressThreshold = 1024 * 1024
+
 // A stat is a single statistic comprising an observation time and size value (in bytes)
 type stat struct {
 	Time time.Time
@@ -48,6 +57,9 @@ func (h *statsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
 		h.in = append(h.in, stat{Time: p.RecvTime, Val: p.Length})
 		h.totalIn += p.Length
 	case *stats.OutPayload:
+		if progress, ok := ctx.Value(uploadProgressKey{}).(*uploadProgress); ok {
+			progress.Add(p.Length)
+		}
 		h.outmtx.Lock()
 		defer h.outmtx.Unlock()
 		h.out = append(h.out, stat{Time: p.SentTime, Val: p.Length})
@@ -101,3 +113,57 @@ func (h *statsHandler) survivingStats(stats []stat, deadline time.Time) int {
 	}
 	return len(stats)
 }
+
+// uploadProgressKey is the context key that an uploadProgress is stored under.
+type uploadProgressKey struct{}
+
+// An uploadProgress tracks the progress of uploading the inputs for a single target and
+// reports it to the build state as it goes.
+type uploadProgress struct {
+	state       *core.BuildState
+	tid         int
+	label       core.BuildLabel
+	status      core.BuildResultStatus
+	total, done int
+	lastReport  time.Time
+	mutex       sync.Mutex
+}
+
+// newUploadProgress returns a new uploadProgress for an upload of the given total size, or nil
+// if the upload is too small to be worth reporting progress for.
+func newUploadProgress(state *core.BuildState, tid int, label core.BuildLabel, status core.BuildResultStatus, total int) *uploadProgress {
+	if total < progressThreshold {
+		return nil
+	}
+	p := &uploadProgress{state: state, tid: tid, label: label, status: status, total: total}
+	p.report()
+	return p
+}
+
+// Context returns a copy of the given context that will have progress recorded against it.
+func (p *uploadProgress) Context(ctx context.Context) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, uploadProgressKey{}, p)
+}
+
+// Add records the given number of bytes as having been uploaded.
+func (p *uploadProgress) Add(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.done += n; p.done > p.total {
+		// The payload sizes include some protocol overhead and we may not need to upload
+		// everything, so don't let it run past the end.
+		p.done = p.total
+	}
+	if time.Since(p.lastReport) >= progressFrequency {
+		p.report()
+	}
+}
+
+// report reports the current progress to the build state. The mutex must be held.
+func (p *uploadProgress) report() {
+	p.lastReport = time.Now()
+	p.state.LogBuildResult(p.tid, p.label, p.status, fmt.Sprintf("Uploading (%d/%dMB)", p.done/(1024*1024), p.total/(1024*1024)))
+}
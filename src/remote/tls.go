@@ -0,0 +1,102 @@
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// tlsConfig returns the TLS configuration to use when connecting to the given endpoint.
+// It returns nil if the connection should not be secure.
+func (c *Client) tlsConfig(endpoint string) (*tls.Config, error) {
+	remote := c.state.Config.Remote
+	caCertFile, certFile, keyFile := remote.CACertFile, remote.CertFile, remote.KeyFile
+	override, present := c.state.Config.RemoteTLS[endpoint]
+	if present {
+		if override.CACertFile != "" {
+			caCertFile = override.CACertFile
+		}
+		if override.CertFile != "" {
+			certFile, keyFile = override.CertFile, override.KeyFile
+		}
+	}
+	if !remote.Secure && !present && caCertFile == "" && certFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caCertFile != "" {
+		b, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificate: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("Failed to load any CA certificates from %s", caCertFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// customTLS returns true if any TLS settings beyond the default have been configured.
+func (c *Client) customTLS() bool {
+	remote := c.state.Config.Remote
+	return remote.CACertFile != "" || remote.CertFile != "" || len(c.state.Config.RemoteTLS) > 0
+}
+
+// tlsDialOption returns a dial option setting the transport security for the given endpoint.
+func (c *Client) tlsDialOption(endpoint string) (grpc.DialOption, error) {
+	config, err := c.tlsConfig(endpoint)
+	if err != nil {
+		return nil, err
+	} else if config == nil {
+		return grpc.WithInsecure(), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// tlsDialer returns a dialer that applies the appropriate TLS configuration for each endpoint
+// it connects to.
+// This is needed because the SDK always applies its own transport credentials when connecting
+// securely, so the only way to get ours in is to tell it the connection is insecure and then
+// establish TLS ourselves when dialling.
+func (c *Client) tlsDialer(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	config, err := c.tlsConfig(addr)
+	if err != nil {
+		return nil, err
+	} else if config == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	config.NextProtos = []string{"h2"}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, present := ctx.Deadline(); present {
+		conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
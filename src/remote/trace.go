@@ -0,0 +1,344 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// traceparentHeader is the metadata key we use to propagate trace context to the server.
+// It follows the W3C Trace Context format (https://www.w3.org/TR/trace-context/) which is
+// understood by OpenTelemetry, so an instrumented server can attach its spans to ours.
+const traceparentHeader = "traceparent"
+
+// traceBatchSize is the number of finished spans we buffer before exporting them.
+const traceBatchSize = 100
+
+// traceExportTimeout is the timeout for sending a batch of spans to a collector.
+const traceExportTimeout = 10 * time.Second
+
+// A span is a single timed operation within a trace, e.g. uploading the inputs for a target.
+type span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Err      error
+	tracer   *tracer
+}
+
+type spanKey struct{}
+
+// String returns the span in traceparent header format.
+func (s *span) String() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.TraceID[:]), hex.EncodeToString(s.SpanID[:]))
+}
+
+// Finish ends this span, recording the given error (if any) against it.
+func (s *span) Finish(err error) {
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.finish(s)
+}
+
+// A spanExporter sends finished spans somewhere they can be viewed.
+type spanExporter interface {
+	Export(spans []*span) error
+}
+
+// A tracer records spans for the remote operations in a build and hands them to an exporter.
+// All of them belong to a single trace whose root span covers the whole build.
+type tracer struct {
+	root     *span
+	exporter spanExporter
+	targets  sync.Map // Maps build labels to the span for building or testing that target.
+	mutex    sync.Mutex
+	spans    []*span // Finished spans that haven't been exported yet
+	wg       sync.WaitGroup
+}
+
+// newTracer creates a new tracer, exporting spans as set in the given config.
+func newTracer(config *core.Configuration) *tracer {
+	t := &tracer{exporter: newSpanExporter(config)}
+	t.root = &span{Name: "build", Start: time.Now(), tracer: t}
+	rand.Read(t.root.TraceID[:])
+	rand.Read(t.root.SpanID[:])
+	return t
+}
+
+// newSpanExporter returns the exporter configured in the [remote] section of the config, or nil if there isn't one.
+func newSpanExporter(config *core.Configuration) spanExporter {
+	switch config.Remote.TraceExporter {
+	case "otlp":
+		return &otlpExporter{url: config.Remote.TraceEndpoint, client: &http.Client{Timeout: traceExportTimeout}}
+	case "file":
+		return &fileExporter{filename: config.Remote.TraceEndpoint}
+	}
+	return nil
+}
+
+// Start starts a new span with the given parent. If target is non-nil the span is annotated with it.
+func (t *tracer) Start(parent *span, name string, target *core.BuildTarget) *span {
+	s := &span{
+		TraceID:  parent.TraceID,
+		ParentID: parent.SpanID,
+		Name:     name,
+		Start:    time.Now(),
+		tracer:   t,
+	}
+	rand.Read(s.SpanID[:])
+	if target != nil {
+		s.Attrs = map[string]string{"plz.target": target.Label.String()}
+	}
+	return s
+}
+
+// TargetSpan returns the span for building or testing the given target, or the root span if
+// it doesn't currently have one.
+func (t *tracer) TargetSpan(target *core.BuildTarget) *span {
+	if s, present := t.targets.Load(target.Label); present {
+		return s.(*span)
+	}
+	return t.root
+}
+
+// finish records a span that has finished, exporting a batch if there are enough of them.
+func (t *tracer) finish(s *span) {
+	if t.exporter == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.spans = append(t.spans, s)
+	if len(t.spans) >= traceBatchSize {
+		t.export(t.spans)
+		t.spans = nil
+	}
+}
+
+// export exports a batch of spans in the background.
+func (t *tracer) export(spans []*span) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		if err := t.exporter.Export(spans); err != nil {
+			log.Warning("Failed to export trace spans: %s", err)
+		}
+	}()
+}
+
+// Shutdown finishes the root span and waits for all remaining spans to be exported.
+func (t *tracer) Shutdown() {
+	t.root.Finish(nil)
+	t.mutex.Lock()
+	if len(t.spans) > 0 {
+		t.export(t.spans)
+		t.spans = nil
+	}
+	t.mutex.Unlock()
+	t.wg.Wait()
+}
+
+// startTargetSpan starts the span for building or testing a target. Spans for the operations
+// we do for it in the meantime (uploading, executing etc) are recorded as children of it.
+func (c *Client) startTargetSpan(target *core.BuildTarget, name string) *span {
+	s := c.tracer.Start(c.tracer.root, name, target)
+	c.tracer.targets.Store(target.Label, s)
+	return s
+}
+
+// finishTargetSpan finishes a span started by startTargetSpan.
+func (c *Client) finishTargetSpan(target *core.BuildTarget, s *span, err error) {
+	c.tracer.targets.Delete(target.Label)
+	s.Finish(err)
+}
+
+// startSpan starts a span for an operation on the given target. It returns a context
+// carrying the span, so that RPCs made with it are attributed to it.
+func (c *Client) startSpan(ctx context.Context, target *core.BuildTarget, name string) (context.Context, *span) {
+	s := c.tracer.Start(c.tracer.TargetSpan(target), name, target)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// traceContext returns a context carrying the current span for the given target; all RPCs
+// made with it (or contexts derived from it) will be attributed to that span.
+func (c *Client) traceContext(ctx context.Context, target *core.BuildTarget) context.Context {
+	return context.WithValue(ctx, spanKey{}, c.tracer.TargetSpan(target))
+}
+
+// withTraceMetadata returns a context with the trace metadata set for an outgoing RPC.
+// If the context doesn't carry a span of its own the root span is used.
+func withTraceMetadata(ctx context.Context, root *span) context.Context {
+	s, ok := ctx.Value(spanKey{}).(*span)
+	if !ok {
+		s = root
+	}
+	return metadata.AppendToOutgoingContext(ctx, traceparentHeader, s.String())
+}
+
+// traceUnaryInterceptor returns a client interceptor that propagates trace context on unary RPCs.
+func traceUnaryInterceptor(root *span) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withTraceMetadata(ctx, root), method, req, reply, cc, opts...)
+	}
+}
+
+// traceStreamInterceptor returns a client interceptor that propagates trace context on streaming RPCs.
+func traceStreamInterceptor(root *span) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withTraceMetadata(ctx, root), desc, cc, method, opts...)
+	}
+}
+
+// An otlpExporter sends spans to an OpenTelemetry collector using OTLP over HTTP.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *otlpExporter) Export(spans []*span) error {
+	b, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response from %s: %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// A fileExporter appends spans to a file, one OTLP JSON request per line.
+type fileExporter struct {
+	filename string
+	mutex    sync.Mutex
+}
+
+func (e *fileExporter) Export(spans []*span) error {
+	b, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	f, err := os.OpenFile(e.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// These types represent the JSON encoding of an OTLP ExportTraceServiceRequest.
+// See https://github.com/open-telemetry/opentelemetry-proto for the definitions.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeOK    = 1
+	otlpStatusCodeError = 2
+)
+
+// otlpRequest converts a set of spans to an OTLP request.
+func otlpRequest(spans []*span) *otlpTraces {
+	converted := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		converted[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpSpanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusCodeOK},
+		}
+		if s.ParentID != [8]byte{} {
+			converted[i].ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		for k, v := range s.Attrs {
+			converted[i].Attributes = append(converted[i].Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.Err != nil {
+			converted[i].Status = otlpStatus{Code: otlpStatusCodeError, Message: s.Err.Error()}
+		}
+	}
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "please"}}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "please", Version: core.PleaseVersion.String()},
+				Spans: converted,
+			}},
+		}},
+	}
+}
@@ -3,13 +3,14 @@ package remote
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,7 +48,15 @@ func (c *Client) targetOutputs(label core.BuildLabel) *pb.Directory {
 }
 
 // setOutputs sets the outputs for a previously executed target.
-func (c *Client) setOutputs(label core.BuildLabel, ar *pb.ActionResult) error {
+// If the action digest is given, they're also persisted for future runs.
+func (c *Client) setOutputs(label core.BuildLabel, actionDigest *pb.Digest, ar *pb.ActionResult) error {
+	if o := c.outputStore.Outputs(label, ar); o != nil {
+		// We've seen this result before, so don't need to fetch any of its trees again.
+		c.outputMutex.Lock()
+		defer c.outputMutex.Unlock()
+		c.outputs[label] = o
+		return nil
+	}
 	o := &pb.Directory{
 		Files:       make([]*pb.FileNode, len(ar.OutputFiles)),
 		Directories: make([]*pb.DirectoryNode, len(ar.OutputDirectories)),
@@ -81,12 +90,36 @@ func (c *Client) setOutputs(label core.BuildLabel, ar *pb.ActionResult) error {
 			Target: s.Target,
 		}
 	}
+	if actionDigest != nil {
+		c.outputStore.Set(label, actionDigest, ar, o)
+	}
 	c.outputMutex.Lock()
 	defer c.outputMutex.Unlock()
 	c.outputs[label] = o
 	return nil
 }
 
+// outputSize returns the total size of the outputs in an action result.
+// This has to fetch the trees of any output directories.
+func (c *Client) outputSize(ar *pb.ActionResult) (uint64, error) {
+	var size int64
+	for _, f := range ar.OutputFiles {
+		size += f.Digest.SizeBytes
+	}
+	for _, d := range ar.OutputDirectories {
+		tree := &pb.Tree{}
+		if err := c.client.ReadProto(context.Background(), digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
+			return 0, wrap(err, "Downloading tree digest for %s [%s]", d.Path, d.TreeDigest.Hash)
+		}
+		for _, dir := range append([]*pb.Directory{tree.Root}, tree.Children...) {
+			for _, f := range dir.Files {
+				size += f.Digest.SizeBytes
+			}
+		}
+	}
+	return uint64(size), nil
+}
+
 // digestMessage calculates the digest of a proto message as described in the
 // Digest message's comments.
 func (c *Client) digestMessage(msg proto.Message) *pb.Digest {
@@ -109,6 +142,11 @@ func (c *Client) digestBlob(b []byte) *pb.Digest {
 	}
 }
 
+// sameDigest returns true if the two given digests are identical.
+func sameDigest(a, b *pb.Digest) bool {
+	return a.Hash == b.Hash && a.SizeBytes == b.SizeBytes
+}
+
 // wrapActionErr wraps an error with information about the action related to it.
 func (c *Client) wrapActionErr(err error, actionDigest *pb.Digest) error {
 	if err == nil || c.state.Config.Remote.DisplayURL == "" {
@@ -149,7 +187,7 @@ func (c *Client) retrieveLocalResults(target *core.BuildTarget, digest *pb.Diges
 		if metadata := c.state.Cache.Retrieve(target, key, nil); metadata != nil && len(metadata.RemoteAction) > 0 {
 			ar := &pb.ActionResult{}
 			if err := proto.Unmarshal(metadata.RemoteAction, ar); err == nil {
-				if err := c.setOutputs(target.Label, ar); err == nil {
+				if err := c.setOutputs(target.Label, digest, ar); err == nil {
 					return metadata, ar
 				}
 			}
@@ -158,6 +196,48 @@ func (c *Client) retrieveLocalResults(target *core.BuildTarget, digest *pb.Diges
 	return nil, nil
 }
 
+// retrieveStoredResults retrieves the results for a target from a previous run, if its action hasn't changed since.
+// Like retrieveLocalResults this does not handle any file data.
+func (c *Client) retrieveStoredResults(target *core.BuildTarget, digest *pb.Digest, needStdout bool) (*core.BuildMetadata, *pb.ActionResult) {
+	if o := c.outputStore.Get(target.Label, digest); o != nil {
+		if err := c.storedBlobsExist(o.Result, needStdout); err != nil {
+			log.Debug("Stored results for %s are no longer usable: %s", target.Label, err)
+			c.outputStore.Delete(target.Label)
+			return nil, nil
+		}
+		if metadata, err := c.buildMetadata(o.Result, needStdout, false); err == nil {
+			c.outputMutex.Lock()
+			defer c.outputMutex.Unlock()
+			c.outputs[target.Label] = o.Outputs
+			return metadata, o.Result
+		}
+	}
+	return nil, nil
+}
+
+// storedBlobsExist checks that the blobs an action result from a previous run refers to are still
+// present in the CAS, since they may have been evicted since it was stored.
+func (c *Client) storedBlobsExist(ar *pb.ActionResult, needStdout bool) error {
+	digests := make([]digest.Digest, 0, len(ar.OutputFiles)+len(ar.OutputDirectories)+1)
+	for _, f := range ar.OutputFiles {
+		digests = append(digests, digest.NewFromProtoUnvalidated(f.Digest))
+	}
+	for _, d := range ar.OutputDirectories {
+		digests = append(digests, digest.NewFromProtoUnvalidated(d.TreeDigest))
+	}
+	if needStdout && ar.StdoutDigest != nil {
+		digests = append(digests, digest.NewFromProtoUnvalidated(ar.StdoutDigest))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	if missing, err := c.client.MissingBlobs(ctx, digests); err != nil {
+		return err
+	} else if len(missing) != 0 {
+		return fmt.Errorf("%d blobs are missing", len(missing))
+	}
+	return nil
+}
+
 // outputsExist returns true if the outputs for this target exist and are up to date.
 func (c *Client) outputsExist(target *core.BuildTarget, digest *pb.Digest) bool {
 	hash, _ := hex.DecodeString(digest.Hash)
@@ -407,6 +487,69 @@ func convertPlatform(config *core.Configuration) *pb.Platform {
 	return platform
 }
 
+// targetPlatform returns the platform to request for building the given target.
+// Targets in a subrepo for another architecture use the platform configured for it (e.g. in
+// .plzconfig_linux_arm64) so they can be routed to workers of that architecture.
+func (c *Client) targetPlatform(target *core.BuildTarget) *pb.Platform {
+	if target.Subrepo != nil && target.Subrepo.IsCrossCompile && target.Subrepo.State != nil {
+		return convertPlatform(target.Subrepo.State.Config)
+	}
+	return c.platform
+}
+
+// addExecProperties returns a copy of the given platform with the target's exec properties merged
+// into it. Properties on the target override any of the same name that are already there.
+// The platform is returned unchanged if the target doesn't have any.
+func addExecProperties(platform *pb.Platform, target *core.BuildTarget) *pb.Platform {
+	if len(target.ExecProperties) == 0 {
+		return platform
+	}
+	ret := &pb.Platform{Properties: make([]*pb.Platform_Property, 0, len(platform.Properties)+len(target.ExecProperties))}
+	for _, prop := range platform.Properties {
+		if _, present := target.ExecProperties[prop.Name]; !present {
+			ret.Properties = append(ret.Properties, prop)
+		}
+	}
+	for name, value := range target.ExecProperties {
+		ret.Properties = append(ret.Properties, &pb.Platform_Property{Name: name, Value: value})
+	}
+	sort.SliceStable(ret.Properties, func(i, j int) bool { return ret.Properties[i].Name < ret.Properties[j].Name })
+	return ret
+}
+
+// addResourceLimits returns a copy of the given platform with properties added for any resource
+// limits set on the given target, so the workers can apply them to the action.
+// The platform is returned unchanged if the target has no limits.
+func addResourceLimits(platform *pb.Platform, target *core.BuildTarget) *pb.Platform {
+	if target.CPULimit <= 0 && target.MemoryLimit == 0 {
+		return platform
+	}
+	ret := &pb.Platform{Properties: append([]*pb.Platform_Property{}, platform.Properties...)}
+	if target.CPULimit > 0 {
+		ret.Properties = append(ret.Properties, &pb.Platform_Property{Name: "cpu_limit", Value: strconv.Itoa(target.CPULimit)})
+	}
+	if target.MemoryLimit > 0 {
+		ret.Properties = append(ret.Properties, &pb.Platform_Property{Name: "memory_limit", Value: strconv.FormatUint(target.MemoryLimit, 10)})
+	}
+	// The API requires properties to be sorted by name.
+	sort.SliceStable(ret.Properties, func(i, j int) bool { return ret.Properties[i].Name < ret.Properties[j].Name })
+	return ret
+}
+
+// addSecrets returns a copy of the given platform with a property listing the secrets that the
+// target needs injected, if it needs any. The workers are responsible for injecting them.
+func addSecrets(platform *pb.Platform, target *core.BuildTarget) *pb.Platform {
+	secrets := target.InjectedSecrets()
+	if len(secrets) == 0 {
+		return platform
+	}
+	sort.Strings(secrets)
+	ret := &pb.Platform{Properties: append([]*pb.Platform_Property{}, platform.Properties...)}
+	ret.Properties = append(ret.Properties, &pb.Platform_Property{Name: "secrets", Value: strings.Join(secrets, ",")})
+	sort.SliceStable(ret.Properties, func(i, j int) bool { return ret.Properties[i].Name < ret.Properties[j].Name })
+	return ret
+}
+
 // removeOutputs removes all outputs for a target.
 func removeOutputs(target *core.BuildTarget) error {
 	outDir := target.OutDir()
@@ -418,30 +561,67 @@ func removeOutputs(target *core.BuildTarget) error {
 	return nil
 }
 
-// subresourceIntegrity returns a string corresponding to a target's hashes in the Subresource Integrity format.
-func subresourceIntegrity(target *core.BuildTarget) string {
-	ret := make([]string, len(target.Hashes))
-	for i, h := range target.Hashes {
-		ret[i] = reencodeSRI(target, h)
+// createOutputSymlink creates a single output symlink from an action result in the target's output directory.
+func createOutputSymlink(target *core.BuildTarget, s *pb.OutputSymlink) error {
+	filename := path.Join(target.OutDir(), s.Path)
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	} else if err := os.RemoveAll(filename); err != nil {
+		return err
 	}
-	return strings.Join(ret, " ")
+	return os.Symlink(localSymlinkTarget(target, s), filename)
 }
 
-// reencodeSRI re-encodes a hash from the hex format we use to base64-encoded.
-func reencodeSRI(target *core.BuildTarget, h string) string {
-	if idx := strings.LastIndexByte(h, ':'); idx != -1 {
-		h = h[idx+1:]
+// localSymlinkTarget returns the target for an output symlink once it's downloaded to the target's
+// output directory.
+// Links to other outputs of the same action are fine as they are, but remotely the outputs are
+// alongside the action's inputs so relative links to those must be rewritten to point to
+// wherever the input is locally (either a source file or another target's output).
+func localSymlinkTarget(target *core.BuildTarget, s *pb.OutputSymlink) string {
+	if path.IsAbs(s.Target) {
+		return s.Target // Nothing we can do about these.
 	}
-	// TODO(peterebden): we should validate at parse time that these are sensible.
-	b, _ := hex.DecodeString(h)
-	h = base64.StdEncoding.EncodeToString(b)
-	if len(b) == sha256.Size {
-		return "sha256-" + h
-	} else if len(b) == sha1.Size {
-		return "sha1-" + h
+	dest := path.Join(path.Dir(s.Path), s.Target)
+	if dest == ".." || strings.HasPrefix(dest, "../") {
+		log.Warning("Output symlink %s of %s points outside its build root (to %s)", s.Path, target, s.Target)
+		return s.Target
 	}
-	log.Warning("Hash string of unknown type on %s: %s", target, h)
-	return h
+	for _, out := range target.Outputs() {
+		if dest == out || strings.HasPrefix(dest, out+"/") {
+			return s.Target
+		}
+	}
+	rel, err := filepath.Rel(path.Dir(path.Join(target.OutDir(), s.Path)), localInputPath(target, dest))
+	if err != nil {
+		return s.Target
+	}
+	return rel
+}
+
+// localInputPath returns the local path corresponding to a path within the target's inputs.
+// If it's one of the outputs of its dependencies it is in plz-out, otherwise it must be a source file.
+func localInputPath(target *core.BuildTarget, p string) string {
+	for _, dep := range target.Dependencies() {
+		for _, out := range dep.Outputs() {
+			if out = path.Join(dep.Label.PackageName, out); p == out || strings.HasPrefix(p, out+"/") {
+				return path.Join(dep.OutDir(), strings.TrimPrefix(p, dep.Label.PackageName+"/"))
+			}
+		}
+	}
+	return p
+}
+
+// subresourceIntegrity returns a string corresponding to a target's hashes in the Subresource Integrity format.
+func subresourceIntegrity(target *core.BuildTarget) string {
+	hashes := target.ExpectedHashes()
+	ret := make([]string, len(hashes))
+	for i, h := range hashes {
+		if h.Algorithm == "" {
+			log.Warning("Hash string of unknown type on %s: %s", target, h)
+		}
+		ret[i] = h.SRI()
+	}
+	return strings.Join(ret, " ")
 }
 
 // updateHashFilename updates an output filename for a hash_filegroup.
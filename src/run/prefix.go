@@ -0,0 +1,80 @@
+package run
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixColours are the colours we cycle through for each target's prefix.
+var prefixColours = []string{
+	"\x1b[32m", // green
+	"\x1b[33m", // yellow
+	"\x1b[34m", // blue
+	"\x1b[35m", // magenta
+	"\x1b[36m", // cyan
+	"\x1b[31m", // red
+}
+
+const resetColour = "\x1b[0m"
+
+// A prefixWriter writes complete lines to an underlying writer, each prefixed with a label
+// identifying where it came from. It's used to multiplex the output of several processes
+// onto the same stream without interleaving partial lines.
+type prefixWriter struct {
+	w      io.Writer
+	mutex  *sync.Mutex
+	prefix []byte
+	buf    []byte
+}
+
+// newPrefixWriter returns a new prefixWriter writing to the given writer.
+// The mutex should be shared between all writers to the same underlying stream.
+// If colour is true the prefix is coloured; idx selects which colour to use.
+func newPrefixWriter(w io.Writer, mutex *sync.Mutex, label string, idx int, colour bool) *prefixWriter {
+	prefix := label + " | "
+	if colour {
+		prefix = prefixColours[idx%len(prefixColours)] + label + resetColour + " | "
+	}
+	return &prefixWriter{w: w, mutex: mutex, prefix: []byte(prefix)}
+}
+
+// Write implements the io.Writer interface.
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.buf = append(pw.buf, b...)
+	idx := bytes.LastIndexByte(pw.buf, '\n')
+	if idx == -1 {
+		return len(b), nil
+	}
+	lines := pw.buf[:idx+1]
+	if err := pw.write(lines); err != nil {
+		return 0, err
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[idx+1:]...)
+	return len(b), nil
+}
+
+// Flush writes out any partial line that remains in the buffer.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	err := pw.write(append(pw.buf, '\n'))
+	pw.buf = pw.buf[:0]
+	return err
+}
+
+// write writes the given complete lines, each with the prefix.
+func (pw *prefixWriter) write(lines []byte) error {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte{'\n'}) {
+		if len(line) > 0 {
+			out.Write(pw.prefix)
+			out.Write(line)
+		}
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	_, err := pw.w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,29 @@
+package run
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	w := newPrefixWriter(&buf, &mutex, "//:a", 0, false)
+	w.Write([]byte("hello\nwor"))
+	assert.Equal(t, "//:a | hello\n", buf.String())
+	w.Write([]byte("ld\nsecond\nthi"))
+	assert.Equal(t, "//:a | hello\n//:a | world\n//:a | second\n", buf.String())
+	w.Flush()
+	assert.Equal(t, "//:a | hello\n//:a | world\n//:a | second\n//:a | thi\n", buf.String())
+}
+
+func TestPrefixWriterColour(t *testing.T) {
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	w := newPrefixWriter(&buf, &mutex, "//:b", 1, true)
+	w.Write([]byte("hello\n"))
+	assert.Equal(t, "\x1b[33m//:b\x1b[0m | hello\n", buf.String())
+}
@@ -4,16 +4,18 @@ package run
 import (
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"gopkg.in/op/go-logging.v1"
 
+	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
 	"github.com/thought-machine/please/src/output"
 	"github.com/thought-machine/please/src/process"
@@ -23,31 +25,65 @@ var log = logging.MustGetLogger("run")
 
 // Run implements the running part of 'plz run'.
 func Run(state *core.BuildState, label core.BuildLabel, args []string, env bool) {
-	run(context.Background(), state, label, args, false, false, env, false)
+	run(context.Background(), state, label, args, false, false, env, false, nil, nil)
 }
 
 // Parallel runs a series of targets in parallel.
 // Returns a relevant exit code (i.e. if at least one subprocess exited unsuccessfully, it will be
-// that code, otherwise 0 if all were successful).
+// the code of the first such target in the order given, otherwise 0 if all were successful).
+// When running more than one target, each line of their output is prefixed with the target that
+// produced it so they can be told apart.
 // The given context can be used to control the lifetime of the subprocesses.
 func Parallel(ctx context.Context, state *core.BuildState, labels []core.BuildLabel, args []string, numTasks int, quiet, env, detach bool) int {
 	limiter := make(chan struct{}, numTasks)
-	var g errgroup.Group
+	errs := make([]error, len(labels))
+	multiplex := len(labels) > 1 && !quiet && !detach
+	width := 0
 	for _, label := range labels {
-		label := label // capture locally
-		g.Go(func() error {
+		if len(label.String()) > width {
+			width = len(label.String())
+		}
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(labels))
+	for i, label := range labels {
+		i, label := i, label // capture locally
+		go func() {
+			defer wg.Done()
 			limiter <- struct{}{}
 			defer func() { <-limiter }()
-			return run(ctx, state, label, args, true, quiet, env, detach)
-		})
+			if !multiplex {
+				errs[i] = run(ctx, state, label, args, true, quiet, env, detach, nil, nil)
+				return
+			}
+			prefix := fmt.Sprintf("%-*s", width, label)
+			stdout := newPrefixWriter(os.Stdout, &mutex, prefix, i, cli.StdOutIsATerminal)
+			stderr := newPrefixWriter(os.Stderr, &mutex, prefix, i, cli.StdErrIsATerminal)
+			errs[i] = run(ctx, state, label, args, true, quiet, env, detach, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+		}()
 	}
-	if err := g.Wait(); err != nil {
+	wg.Wait()
+	code := 0
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
 		if ctx.Err() != context.Canceled { // Don't error if the context killed the process.
-			log.Error("Command failed: %s", err)
+			log.Error("%s failed: %s", labels[i], err)
+		}
+		if code == 0 {
+			code = err.(*exitError).code
 		}
-		return err.(*exitError).code
+		failed++
 	}
-	return 0
+	if failed > 0 && len(labels) > 1 && ctx.Err() != context.Canceled {
+		log.Error("%d of %d targets failed", failed, len(labels))
+	}
+	return code
 }
 
 // Sequential runs a series of targets sequentially.
@@ -56,7 +92,7 @@ func Parallel(ctx context.Context, state *core.BuildState, labels []core.BuildLa
 func Sequential(state *core.BuildState, labels []core.BuildLabel, args []string, quiet, env bool) int {
 	for _, label := range labels {
 		log.Notice("Running %s", label)
-		if err := run(context.Background(), state, label, args, true, quiet, env, false); err != nil {
+		if err := run(context.Background(), state, label, args, true, quiet, env, false, nil, nil); err != nil {
 			log.Error("%s", err)
 			return err.(*exitError).code
 		}
@@ -68,7 +104,8 @@ func Sequential(state *core.BuildState, labels []core.BuildLabel, args []string,
 // If fork is true then we fork to run the target and return any error from the subprocesses.
 // If it's false this function never returns (because we either win or die; it's like
 // Game of Thrones except rather less glamorous).
-func run(ctx context.Context, state *core.BuildState, label core.BuildLabel, args []string, fork, quiet, setenv, detach bool) error {
+// If stdout and stderr are given, the forked process' output is written to them.
+func run(ctx context.Context, state *core.BuildState, label core.BuildLabel, args []string, fork, quiet, setenv, detach bool, stdout, stderr io.Writer) error {
 	target := state.Graph.TargetOrDie(label)
 	if !target.IsBinary {
 		log.Fatalf("Target %s cannot be run; it's not marked as binary", label)
@@ -108,7 +145,12 @@ func run(ctx context.Context, state *core.BuildState, label core.BuildLabel, arg
 	// Note that we don't connect stdin. It doesn't make sense for multiple processes.
 	// The process executor doesn't actually support not having a timeout, but the max is ~290 years so nobody
 	// should know the difference.
-	_, output, err := process.New("").ExecWithTimeout(target, "", env, time.Duration(math.MaxInt64), false, false, !quiet, args)
+	if stdout != nil {
+		// The output has already been written to the given writers, so there's no need to repeat it in the error.
+		_, _, err := process.New("", "").ExecWithOutput(unlimitedTarget{target}, "", env, time.Duration(math.MaxInt64), stdout, stderr, args)
+		return toExitError(err, args, nil)
+	}
+	_, output, err := process.New("", "").ExecWithTimeout(unlimitedTarget{target}, "", env, time.Duration(math.MaxInt64), false, false, !quiet, args)
 	return toExitError(err, args, output)
 }
 
@@ -168,6 +210,15 @@ func toExitError(err error, cmd []string, out []byte) error {
 	}
 }
 
+// unlimitedTarget wraps a target to ignore its resource limits; they apply to building it, not to running it.
+type unlimitedTarget struct {
+	*core.BuildTarget
+}
+
+func (t unlimitedTarget) ResourceLimits() (int, uint64) {
+	return 0, 0
+}
+
 type exitError struct {
 	msg  string
 	code int
@@ -129,8 +129,11 @@ func (g *git) Remove(names []string) error {
 	return nil
 }
 
-func (g *git) ChangedLines() (map[string][]int, error) {
-	cmd := exec.Command("git", "diff", "origin/master", "--unified=0", "--no-color", "--no-ext-diff")
+func (g *git) ChangedLines(since string) (map[string][]int, error) {
+	if since == "" {
+		since = "origin/master"
+	}
+	cmd := exec.Command("git", "diff", since, "--unified=0", "--no-color", "--no-ext-diff")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("git diff failed: %s", err)
@@ -142,7 +145,9 @@ func (g *git) parseChangedLines(input []byte) (map[string][]int, error) {
 	m := map[string][]int{}
 	fds, err := diff.ParseMultiFileDiff(input)
 	for _, fd := range fds {
-		m[strings.TrimPrefix(fd.NewName, "b/")] = g.parseHunks(fd.Hunks)
+		if fd.NewName != "/dev/null" { // Deleted files don't have any lines left to consider.
+			m[strings.TrimPrefix(fd.NewName, "b/")] = g.parseHunks(fd.Hunks)
+		}
 	}
 	return m, err
 }
@@ -22,3 +22,18 @@ func TestParseChangedLines(t *testing.T) {
 		"tools/please_pex/behave.py":                                          {2, 3, 10, 11, 12, 13, 14, 15, 16, 17, 24, 25, 26, 27, 28, 29, 30, 31, 32},
 	}, m)
 }
+
+func TestParseChangedLinesDeletedFile(t *testing.T) {
+	g := git{}
+	m, err := g.parseChangedLines([]byte(`diff --git a/src/gone.go b/src/gone.go
+deleted file mode 100644
+index 3b18e51..0000000
+--- a/src/gone.go
++++ /dev/null
+@@ -1,2 +0,0 @@
+-package gone
+-
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{}, m)
+}
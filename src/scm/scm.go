@@ -26,9 +26,10 @@ type SCM interface {
 	IgnoreFile(name string) error
 	// Remove deletes the given files from the SCM.
 	Remove(names []string) error
-	// ChangedLines returns the set of lines that have been modified,
-	// as a map of filename -> affected line numbers.
-	ChangedLines() (map[string][]int, error)
+	// ChangedLines returns the set of lines that have been modified since the given revision,
+	// as a map of filename -> affected line numbers. If the revision is empty it defaults to
+	// the main branch of the upstream repo.
+	ChangedLines(since string) (map[string][]int, error)
 	// Checkout checks out the given revision.
 	Checkout(revision string) error
 	// CurrentRevDate returns the commit date of the current revision, formatted according to the given format string.
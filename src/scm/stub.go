@@ -28,7 +28,7 @@ func (s *stub) Remove(names []string) error {
 	return fmt.Errorf("Unknown SCM, can't remove files")
 }
 
-func (s *stub) ChangedLines() (map[string][]int, error) {
+func (s *stub) ChangedLines(since string) (map[string][]int, error) {
 	return nil, fmt.Errorf("Unknown SCM, can't calculate changed lines")
 }
 
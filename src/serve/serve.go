@@ -0,0 +1,168 @@
+// +build !bootstrap
+
+// Package serve implements a gRPC service that answers queries about the build graph.
+// This lets external tools (e.g. IDE plugins) query a long-running plz process instead of
+// re-running plz query and re-parsing the repo every time.
+package serve
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/query"
+	pb "github.com/thought-machine/please/src/serve/proto/graph"
+)
+
+var log = logging.MustGetLogger("serve")
+
+// Serve serves the graph of the given state over gRPC on the given host & port.
+// It blocks until the server stops.
+func Serve(state *core.BuildState, host string, port int) error {
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	log.Notice("Serving build graph over gRPC on %s", lis.Addr())
+	return newServer(state).Serve(lis)
+}
+
+// newServer creates a new gRPC server with the graph service registered.
+func newServer(state *core.BuildState) *grpc.Server {
+	s := grpc.NewServer()
+	pb.RegisterGraphServer(s, &graphServer{state: state})
+	return s
+}
+
+// A graphServer implements the Graph service.
+// The graph isn't modified once parsing is complete, so it needs no locking of its own.
+type graphServer struct {
+	state *core.BuildState
+}
+
+// Targets implements the RPC interface.
+func (g *graphServer) Targets(ctx context.Context, r *pb.TargetsRequest) (*pb.TargetsResponse, error) {
+	labels, err := g.parseLabels(r.Labels)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.TargetsResponse{Targets: make([]*pb.Target, len(labels))}
+	for i, label := range labels {
+		resp.Targets[i] = toProtoTarget(g.state.Graph, g.state.Graph.Target(label))
+	}
+	return resp, nil
+}
+
+// ReverseDependencies implements the RPC interface.
+func (g *graphServer) ReverseDependencies(ctx context.Context, r *pb.ReverseDependenciesRequest) (*pb.ReverseDependenciesResponse, error) {
+	labels, err := g.parseLabels(r.Labels)
+	if err != nil {
+		return nil, err
+	}
+	level := int(r.Level)
+	if level <= 0 {
+		level = -1
+	}
+	return &pb.ReverseDependenciesResponse{
+		Labels: labelStrings(query.ReverseDepLabels(g.state, labels, level, r.Hidden)),
+	}, nil
+}
+
+// Owners implements the RPC interface.
+func (g *graphServer) Owners(ctx context.Context, r *pb.OwnersRequest) (*pb.OwnersResponse, error) {
+	resp := &pb.OwnersResponse{Owners: make([]*pb.Owner, len(r.Files))}
+	for i, file := range r.Files {
+		resp.Owners[i] = &pb.Owner{
+			File:   file,
+			Labels: labelStrings(query.WhatInputLabels(g.state.Graph, file, r.Hidden)),
+		}
+	}
+	return resp, nil
+}
+
+// Packages implements the RPC interface.
+func (g *graphServer) Packages(ctx context.Context, r *pb.PackagesRequest) (*pb.PackagesResponse, error) {
+	prefix := strings.Trim(path.Clean(r.Prefix), "/")
+	if prefix == "." {
+		prefix = ""
+	}
+	resp := &pb.PackagesResponse{RepoRoot: core.RepoRoot}
+	for _, pkg := range g.state.Graph.PackageMap() {
+		if prefix != "" && pkg.Name != prefix && !strings.HasPrefix(pkg.Name, prefix+"/") {
+			continue
+		}
+		targets := pkg.AllTargets()
+		labels := make(core.BuildLabels, len(targets))
+		for i, target := range targets {
+			labels[i] = target.Label
+		}
+		sort.Sort(labels)
+		resp.Packages = append(resp.Packages, &pb.Package{
+			Name:     pkg.Name,
+			Filename: pkg.Filename,
+			Targets:  labelStrings(labels),
+		})
+	}
+	sort.Slice(resp.Packages, func(i, j int) bool { return resp.Packages[i].Name < resp.Packages[j].Name })
+	return resp, nil
+}
+
+// parseLabels parses a set of build labels from a request, expands any pseudo-labels and checks that they all exist.
+func (g *graphServer) parseLabels(labels []string) (core.BuildLabels, error) {
+	ret := make([]core.BuildLabel, len(labels))
+	for i, l := range labels {
+		label, err := core.TryParseBuildLabel(l, "", "")
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+		}
+		ret[i] = label
+	}
+	expanded := g.state.ExpandLabels(ret)
+	for _, label := range expanded {
+		if g.state.Graph.Target(label) == nil {
+			return nil, status.Errorf(codes.NotFound, "Unknown target %s", label)
+		}
+	}
+	return expanded, nil
+}
+
+// toProtoTarget converts a build target to its proto representation.
+func toProtoTarget(graph *core.BuildGraph, target *core.BuildTarget) *pb.Target {
+	sources := []string{}
+	for _, src := range target.AllSources() {
+		if src.Label() == nil {
+			sources = append(sources, src.Paths(graph)...) // Plain files are given relative to the repo root.
+		} else {
+			sources = append(sources, src.String())
+		}
+	}
+	return &pb.Target{
+		Label:        target.Label.String(),
+		Labels:       target.Labels,
+		Dependencies: labelStrings(target.DeclaredDependencies()),
+		Sources:      sources,
+		Outputs:      target.Outputs(),
+		Visibility:   labelStrings(target.Visibility),
+		Binary:       target.IsBinary,
+		Test:         target.IsTest,
+		Filegroup:    target.IsFilegroup,
+	}
+}
+
+// labelStrings converts a set of build labels to strings.
+func labelStrings(labels []core.BuildLabel) []string {
+	ret := make([]string, len(labels))
+	for i, l := range labels {
+		ret[i] = l.String()
+	}
+	return ret
+}
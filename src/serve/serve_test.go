@@ -0,0 +1,135 @@
+package serve
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/core"
+	pb "github.com/thought-machine/please/src/serve/proto/graph"
+)
+
+func TestTargets(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	resp, err := client.Targets(context.Background(), &pb.TargetsRequest{Labels: []string{"//package:branch"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Targets))
+	target := resp.Targets[0]
+	assert.Equal(t, "//package:branch", target.Label)
+	assert.Equal(t, []string{"//package:root"}, target.Dependencies)
+	assert.Equal(t, []string{"package/branch.go"}, target.Sources)
+	assert.Equal(t, []string{"branch.a"}, target.Outputs)
+	assert.Equal(t, []string{"go"}, target.Labels)
+	assert.False(t, target.Test)
+}
+
+func TestTargetsPseudoLabel(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	resp, err := client.Targets(context.Background(), &pb.TargetsRequest{Labels: []string{"//package:all"}})
+	require.NoError(t, err)
+	labels := []string{}
+	for _, target := range resp.Targets {
+		labels = append(labels, target.Label)
+	}
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:root"}, labels)
+}
+
+func TestTargetsErrors(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	_, err := client.Targets(context.Background(), &pb.TargetsRequest{Labels: []string{"//package:wibble"}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Targets(context.Background(), &pb.TargetsRequest{Labels: []string{"package:wibble"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestReverseDependencies(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	resp, err := client.ReverseDependencies(context.Background(), &pb.ReverseDependenciesRequest{Labels: []string{"//package:root"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"//package:branch", "//package:leaf"}, resp.Labels)
+	resp, err = client.ReverseDependencies(context.Background(), &pb.ReverseDependenciesRequest{Labels: []string{"//package:root"}, Level: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"//package:branch"}, resp.Labels)
+}
+
+func TestOwners(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	resp, err := client.Owners(context.Background(), &pb.OwnersRequest{Files: []string{"package/branch.go", "package/wibble.go"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(resp.Owners))
+	assert.Equal(t, "package/branch.go", resp.Owners[0].File)
+	assert.Equal(t, []string{"//package:branch"}, resp.Owners[0].Labels)
+	assert.Equal(t, "package/wibble.go", resp.Owners[1].File)
+	assert.Equal(t, 0, len(resp.Owners[1].Labels))
+}
+
+func TestPackages(t *testing.T) {
+	client, shutdown := newClient(t)
+	defer shutdown()
+	resp, err := client.Packages(context.Background(), &pb.PackagesRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(resp.Packages))
+	assert.Equal(t, core.RepoRoot, resp.RepoRoot)
+	assert.Equal(t, "package", resp.Packages[0].Name)
+	assert.Equal(t, "package/BUILD", resp.Packages[0].Filename)
+	assert.Equal(t, []string{"//package:branch", "//package:leaf", "//package:root"}, resp.Packages[0].Targets)
+	assert.Equal(t, "package/sub", resp.Packages[1].Name)
+
+	resp, err = client.Packages(context.Background(), &pb.PackagesRequest{Prefix: "package/sub"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Packages))
+	assert.Equal(t, "package/sub", resp.Packages[0].Name)
+}
+
+// newClient starts a server on a test graph and returns a client connected to it,
+// along with a function to shut it down again.
+func newClient(t *testing.T) (pb.GraphClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := newServer(newState())
+	go s.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return pb.NewGraphClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func newState() *core.BuildState {
+	state := core.NewDefaultBuildState()
+	graph := state.Graph
+	root := core.NewBuildTarget(core.ParseBuildLabel("//package:root", ""))
+	branch := core.NewBuildTarget(core.ParseBuildLabel("//package:branch", ""))
+	leaf := core.NewBuildTarget(core.ParseBuildLabel("//package:leaf", ""))
+	branch.AddSource(core.FileLabel{File: "branch.go", Package: "package"})
+	branch.AddOutput("branch.a")
+	branch.AddLabel("go")
+	branch.AddDependency(root.Label)
+	leaf.AddDependency(branch.Label)
+	graph.AddTarget(root)
+	graph.AddTarget(branch)
+	graph.AddTarget(leaf)
+	graph.AddDependency(branch.Label, root.Label)
+	graph.AddDependency(leaf.Label, branch.Label)
+
+	pkg := core.NewPackage("package")
+	pkg.Filename = "package/BUILD"
+	pkg.AddTarget(root)
+	pkg.AddTarget(branch)
+	pkg.AddTarget(leaf)
+	graph.AddPackage(pkg)
+	graph.AddPackage(core.NewPackage("package/sub"))
+	return state
+}
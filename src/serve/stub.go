@@ -0,0 +1,16 @@
+// +build bootstrap
+
+// Package serve implements a gRPC service that answers queries about the build graph.
+// This file is a stub used only for initial bootstrap.
+package serve
+
+import (
+	"fmt"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Serve is a stub that always returns an error.
+func Serve(state *core.BuildState, host string, port int) error {
+	return fmt.Errorf("Not supported during initial bootstrap")
+}
@@ -254,6 +254,8 @@ type IncrementalStats struct {
 	ModifiedLines int     `json:"modified_lines"`
 	CoveredLines  int     `json:"covered_lines"`
 	Percentage    float32 `json:"percentage"`
+	// The modified lines in each file that weren't covered.
+	UncoveredLines map[string][]int `json:"uncovered_lines,omitempty"`
 }
 
 // RemoveFilesFromCoverage removes any files with extensions matching the given set from coverage.
@@ -280,7 +282,7 @@ func CalculateIncrementalStats(state *core.BuildState, lines map[string][]int) *
 }
 
 func calculateIncrementalStats(state *core.BuildState, coverage core.TestCoverage, lines map[string][]int, files map[string]bool) *IncrementalStats {
-	stats := &IncrementalStats{}
+	stats := &IncrementalStats{UncoveredLines: map[string][]int{}}
 	for file, lines := range lines {
 		// Include all files except those explicitly marked as test targets.
 		if include, present := files[file]; include || !present {
@@ -295,12 +297,14 @@ func calculateIncrementalStats(state *core.BuildState, coverage core.TestCoverag
 								stats.CoveredLines++
 							} else if c == core.Uncovered || c == core.Unreachable {
 								stats.ModifiedLines++
+								stats.UncoveredLines[file] = append(stats.UncoveredLines[file], line)
 							} // Non-executable lines don't count here.
 						}
 					}
 				} else {
 					// Don't know anything about it, assume all lines are uncovered.
 					stats.ModifiedLines += len(lines)
+					stats.UncoveredLines[file] = append(stats.UncoveredLines[file], lines...)
 				}
 			}
 		}
@@ -243,6 +243,7 @@ func TestIncrementalStats(t *testing.T) {
 	assert.Equal(t, 2, stats.ModifiedLines)
 	assert.Equal(t, 1, stats.CoveredLines)
 	assert.EqualValues(t, 50.0, stats.Percentage)
+	assert.Equal(t, map[string][]int{"src/test/coverage.go": {2}}, stats.UncoveredLines)
 }
 
 func TestGetDirectoryCoverage(t *testing.T) {
@@ -265,3 +266,27 @@ func TestGetDirectoryCoverage(t *testing.T) {
 	}
 	assert.Equal(t, expectedDirCoverage, dirCoverage)
 }
+
+func TestHTMLCoverageReport(t *testing.T) {
+	report := buildHTMLReport(core.TestCoverage{
+		Files: map[string][]core.LineCoverage{
+			goCoverageFile:      {core.NotExecutable, core.Covered, core.Uncovered},
+			"my/dir1/file_1.go": {core.Uncovered, core.Covered},
+			"my/dir1/file_2.go": {core.NotExecutable},
+		},
+	})
+	assert.EqualValues(t, 50.0, report.Percentage)
+	assert.Equal(t, 2, len(report.Packages))
+	assert.Equal(t, "my/dir1", report.Packages[0].Name)
+	assert.Equal(t, 1, len(report.Packages[0].Files)) // file_2 has nothing coverable in it
+	assert.Equal(t, "src/test/test_data", report.Packages[1].Name)
+
+	lines := report.Packages[1].Files[0].Lines
+	assert.Equal(t, 360, len(lines))
+	assert.Equal(t, htmlLine{Number: 1, Text: "mode: set"}, lines[0])
+	assert.Equal(t, "covered", lines[1].Class)
+	assert.Equal(t, "uncovered", lines[2].Class)
+	assert.Equal(t, "", lines[3].Class)
+	// This doesn't exist so we shouldn't have any text for it.
+	assert.Equal(t, htmlLine{Number: 1, Class: "uncovered"}, report.Packages[0].Files[0].Lines[0])
+}
@@ -0,0 +1,235 @@
+// Code for recording the results of each test run, and analysing them afterwards to
+// find tests that are flaky.
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A HistoryRecord records the outcome of a single test case in a single run of a test target.
+type HistoryRecord struct {
+	Label     string        `json:"label"`
+	Hash      string        `json:"hash"`
+	Test      string        `json:"test"`
+	Passes    int           `json:"passes,omitempty"`
+	Failures  int           `json:"failures,omitempty"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// A Flake describes a test case that has both passed and failed for identical inputs.
+type Flake struct {
+	Label    string
+	Test     string
+	Runs     int // Total number of runs of this test case
+	Failures int // Number of those runs that failed
+	Hashes   int // Number of distinct input hashes for which the test both passed and failed
+}
+
+// historyMutex guards against concurrent writes to the local history file.
+var historyMutex sync.Mutex
+
+// recordHistory records the results of the given target's last test run in the history store,
+// if one is configured. The hash identifies the inputs to the test.
+func recordHistory(state *core.BuildState, target *core.BuildTarget, hash []byte) {
+	if state.Config.Test.HistoryFile == "" && state.Config.Test.HistoryURL == "" {
+		return
+	} else if hash == nil && state.TargetHasher != nil {
+		// Remotely executed tests don't have a runtime hash calculated locally. The output hash
+		// of the test target is the next best thing.
+		h, err := state.TargetHasher.OutputHash(target)
+		if err != nil {
+			log.Warning("Failed to calculate hash of %s for test history: %s", target, err)
+			return
+		}
+		hash = h
+	}
+	b := serialiseHistory(historyRecords(target, hash))
+	if state.Config.Test.HistoryFile != "" {
+		if err := appendHistory(state.Config.Test.HistoryFile, b); err != nil {
+			log.Warning("Failed to record test history: %s", err)
+		}
+	}
+	if state.Config.Test.HistoryURL != "" {
+		if err := uploadHistory(historyClient(state.Config), state.Config.Test.HistoryURL.String(), b); err != nil {
+			log.Warning("Failed to upload test history: %s", err)
+		}
+	}
+}
+
+// historyRecords converts the results of a target into records for the history store.
+func historyRecords(target *core.BuildTarget, hash []byte) []HistoryRecord {
+	records := make([]HistoryRecord, 0, len(target.Results.TestCases))
+	h := hex.EncodeToString(hash)
+	timestamp := time.Now()
+	for _, testCase := range target.Results.TestCases {
+		record := HistoryRecord{
+			Label:     target.Label.String(),
+			Hash:      h,
+			Test:      testCaseName(testCase),
+			Failures:  len(testCase.Failures()) + len(testCase.Errors()),
+			Timestamp: timestamp,
+		}
+		if success := testCase.Success(); success != nil {
+			record.Passes = 1
+			if success.Duration != nil {
+				record.Duration = *success.Duration
+			}
+		} else if record.Failures == 0 {
+			continue // Must have been skipped, there's nothing useful to record.
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func testCaseName(testCase core.TestCase) string {
+	if testCase.ClassName != "" {
+		return testCase.ClassName + "." + testCase.Name
+	}
+	return testCase.Name
+}
+
+// serialiseHistory serialises a set of records, one JSON object per line.
+func serialiseHistory(records []HistoryRecord) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, record := range records {
+		enc.Encode(record) // Can't fail, there's nothing in a record that isn't serialisable.
+	}
+	return b.Bytes()
+}
+
+// appendHistory appends some serialised records to the given file.
+func appendHistory(filename string, b []byte) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// historyClient returns the HTTP client to use to communicate with the history server.
+func historyClient(config *core.Configuration) *http.Client {
+	return &http.Client{Timeout: time.Duration(config.Test.HistoryTimeout)}
+}
+
+// uploadHistory uploads some serialised records to a remote server.
+func uploadHistory(client *http.Client, url string, b []byte) error {
+	resp, err := client.Post(url, "application/x-ndjson", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Error from remote server: %s", resp.Status)
+	}
+	return nil
+}
+
+// ReadHistory reads all the records from the configured history store.
+func ReadHistory(config *core.Configuration) ([]HistoryRecord, error) {
+	if config.Test.HistoryURL != "" {
+		resp, err := historyClient(config).Get(config.Test.HistoryURL.String())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("Error from remote server: %s", resp.Status)
+		}
+		return parseHistory(resp.Body)
+	} else if config.Test.HistoryFile != "" {
+		f, err := os.Open(config.Test.HistoryFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseHistory(f)
+	}
+	return nil, fmt.Errorf("No test history store configured; set historyfile or historyurl in the [test] section of your config")
+}
+
+// parseHistory parses a series of records, one per line.
+func parseHistory(r io.Reader) ([]HistoryRecord, error) {
+	records := []HistoryRecord{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("Invalid test history record: %s", err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// FindFlakes identifies tests whose outcomes differ between runs with identical inputs.
+// They're returned sorted with the most frequently flipping ones first.
+func FindFlakes(records []HistoryRecord) []Flake {
+	type key struct{ Label, Test string }
+	type outcomes struct{ Passes, Failures int }
+	tests := map[key]map[string]*outcomes{}
+	for _, record := range records {
+		k := key{Label: record.Label, Test: record.Test}
+		hashes, present := tests[k]
+		if !present {
+			hashes = map[string]*outcomes{}
+			tests[k] = hashes
+		}
+		o, present := hashes[record.Hash]
+		if !present {
+			o = &outcomes{}
+			hashes[record.Hash] = o
+		}
+		o.Passes += record.Passes
+		o.Failures += record.Failures
+	}
+	flakes := []Flake{}
+	for k, hashes := range tests {
+		flake := Flake{Label: k.Label, Test: k.Test}
+		for _, o := range hashes {
+			flake.Runs += o.Passes + o.Failures
+			flake.Failures += o.Failures
+			if o.Passes > 0 && o.Failures > 0 {
+				flake.Hashes++
+			}
+		}
+		if flake.Hashes > 0 {
+			flakes = append(flakes, flake)
+		}
+	}
+	sort.Slice(flakes, func(i, j int) bool {
+		if flakes[i].Hashes != flakes[j].Hashes {
+			return flakes[i].Hashes > flakes[j].Hashes
+		} else if flakes[i].Label != flakes[j].Label {
+			return flakes[i].Label < flakes[j].Label
+		}
+		return flakes[i].Test < flakes[j].Test
+	})
+	return flakes
+}
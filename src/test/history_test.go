@@ -0,0 +1,78 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestHistoryRecords(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:history_test", ""))
+	d := 2 * time.Second
+	target.Results.TestCases = core.TestCases{
+		{ClassName: "HistoryTest", Name: "TestPass", Executions: []core.TestExecution{{Duration: &d}}},
+		{Name: "TestFlaky", Executions: []core.TestExecution{
+			{Failure: &core.TestResultFailure{Message: "nope"}},
+			{},
+		}},
+		{Name: "TestSkip", Executions: []core.TestExecution{{Skip: &core.TestResultSkip{}}}},
+	}
+	records := historyRecords(target, []byte{0xab, 0xcd})
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "//src/test:history_test", records[0].Label)
+	assert.Equal(t, "abcd", records[0].Hash)
+	assert.Equal(t, "HistoryTest.TestPass", records[0].Test)
+	assert.Equal(t, 1, records[0].Passes)
+	assert.Equal(t, d, records[0].Duration)
+	assert.Equal(t, "TestFlaky", records[1].Test)
+	assert.Equal(t, 1, records[1].Passes)
+	assert.Equal(t, 1, records[1].Failures)
+
+	// Check they survive a round trip.
+	parsed, err := parseHistory(bytes.NewReader(serialiseHistory(records)))
+	assert.NoError(t, err)
+	assert.Equal(t, len(records), len(parsed))
+	assert.Equal(t, records[1].Test, parsed[1].Test)
+	assert.Equal(t, records[1].Failures, parsed[1].Failures)
+}
+
+func TestFindFlakes(t *testing.T) {
+	records := []HistoryRecord{
+		// Always passes
+		{Label: "//a:a", Hash: "1", Test: "TestA", Passes: 1},
+		{Label: "//a:a", Hash: "1", Test: "TestA", Passes: 1},
+		// Fails on one hash, passes on another; that's not flaky, something changed.
+		{Label: "//a:a", Hash: "1", Test: "TestB", Failures: 1},
+		{Label: "//a:a", Hash: "2", Test: "TestB", Passes: 1},
+		// Flips on the same hash across runs
+		{Label: "//b:b", Hash: "1", Test: "TestC", Passes: 1},
+		{Label: "//b:b", Hash: "1", Test: "TestC", Failures: 1},
+		{Label: "//b:b", Hash: "2", Test: "TestC", Passes: 1},
+		{Label: "//b:b", Hash: "2", Test: "TestC", Failures: 1},
+		// Flips within a single run
+		{Label: "//c:c", Hash: "1", Test: "TestD", Passes: 1, Failures: 2},
+	}
+	assert.Equal(t, []Flake{
+		{Label: "//b:b", Test: "TestC", Runs: 4, Failures: 2, Hashes: 2},
+		{Label: "//c:c", Test: "TestD", Runs: 3, Failures: 2, Hashes: 1},
+	}, FindFlakes(records))
+}
+
+func TestUploadHistoryTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done // Never responds until the test is over.
+	}))
+	defer srv.Close()
+	defer close(done)
+	config := core.DefaultConfiguration()
+	config.Test.HistoryTimeout = cli.Duration(100 * time.Millisecond)
+	assert.Error(t, uploadHistory(historyClient(config), srv.URL, []byte("{}\n")))
+}
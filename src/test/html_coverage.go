@@ -0,0 +1,179 @@
+// Code for writing an HTML coverage report.
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// WriteHTMLCoverageToFileOrDie writes the collected coverage data to a file as an HTML report. Dies on failure.
+func WriteHTMLCoverageToFileOrDie(coverage core.TestCoverage, filename string) {
+	var b bytes.Buffer
+	if err := htmlTemplate.Execute(&b, buildHTMLReport(coverage)); err != nil {
+		log.Fatalf("Failed to generate HTML coverage report: %s", err)
+	} else if err := ioutil.WriteFile(filename, b.Bytes(), 0644); err != nil {
+		log.Fatalf("Failed to write coverage report to %s: %s", filename, err)
+	}
+}
+
+// buildHTMLReport assembles the data that the template needs to render the report.
+func buildHTMLReport(coverage core.TestCoverage) *htmlReport {
+	report := &htmlReport{}
+	packages := map[string]*htmlPackage{}
+	var covered, total int
+	for i, file := range coverage.OrderedFiles() {
+		lines := coverage.Files[file]
+		fileCovered, fileTotal := CountCoverage(lines)
+		if fileTotal == 0 {
+			continue
+		}
+		covered += fileCovered
+		total += fileTotal
+		f := &htmlFile{
+			ID:         i,
+			Name:       file,
+			Percentage: percentage(fileCovered, fileTotal),
+			Lines:      htmlLines(file, lines),
+		}
+		report.Files = append(report.Files, f)
+		dir := filepath.Dir(file)
+		pkg, present := packages[dir]
+		if !present {
+			pkg = &htmlPackage{Name: dir}
+			packages[dir] = pkg
+			report.Packages = append(report.Packages, pkg)
+		}
+		pkg.Files = append(pkg.Files, f)
+		pkg.covered += fileCovered
+		pkg.total += fileTotal
+	}
+	for _, pkg := range report.Packages {
+		pkg.Percentage = percentage(pkg.covered, pkg.total)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool { return report.Packages[i].Name < report.Packages[j].Name })
+	report.Percentage = percentage(covered, total)
+	return report
+}
+
+// htmlLines reads the given source file and annotates each of its lines with its coverage.
+// If the file can't be read (e.g. because it was generated) the lines are left blank.
+func htmlLines(filename string, coverage []core.LineCoverage) []htmlLine {
+	lines := make([]htmlLine, len(coverage))
+	for i, c := range coverage {
+		lines[i] = htmlLine{Number: i + 1, Class: htmlLineClass(c)}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Debug("Can't read %s for coverage report: %s", filename, err)
+		return lines
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		if i < len(lines) {
+			lines[i].Text = scanner.Text()
+		} else {
+			// Trailing lines with no coverage information (which is common for some formats).
+			lines = append(lines, htmlLine{Number: i + 1, Text: scanner.Text()})
+		}
+	}
+	return lines
+}
+
+func htmlLineClass(c core.LineCoverage) string {
+	switch c {
+	case core.Covered:
+		return "covered"
+	case core.Uncovered, core.Unreachable:
+		return "uncovered"
+	}
+	return ""
+}
+
+func percentage(covered, total int) float32 {
+	if total == 0 {
+		return 0
+	}
+	return 100.0 * float32(covered) / float32(total)
+}
+
+type htmlReport struct {
+	Percentage float32
+	Packages   []*htmlPackage
+	Files      []*htmlFile
+}
+
+type htmlPackage struct {
+	Name       string
+	Percentage float32
+	Files      []*htmlFile
+	covered    int
+	total      int
+}
+
+type htmlFile struct {
+	ID         int
+	Name       string
+	Percentage float32
+	Lines      []htmlLine
+}
+
+type htmlLine struct {
+	Number int
+	Class  string
+	Text   string
+}
+
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table.summary { border-collapse: collapse; }
+table.summary td { padding: 2px 12px; }
+tr.package td { font-weight: bold; border-top: 1px solid #ccc; }
+td.pct { text-align: right; }
+a { cursor: pointer; color: #06c; }
+div.file { display: none; }
+pre { font-size: 12px; }
+span.covered { background-color: #cfc; }
+span.uncovered { background-color: #fcc; }
+span.num { display: inline-block; width: 4em; color: #999; text-align: right; margin-right: 1em; }
+</style>
+<script>
+function show(id) {
+  var files = document.getElementsByClassName("file");
+  for (var i = 0; i < files.length; i++) {
+    files[i].style.display = files[i].id === "file" + id ? "block" : "none";
+  }
+  document.getElementById("summary").style.display = id === null ? "block" : "none";
+  window.scrollTo(0, 0);
+}
+</script>
+</head>
+<body>
+<div id="summary">
+<h1>Coverage report: {{ printf "%.1f" .Percentage }}%</h1>
+<table class="summary">
+{{ range .Packages }}<tr class="package"><td>{{ .Name }}</td><td class="pct">{{ printf "%.1f" .Percentage }}%</td></tr>
+{{ range .Files }}<tr><td>&nbsp;&nbsp;<a onclick="show({{ .ID }})">{{ .Name }}</a></td><td class="pct">{{ printf "%.1f" .Percentage }}%</td></tr>
+{{ end }}{{ end }}</table>
+</div>
+{{ range .Files }}<div class="file" id="file{{ .ID }}">
+<h2><a onclick="show(null)">&larr;</a> {{ .Name }}: {{ printf "%.1f" .Percentage }}%</h2>
+<pre>{{ range .Lines }}<span class="num">{{ .Number }}</span><span class="{{ .Class }}">{{ .Text }}</span>
+{{ end }}</pre>
+</div>
+{{ end }}</body>
+</html>
+`))
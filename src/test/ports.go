@@ -0,0 +1,42 @@
+package test
+
+import (
+	"net"
+	"sync"
+)
+
+// A portAllocator hands out ports to tests that have asked for one.
+// It guarantees that no two concurrently running tests are given the same port, although
+// obviously it can't stop other processes on the machine from taking it in the meantime.
+type portAllocator struct {
+	ports map[int]bool
+	mutex sync.Mutex
+}
+
+var ports = portAllocator{ports: map[int]bool{}}
+
+// Allocate returns a currently unused port. It should be released once the test has finished.
+func (pa *portAllocator) Allocate() (int, error) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	// Ask the kernel for a free port, then retry if it happens to give us one we've already handed out.
+	for {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if !pa.ports[port] {
+			pa.ports[port] = true
+			return port, nil
+		}
+	}
+}
+
+// Release releases a previously allocated port.
+func (pa *portAllocator) Release(port int) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	delete(pa.ports, port)
+}
@@ -0,0 +1,27 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocatePortsAreUnique(t *testing.T) {
+	pa := portAllocator{ports: map[int]bool{}}
+	seen := map[int]bool{}
+	for i := 0; i < 10; i++ {
+		port, err := pa.Allocate()
+		assert.NoError(t, err)
+		assert.False(t, seen[port], "Port %d allocated twice", port)
+		seen[port] = true
+	}
+}
+
+func TestReleasePort(t *testing.T) {
+	pa := portAllocator{ports: map[int]bool{}}
+	port, err := pa.Allocate()
+	assert.NoError(t, err)
+	assert.True(t, pa.ports[port])
+	pa.Release(port)
+	assert.False(t, pa.ports[port])
+}
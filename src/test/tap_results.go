@@ -0,0 +1,109 @@
+// Code for writing test results in TAP (Test Anything Protocol) format.
+
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// WriteTAPResultsToFileOrDie writes test results out to a file in TAP format. Dies on any errors.
+func WriteTAPResultsToFileOrDie(graph *core.BuildGraph, filename string) {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		log.Fatalf("Failed to create directory for test output")
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Failed to write TAP results to %s: %s", filename, err)
+	}
+	defer f.Close()
+	if err := writeTAPResults(f, targetsWithResults(graph)); err != nil {
+		log.Fatalf("Failed to write TAP results to %s: %s", filename, err)
+	}
+}
+
+// targetsWithResults returns all the test targets in the graph that have results, sorted by label.
+func targetsWithResults(graph *core.BuildGraph) []*core.BuildTarget {
+	targets := []*core.BuildTarget{}
+	for _, target := range graph.AllTargets() {
+		if target.IsTest && len(target.Results.TestCases) > 0 {
+			targets = append(targets, target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Label.Less(targets[j].Label) })
+	return targets
+}
+
+// writeTAPResults writes results for the given targets as a single TAP stream.
+func writeTAPResults(w io.Writer, targets []*core.BuildTarget) error {
+	total := 0
+	for _, target := range targets {
+		total += len(target.Results.TestCases)
+	}
+	if _, err := fmt.Fprintf(w, "TAP version 13\n1..%d\n", total); err != nil {
+		return err
+	}
+	i := 1
+	for _, target := range targets {
+		for _, testCase := range target.Results.TestCases {
+			if err := writeTAPTestCase(w, i, target.Label, testCase); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// writeTAPTestCase writes a single test point.
+func writeTAPTestCase(w io.Writer, i int, label core.BuildLabel, testCase core.TestCase) error {
+	name := label.String() + " " + testCase.Name
+	if testCase.ClassName != "" {
+		name = label.String() + " " + testCase.ClassName + "." + testCase.Name
+	}
+	// # introduces a directive in TAP so must be escaped in the description.
+	name = strings.Replace(name, "#", `\#`, -1)
+	if testCase.Success() != nil {
+		_, err := fmt.Fprintf(w, "ok %d - %s\n", i, name)
+		return err
+	} else if skip := testCase.Skip(); skip != nil {
+		_, err := fmt.Fprintf(w, "ok %d - %s # SKIP %s\n", i, name, strings.Replace(skip.Skip.Message, "\n", " ", -1))
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "not ok %d - %s\n", i, name); err != nil {
+		return err
+	}
+	// Add a YAML block describing the (last) failure.
+	var failure *core.TestResultFailure
+	severity := "fail"
+	if errors := testCase.Errors(); len(errors) > 0 {
+		failure = errors[len(errors)-1].Error
+		severity = "error"
+	} else if failures := testCase.Failures(); len(failures) > 0 {
+		failure = failures[len(failures)-1].Failure
+	}
+	if failure == nil {
+		return nil
+	}
+	fmt.Fprintf(w, "  ---\n  severity: %s\n", severity)
+	if failure.Type != "" {
+		fmt.Fprintf(w, "  type: %q\n", failure.Type)
+	}
+	if failure.Message != "" {
+		fmt.Fprintf(w, "  message: %q\n", failure.Message)
+	}
+	if failure.Traceback != "" {
+		fmt.Fprintf(w, "  traceback: |\n")
+		for _, line := range strings.Split(strings.TrimRight(failure.Traceback, "\n"), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	_, err := fmt.Fprintf(w, "  ...\n")
+	return err
+}
@@ -0,0 +1,43 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestWriteTAPResults(t *testing.T) {
+	target1 := core.NewBuildTarget(core.ParseBuildLabel("//src/test:a_test", ""))
+	target1.Results.TestCases = core.TestCases{
+		{ClassName: "ATest", Name: "TestPass", Executions: []core.TestExecution{{}}},
+		{ClassName: "ATest", Name: "TestSkip", Executions: []core.TestExecution{
+			{Skip: &core.TestResultSkip{Message: "not today"}},
+		}},
+	}
+	target2 := core.NewBuildTarget(core.ParseBuildLabel("//src/test:b_test", ""))
+	target2.Results.TestCases = core.TestCases{
+		{Name: "TestFail #1", Executions: []core.TestExecution{
+			{Failure: &core.TestResultFailure{Type: "AssertionError", Message: "1 != 2", Traceback: "line 1\nline 2\n"}},
+		}},
+	}
+	var b bytes.Buffer
+	err := writeTAPResults(&b, []*core.BuildTarget{target1, target2})
+	assert.NoError(t, err)
+	assert.Equal(t, `TAP version 13
+1..3
+ok 1 - //src/test:a_test ATest.TestPass
+ok 2 - //src/test:a_test ATest.TestSkip # SKIP not today
+not ok 3 - //src/test:b_test TestFail \#1
+  ---
+  severity: fail
+  type: "AssertionError"
+  message: "1 != 2"
+  traceback: |
+    line 1
+    line 2
+  ...
+`, b.String())
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -234,6 +235,7 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		moveAndCacheOutputFiles(&target.Results, coverage)
 	}
 	logTargetResults(tid, state, target, coverage)
+	recordHistory(state, target, hash)
 }
 
 func logTargetResults(tid int, state *core.BuildState, target *core.BuildTarget, coverage *core.TestCoverage) {
@@ -313,6 +315,10 @@ func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget) (string
 		replacedCmd += " " + args
 		env = append(env, "TESTS="+args)
 	}
+	if err != nil {
+		return "", nil, err
+	}
+	replacedCmd, err = core.WrapTestFixtures(state, target, replacedCmd)
 	return replacedCmd, env, err
 }
 
@@ -321,8 +327,26 @@ func runTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if target.HasLabel(core.TestPortLabel) {
+		port, err := ports.Allocate()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to allocate port for %s: %s", target.Label, err)
+		}
+		defer ports.Release(port)
+		env = append(env, "TEST_PORT="+strconv.Itoa(port))
+	}
 	log.Debug("Running test %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	_, stderr, err := state.ProcessExecutor.ExecWithTimeoutShellStdStreams(target, target.TestDir(), env, target.TestTimeout, state.ShowAllOutput, replacedCmd, target.TestSandbox, state.DebugTests)
+	secrets, err := core.InjectedSecretEnv(state.Config, target)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, secrets...)
+	sandbox := target.TestSandbox
+	if !sandbox && state.Config.Test.NetworkNamespace {
+		env = append(env, core.SandboxNetworkOnlyEnv)
+		sandbox = true
+	}
+	_, stderr, err := state.ProcessExecutor.ExecWithTimeoutShellStdStreams(target, target.TestDir(), env, target.TestTimeout, state.ShowAllOutput, replacedCmd, sandbox, state.DebugTests)
 	return stderr, err
 }
 
@@ -331,6 +355,20 @@ func doTest(tid int, state *core.BuildState, target *core.BuildTarget, outputFil
 	metadata, resultsData, coverage, err := doTestResults(tid, state, target, outputFile, runRemotely)
 	duration := time.Since(startTime)
 	parsedSuite := parseTestOutput(metadata.Stdout, string(metadata.Stderr), err, duration, target, outputFile, resultsData)
+	if budgetErr := checkBudget(state, target, metadata, duration); budgetErr != nil {
+		parsedSuite.TestCases = append(parsedSuite.TestCases, core.TestCase{
+			Name: target.Results.Name,
+			Executions: []core.TestExecution{
+				{
+					Duration: &duration,
+					Failure: &core.TestResultFailure{
+						Type:    "BudgetExceeded",
+						Message: budgetErr.Error(),
+					},
+				},
+			},
+		})
+	}
 	return core.TestSuite{
 		Package:    strings.Replace(target.Label.PackageName, "/", ".", -1),
 		Name:       target.Label.Name,
@@ -358,6 +396,15 @@ func doTestResults(tid int, state *core.BuildState, target *core.BuildTarget, ou
 	return &core.BuildMetadata{Stdout: stdout}, nil, coverage, err
 }
 
+// checkBudget checks how long a test took against its budget.
+// For remote tests we prefer the time it actually ran for, since that excludes any queueing.
+func checkBudget(state *core.BuildState, target *core.BuildTarget, metadata *core.BuildMetadata, duration time.Duration) error {
+	if !metadata.StartTime.IsZero() && !metadata.EndTime.IsZero() {
+		duration = metadata.EndTime.Sub(metadata.StartTime)
+	}
+	return state.CheckBudget(target, true, 0, duration)
+}
+
 func parseRemoteCoverage(state *core.BuildState, target *core.BuildTarget, coverage []byte) (*core.TestCoverage, error) {
 	if !state.NeedCoverage {
 		return core.NewTestCoverage(), nil
@@ -23,12 +23,15 @@ var opts = struct {
 	Mode string `short:"m" long:"mode" default:"stdio" choice:"stdio" choice:"tcp" description:"Mode of the language server communication"`
 	Host string `short:"h" long:"host" default:"127.0.0.1" description:"TCP host to communicate with"`
 	Port string `short:"p" long:"port" default:"4040" description:"TCP port to communicate with"`
+
+	PlzServe string `long:"plz_serve" default:"127.0.0.1:7778" description:"Address of a plz serve process to get the build graph from. If there isn't one running, the repo is parsed locally instead."`
 }{
 	Usage: `
 build_langserver is a binary shipped with Please that you can use as a language server for build files.
 
 It speaks language server protocol from vscode, you can plugin this binary in your IDE to start the language server.
-Currently, it supports autocompletion, goto definition for build_defs, and signature help
+Currently, it supports autocompletion, goto definition for build_defs, and signature help.
+If a plz serve process is running it uses the build graph from that rather than parsing the repo itself.
 `,
 }
 
@@ -38,7 +41,9 @@ func main() {
 	if opts.LogFile != "" {
 		cli.InitFileLogging(string(opts.LogFile), opts.Verbosity)
 	}
-	if err := serve(lsp.NewHandler()); err != nil {
+	handler := lsp.NewHandler()
+	handler.GraphAddress = opts.PlzServe
+	if err := serve(handler); err != nil {
 		log.Fatalf("fail to start server: %s", err)
 	}
 }
@@ -39,14 +39,14 @@ func (h *Handler) completeLabel(doc *doc, partial string, line, col int) (*lsp.C
 				if ((label.Name == "all" && !strings.HasPrefix(t.Label.Name, "_")) || strings.HasPrefix(t.Label.Name, label.Name)) && pkgLabel.CanSee(h.state, t) {
 					s := t.Label.ShortString(core.BuildLabel{PackageName: pkgName})
 					if !strings.HasPrefix(s, partial) {
-						s = t.Label.String() // Don't abbreviate it if we end up losing part of what's there
+						s = labelString(t.Label, partial) // Don't abbreviate it if we end up losing part of what's there
 					}
 					list.Items = append(list.Items, completionItem(s, partial, line, col))
 					m[s] = true
 				}
 			}
 		}
-		if idx == 0 || pkgName == label.PackageName {
+		if idx == 0 || (pkgName == label.PackageName && label.Subrepo == "") {
 			// We are in the current document, provide local completions from it.
 			// This handles the case where a user added something locally but hasn't saved it yet.
 			for _, target := range h.allTargets(doc) {
@@ -60,13 +60,63 @@ func (h *Handler) completeLabel(doc *doc, partial string, line, col int) (*lsp.C
 		return list, nil
 	}
 	// OK, it doesn't specify a package yet. Find any relevant ones.
+	if prefix, subrepo := splitSubrepo(partial); prefix != "" {
+		// It's in a subrepo (or an architecture), which we may not know the name of yet.
+		idx := strings.Index(subrepo, "//")
+		if idx == -1 {
+			return &lsp.CompletionList{
+				IsIncomplete: true,
+				Items:        h.completeSubrepos(prefix, subrepo, line, col),
+			}, nil
+		}
+		parts := strings.Split(strings.TrimLeft(subrepo[idx:], "/"), "/")
+		subrepo = subrepo[:idx]
+		items := []lsp.CompletionItem{}
+		if pkgs := h.subrepoPkgs[subrepo]; pkgs != nil {
+			items = h.completePackages(pkgs, prefix+subrepo, parts, parts, line, col)
+		}
+		return &lsp.CompletionList{IsIncomplete: true, Items: items}, nil
+	}
 	parts := strings.Split(strings.TrimLeft(partial, "/"), "/")
 	return &lsp.CompletionList{
 		IsIncomplete: true,
-		Items:        h.completePackages(h.pkgs, parts, parts, line, col),
+		Items:        h.completePackages(h.pkgs, "", parts, parts, line, col),
 	}, nil
 }
 
+// completeSubrepos provides completions for the name of a subrepo.
+// The prefix is the syntax used to introduce it, either /// or @.
+func (h *Handler) completeSubrepos(prefix, partial string, line, col int) []lsp.CompletionItem {
+	items := []lsp.CompletionItem{}
+	for _, subrepo := range h.state.Graph.Subrepos() {
+		if strings.HasPrefix(subrepo.Name, partial) {
+			item := completionItem(prefix+subrepo.Name+"//", prefix+partial, line, col)
+			item.Kind = lsp.CIKModule
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitSubrepo splits a partial build label that begins with a subrepo into the syntax that
+// introduces it (/// or @) and the remainder. It returns an empty prefix if it isn't in one.
+func splitSubrepo(partial string) (string, string) {
+	if strings.HasPrefix(partial, "///") {
+		return "///", partial[3:]
+	} else if strings.HasPrefix(partial, "@") {
+		return "@", partial[1:]
+	}
+	return "", partial
+}
+
+// labelString returns the full string form of a label, written in the same style as the given partial label.
+func labelString(label core.BuildLabel, partial string) string {
+	if label.Subrepo != "" && strings.HasPrefix(partial, "@") {
+		return "@" + strings.TrimPrefix(label.String(), "///")
+	}
+	return label.String()
+}
+
 // completeUnparsed does a best-effort completion when we don't have an AST to work from.
 func (h *Handler) completeUnparsed(doc *doc, line, col int) (*lsp.CompletionList, error) {
 	lines := doc.Lines()
@@ -93,7 +143,7 @@ func (h *Handler) completeUnparsed(doc *doc, line, col int) (*lsp.CompletionList
 func (h *Handler) completeString(doc *doc, s string, line, col int) (*lsp.CompletionList, error) {
 	if s == "" || s == "/" {
 		return &lsp.CompletionList{IsIncomplete: true}, nil
-	} else if core.LooksLikeABuildLabel(s) {
+	} else if core.LooksLikeABuildLabel(s) || strings.HasPrefix(s, "@") {
 		return h.completeLabel(doc, s, line, col)
 	}
 	// Not a label, assume file.
@@ -158,9 +208,25 @@ func completionItem(label, prefix string, line, col int) lsp.CompletionItem {
 }
 
 func (h *Handler) buildPackageTree() {
+	pkgs := map[string][]*core.Package{}
+	for _, p := range h.state.Graph.PackageMap() {
+		pkgs[p.SubrepoName] = append(pkgs[p.SubrepoName], p)
+	}
+	subrepoPkgs := make(map[string]*pkg, len(pkgs))
+	for subrepo, p := range pkgs {
+		if subrepo != "" {
+			subrepoPkgs[subrepo] = packageTree(p)
+		}
+	}
+	h.subrepoPkgs = subrepoPkgs
+	h.pkgs = packageTree(pkgs[""])
+}
+
+// packageTree builds a tree of the given packages, which should all be in the same subrepo.
+func packageTree(pkgs []*core.Package) *pkg {
 	root := &pkg{Subpackages: map[string]*pkg{}}
 	all := map[string]*pkg{"": root}
-	for _, p := range h.state.Graph.PackageMap() {
+	for _, p := range pkgs {
 		all[p.Name] = &pkg{Package: p}
 	}
 	root = all[""]
@@ -184,7 +250,7 @@ func (h *Handler) buildPackageTree() {
 			attachChild(name, pkg)
 		}
 	}
-	h.pkgs = root
+	return root
 }
 
 // A pkg represents a build package, although it also includes directories with no BUILD file
@@ -194,11 +260,12 @@ type pkg struct {
 	Subpackages map[string]*pkg
 }
 
-// completePackages returns completions of all packages given the relevant parts
-func (h *Handler) completePackages(pkg *pkg, allParts, parts []string, line, col int) []lsp.CompletionItem {
+// completePackages returns completions of all packages given the relevant parts.
+// The subrepo prefix is prepended to each of them (e.g. ///subrepo), or is empty for the main repo.
+func (h *Handler) completePackages(pkg *pkg, subrepo string, allParts, parts []string, line, col int) []lsp.CompletionItem {
 	items := []lsp.CompletionItem{}
 	if part := parts[0]; len(parts) == 1 {
-		prefix := "//" + strings.Join(allParts[:len(allParts)-1], "/")
+		prefix := subrepo + "//" + strings.Join(allParts[:len(allParts)-1], "/")
 		if len(allParts) > 1 {
 			prefix += "/"
 		}
@@ -210,7 +277,7 @@ func (h *Handler) completePackages(pkg *pkg, allParts, parts []string, line, col
 		}
 	} else if pkg.Subpackages != nil {
 		if pkg := pkg.Subpackages[part]; pkg != nil {
-			return h.completePackages(pkg, allParts, parts[1:], line, col)
+			return h.completePackages(pkg, subrepo, allParts, parts[1:], line, col)
 		}
 	}
 	return items
@@ -15,6 +15,8 @@ import (
 
 // definition implements 'go-to-definition' support.
 // It is also used for go-to-declaration since we do not make a distinction between the two.
+// Build labels jump to the definition of the target, strings naming files in the package open
+// that file, and names of functions jump to their definition (which may be in a subinclude).
 func (h *Handler) definition(params *lsp.TextDocumentPositionParams) ([]lsp.Location, error) {
 	doc := h.doc(params.TextDocument.URI)
 	ast := h.parseIfNeeded(doc)
@@ -22,8 +24,15 @@ func (h *Handler) definition(params *lsp.TextDocumentPositionParams) ([]lsp.Loca
 	pos := aspPos(params.Position)
 	asp.WalkAST(ast, func(expr *asp.Expression) bool {
 		if asp.WithinRange(pos, expr.Pos, expr.EndPos) {
-			if expr.Val.Ident != nil {
-				if loc := h.findDefinition(expr.Val.Ident.Name); loc.URI != "" {
+			if expr.Val == nil {
+				return true
+			} else if expr.Val.String != "" {
+				if loc := h.findStringDefinition(doc, ast, stringLiteral(expr.Val.String)); loc.URI != "" {
+					locs = append(locs, loc)
+				}
+				return false
+			} else if expr.Val.Ident != nil {
+				if loc := h.findDefinition(doc, ast, expr.Val.Ident.Name); loc.URI != "" {
 					locs = append(locs, loc)
 					return false
 				}
@@ -32,11 +41,14 @@ func (h *Handler) definition(params *lsp.TextDocumentPositionParams) ([]lsp.Loca
 		}
 		return false
 	})
+	if len(locs) > 0 {
+		return locs, nil
+	}
 	// It might also be a statement.
 	asp.WalkAST(ast, func(stmt *asp.Statement) bool {
 		if asp.WithinRange(pos, stmt.Pos, stmt.EndPos) {
 			if stmt.Ident != nil {
-				if loc := h.findDefinition(stmt.Ident.Name); loc.URI != "" {
+				if loc := h.findDefinition(doc, ast, stmt.Ident.Name); loc.URI != "" {
 					locs = append(locs, loc)
 					return false
 				}
@@ -49,7 +61,16 @@ func (h *Handler) definition(params *lsp.TextDocumentPositionParams) ([]lsp.Loca
 }
 
 // findDefinition returns the location of a global of the given name.
-func (h *Handler) findDefinition(name string) lsp.Location {
+// Builtins are checked first, then anything subincluded by the given statements.
+func (h *Handler) findDefinition(doc *doc, ast []*asp.Statement, name string) lsp.Location {
+	if loc := h.findBuiltinDefinition(name); loc.URI != "" {
+		return loc
+	}
+	return h.findSubincludedDefinition(doc.PackageName(), ast, name, map[string]bool{})
+}
+
+// findBuiltinDefinition returns the location of a builtin function of the given name.
+func (h *Handler) findBuiltinDefinition(name string) lsp.Location {
 	if f, present := h.builtins[name]; present {
 		if f.FuncDef.IsBuiltin && !strings.Contains(f.Pos.Filename, "/") {
 			// Extract the builtin to a temporary location so the user can see it.
@@ -71,14 +92,152 @@ func (h *Handler) findDefinition(name string) lsp.Location {
 			}
 			f.Pos.Filename = dest
 		}
-		file := f.Pos.Filename
-		if !path.IsAbs(file) {
-			file = path.Join(h.root, f.Pos.Filename)
+		return h.location(f.Pos.Filename, f.Pos, f.EndPos)
+	}
+	return lsp.Location{}
+}
+
+// findSubincludedDefinition returns the location of a function of the given name that's defined
+// in a file subincluded by the given statements (transitively, if that file subincludes others).
+// pkgName is the package the statements are in; seen tracks files we've already looked at.
+func (h *Handler) findSubincludedDefinition(pkgName string, stmts []*asp.Statement, name string, seen map[string]bool) lsp.Location {
+	for _, stmt := range stmts {
+		if stmt.Ident == nil || stmt.Ident.Name != "subinclude" || stmt.Ident.Action == nil || stmt.Ident.Action.Call == nil {
+			continue
 		}
-		return lsp.Location{
-			URI:   lsp.DocumentURI("file://" + file),
-			Range: rng(f.Pos, f.EndPos),
+		for _, arg := range stmt.Ident.Action.Call.Arguments {
+			if arg.Value.Val == nil || arg.Value.Val.String == "" {
+				continue
+			}
+			l, err := core.TryParseBuildLabel(stringLiteral(arg.Value.Val.String), pkgName, "")
+			if err != nil {
+				continue
+			}
+			t := h.state.Graph.Target(l)
+			if t == nil {
+				continue
+			}
+			for _, filename := range h.subincludeFiles(t) {
+				if seen[filename] {
+					continue
+				}
+				seen[filename] = true
+				stmts, err := h.parser.ParseFileOnly(filename)
+				if err != nil {
+					log.Debug("Failed to parse subinclude %s: %s", filename, err)
+					continue
+				}
+				for _, stmt := range stmts {
+					if stmt.FuncDef != nil && stmt.FuncDef.Name == name {
+						return h.location(filename, stmt.Pos, stmt.EndPos)
+					}
+				}
+				if loc := h.findSubincludedDefinition(t.Label.PackageName, stmts, name, seen); loc.URI != "" {
+					return loc
+				}
+			}
 		}
 	}
 	return lsp.Location{}
 }
+
+// subincludeFiles returns the files that subincluding the given target would load.
+// We prefer to return the original sources of filegroups since they're more useful to the user
+// (and the outputs may well not exist since we never build anything).
+func (h *Handler) subincludeFiles(t *core.BuildTarget) []string {
+	if t.IsFilegroup {
+		return t.AllSourcePaths(h.state.Graph)
+	}
+	return t.FullOutputs()
+}
+
+// findStringDefinition returns the location that a string refers to; for a build label that's
+// the definition of the target, otherwise it's a file of that name in the current package.
+func (h *Handler) findStringDefinition(doc *doc, ast []*asp.Statement, s string) lsp.Location {
+	pkgName := doc.PackageName()
+	if !core.LooksLikeABuildLabel(s) {
+		if filename := path.Join(h.root, pkgName, s); s != "" && core.PathExists(filename) {
+			return lsp.Location{URI: lsp.DocumentURI("file://" + filename)}
+		}
+		return lsp.Location{}
+	}
+	l, err := core.TryParseBuildLabel(s, pkgName, "")
+	if err != nil || l.IsAllTargets() || l.IsAllSubpackages() {
+		return lsp.Location{}
+	}
+	return h.findLabelDefinition(doc, ast, l)
+}
+
+// findLabelDefinition returns the location of the definition of the target with the given label.
+func (h *Handler) findLabelDefinition(doc *doc, ast []*asp.Statement, l core.BuildLabel) lsp.Location {
+	if l.Subrepo != "" {
+		return lsp.Location{}
+	}
+	l = l.Parent() // Jump to the target the user wrote, not whatever internal target it might have created.
+	if pkgName := doc.PackageName(); l.PackageName == pkgName {
+		// Use the current document since it may have unsaved changes.
+		if stmt := findTarget(ast, l.Name); stmt != nil {
+			return h.location(doc.Filename, stmt.Pos, stmt.EndPos)
+		}
+		return lsp.Location{}
+	}
+	filename := h.buildFile(l.PackageName)
+	if filename == "" {
+		return lsp.Location{}
+	}
+	stmts, err := h.parser.ParseFileOnly(filename)
+	if err != nil {
+		log.Debug("Failed to parse %s: %s", filename, err)
+		return h.location(filename, asp.Position{Line: 1, Column: 1}, asp.Position{Line: 1, Column: 1})
+	} else if stmt := findTarget(stmts, l.Name); stmt != nil {
+		return h.location(filename, stmt.Pos, stmt.EndPos)
+	}
+	// The target may have been created by a macro or in some other way we can't identify.
+	// At least we can take the user to the right file.
+	return h.location(filename, asp.Position{Line: 1, Column: 1}, asp.Position{Line: 1, Column: 1})
+}
+
+// buildFile returns the name of the BUILD file for the given package, or the empty string if
+// there isn't one.
+func (h *Handler) buildFile(pkgName string) string {
+	if pkg := h.state.Graph.Package(pkgName, ""); pkg != nil {
+		return pkg.Filename
+	}
+	for _, name := range h.state.Config.Parse.BuildFileName {
+		if filename := path.Join(pkgName, name); core.PathExists(path.Join(h.root, filename)) {
+			return filename
+		}
+	}
+	return ""
+}
+
+// findTarget returns the statement calling a function to create a target of the given name.
+func findTarget(stmts []*asp.Statement, name string) *asp.Statement {
+	var ret *asp.Statement
+	asp.WalkAST(stmts, func(stmt *asp.Statement) bool {
+		if ret != nil {
+			return false
+		} else if stmt.Ident == nil || stmt.Ident.Action == nil || stmt.Ident.Action.Call == nil {
+			return true
+		}
+		for _, arg := range stmt.Ident.Action.Call.Arguments {
+			if arg.Name == "name" && arg.Value.Val != nil && arg.Value.Val.String != "" && stringLiteral(arg.Value.Val.String) == name {
+				ret = stmt
+				return false
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+// location returns an LSP location for a range within the given file.
+func (h *Handler) location(filename string, start, end asp.Position) lsp.Location {
+	if !path.IsAbs(filename) {
+		filename = path.Join(h.root, filename)
+	}
+	return lsp.Location{
+		URI:   lsp.DocumentURI("file://" + filename),
+		Range: rng(start, end),
+	}
+}
@@ -63,8 +63,101 @@ func TestDefinitionBuiltin(t *testing.T) {
 	assert.Equal(t, []lsp.Location{
 		{
 			URI:   lsp.DocumentURI("file://" + path.Join(cacheDir, "please/misc_rules.build_defs")),
-			Range: xrng(3, 0, 122, 5),
+			Range: xrng(3, 0, 145, 5),
 		},
 	}, locs)
 
 }
+
+func TestDefinitionSubinclude(t *testing.T) {
+	// inner_rule is only available transitively, via the subinclude in outer.build_defs.
+	h := initHandlerText(`subinclude("//src/defs:outer")
+
+inner_rule(name = "test")`)
+	h.WaitForPackageTree()
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/definition", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 2, Character: 3},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/src/defs/inner.build_defs")),
+			Range: xrng(0, 0, 4, 5),
+		},
+	}, locs)
+}
+
+func TestDefinitionLabel(t *testing.T) {
+	h := initHandlerText(`x = ["//src/core:config_test"]`)
+	h.WaitForPackageTree()
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/definition", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 0, Character: 10},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/src/core/test.build")),
+			Range: xrng(18, 0, 25, 1),
+		},
+	}, locs)
+}
+
+func TestDefinitionLabelAtRoot(t *testing.T) {
+	// Files at the root of the repo are in the package "", not ".".
+	const uri = "file://BUILD"
+	h := initHandler()
+	err := h.Request("textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:  uri,
+			Text: "filegroup(name = \"a\")\nfilegroup(name = \"b\", srcs = [\"//:a\"])",
+		},
+	}, nil)
+	assert.NoError(t, err)
+	locs := []lsp.Location{}
+	err = h.Request("textDocument/definition", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: uri,
+		},
+		Position: lsp.Position{Line: 1, Character: 32},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   lsp.DocumentURI("file://" + path.Join(h.root, "BUILD")),
+			Range: xrng(0, 0, 0, 21),
+		},
+	}, locs)
+}
+
+func TestDefinitionSource(t *testing.T) {
+	const uri = "file://src/defs/test.build"
+	h := initHandler()
+	err := h.Request("textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:  uri,
+			Text: `filegroup(name = "outer", srcs = ["outer.build_defs"])`,
+		},
+	}, nil)
+	assert.NoError(t, err)
+	locs := []lsp.Location{}
+	err = h.Request("textDocument/definition", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: uri,
+		},
+		Position: lsp.Position{Line: 0, Character: 40},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI: lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/src/defs/outer.build_defs")),
+		},
+	}, locs)
+}
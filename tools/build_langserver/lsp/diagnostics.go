@@ -2,7 +2,9 @@ package lsp
 
 import (
 	"context"
+	"fmt"
 	"path"
+	"strings"
 
 	"github.com/sourcegraph/go-lsp"
 
@@ -29,7 +31,7 @@ func (h *Handler) diagnose(d *doc) {
 func (h *Handler) diagnostics(d *doc, ast []*asp.Statement) []lsp.Diagnostic {
 	diags := []lsp.Diagnostic{}
 	pkgLabel := core.BuildLabel{
-		PackageName: path.Dir(d.Filename),
+		PackageName: d.PackageName(),
 		Name:        "all",
 	}
 	asp.WalkAST(ast, func(expr *asp.Expression) bool {
@@ -73,9 +75,50 @@ func (h *Handler) diagnostics(d *doc, ast []*asp.Statement) []lsp.Diagnostic {
 		}
 		return true
 	})
+	for _, err := range h.typeChecker(pkgLabel).Check(ast) {
+		diags = append(diags, lsp.Diagnostic{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: err.Pos.Line - 1, Character: err.Pos.Column - 1},
+				End:   lsp.Position{Line: err.EndPos.Line - 1, Character: err.EndPos.Column - 1},
+			},
+			Severity: lsp.Error,
+			Source:   diagSource,
+			Message:  fmt.Sprintf("Invalid type for argument %s to %s; expected %s, was %s", err.Argument, err.Function, strings.Join(err.Expected, " or "), err.Actual),
+		})
+	}
 	return diags
 }
 
+// typeChecker returns a type checker for files in the given package.
+// Subincludes are resolved using whatever we already know from the initial parse.
+func (h *Handler) typeChecker(pkgLabel core.BuildLabel) *asp.TypeChecker {
+	tc := asp.NewTypeChecker()
+	for _, stmt := range h.builtins {
+		tc.AddFunction(stmt.FuncDef)
+	}
+	tc.IntsAsBools = h.state.Config.Bazel.Compatibility
+	tc.Subinclude = func(s string) ([]*asp.Statement, error) {
+		l, err := core.TryParseBuildLabel(s, pkgLabel.PackageName, pkgLabel.Subrepo)
+		if err != nil {
+			return nil, err
+		}
+		t := h.state.Graph.Target(l)
+		if t == nil {
+			return nil, fmt.Errorf("Unknown target %s", l)
+		}
+		stmts := []*asp.Statement{}
+		for _, out := range t.FullOutputs() {
+			s, err := h.parser.ParseFileOnly(out)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, s...)
+		}
+		return stmts, nil
+	}
+	return tc
+}
+
 func diagnosticsEqual(a, b []lsp.Diagnostic) bool {
 	if len(a) != len(b) {
 		return false
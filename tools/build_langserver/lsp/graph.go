@@ -0,0 +1,154 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/query"
+	pb "github.com/thought-machine/please/src/serve/proto/graph"
+)
+
+// graphTimeout is how long we wait to connect to a plz serve process before giving up on it.
+var graphTimeout = 1 * time.Second
+
+// graphBatchSize is the number of packages we request targets for at once when loading a remote graph.
+const graphBatchSize = 100
+
+// connectGraph connects to a plz serve process at the given address.
+// It returns nil if there isn't one, in which case we fall back to parsing the repo ourselves.
+func connectGraph(address string) pb.GraphClient {
+	if address == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), graphTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		log.Info("No plz serve process found at %s, will parse the repo instead: %s", address, err)
+		return nil
+	}
+	log.Notice("Attached to plz serve process at %s", address)
+	return pb.NewGraphClient(conn)
+}
+
+// loadGraph populates our build graph from a remote plz serve process.
+// Only the parts we need for completion & diagnostics are filled in; targets are not linked
+// to their dependencies, so anything needing that (e.g. reverse dependencies) must ask the remote.
+// Nothing is added to the graph unless it all loads successfully.
+func (h *Handler) loadGraph(client pb.GraphClient) error {
+	ctx := context.Background()
+	pkgs, err := client.Packages(ctx, &pb.PackagesRequest{})
+	if err != nil {
+		return err
+	} else if pkgs.RepoRoot != h.root {
+		return fmt.Errorf("plz serve is serving a different repo (%s)", pkgs.RepoRoot)
+	}
+	packages := []*core.Package{}
+	targets := []*core.BuildTarget{}
+	for i := 0; i < len(pkgs.Packages); i += graphBatchSize {
+		batch := pkgs.Packages[i:]
+		if len(batch) > graphBatchSize {
+			batch = batch[:graphBatchSize]
+		}
+		labels := make([]string, 0, len(batch))
+		for _, p := range batch {
+			if len(p.Targets) == 0 {
+				continue // Asking for :all would be an error
+			}
+			pkg := core.NewPackage(p.Name)
+			pkg.Filename = p.Filename
+			packages = append(packages, pkg)
+			labels = append(labels, "//"+p.Name+":all")
+		}
+		if len(labels) == 0 {
+			continue
+		}
+		resp, err := client.Targets(ctx, &pb.TargetsRequest{Labels: labels})
+		if err != nil {
+			return err
+		}
+		for _, t := range resp.Targets {
+			target, err := fromProtoTarget(t)
+			if err != nil {
+				log.Warning("Invalid target from plz serve: %s", err)
+				continue
+			}
+			targets = append(targets, target)
+		}
+	}
+	for _, pkg := range packages {
+		h.state.Graph.AddPackage(pkg)
+	}
+	for _, target := range targets {
+		if pkg := h.state.Graph.PackageByLabel(target.Label); pkg != nil {
+			pkg.AddTarget(target)
+			h.state.Graph.AddTarget(target)
+		}
+	}
+	return nil
+}
+
+// remoteGraph returns the client for the plz serve process we're attached to, or nil if there isn't one.
+func (h *Handler) remoteGraph() pb.GraphClient {
+	h.graphMutex.RLock()
+	defer h.graphMutex.RUnlock()
+	return h.graph
+}
+
+// fromProtoTarget converts a target from the remote graph back to a BuildTarget.
+func fromProtoTarget(t *pb.Target) (*core.BuildTarget, error) {
+	label, err := core.TryParseBuildLabel(t.Label, "", "")
+	if err != nil {
+		return nil, err
+	}
+	target := core.NewBuildTarget(label)
+	target.Labels = t.Labels
+	target.IsBinary = t.Binary
+	target.IsTest = t.Test
+	target.IsFilegroup = t.Filegroup
+	for _, v := range t.Visibility {
+		if l, err := core.TryParseBuildLabel(v, "", ""); err == nil {
+			target.Visibility = append(target.Visibility, l)
+		}
+	}
+	for _, out := range t.Outputs {
+		target.AddOutput(out)
+	}
+	for _, src := range t.Sources {
+		if !core.LooksLikeABuildLabel(src) {
+			target.AddSource(core.FileLabel{File: strings.TrimPrefix(src, label.PackageName+"/"), Package: label.PackageName})
+		} else if l, err := core.TryParseBuildLabel(strings.SplitN(src, "|", 2)[0], "", ""); err == nil {
+			target.AddSource(l)
+		}
+	}
+	return target, nil
+}
+
+// reverseDependencies returns the labels of the targets that directly depend on the given one.
+// If we're attached to a plz serve process it's asked, otherwise we use our own graph.
+func (h *Handler) reverseDependencies(label core.BuildLabel) ([]core.BuildLabel, error) {
+	if graph := h.remoteGraph(); graph != nil {
+		resp, err := graph.ReverseDependencies(context.Background(), &pb.ReverseDependenciesRequest{
+			Labels: []string{label.String()},
+			Level:  1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]core.BuildLabel, 0, len(resp.Labels))
+		for _, l := range resp.Labels {
+			if l, err := core.TryParseBuildLabel(l, "", ""); err == nil {
+				ret = append(ret, l)
+			}
+		}
+		return ret, nil
+	} else if h.state.Graph.Target(label) == nil {
+		return nil, nil
+	}
+	return query.ReverseDepLabels(h.state, []core.BuildLabel{label}, 1, false), nil
+}
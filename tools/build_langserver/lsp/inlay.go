@@ -0,0 +1,186 @@
+package lsp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// As with semantic tokens, go-lsp predates inlay hints so we define the types we need here.
+
+// inlayHintParams is the request for textDocument/inlayHint.
+type inlayHintParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	Range        lsp.Range                  `json:"range"`
+}
+
+// An inlayHint is a single hint that the client displays inline.
+type inlayHint struct {
+	Position    lsp.Position `json:"position"`
+	Label       string       `json:"label"`
+	Kind        int          `json:"kind,omitempty"`
+	PaddingLeft bool         `json:"paddingLeft,omitempty"`
+}
+
+// inlayHintParameter is the kind of hint for parameters (as opposed to types).
+const inlayHintParameter = 2
+
+// inlayHint implements textDocument/inlayHint.
+// For each call to a builtin rule, we show the values that omitted arguments will get where those
+// come from the config (e.g. visibility, test_only). These are the ones the user can't easily
+// see from the rule's signature since they depend on the repo's config and on package().
+func (h *Handler) inlayHint(params *inlayHintParams) ([]inlayHint, error) {
+	doc := h.doc(params.TextDocument.URI)
+	ast := h.parseIfNeeded(doc)
+	lines := doc.Lines()
+	overrides := packageConfig(ast)
+	hints := []inlayHint{}
+	asp.WalkAST(ast, func(stmt *asp.Statement) bool {
+		if stmt.Ident == nil || stmt.Ident.Action == nil || stmt.Ident.Action.Call == nil {
+			return true
+		} else if r := rng(stmt.Pos, stmt.EndPos); comparePositions(r.End, params.Range.Start) || comparePositions(params.Range.End, r.Start) {
+			return false // Outside the requested range
+		}
+		f, present := h.builtins[stmt.Ident.Name]
+		if !present {
+			return true
+		}
+		// The closing bracket is the last character of the statement.
+		end := pos(stmt.EndPos)
+		end.Character--
+		if end.Line < len(lines) {
+			end.Character = utf16Column(lines[end.Line], end.Character)
+		}
+		for _, arg := range omittedArgs(f.FuncDef, stmt.Ident.Action.Call) {
+			if value, ok := h.defaultValue(arg, overrides); ok {
+				hints = append(hints, inlayHint{
+					Position:    end,
+					Label:       arg.Name + "=" + value,
+					Kind:        inlayHintParameter,
+					PaddingLeft: true,
+				})
+			}
+		}
+		return true
+	})
+	return hints, nil
+}
+
+// omittedArgs returns the arguments to a function that aren't given at a call site.
+func omittedArgs(f *asp.FuncDef, call *asp.Call) []asp.Argument {
+	given := map[string]bool{}
+	for i, arg := range call.Arguments {
+		if arg.Name != "" {
+			given[arg.Name] = true
+		} else if i < len(f.Arguments) {
+			given[f.Arguments[i].Name] = true
+		}
+	}
+	ret := []asp.Argument{}
+	for _, arg := range f.Arguments {
+		if arg.Value == nil || arg.IsPrivate || given[arg.Name] {
+			continue
+		}
+		omitted := true
+		for _, alias := range arg.Aliases {
+			omitted = omitted && !given[alias]
+		}
+		if omitted {
+			ret = append(ret, arg)
+		}
+	}
+	return ret
+}
+
+// configDefaults are the arguments that build_rule sets from the config if they're None.
+// This mirrors buildRule in src/parse/asp/builtins.go.
+var configDefaults = map[string]string{
+	"visibility":   "DEFAULT_VISIBILITY",
+	"test_only":    "DEFAULT_TESTONLY",
+	"licences":     "DEFAULT_LICENCES",
+	"sandbox":      "BUILD_SANDBOX",
+	"test_sandbox": "TEST_SANDBOX",
+}
+
+// defaultValue returns the value that an omitted argument will take, if it's derived from the config.
+// That's either because its default is explicitly CONFIG.X, or because build_rule defaults it
+// from the config (in which case any non-None default on the calling rule is what gets passed through).
+// overrides are any config values set by package() in the current file.
+func (h *Handler) defaultValue(arg asp.Argument, overrides map[string]string) (string, bool) {
+	if name := configProperty(arg.Value); name != "" {
+		return h.configValue(name, overrides)
+	}
+	name, present := configDefaults[arg.Name]
+	if !present {
+		return "", false
+	} else if value, ok := literal(arg.Value); ok && value != "None" {
+		return value, true
+	}
+	return h.configValue(name, overrides)
+}
+
+// configValue returns the value of a config property, or false if it isn't set.
+func (h *Handler) configValue(name string, overrides map[string]string) (string, bool) {
+	if value, present := overrides[name]; present {
+		return value, true
+	}
+	value, ok := h.parser.ConfigValue(name)
+	return value, ok && value != "None"
+}
+
+// configProperty returns the name of the config property an expression refers to (e.g. CONFIG.X),
+// or the empty string if it isn't one.
+func configProperty(expr *asp.Expression) string {
+	if expr == nil || expr.Val == nil || expr.Val.Ident == nil || len(expr.Op) > 0 {
+		return ""
+	} else if ident := expr.Val.Ident; ident.Name != "CONFIG" || len(ident.Action) != 1 || ident.Action[0].Property == nil || len(ident.Action[0].Property.Action) > 0 {
+		return ""
+	}
+	return expr.Val.Ident.Action[0].Property.Name
+}
+
+// packageConfig returns the config values set by any calls to package() in the given statements.
+// Only literal values are understood.
+func packageConfig(stmts []*asp.Statement) map[string]string {
+	ret := map[string]string{}
+	for _, stmt := range stmts {
+		if stmt.Ident == nil || stmt.Ident.Name != "package" || stmt.Ident.Action == nil || stmt.Ident.Action.Call == nil {
+			continue
+		}
+		for _, arg := range stmt.Ident.Action.Call.Arguments {
+			if value, ok := literal(&arg.Value); ok && arg.Name != "" {
+				ret[strings.ToUpper(arg.Name)] = value
+			}
+		}
+	}
+	return ret
+}
+
+// literal returns the formatted value of a literal expression, or false if it isn't one.
+func literal(expr *asp.Expression) (string, bool) {
+	if expr == nil || expr.Val == nil || expr.UnaryOp != nil || len(expr.Op) > 0 || expr.If != nil {
+		return "", false
+	} else if val := expr.Val; val.Bool != "" {
+		return val.Bool, true
+	} else if val.Int != nil {
+		return strconv.Itoa(val.Int.Int), true
+	} else if val.Float != nil {
+		return strconv.FormatFloat(val.Float.Float, 'g', -1, 64), true
+	} else if val.String != "" {
+		return strconv.Quote(stringLiteral(val.String)), true
+	} else if val.List != nil && val.List.Comprehension == nil {
+		values := make([]string, len(val.List.Values))
+		for i, v := range val.List.Values {
+			s, ok := literal(v)
+			if !ok {
+				return "", false
+			}
+			values[i] = s
+		}
+		return "[" + strings.Join(values, ", ") + "]", true
+	}
+	return "", false
+}
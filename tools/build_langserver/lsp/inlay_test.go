@@ -0,0 +1,94 @@
+package lsp
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlayHints(t *testing.T) {
+	h := initHandlerText(`package(default_visibility = ["PUBLIC"])
+
+genrule(
+    name = "test",
+    cmd = "echo hello > $OUT",
+    sandbox = True,
+)
+
+filegroup(name = "fg", testonly = True)`)
+	hints := []inlayHint{}
+	err := h.Request("textDocument/inlayHint", &inlayHintParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(0, 0, 9, 0),
+	}, &hints)
+	assert.Nil(t, err)
+	assert.Equal(t, []inlayHint{
+		{
+			Position:    lsp.Position{Line: 6, Character: 0},
+			Label:       `visibility=["PUBLIC"]`,
+			Kind:        inlayHintParameter,
+			PaddingLeft: true,
+		},
+		{
+			Position:    lsp.Position{Line: 6, Character: 0},
+			Label:       "test_only=False",
+			Kind:        inlayHintParameter,
+			PaddingLeft: true,
+		},
+		{
+			Position:    lsp.Position{Line: 8, Character: 38},
+			Label:       `visibility=["PUBLIC"]`,
+			Kind:        inlayHintParameter,
+			PaddingLeft: true,
+		},
+	}, hints)
+}
+
+func TestInlayHintsRange(t *testing.T) {
+	h := initHandlerText(`genrule(
+    name = "test",
+    cmd = "echo hello > $OUT",
+)
+
+filegroup(name = "fg")`)
+	hints := []inlayHint{}
+	err := h.Request("textDocument/inlayHint", &inlayHintParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(5, 0, 6, 0),
+	}, &hints)
+	assert.Nil(t, err)
+	assert.Equal(t, []inlayHint{
+		{
+			Position:    lsp.Position{Line: 5, Character: 21},
+			Label:       "test_only=False",
+			Kind:        inlayHintParameter,
+			PaddingLeft: true,
+		},
+	}, hints)
+}
+
+func TestInlayHintsUTF16(t *testing.T) {
+	// The emoji is four bytes in UTF-8 but two UTF-16 code units, which is what LSP counts in.
+	h := initHandlerText(`filegroup(name = "😀")`)
+	hints := []inlayHint{}
+	err := h.Request("textDocument/inlayHint", &inlayHintParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(0, 0, 1, 0),
+	}, &hints)
+	assert.Nil(t, err)
+	assert.Equal(t, []inlayHint{
+		{
+			Position:    lsp.Position{Line: 0, Character: 21},
+			Label:       "test_only=False",
+			Kind:        inlayHintParameter,
+			PaddingLeft: true,
+		},
+	}, hints)
+}
@@ -20,21 +20,28 @@ import (
 	"github.com/thought-machine/please/src/help"
 	"github.com/thought-machine/please/src/parse/asp"
 	"github.com/thought-machine/please/src/plz"
+	pb "github.com/thought-machine/please/src/serve/proto/graph"
 )
 
 var log = logging.MustGetLogger("lsp")
 
 // A Handler is a handler suitable for use with jsonrpc2.
 type Handler struct {
-	Conn     Conn
-	methods  map[string]method
-	docs     map[string]*doc
-	mutex    sync.Mutex // guards docs
-	state    *core.BuildState
-	parser   *asp.Parser
-	builtins map[string]*asp.Statement
-	pkgs     *pkg
-	root     string
+	Conn Conn
+	// GraphAddress is the address of a plz serve process to attach to. If it's empty, or
+	// there is nothing listening there, we parse the repo ourselves instead.
+	GraphAddress string
+	graph        pb.GraphClient
+	graphMutex   sync.RWMutex // guards graph
+	methods      map[string]method
+	docs         map[string]*doc
+	mutex        sync.Mutex // guards docs
+	state        *core.BuildState
+	parser       *asp.Parser
+	builtins     map[string]*asp.Statement
+	pkgs         *pkg
+	subrepoPkgs  map[string]*pkg
+	root         string
 }
 
 // A Conn is a minimal set of the jsonrpc2.Conn that we need.
@@ -42,6 +49,8 @@ type Conn interface {
 	io.Closer
 	// Notify sends an asynchronous notification.
 	Notify(ctx context.Context, method string, params interface{}, opts ...jsonrpc2.CallOption) error
+	// Call sends a request to the client and waits for its response.
+	Call(ctx context.Context, method string, params, result interface{}, opts ...jsonrpc2.CallOption) error
 }
 
 type method struct {
@@ -56,19 +65,23 @@ func NewHandler() *Handler {
 		pkgs: &pkg{},
 	}
 	h.methods = map[string]method{
-		"initialize":                  h.method(h.initialize),
-		"initialized":                 h.method(h.initialized),
-		"shutdown":                    h.method(h.shutdown),
-		"exit":                        h.method(h.exit),
-		"textDocument/didOpen":        h.method(h.didOpen),
-		"textDocument/didChange":      h.method(h.didChange),
-		"textDocument/didSave":        h.method(h.didSave),
-		"textDocument/didClose":       h.method(h.didClose),
-		"textDocument/formatting":     h.method(h.formatting),
-		"textDocument/completion":     h.method(h.completion),
-		"textDocument/documentSymbol": h.method(h.symbols),
-		"textDocument/definition":     h.method(h.definition),
-		"textDocument/declaration":    h.method(h.definition),
+		"initialize":                       h.method(h.initialize),
+		"initialized":                      h.method(h.initialized),
+		"shutdown":                         h.method(h.shutdown),
+		"exit":                             h.method(h.exit),
+		"textDocument/didOpen":             h.method(h.didOpen),
+		"textDocument/didChange":           h.method(h.didChange),
+		"textDocument/didSave":             h.method(h.didSave),
+		"textDocument/didClose":            h.method(h.didClose),
+		"textDocument/formatting":          h.method(h.formatting),
+		"textDocument/completion":          h.method(h.completion),
+		"textDocument/documentSymbol":      h.method(h.symbols),
+		"textDocument/definition":          h.method(h.definition),
+		"textDocument/references":          h.method(h.references),
+		"textDocument/declaration":         h.method(h.definition),
+		"textDocument/semanticTokens/full": h.method(h.semanticTokensFull),
+		"textDocument/inlayHint":           h.method(h.inlayHint),
+		"workspace/executeCommand":         h.method(h.executeCommand),
 	}
 	return h
 }
@@ -79,7 +92,7 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 		if err := conn.ReplyWithError(ctx, req.ID, err); err != nil {
 			log.Error("Failed to send error response: %s", err)
 		}
-	} else if resp != nil {
+	} else if !req.Notif {
 		if err := conn.Reply(ctx, req.ID, resp); err != nil {
 			log.Error("Failed to send response: %s", err)
 		}
@@ -127,7 +140,19 @@ func (h *Handler) method(f interface{}) method {
 	}
 }
 
-func (h *Handler) initialize(params *lsp.InitializeParams) (*lsp.InitializeResult, error) {
+// initializeResult is the equivalent of lsp.InitializeResult, but with the extra capabilities we support.
+type initializeResult struct {
+	Capabilities serverCapabilities `json:"capabilities,omitempty"`
+}
+
+// serverCapabilities extends lsp.ServerCapabilities with newer things that go-lsp doesn't know about.
+type serverCapabilities struct {
+	lsp.ServerCapabilities
+	SemanticTokensProvider *semanticTokensOptions `json:"semanticTokensProvider,omitempty"`
+	InlayHintProvider      bool                   `json:"inlayHintProvider,omitempty"`
+}
+
+func (h *Handler) initialize(params *lsp.InitializeParams) (*initializeResult, error) {
 	// This is a bit yucky and stateful, but we only need to do it once.
 	if err := os.Chdir(fromURI(params.RootURI)); err != nil {
 		return nil, err
@@ -146,10 +171,23 @@ func (h *Handler) initialize(params *lsp.InitializeParams) (*lsp.InitializeResul
 	h.state.NeedBuild = false
 	// We need an unwrapped parser instance as well for raw access.
 	h.parser = asp.NewParser(h.state)
-	// Parse everything in the repo up front.
-	// This is a lot easier than trying to do clever partial parses later on, although
-	// eventually we may want that if we start dealing with truly large repos.
 	go func() {
+		// If there's a plz serve process running, it already has the whole graph so we can just use that.
+		if client := connectGraph(h.GraphAddress); client != nil {
+			if err := h.loadGraph(client); err != nil {
+				log.Warning("Failed to load build graph from plz serve, will parse the repo instead: %s", err)
+			} else {
+				h.graphMutex.Lock()
+				h.graph = client
+				h.graphMutex.Unlock()
+				h.buildPackageTree()
+				log.Debug("built completion package tree")
+				return
+			}
+		}
+		// Otherwise parse everything in the repo up front.
+		// This is a lot easier than trying to do clever partial parses later on, although
+		// eventually we may want that if we start dealing with truly large repos.
 		plz.RunHost(core.WholeGraph, h.state)
 		log.Debug("initial parse complete")
 		h.buildPackageTree()
@@ -157,20 +195,31 @@ func (h *Handler) initialize(params *lsp.InitializeParams) (*lsp.InitializeResul
 	}()
 	// Record all the builtin functions now
 	h.builtins = help.AllBuiltinFunctions(h.state)
-	return &lsp.InitializeResult{
-		Capabilities: lsp.ServerCapabilities{
-			TextDocumentSync: &lsp.TextDocumentSyncOptionsOrKind{
-				Options: &lsp.TextDocumentSyncOptions{
-					OpenClose: true,
-					Change:    lsp.TDSKFull, // TODO(peterebden): Support incremental updates
+	return &initializeResult{
+		Capabilities: serverCapabilities{
+			ServerCapabilities: lsp.ServerCapabilities{
+				TextDocumentSync: &lsp.TextDocumentSyncOptionsOrKind{
+					Options: &lsp.TextDocumentSyncOptions{
+						OpenClose: true,
+						Change:    lsp.TDSKFull, // TODO(peterebden): Support incremental updates
+					},
+				},
+				DocumentFormattingProvider: true,
+				DocumentSymbolProvider:     true,
+				DefinitionProvider:         true,
+				ReferencesProvider:         true,
+				CompletionProvider: &lsp.CompletionOptions{
+					TriggerCharacters: []string{"/", ":"},
+				},
+				ExecuteCommandProvider: &lsp.ExecuteCommandOptions{
+					Commands: []string{organiseDepsCommand},
 				},
 			},
-			DocumentFormattingProvider: true,
-			DocumentSymbolProvider:     true,
-			DefinitionProvider:         true,
-			CompletionProvider: &lsp.CompletionOptions{
-				TriggerCharacters: []string{"/", ":"},
+			SemanticTokensProvider: &semanticTokensOptions{
+				Legend: semanticLegend,
+				Full:   true,
 			},
+			InlayHintProvider: true,
 		},
 	}, nil
 }
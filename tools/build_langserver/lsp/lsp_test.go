@@ -303,6 +303,39 @@ func TestCompletionPackages(t *testing.T) {
 	}, completions)
 }
 
+func TestCompletionSubrepos(t *testing.T) {
+	h := NewHandler()
+	h.state = core.NewDefaultBuildState()
+	h.state.Graph.AddSubrepo(&core.Subrepo{Name: "third_party/go/grpc"})
+	h.state.Graph.AddSubrepo(&core.Subrepo{Name: "linux_arm64", IsCrossCompile: true})
+	pkg := core.NewPackage("src/core")
+	pkg.SubrepoName = "linux_arm64"
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "src/core", Name: "core", Subrepo: "linux_arm64"})
+	target.Visibility = core.WholeGraph
+	pkg.AddTarget(target)
+	h.state.Graph.AddPackage(pkg)
+	h.state.Graph.AddTarget(target)
+	h.buildPackageTree()
+	doc := &doc{Filename: "test/test.build"}
+
+	complete := func(partial string) []string {
+		list, err := h.completeString(doc, partial, 0, len(partial))
+		assert.NoError(t, err)
+		labels := []string{}
+		for _, item := range list.Items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+	assert.Equal(t, []string{"///third_party/go/grpc//"}, complete("///thi"))
+	assert.Equal(t, []string{"@linux_arm64//", "@third_party/go/grpc//"}, complete("@"))
+	assert.Equal(t, []string{"@linux_arm64//src"}, complete("@linux_arm64//s"))
+	assert.Equal(t, []string{"///linux_arm64//src/core"}, complete("///linux_arm64//src/c"))
+	assert.Equal(t, []string{"@linux_arm64//src/core:core"}, complete("@linux_arm64//src/core:"))
+	// Packages in subrepos shouldn't turn up in the main repo.
+	assert.Equal(t, []string{}, complete("//s"))
+}
+
 const testCompletionContentInMemory = `
 go_library(
     name = "test",
@@ -557,6 +590,41 @@ func TestDiagnostics(t *testing.T) {
 	}, msg.Payload)
 }
 
+const testTypeDiagnosticsContent = `
+go_library(
+    name = "test",
+    srcs = "test.go",
+)
+`
+
+func TestTypeDiagnostics(t *testing.T) {
+	h := initHandler()
+	err := h.Request("textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:  "file://test/test.build",
+			Text: testTypeDiagnosticsContent,
+		},
+	}, nil)
+	assert.NoError(t, err)
+	r := h.Conn.(*rpc)
+	msg := <-r.Notifications
+	assert.Equal(t, "textDocument/publishDiagnostics", msg.Method)
+	assert.Equal(t, &lsp.PublishDiagnosticsParams{
+		URI: lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/test/test.build")),
+		Diagnostics: []lsp.Diagnostic{
+			{
+				Range: lsp.Range{
+					Start: lsp.Position{Line: 3, Character: 11},
+					End:   lsp.Position{Line: 3, Character: 20},
+				},
+				Severity: lsp.Error,
+				Source:   "plz tool langserver",
+				Message:  "Invalid type for argument srcs to go_library; expected list, was str",
+			},
+		},
+	}, msg.Payload)
+}
+
 // initHandler is a wrapper around creating a new handler and initializing it, which is
 // more convenient for most tests.
 func initHandler() *Handler {
@@ -594,6 +662,12 @@ func (r *rpc) Notify(ctx context.Context, method string, params interface{}, opt
 	return nil
 }
 
+func (r *rpc) Call(ctx context.Context, method string, params, result interface{}, opts ...jsonrpc2.CallOption) error {
+	r.Notifications <- message{Method: method, Payload: params}
+	// Pretend the client accepted whatever we sent it.
+	return json.Unmarshal([]byte(`{"applied": true}`), result)
+}
+
 // Request is a slightly higher-level wrapper for testing that handles JSON serialisation.
 func (h *Handler) Request(method string, req, resp interface{}) *jsonrpc2.Error {
 	b, err := json.Marshal(req)
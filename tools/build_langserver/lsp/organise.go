@@ -0,0 +1,175 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// organiseDepsCommand is the name of the command that organises deps in a file.
+const organiseDepsCommand = "plz.organizeDeps"
+
+// organisedArgs are the set of call arguments that we organise.
+var organisedArgs = map[string]bool{
+	"deps":          true,
+	"exported_deps": true,
+	"srcs":          true,
+	"data":          true,
+	"tools":         true,
+	"visibility":    true,
+}
+
+// applyWorkspaceEditParams are the parameters to a workspace/applyEdit request.
+type applyWorkspaceEditParams struct {
+	Label string            `json:"label,omitempty"`
+	Edit  lsp.WorkspaceEdit `json:"edit"`
+}
+
+// applyWorkspaceEditResult is the client's response to a workspace/applyEdit request.
+type applyWorkspaceEditResult struct {
+	Applied       bool   `json:"applied"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+// executeCommand implements workspace/executeCommand.
+// The edits are sent back to the client as a workspace/applyEdit request; the document is then
+// updated when it sends us the resulting change, as for any other edit.
+func (h *Handler) executeCommand(params *lsp.ExecuteCommandParams) (*struct{}, error) {
+	if params.Command != organiseDepsCommand {
+		return nil, fmt.Errorf("Unknown command %s", params.Command)
+	} else if len(params.Arguments) != 1 {
+		return nil, fmt.Errorf("%s takes exactly one argument, the URI of the document to organise", params.Command)
+	}
+	uri, ok := params.Arguments[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid argument to %s: %v", params.Command, params.Arguments[0])
+	}
+	edits, err := h.organiseDeps(lsp.DocumentURI(uri))
+	if err != nil {
+		return nil, err
+	} else if len(edits) == 0 {
+		return nil, nil
+	}
+	// This has to happen asynchronously; the client won't answer until we've replied to this request.
+	go func() {
+		result := &applyWorkspaceEditResult{}
+		if err := h.Conn.Call(context.Background(), "workspace/applyEdit", &applyWorkspaceEditParams{
+			Label: "Organise deps",
+			Edit:  lsp.WorkspaceEdit{Changes: map[string][]lsp.TextEdit{uri: edits}},
+		}, result); err != nil {
+			log.Error("Failed to apply edits to %s: %s", uri, err)
+		} else if !result.Applied {
+			log.Warning("Client didn't apply edits to %s: %s", uri, result.FailureReason)
+		}
+	}()
+	return nil, nil
+}
+
+// organiseDeps canonicalises, deduplicates and sorts all the labels in the given document.
+func (h *Handler) organiseDeps(uri lsp.DocumentURI) ([]lsp.TextEdit, error) {
+	doc := h.doc(uri)
+	if !h.state.Config.IsABuildFile(path.Base(doc.Filename)) {
+		return []lsp.TextEdit{}, nil // Labels are only meaningful in BUILD files.
+	}
+	f, err := build.ParseBuild(doc.Filename, []byte(doc.Text()))
+	if err != nil {
+		return nil, err
+	}
+	pkg := core.BuildLabel{PackageName: doc.PackageName()}
+	build.Walk(f, func(expr build.Expr, stack []build.Expr) {
+		if call, ok := expr.(*build.CallExpr); ok {
+			for _, arg := range call.List {
+				if assign, ok := arg.(*build.AssignExpr); ok {
+					if lhs, ok := assign.LHS.(*build.Ident); ok && organisedArgs[lhs.Name] {
+						if list, ok := assign.RHS.(*build.ListExpr); ok {
+							organiseList(list, pkg)
+						}
+					}
+				}
+			}
+		}
+	})
+	before := doc.Text()
+	after := string(build.Format(f))
+	if before == after {
+		return []lsp.TextEdit{}, nil
+	}
+	edits := computeEdits(doc.Lines(), strings.Split(after, "\n"))
+	ret := make([]lsp.TextEdit, len(edits))
+	for i, edit := range edits {
+		ret[i] = *edit
+	}
+	return ret, nil
+}
+
+// organiseList canonicalises, deduplicates and sorts a single list.
+// Lists containing anything other than plain strings are left alone since we can't safely reorder them.
+func organiseList(list *build.ListExpr, pkg core.BuildLabel) {
+	strs := make([]*build.StringExpr, 0, len(list.List))
+	for _, elem := range list.List {
+		str, ok := elem.(*build.StringExpr)
+		if !ok {
+			return
+		}
+		strs = append(strs, str)
+	}
+	seen := make(map[string]bool, len(strs))
+	list.List = list.List[:0]
+	for _, str := range strs {
+		str.Value = canonicaliseLabel(str.Value, pkg)
+		if !seen[str.Value] {
+			seen[str.Value] = true
+			list.List = append(list.List, str)
+		}
+	}
+	sort.SliceStable(list.List, func(i, j int) bool {
+		return labelLess(list.List[i].(*build.StringExpr).Value, list.List[j].(*build.StringExpr).Value)
+	})
+}
+
+// canonicaliseLabel returns the shortest form of a label within the given package.
+// Strings that aren't build labels (e.g. source files) are returned unchanged.
+func canonicaliseLabel(s string, pkg core.BuildLabel) string {
+	if !core.LooksLikeABuildLabel(s) || strings.HasSuffix(s, "/...") || strings.HasSuffix(s, ":all") {
+		return s
+	}
+	label, err := core.TryParseBuildLabel(s, pkg.PackageName, "")
+	if err != nil {
+		return s
+	}
+	return label.ShortString(pkg)
+}
+
+// labelLess orders strings following the same rules as the formatter; local labels first,
+// then absolute ones, then subrepo ones, with files sorted before any of them.
+func labelLess(a, b string) bool {
+	if pa, pb := labelPhase(a), labelPhase(b); pa != pb {
+		return pa < pb
+	}
+	sa := strings.Split(strings.Replace(a, ":", ".", -1), ".")
+	sb := strings.Split(strings.Replace(b, ":", ".", -1), ".")
+	for i := 0; i < len(sa) && i < len(sb); i++ {
+		if sa[i] != sb[i] {
+			return sa[i] < sb[i]
+		}
+	}
+	return len(sa) < len(sb)
+}
+
+func labelPhase(s string) int {
+	if strings.HasPrefix(s, ":") {
+		return 1
+	} else if strings.HasPrefix(s, "//") {
+		return 2
+	} else if strings.HasPrefix(s, "@") {
+		return 3
+	}
+	return 0
+}
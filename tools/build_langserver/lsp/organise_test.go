@@ -0,0 +1,78 @@
+package lsp
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const testOrganiseContent = `go_test(
+    name = "lsp_test",
+    srcs = ["lsp_test.go", "lsp_test.go"],
+    deps = [
+        "//third_party/go:testify",
+        "//test:lsp",
+        "//src/core:core",
+        ":lsp",
+    ],
+)
+`
+
+const testOrganisedContent = `go_test(
+    name = "lsp_test",
+    srcs = ["lsp_test.go"],
+    deps = [
+        ":lsp",
+        "//src/core",
+        "//third_party/go:testify",
+    ],
+)
+`
+
+func TestOrganiseDeps(t *testing.T) {
+	h := initHandlerText(testOrganiseContent)
+	err := h.Request("workspace/executeCommand", &lsp.ExecuteCommandParams{
+		Command:   "plz.organizeDeps",
+		Arguments: []interface{}{testURI},
+	}, nil)
+	assert.NoError(t, err)
+	r := h.Conn.(*rpc)
+	msg := <-r.Notifications
+	for msg.Method == "textDocument/publishDiagnostics" {
+		msg = <-r.Notifications
+	}
+	assert.Equal(t, "workspace/applyEdit", msg.Method)
+	params := msg.Payload.(*applyWorkspaceEditParams)
+	assert.Equal(t, 1, len(params.Edit.Changes))
+	// The document itself shouldn't change until the client tells us it has.
+	assert.Equal(t, testOrganiseContent, h.CurrentContent("test/test.build"))
+	err = h.Request("textDocument/didChange", &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: testURI},
+		},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: testOrganisedContent}},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, testOrganisedContent, h.CurrentContent("test/test.build"))
+}
+
+func TestOrganiseDepsUnknownCommand(t *testing.T) {
+	h := initHandlerText(testOrganiseContent)
+	err := h.Request("workspace/executeCommand", &lsp.ExecuteCommandParams{
+		Command:   "plz.wibble",
+		Arguments: []interface{}{testURI},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestCanonicaliseLabel(t *testing.T) {
+	pkg := core.BuildLabel{PackageName: "src/core"}
+	assert.Equal(t, ":core", canonicaliseLabel("//src/core:core", pkg))
+	assert.Equal(t, "//src/parse", canonicaliseLabel("//src/parse:parse", pkg))
+	assert.Equal(t, "//src/parse:asp", canonicaliseLabel("//src/parse:asp", pkg))
+	assert.Equal(t, "test_data/file.txt", canonicaliseLabel("test_data/file.txt", pkg))
+	assert.Equal(t, "//src/...", canonicaliseLabel("//src/...", pkg))
+}
@@ -0,0 +1,74 @@
+package lsp
+
+import (
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// references implements 'find references' support.
+// Given a build label, or a position within the definition of a target, it finds all the
+// targets that depend on that target.
+func (h *Handler) references(params *lsp.ReferenceParams) ([]lsp.Location, error) {
+	doc := h.doc(params.TextDocument.URI)
+	ast := h.parseIfNeeded(doc)
+	locs := []lsp.Location{}
+	label, ok := h.labelAt(doc, ast, aspPos(params.Position))
+	if !ok {
+		return locs, nil
+	}
+	labels, err := h.reverseDependencies(label)
+	if err != nil {
+		return nil, err
+	}
+	if params.Context.IncludeDeclaration {
+		labels = append([]core.BuildLabel{label}, labels...)
+	}
+	for _, l := range labels {
+		if loc := h.findLabelDefinition(doc, ast, l); loc.URI != "" {
+			locs = append(locs, loc)
+		}
+	}
+	return locs, nil
+}
+
+// labelAt returns the build label of the target at the given position.
+// That's either a string literal naming it, or otherwise the target whose definition encloses the position.
+func (h *Handler) labelAt(doc *doc, ast []*asp.Statement, pos asp.Position) (core.BuildLabel, bool) {
+	pkgName := doc.PackageName()
+	var label core.BuildLabel
+	found := false
+	asp.WalkAST(ast, func(expr *asp.Expression) bool {
+		if found || !asp.WithinRange(pos, expr.Pos, expr.EndPos) {
+			return false
+		} else if expr.Val != nil && expr.Val.String != "" {
+			if s := stringLiteral(expr.Val.String); core.LooksLikeABuildLabel(s) {
+				if l, err := core.TryParseBuildLabel(s, pkgName, ""); err == nil && !l.IsAllTargets() && !l.IsAllSubpackages() {
+					label = l.Parent()
+					found = true
+				}
+			}
+			return false
+		}
+		return true
+	})
+	if found {
+		return label, true
+	}
+	asp.WalkAST(ast, func(stmt *asp.Statement) bool {
+		if found || !asp.WithinRange(pos, stmt.Pos, stmt.EndPos) {
+			return false
+		} else if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Call != nil {
+			for _, arg := range stmt.Ident.Action.Call.Arguments {
+				if arg.Name == "name" && arg.Value.Val != nil && arg.Value.Val.String != "" {
+					label = core.BuildLabel{PackageName: pkgName, Name: stringLiteral(arg.Value.Val.String)}
+					found = true
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return label, found
+}
@@ -0,0 +1,177 @@
+package lsp
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/thought-machine/please/src/core"
+	pb "github.com/thought-machine/please/src/serve/proto/graph"
+)
+
+var coreTestURI = lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/src/core/test.build"))
+
+func TestReferences(t *testing.T) {
+	h := initHandlerText(`x = ["//src/core:core"]`)
+	h.WaitForPackageTree()
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 0, Character: 10},
+		},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   coreTestURI,
+			Range: xrng(18, 0, 25, 1),
+		},
+	}, locs)
+}
+
+func TestReferencesIncludeDeclaration(t *testing.T) {
+	h := initHandlerText(`x = ["//src/core:core"]`)
+	h.WaitForPackageTree()
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 0, Character: 10},
+		},
+		Context: lsp.ReferenceContext{IncludeDeclaration: true},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   coreTestURI,
+			Range: xrng(0, 0, 16, 1),
+		},
+		{
+			URI:   coreTestURI,
+			Range: xrng(18, 0, 25, 1),
+		},
+	}, locs)
+}
+
+func TestReferencesStatement(t *testing.T) {
+	h := initHandlerText(`go_library(name = "lsp")`)
+	h.WaitForPackageTree()
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 0, Character: 3},
+		},
+		Context: lsp.ReferenceContext{IncludeDeclaration: true},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data/test/test.build")),
+			Range: xrng(0, 0, 0, 24),
+		},
+	}, locs)
+}
+
+func TestReferencesRemote(t *testing.T) {
+	h := initHandlerText(`x = ["//src/core:core"]`)
+	h.WaitForPackageTree()
+	// The remote graph is authoritative, so we should get whatever it says.
+	h.graph = &fakeGraph{}
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 0, Character: 10},
+		},
+	}, &locs)
+	assert.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{
+			URI:   coreTestURI,
+			Range: xrng(0, 0, 16, 1),
+		},
+	}, locs)
+}
+
+func TestLoadGraph(t *testing.T) {
+	h := NewHandler()
+	h.state = core.NewDefaultBuildState()
+	h.root = "/repo"
+	require.NoError(t, h.loadGraph(&fakeGraph{root: "/repo"}))
+	pkg := h.state.Graph.Package("src/core", "")
+	require.NotNil(t, pkg)
+	assert.Equal(t, "src/core/test.build", pkg.Filename)
+	target := h.state.Graph.Target(core.ParseBuildLabel("//src/core:core", ""))
+	require.NotNil(t, target)
+	assert.Equal(t, []core.BuildLabel{core.WholeGraph[0]}, target.Visibility)
+	assert.Equal(t, []string{"core.a"}, target.Outputs())
+	assert.Equal(t, []core.BuildInput{
+		core.FileLabel{File: "config.go", Package: "src/core"},
+		core.ParseBuildLabel("//src/core:version", ""),
+	}, target.AllSources())
+	defs := h.state.Graph.Target(core.ParseBuildLabel("//build_defs:defs", ""))
+	require.NotNil(t, defs)
+	assert.True(t, defs.IsFilegroup)
+	assert.Nil(t, h.state.Graph.Package("empty", ""))
+}
+
+func TestLoadGraphDifferentRepo(t *testing.T) {
+	h := NewHandler()
+	h.state = core.NewDefaultBuildState()
+	h.root = "/repo"
+	assert.Error(t, h.loadGraph(&fakeGraph{root: "/another_repo"}))
+	assert.Nil(t, h.state.Graph.Package("src/core", ""))
+}
+
+func TestConnectGraphNoServer(t *testing.T) {
+	graphTimeout = 0
+	assert.Nil(t, connectGraph(""))
+	assert.Nil(t, connectGraph("127.0.0.1:1"))
+}
+
+// A fakeGraph implements a minimal version of the plz serve API.
+type fakeGraph struct {
+	pb.GraphClient
+	root string
+}
+
+func (g *fakeGraph) Packages(ctx context.Context, in *pb.PackagesRequest, opts ...grpc.CallOption) (*pb.PackagesResponse, error) {
+	return &pb.PackagesResponse{
+		RepoRoot: g.root,
+		Packages: []*pb.Package{
+			{Name: "build_defs", Filename: "build_defs/test.build", Targets: []string{"//build_defs:defs"}},
+			{Name: "empty", Filename: "empty/test.build"},
+			{Name: "src/core", Filename: "src/core/test.build", Targets: []string{"//src/core:core", "//src/core:version"}},
+		},
+	}, nil
+}
+
+func (g *fakeGraph) Targets(ctx context.Context, in *pb.TargetsRequest, opts ...grpc.CallOption) (*pb.TargetsResponse, error) {
+	return &pb.TargetsResponse{
+		Targets: []*pb.Target{
+			{Label: "//build_defs:defs", Sources: []string{"build_defs/go_bindata.build_defs"}, Filegroup: true},
+			{Label: "//src/core:core", Sources: []string{"src/core/config.go", "//src/core:version"}, Outputs: []string{"core.a"}, Visibility: []string{"//..."}},
+			{Label: "//src/core:version"},
+		},
+	}, nil
+}
+
+func (g *fakeGraph) ReverseDependencies(ctx context.Context, in *pb.ReverseDependenciesRequest, opts ...grpc.CallOption) (*pb.ReverseDependenciesResponse, error) {
+	return &pb.ReverseDependenciesResponse{Labels: []string{"//src/core:core"}}, nil
+}
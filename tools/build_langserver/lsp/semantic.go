@@ -0,0 +1,227 @@
+package lsp
+
+import (
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// The go-lsp package predates semantic tokens, so we define the types we need for them here.
+
+// A semanticTokensLegend describes the token types & modifiers that we emit.
+type semanticTokensLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+// semanticTokensOptions describes our support for semantic tokens to the client.
+type semanticTokensOptions struct {
+	Legend semanticTokensLegend `json:"legend"`
+	Full   bool                 `json:"full"`
+}
+
+// semanticTokensParams is the request for textDocument/semanticTokens/full.
+type semanticTokensParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+}
+
+// semanticTokens is the response to textDocument/semanticTokens/full.
+type semanticTokens struct {
+	Data []uint32 `json:"data"`
+}
+
+// Token types, which are indices into the legend below.
+const (
+	semanticKeyword uint32 = iota
+	semanticFunction
+	semanticParameter
+	semanticVariable
+	semanticString
+	semanticNumber
+	semanticLabel
+)
+
+// Token modifiers, which are bit flags corresponding to the legend.
+const (
+	semanticDeclaration uint32 = 1 << iota
+	semanticDefaultLibrary
+)
+
+// semanticLegend is the legend we send to the client. Build labels don't have an obvious
+// equivalent among the standard token types; we use namespace since they name things in
+// other packages.
+var semanticLegend = semanticTokensLegend{
+	TokenTypes:     []string{"keyword", "function", "parameter", "variable", "string", "number", "namespace"},
+	TokenModifiers: []string{"declaration", "defaultLibrary"},
+}
+
+// keywords are the identifiers that are reserved words in the language.
+var keywords = map[string]bool{
+	"and": true, "assert": true, "break": true, "continue": true, "def": true, "elif": true,
+	"else": true, "for": true, "if": true, "in": true, "is": true, "lambda": true, "not": true,
+	"or": true, "pass": true, "return": true, "None": true, "True": true, "False": true,
+}
+
+// semanticTokensFull implements textDocument/semanticTokens/full.
+// It's based on the token stream from the lexer rather than the AST, which means it still
+// works sensibly on files that don't parse (e.g. because the user is halfway through editing them).
+func (h *Handler) semanticTokensFull(params *semanticTokensParams) (*semanticTokens, error) {
+	doc := h.doc(params.TextDocument.URI)
+	// Ignore any error; as with parsing, we just take whatever we got before it.
+	lines := doc.Lines()
+	tokens, _ := asp.Tokenize(strings.NewReader(strings.Join(lines, "\n")))
+	enc := &semanticEncoder{lines: lines}
+	// Tracks the brackets we're inside; each is true if it's the arguments to a call or function definition.
+	brackets := []bool{}
+	inCall := func() bool { return len(brackets) > 0 && brackets[len(brackets)-1] }
+	inDef := false
+	for i, tok := range tokens {
+		var next, prev asp.Token
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+		if i > 0 {
+			prev = tokens[i-1]
+		}
+		switch tok.Type {
+		case asp.Ident:
+			if keywords[tok.Value] {
+				enc.Add(tok.Pos, tok.Value, semanticKeyword, 0)
+			} else if prev.Type == asp.Ident && prev.Value == "def" {
+				enc.Add(tok.Pos, tok.Value, semanticFunction, semanticDeclaration)
+				inDef = true
+			} else if next.Type == '(' {
+				var modifiers uint32
+				if _, present := h.builtins[tok.Value]; present {
+					modifiers = semanticDefaultLibrary
+				}
+				enc.Add(tok.Pos, tok.Value, semanticFunction, modifiers)
+			} else if inCall() && (next.Type == '=' || (inDef && len(brackets) == 1 && (prev.Type == '(' || prev.Type == ','))) {
+				enc.Add(tok.Pos, tok.Value, semanticParameter, 0)
+			} else {
+				enc.Add(tok.Pos, tok.Value, semanticVariable, 0)
+			}
+		case asp.Int:
+			enc.Add(tok.Pos, tok.Value, semanticNumber, 0)
+		case asp.String:
+			enc.AddString(tok.Pos, tok.Value)
+		case '(':
+			brackets = append(brackets, prev.Type == asp.Ident && !keywords[prev.Value])
+		case '[', '{':
+			brackets = append(brackets, false)
+		case ')', ']', '}':
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+			if len(brackets) == 0 {
+				inDef = false
+			}
+		}
+	}
+	return &semanticTokens{Data: enc.Data}, nil
+}
+
+// A semanticEncoder encodes tokens into the relative format that LSP expects.
+// Columns and lengths are in UTF-16 code units, as LSP requires; lines are the document
+// being encoded so we can convert the lexer's byte offsets.
+type semanticEncoder struct {
+	Data     []uint32
+	lines    []string
+	lastLine int
+	lastCol  int
+}
+
+// Add adds a single token at the given position, which may span multiple lines.
+func (enc *semanticEncoder) Add(pos asp.Position, value string, tokenType, modifiers uint32) {
+	line := pos.Line - 1
+	col := pos.Column - 1
+	for i, s := range strings.Split(value, "\n") {
+		if i > 0 {
+			line++
+			col = 0
+		}
+		enc.add(line, col, s, tokenType, modifiers)
+	}
+}
+
+// add adds a single token that doesn't span multiple lines, starting at the given byte offset in it.
+func (enc *semanticEncoder) add(line, col int, s string, tokenType, modifiers uint32) {
+	length := utf16Len(s)
+	if length == 0 {
+		return
+	}
+	if line < len(enc.lines) {
+		col = utf16Column(enc.lines[line], col)
+	}
+	deltaCol := col
+	if line == enc.lastLine {
+		deltaCol = col - enc.lastCol
+	}
+	enc.Data = append(enc.Data, uint32(line-enc.lastLine), uint32(deltaCol), uint32(length), tokenType, modifiers)
+	enc.lastLine = line
+	enc.lastCol = col
+}
+
+// AddString adds a string token. Build labels are distinguished from other strings, and the
+// interpolated variables in f-strings are emitted separately from the literal parts.
+func (enc *semanticEncoder) AddString(pos asp.Position, value string) {
+	if strings.HasPrefix(value, "f") {
+		enc.addFString(pos, value)
+	} else if core.LooksLikeABuildLabel(unquote(value)) {
+		enc.Add(pos, value, semanticLabel, 0)
+	} else {
+		enc.Add(pos, value, semanticString, 0)
+	}
+}
+
+// addFString adds the parts of an f-string.
+func (enc *semanticEncoder) addFString(pos asp.Position, value string) {
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] != '{' {
+			continue
+		} else if i+1 < len(value) && value[i+1] == '{' {
+			i++ // Escaped brace
+			continue
+		} else if i > 0 && value[i-1] == '$' {
+			continue // Shell-style variable, which isn't interpolated.
+		}
+		end := strings.IndexByte(value[i:], '}')
+		if end == -1 {
+			break
+		}
+		end += i
+		enc.Add(pos, value[start:i+1], semanticString, 0)
+		pos = advance(pos, value[start:i+1])
+		enc.Add(pos, value[i+1:end], semanticVariable, 0)
+		pos = advance(pos, value[i+1:end])
+		start = end
+		i = end
+	}
+	enc.Add(pos, value[start:], semanticString, 0)
+}
+
+// advance returns the position after the given text, starting at the given position.
+func advance(pos asp.Position, s string) asp.Position {
+	if idx := strings.LastIndexByte(s, '\n'); idx != -1 {
+		pos.Line += strings.Count(s, "\n")
+		pos.Column = len(s) - idx
+		return pos
+	}
+	pos.Column += len(s)
+	return pos
+}
+
+// unquote returns the contents of a raw string token without its prefix or quotes.
+func unquote(s string) string {
+	s = strings.TrimPrefix(s, "r")
+	for _, quote := range []string{`"""`, `'''`, `"`, `'`} {
+		if strings.HasPrefix(s, quote) && strings.HasSuffix(s, quote) && len(s) >= 2*len(quote) {
+			return s[len(quote) : len(s)-len(quote)]
+		}
+	}
+	return s
+}
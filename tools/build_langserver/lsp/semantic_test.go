@@ -0,0 +1,61 @@
+package lsp
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemanticTokens(t *testing.T) {
+	h := initHandlerText(`def my_rule(name, srcs=None):
+    return filegroup(name = name, srcs = srcs + [f"{name}.txt"], deps = ["//src/core"], test_only = True, priority = 1)`)
+	tokens := &semanticTokens{}
+	err := h.Request("textDocument/semanticTokens/full", &semanticTokensParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+	}, tokens)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{
+		0, 0, 3, semanticKeyword, 0,
+		0, 4, 7, semanticFunction, semanticDeclaration,
+		0, 8, 4, semanticParameter, 0,
+		0, 6, 4, semanticParameter, 0,
+		0, 5, 4, semanticKeyword, 0,
+		1, 4, 6, semanticKeyword, 0,
+		0, 7, 9, semanticFunction, semanticDefaultLibrary,
+		0, 10, 4, semanticParameter, 0,
+		0, 7, 4, semanticVariable, 0,
+		0, 6, 4, semanticParameter, 0,
+		0, 7, 4, semanticVariable, 0,
+		0, 8, 3, semanticString, 0, // f"{
+		0, 3, 4, semanticVariable, 0, // name
+		0, 4, 6, semanticString, 0, // }.txt"
+		0, 9, 4, semanticParameter, 0,
+		0, 8, 12, semanticLabel, 0,
+		0, 15, 9, semanticParameter, 0,
+		0, 12, 4, semanticKeyword, 0,
+		0, 6, 8, semanticParameter, 0,
+		0, 11, 1, semanticNumber, 0,
+	}, tokens.Data)
+}
+
+func TestSemanticTokensUTF16(t *testing.T) {
+	h := initHandlerText(`x = ["😀", "é"]
+y = 1`)
+	tokens := &semanticTokens{}
+	err := h.Request("textDocument/semanticTokens/full", &semanticTokensParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+	}, tokens)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{
+		0, 0, 1, semanticVariable, 0,
+		0, 5, 4, semanticString, 0, // The emoji is a surrogate pair
+		0, 6, 3, semanticString, 0,
+		1, 0, 1, semanticVariable, 0,
+		0, 4, 1, semanticNumber, 0,
+	}, tokens.Data)
+}
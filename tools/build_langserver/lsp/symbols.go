@@ -58,6 +58,8 @@ func exprToSymbol(expr *asp.Expression) (string, lsp.SymbolKind) {
 		return reconstructFString(v.FString), lsp.SKString
 	} else if v.Int != nil {
 		return strconv.Itoa(v.Int.Int), lsp.SKNumber
+	} else if v.Float != nil {
+		return strconv.FormatFloat(v.Float.Float, 'g', -1, 64), lsp.SKNumber
 	} else if v.Bool != "" {
 		if v.Bool == "None" {
 			return "None", lsp.SKConstant
@@ -67,6 +69,8 @@ func exprToSymbol(expr *asp.Expression) (string, lsp.SymbolKind) {
 		return "list", lsp.SKArray
 	} else if v.Dict != nil {
 		return "dict", lsp.SKObject
+	} else if v.Set != nil {
+		return "set", lsp.SKArray
 	} else if v.Ident != nil {
 		if len(v.Ident.Action) > 0 && v.Ident.Action[0].Call != nil {
 			return v.Ident.Name, lsp.SKFunction
@@ -111,6 +115,28 @@ func pos(pos asp.Position) lsp.Position {
 	return lsp.Position{Line: pos.Line - 1, Character: pos.Column - 1}
 }
 
+// utf16Column converts a byte offset within a line into a column in UTF-16 code units,
+// which is how LSP counts characters.
+func utf16Column(line string, col int) int {
+	if col > len(line) {
+		return utf16Len(line) + col - len(line)
+	}
+	return utf16Len(line[:col])
+}
+
+// utf16Len returns the length of a string in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2 // Outside the BMP, so it's a surrogate pair
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
 // aspPos converts an LSP position into an asp one.
 // Note 1 vs 0-indexing again.
 func aspPos(pos lsp.Position) asp.Position {
@@ -7,9 +7,9 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/bazelbuild/buildtools/build"
 	"github.com/sourcegraph/go-lsp"
 
+	"github.com/thought-machine/please/src/format"
 	"github.com/thought-machine/please/src/parse/asp"
 )
 
@@ -38,6 +38,15 @@ func (d *doc) Lines() []string {
 	return d.Content
 }
 
+// PackageName returns the name of the package this document is in.
+// Files at the repo root are in the package "", not ".".
+func (d *doc) PackageName() string {
+	if pkg := path.Dir(d.Filename); pkg != "." {
+		return pkg
+	}
+	return ""
+}
+
 func (d *doc) SetText(text string) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
@@ -137,22 +146,22 @@ func (h *Handler) didClose(params *lsp.DidCloseTextDocumentParams) (*struct{}, e
 func (h *Handler) formatting(params *lsp.DocumentFormattingParams) ([]*lsp.TextEdit, error) {
 	doc := h.doc(params.TextDocument.URI)
 	// Ignore formatting options, BUILD files are always canonically formatted at 4-space tabs.
-	fn := build.ParseDefault
-	if h.state.Config.IsABuildFile(path.Base(doc.Filename)) {
-		fn = build.ParseBuild
-	}
-	f, err := fn(doc.Filename, []byte(doc.Text()))
+	before := doc.Text()
+	formatted, err := format.Format(h.state.Config, doc.Filename, []byte(before))
 	if err != nil {
 		return nil, err
 	}
-	before := doc.Text()
-	after := string(build.Format(f))
+	after := string(formatted)
 	if before == after {
 		return []*lsp.TextEdit{}, nil // Already formatted - great!
 	}
 	linesBefore := doc.Lines()
 	doc.SetText(after)
-	linesAfter := doc.Lines()
+	return computeEdits(linesBefore, doc.Lines()), nil
+}
+
+// computeEdits returns the set of edits needed to transform one set of lines into another.
+func computeEdits(linesBefore, linesAfter []string) []*lsp.TextEdit {
 	// TODO(peterebden): Could do cleverer matching here...
 	edits := []*lsp.TextEdit{}
 	for i, line := range linesAfter {
@@ -176,5 +185,5 @@ func (h *Handler) formatting(params *lsp.DocumentFormattingParams) ([]*lsp.TextE
 			})
 		}
 	}
-	return edits, nil
+	return edits
 }
@@ -0,0 +1,223 @@
+// Package converter implements conversion of Bazel WORKSPACE and MODULE.bazel files into
+// equivalent Please build rules.
+package converter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// Convert converts the given WORKSPACE or MODULE.bazel file into a BUILD file containing equivalent
+// Please rules. Repository rules that we don't know how to convert are noted in comments.
+func Convert(filename string, data []byte) ([]byte, error) {
+	f, err := build.ParseWorkspace(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	out := &build.File{Path: "BUILD", Type: build.TypeBuild}
+	unconverted := []string{}
+	for _, stmt := range f.Stmt {
+		call, ok := stmt.(*build.CallExpr)
+		if !ok {
+			continue
+		}
+		rule := callName(call)
+		if converted, err := convertCall(rule, call); err != nil {
+			return nil, fmt.Errorf("%s: %s", position(filename, call), err)
+		} else if converted != nil {
+			out.Stmt = append(out.Stmt, converted)
+		} else if msg := unconvertedMessage(rule, call); msg != "" {
+			unconverted = append(unconverted, msg)
+		}
+	}
+	if len(unconverted) > 0 {
+		comments := make([]build.Comment, len(unconverted)+1)
+		comments[0] = build.Comment{Token: "# The following could not be converted automatically:"}
+		for i, msg := range unconverted {
+			comments[i+1] = build.Comment{Token: "#   " + msg}
+		}
+		out.Stmt = append(out.Stmt, &build.CommentBlock{Comments: build.Comments{After: comments}})
+	}
+	return build.Format(out), nil
+}
+
+// convertCall converts a single call into its Please equivalent. It returns nil if the call
+// isn't one we know how to convert.
+func convertCall(rule string, call *build.CallExpr) (build.Expr, error) {
+	switch rule {
+	case "http_archive":
+		return convertHTTPArchive(call)
+	case "http_file":
+		return convertHTTPFile(call)
+	}
+	return nil, nil
+}
+
+// convertHTTPArchive converts a http_archive call to http_archive or new_http_archive,
+// depending on whether it supplies its own BUILD file.
+func convertHTTPArchive(call *build.CallExpr) (build.Expr, error) {
+	args := arguments(call)
+	name, err := requiredString(args, "name")
+	if err != nil {
+		return nil, err
+	}
+	urls, err := urls(args)
+	if err != nil {
+		return nil, err
+	}
+	rule := "http_archive"
+	ret := []build.Expr{assign("name", str(name)), assign("urls", urls)}
+	if buildFile := stringArg(args, "build_file"); buildFile != "" {
+		path, err := convertBuildFile(buildFile)
+		if err != nil {
+			return nil, err
+		}
+		rule = "new_http_archive"
+		ret = append(ret, assign("build_file", str(path)))
+	} else if content, ok := args["build_file_content"]; ok {
+		rule = "new_http_archive"
+		ret = append(ret, assign("build_file_content", content))
+	}
+	if prefix := stringArg(args, "strip_prefix"); prefix != "" {
+		ret = append(ret, assign("strip_prefix", str(prefix)))
+	}
+	if hash := stringArg(args, "sha256"); hash != "" {
+		ret = append(ret, assign("hashes", list(str(hash))))
+	}
+	return newCall(rule, ret), nil
+}
+
+// convertHTTPFile converts a http_file call to a remote_file.
+func convertHTTPFile(call *build.CallExpr) (build.Expr, error) {
+	args := arguments(call)
+	name, err := requiredString(args, "name")
+	if err != nil {
+		return nil, err
+	}
+	urls, err := urls(args)
+	if err != nil {
+		return nil, err
+	}
+	ret := []build.Expr{assign("name", str(name)), assign("url", urls)}
+	if out := stringArg(args, "downloaded_file_path"); out != "" {
+		ret = append(ret, assign("out", str(path.Base(out))))
+	}
+	if hash := stringArg(args, "sha256"); hash != "" {
+		ret = append(ret, assign("hashes", list(str(hash))))
+	}
+	if ident, ok := args["executable"].(*build.Ident); ok && ident.Name == "True" {
+		ret = append(ret, assign("binary", &build.Ident{Name: "True"}))
+	}
+	ret = append(ret, assign("visibility", list(str("PUBLIC"))))
+	return newCall("remote_file", ret), nil
+}
+
+// unconvertedMessage returns a description of a call we couldn't convert, or the empty string
+// if it's something we don't need to convert at all.
+func unconvertedMessage(rule string, call *build.CallExpr) string {
+	args := arguments(call)
+	switch rule {
+	case "", "load", "workspace", "module", "register_toolchains", "register_execution_platforms", "use_extension", "use_repo":
+		return "" // Nothing to do for these, there's no equivalent.
+	case "bazel_dep":
+		return fmt.Sprintf("bazel_dep %s@%s: dependencies on the Bazel registry need to be fetched with http_archive", stringArg(args, "name"), stringArg(args, "version"))
+	}
+	if name := stringArg(args, "name"); name != "" {
+		return fmt.Sprintf("%s(name = %q)", rule, name)
+	}
+	return rule + "()"
+}
+
+// callName returns the name of the function called by a call expression.
+func callName(call *build.CallExpr) string {
+	switch x := call.X.(type) {
+	case *build.Ident:
+		return x.Name
+	case *build.DotExpr:
+		return x.Name
+	}
+	return ""
+}
+
+// arguments returns the keyword arguments to a call.
+func arguments(call *build.CallExpr) map[string]build.Expr {
+	ret := map[string]build.Expr{}
+	for _, arg := range call.List {
+		if assign, ok := arg.(*build.AssignExpr); ok {
+			if ident, ok := assign.LHS.(*build.Ident); ok {
+				ret[ident.Name] = assign.RHS
+			}
+		}
+	}
+	return ret
+}
+
+// stringArg returns the value of a string argument, or the empty string if it isn't a string literal.
+func stringArg(args map[string]build.Expr, name string) string {
+	if s, ok := args[name].(*build.StringExpr); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// requiredString returns a string argument, or an error if it isn't set.
+func requiredString(args map[string]build.Expr, name string) (string, error) {
+	if s := stringArg(args, name); s != "" {
+		return s, nil
+	}
+	return "", fmt.Errorf("missing required argument %s", name)
+}
+
+// urls returns the list of URLs for a rule, from either its url or urls arguments.
+func urls(args map[string]build.Expr) (build.Expr, error) {
+	if url := stringArg(args, "url"); url != "" {
+		return list(str(url)), nil
+	} else if l, ok := args["urls"].(*build.ListExpr); ok && len(l.List) > 0 {
+		return l, nil
+	}
+	return nil, fmt.Errorf("must pass one of url or urls")
+}
+
+// convertBuildFile converts the label of a build_file to the path of that file.
+// Bazel lets any file be referred to by a label (e.g. @//third_party:zlib.BUILD, where the leading
+// @ explicitly means the main repo) but Please only has labels for targets, so we refer to it by
+// its path from the repo root, which is where the converted rules go.
+func convertBuildFile(label string) (string, error) {
+	if strings.HasPrefix(label, "@//") {
+		label = label[1:]
+	} else if strings.HasPrefix(label, "@") {
+		return "", fmt.Errorf("build_file %s is in another repository, which can't be converted", label)
+	} else if !strings.HasPrefix(label, "//") && !strings.HasPrefix(label, ":") {
+		return label, nil // Already a path
+	}
+	label = strings.TrimPrefix(label, "//")
+	if idx := strings.IndexByte(label, ':'); idx != -1 {
+		return path.Join(label[:idx], label[idx+1:]), nil
+	}
+	return path.Join(label, path.Base(label)), nil // //pkg is short for //pkg:pkg
+}
+
+// position returns a description of where a call is in a file.
+func position(filename string, call *build.CallExpr) string {
+	start, _ := call.Span()
+	return fmt.Sprintf("%s:%d", filename, start.Line)
+}
+
+func newCall(name string, args []build.Expr) *build.CallExpr {
+	return &build.CallExpr{X: &build.Ident{Name: name}, List: args, ForceMultiLine: true}
+}
+
+func assign(name string, value build.Expr) *build.AssignExpr {
+	return &build.AssignExpr{LHS: &build.Ident{Name: name}, Op: "=", RHS: value}
+}
+
+func str(s string) *build.StringExpr {
+	return &build.StringExpr{Value: s}
+}
+
+func list(exprs ...build.Expr) *build.ListExpr {
+	return &build.ListExpr{List: exprs}
+}
@@ -0,0 +1,66 @@
+package converter
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDir = "tools/workspace_to_build/converter/test_data/"
+
+func TestConvertWorkspace(t *testing.T) {
+	data, err := ioutil.ReadFile(testDir + "WORKSPACE")
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile(testDir + "BUILD.expected")
+	require.NoError(t, err)
+	b, err := Convert("WORKSPACE", data)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(b))
+}
+
+func TestConvertModule(t *testing.T) {
+	b, err := Convert("MODULE.bazel", []byte(`module(name = "example", version = "1.0")
+
+bazel_dep(name = "rules_go", version = "0.41.0")
+
+http_archive = use_repo_rule("@bazel_tools//tools/build_defs/repo:http.bzl", "http_archive")
+
+http_archive(
+    name = "rules_foo",
+    url = "https://example.com/rules_foo.tar.gz",
+)
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, `http_archive(
+    name = "rules_foo",
+    urls = ["https://example.com/rules_foo.tar.gz"],
+)
+
+# The following could not be converted automatically:
+#   bazel_dep rules_go@0.41.0: dependencies on the Bazel registry need to be fetched with http_archive
+`, string(b))
+}
+
+func TestConvertMissingURL(t *testing.T) {
+	_, err := Convert("WORKSPACE", []byte(`http_archive(name = "rules_foo")`))
+	assert.Error(t, err)
+}
+
+func TestConvertBuildFile(t *testing.T) {
+	for label, expected := range map[string]string{
+		"@//third_party:zlib.BUILD": "third_party/zlib.BUILD",
+		"//third_party:zlib.BUILD":  "third_party/zlib.BUILD",
+		"@//:zlib.BUILD":            "zlib.BUILD",
+		":zlib.BUILD":               "zlib.BUILD",
+		"//third_party/zlib":        "third_party/zlib/zlib",
+		"zlib.BUILD":                "zlib.BUILD",
+	} {
+		path, err := convertBuildFile(label)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, path, label)
+	}
+	_, err := convertBuildFile("@other//third_party:zlib.BUILD")
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+// Package main implements a tool to convert Bazel WORKSPACE and MODULE.bazel files into
+// equivalent Please rules, to ease migrating existing third-party setups.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/tools/workspace_to_build/converter"
+)
+
+var opts = struct {
+	Usage string
+	Out   string `short:"o" long:"output" description:"File to write the converted rules to. Defaults to stdout."`
+	Args  struct {
+		In string `positional-arg-name:"file" required:"true" description:"WORKSPACE or MODULE.bazel file to convert"`
+	} `positional-args:"true"`
+}{
+	Usage: `
+workspace_to_build converts the repository rules in a Bazel WORKSPACE or MODULE.bazel file into
+equivalent Please rules.
+
+http_archive rules become http_archive or new_http_archive, and http_file rules become remote_file,
+preserving their sha256 hashes. Anything else is listed in a comment at the end of the output
+since it will need converting by hand.
+`,
+}
+
+func main() {
+	cli.ParseFlagsOrDie("workspace_to_build", &opts)
+	if err := convert(opts.Args.In, opts.Out); err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func convert(in, out string) error {
+	data, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	b, err := converter.Convert(in, data)
+	if err != nil {
+		return err
+	} else if out == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(out, b, 0644)
+}